@@ -51,6 +51,22 @@ func assertLike(exp string, got string) error {
 	return nil
 }
 
+// mockLog contains the rows the mock backends return for log table queries. The rows are
+// not filtered, the last log query is kept to verify its filters. Nil rows return no log entries.
+var mockLog struct {
+	sync.Mutex
+	rows  [][]interface{}
+	query string
+}
+
+// setMockLog sets the log entries returned by the mock backends.
+func setMockLog(rows [][]interface{}) {
+	mockLog.Lock()
+	mockLog.rows = rows
+	mockLog.query = ""
+	mockLog.Unlock()
+}
+
 func StartMockLivestatusSource(nr int, numHosts int, numServices int) (listen string) {
 	startedChannel := make(chan bool)
 	listen = fmt.Sprintf("mock%d.sock", nr)
@@ -98,6 +114,19 @@ func StartMockLivestatusSource(nr int, numHosts int, numServices int) (listen st
 				continue
 			}
 
+			if req.Table == "log" {
+				mockLog.Lock()
+				rows := mockLog.rows
+				mockLog.query = req.String()
+				mockLog.Unlock()
+				if rows != nil {
+					dat, _ := json.Marshal(rows)
+					conn.Write([]byte(fmt.Sprintf("200 %11d\n%s\n", len(dat)+1, dat)))
+					conn.Close()
+					continue
+				}
+			}
+
 			if len(req.Filter) > 0 || len(req.Stats) > 0 {
 				conn.Write([]byte("200            3\n[]\n"))
 				conn.Close()
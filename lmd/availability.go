@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AvailabilityRange is the time window of an availability query, ex.: Availability: 1500000000 1500086400
+type AvailabilityRange struct {
+	Start int64
+	End   int64
+}
+
+// availabilityColumns are the columns of each availability row. The state times
+// are the seconds spent in the states 0 (up/ok), 1 (down/warning), 2 (unreachable/critical)
+// and 3 (unknown). Time before the first state entry is indeterminate.
+var availabilityColumns = []Column{
+	{Name: "peer_key", Type: StringCol},
+	{Name: "host_name", Type: StringCol},
+	{Name: "service_description", Type: StringCol},
+	{Name: "time_state0", Type: IntCol},
+	{Name: "time_state1", Type: IntCol},
+	{Name: "time_state2", Type: IntCol},
+	{Name: "time_state3", Type: IntCol},
+	{Name: "time_indeterminate", Type: IntCol},
+	{Name: "availability", Type: FloatCol},
+}
+
+// availabilityLogTypes contains the log types which set the hard state of a host or service.
+var availabilityLogTypes = map[string]bool{
+	"HOST ALERT":            true,
+	"SERVICE ALERT":         true,
+	"INITIAL HOST STATE":    true,
+	"INITIAL SERVICE STATE": true,
+	"CURRENT HOST STATE":    true,
+	"CURRENT SERVICE STATE": true,
+}
+
+// availabilityLogColumns are requested from the log table of each backend.
+var availabilityLogColumns = []string{"time", "type", "host_name", "service_description", "state", "state_type"}
+
+func parseAvailability(field **AvailabilityRange, value string) (err error) {
+	tmp := strings.Fields(value)
+	if len(tmp) != 2 {
+		return errors.New("bad request: availability must be Availability: <start> <end>")
+	}
+	start, err1 := strconv.ParseInt(tmp[0], 10, 64)
+	end, err2 := strconv.ParseInt(tmp[1], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end <= start {
+		return errors.New("bad request: availability requires two timestamps with start before end")
+	}
+	*field = &AvailabilityRange{Start: start, End: end}
+	return
+}
+
+// String returns the time window as used in the Availability header.
+func (a *AvailabilityRange) String() string {
+	return fmt.Sprintf("%d %d", a.Start, a.End)
+}
+
+// availabilityIndexes validates an availability query and returns the columns of its result.
+// The filters of the query select the hosts and services from the log table.
+func (req *Request) availabilityIndexes(table *Table) (columns []Column, err error) {
+	if table.Name != "log" {
+		err = errors.New("bad request: Availability is only supported for the log table")
+		return
+	}
+	if len(req.Columns) > 0 || len(req.Stats) > 0 {
+		err = errors.New("bad request: Availability cannot be used with Columns or Stats")
+		return
+	}
+	if len(req.Sort) > 0 {
+		err = errors.New("bad request: Availability cannot be used with Sort, rows are sorted by host and service")
+		return
+	}
+	for j, col := range availabilityColumns {
+		col.Index = j
+		columns = append(columns, col)
+		req.Columns = append(req.Columns, col.Name)
+	}
+	req.SendColumnsHeader = true
+	return
+}
+
+// availabilityLookback is the time before the requested window which is fetched as well,
+// so the state at the start of the window is known. The core logs the current state of all
+// hosts and services on every log rotation, which happens at least once a day.
+const availabilityLookback = 86400
+
+// availabilityFilter returns the filters of the query restricted to the state
+// entries of the requested time window and the lookback before it.
+func (req *Request) availabilityFilter() (filter []Filter, err error) {
+	filter = append(filter, req.Filter...)
+	start := req.Availability.Start - availabilityLookback
+	if start < 0 {
+		start = 0
+	}
+	values := []string{
+		fmt.Sprintf("time >= %d", start),
+		fmt.Sprintf("time < %d", req.Availability.End),
+	}
+	types := make([]string, 0, len(availabilityLogTypes))
+	for logType := range availabilityLogTypes {
+		types = append(types, logType)
+	}
+	sort.Strings(types)
+	for _, logType := range types {
+		values = append(values, "type = "+logType)
+	}
+	for _, value := range values {
+		line := "Filter: " + value
+		err = ParseFilter(value, &line, "log", &filter)
+		if err != nil {
+			return
+		}
+	}
+	line := fmt.Sprintf("Or: %d", len(types))
+	err = ParseFilterOp("or", fmt.Sprintf("%d", len(types)), &line, &filter)
+	return
+}
+
+// BuildAvailabilityResult fetches the state entries of the requested time window from
+// the log table of all peers and calculates the time spent in each state.
+func (res *Response) BuildAvailabilityResult(peers []string) (err error) {
+	req := res.Request
+	res.Result = make([][]interface{}, 0)
+	filter, err := req.availabilityFilter()
+	if err != nil {
+		return
+	}
+
+	waitgroup := &sync.WaitGroup{}
+	resultLock := sync.Mutex{}
+
+	// rows are merged in the order of the peers once all peers are done
+	peerResults := make([][][]interface{}, len(peers))
+
+	for n, id := range peers {
+		p := DataStore[id]
+
+		p.PeerLock.RLock()
+		if p.Status["PeerStatus"].(PeerStatus) == PeerStatusDown {
+			resultLock.Lock()
+			res.Failed[p.ID] = fmt.Sprintf("%v", p.Status["LastError"])
+			resultLock.Unlock()
+			p.PeerLock.RUnlock()
+			continue
+		}
+		p.PeerLock.RUnlock()
+
+		waitgroup.Add(1)
+		go func(peer *Peer, wg *sync.WaitGroup, n int) {
+			// make sure we log panics properly
+			defer logPanicExit()
+			defer wg.Done()
+
+			scoped, err := peer.scopedFilter("log", filter)
+			if err != nil {
+				resultLock.Lock()
+				res.Failed[peer.ID] = err.Error()
+				resultLock.Unlock()
+				return
+			}
+			logRequest := &Request{
+				Table:           "log",
+				Filter:          scoped,
+				Columns:         availabilityLogColumns,
+				OutputFormat:    "json",
+				ResponseFixed16: true,
+				canceler:        req.canceler,
+				peerBytes:       req.peerBytes,
+				rawCapture:      req.rawCapture,
+			}
+			result, qErr := peer.Query(logRequest)
+			if qErr == nil {
+				qErr = checkResultColumns(result, len(availabilityLogColumns))
+			}
+			resultLock.Lock()
+			defer resultLock.Unlock()
+			if qErr != nil {
+				res.Failed[peer.ID] = qErr.Error()
+				return
+			}
+			rows := calculateAvailability(result, req.Availability)
+			for _, row := range rows {
+				row[0] = peer.ID
+			}
+			res.countPeerResult(len(rows) > 0)
+			peerResults[n] = rows
+		}(p, waitgroup, n)
+	}
+	waitgroup.Wait()
+	for _, result := range peerResults {
+		res.Result = append(res.Result, result...)
+	}
+	return
+}
+
+// logEntriesByTime sorts log entries by their time column.
+type logEntriesByTime [][]interface{}
+
+func (l logEntriesByTime) Len() int      { return len(l) }
+func (l logEntriesByTime) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l logEntriesByTime) Less(i, j int) bool {
+	return numberToFloat(&l[i][0]) < numberToFloat(&l[j][0])
+}
+
+// availabilityState is the current state of a single host or service while walking through its log entries.
+type availabilityState struct {
+	host    string
+	service string
+	state   int
+	last    int64
+	times   [5]int64 // seconds in the states 0 to 3, followed by the indeterminate time
+}
+
+// add accounts the time until ts to the current state.
+func (a *availabilityState) add(ts int64) {
+	if ts > a.last {
+		a.times[a.state] += ts - a.last
+		a.last = ts
+	}
+}
+
+// calculateAvailability calculates the seconds spent in each state for all hosts and services
+// from the log entries of a single peer. Only hard states are used, log entries before the
+// time window set the state at its start and later entries are ignored. The returned rows
+// are sorted by host and service and leave the peer_key column empty.
+func calculateAvailability(entries [][]interface{}, window *AvailabilityRange) [][]interface{} {
+	sorted := make([][]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		if len(entry) >= len(availabilityLogColumns) {
+			sorted = append(sorted, entry)
+		}
+	}
+	sort.Stable(logEntriesByTime(sorted))
+
+	indeterminate := len(availabilityState{}.times) - 1
+	objects := make(map[string]*availabilityState)
+	for _, entry := range sorted {
+		ts := int64(numberToFloat(&entry[0]))
+		if ts >= window.End {
+			continue
+		}
+		if !availabilityLogTypes[fmt.Sprintf("%v", entry[1])] || fmt.Sprintf("%v", entry[5]) != "HARD" {
+			continue
+		}
+		state := int(numberToFloat(&entry[4]))
+		if state < 0 || state >= indeterminate {
+			continue
+		}
+		host := fmt.Sprintf("%v", entry[2])
+		service := ""
+		if entry[3] != nil {
+			service = fmt.Sprintf("%v", entry[3])
+		}
+		key := host + ";" + service
+		obj, ok := objects[key]
+		if !ok {
+			obj = &availabilityState{host: host, service: service, state: indeterminate, last: window.Start}
+			objects[key] = obj
+		}
+		obj.add(ts)
+		obj.state = state
+	}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	total := float64(window.End - window.Start)
+	rows := make([][]interface{}, 0, len(keys))
+	for _, key := range keys {
+		obj := objects[key]
+		obj.add(window.End)
+		row := []interface{}{"", obj.host, obj.service}
+		for _, t := range obj.times {
+			row = append(row, int(t))
+		}
+		row = append(row, float64(obj.times[0])*100/total)
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAvailabilityCalculation(t *testing.T) {
+	entries := [][]interface{}{
+		{900.0, "HOST ALERT", "h1", "", 1.0, "HARD"},
+		{1000.0, "INITIAL HOST STATE", "h1", "", 0.0, "HARD"},
+		{1200.0, "HOST ALERT", "h1", "", 1.0, "SOFT"},
+		{1300.0, "HOST ALERT", "h1", "", 1.0, "HARD"},
+		{1400.0, "HOST NOTIFICATION", "h1", "", 1.0, "HARD"},
+		{1500.0, "HOST ALERT", "h1", "", 0.0, "HARD"},
+		{1600.0, "SERVICE ALERT", "h1", "svc", 0.0, "HARD"},
+		{1100.0, "SERVICE ALERT", "h1", "svc", 2.0, "HARD"},
+		{2000.0, "HOST ALERT", "h1", "", 2.0, "HARD"},
+		{500.0, "CURRENT SERVICE STATE", "h1", "svc2", 1.0, "HARD"},
+	}
+	expect := [][]interface{}{
+		{"", "h1", "", 800, 200, 0, 0, 0, 80.0},
+		{"", "h1", "svc", 400, 0, 500, 0, 100, 40.0},
+		{"", "h1", "svc2", 0, 1000, 0, 0, 0, 0.0},
+	}
+	rows := calculateAvailability(entries, &AvailabilityRange{Start: 1000, End: 2000})
+	if err := assertEq(expect, rows); err != nil {
+		t.Error(err)
+	}
+
+	// no state entries at all
+	rows = calculateAvailability([][]interface{}{}, &AvailabilityRange{Start: 1000, End: 2000})
+	if err := assertEq(0, len(rows)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAvailabilityResponse(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// the states before the window are known from the entries of the last log rotation
+	setMockLog([][]interface{}{
+		{50000.0, "CURRENT HOST STATE", "h1", "", 1.0, "HARD"},
+		{60000.0, "CURRENT SERVICE STATE", "h1", "svc", 0.0, "HARD"},
+		{100500.0, "HOST ALERT", "h1", "", 0.0, "HARD"},
+	})
+	defer setMockLog(nil)
+
+	res, err := peer.QueryString("GET log\nFilter: host_name = h1\nAvailability: 100000 101000\nColumnHeaders: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("time_indeterminate", res[0][7]); err != nil {
+		t.Error(err)
+	}
+	expect := [][]interface{}{
+		{"mockid0", "h1", "", 500.0, 500.0, 0.0, 0.0, 0.0, 50.0},
+		{"mockid0", "h1", "svc", 1000.0, 0.0, 0.0, 0.0, 0.0, 100.0},
+	}
+	if err = assertEq(expect, res[1:]); err != nil {
+		t.Error(err)
+	}
+
+	// the backend is asked for the state entries of the window and the day before
+	mockLog.Lock()
+	query := mockLog.query
+	mockLog.Unlock()
+	for _, expect := range []string{
+		"Filter: host_name = h1\n",
+		"Filter: time >= 13600\n",
+		"Filter: time < 101000\n",
+		"Filter: type = INITIAL HOST STATE\n",
+		"Filter: type = CURRENT SERVICE STATE\n",
+		"Or: 6\n",
+	} {
+		if !strings.Contains(query, expect) {
+			t.Errorf("log query misses %q:\n%s", expect, query)
+		}
+	}
+	if strings.Contains(query, "class") {
+		t.Errorf("log query must not filter by class:\n%s", query)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -48,6 +49,44 @@ func BenchmarkSingleFilter(b *testing.B) {
 	}
 }
 
+func BenchmarkServiceDescriptionLiteral_1k_svc(b *testing.B) {
+	b.StopTimer()
+	peer := StartTestPeer(1, 100, 1000)
+	PauseTestPeers(peer)
+
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: description ~ svc_1")
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	b.StopTimer()
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func BenchmarkServiceDescriptionRegex_1k_svc(b *testing.B) {
+	b.StopTimer()
+	peer := StartTestPeer(1, 100, 1000)
+	PauseTestPeers(peer)
+
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: description ~ svc_[1]")
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	b.StopTimer()
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
 func BenchmarkSingleFilter_1k_svc__1Peer(b *testing.B) {
 	b.StopTimer()
 	peer := StartTestPeer(1, 100, 1000)
@@ -429,3 +468,45 @@ Columns: accept_passive_checks acknowledged action_url action_url_expanded activ
 Limit: 100
 OutputFormat: json
 ResponseHeader: fixed16`
+
+// benchmarkRows returns service like result rows for encoder benchmarks.
+func benchmarkRows(num int) [][]interface{} {
+	rows := make([][]interface{}, num)
+	for i := range rows {
+		rows[i] = []interface{}{
+			fmt.Sprintf("testhost_%d", i/10),
+			fmt.Sprintf("service_%d", i),
+			float64(i % 4),
+			"OK - load average: 0.12, 0.18, 0.21\nlong <output>",
+			1.2345,
+			float64(1500000000 + i),
+			[]interface{}{"admin", "web"},
+			map[string]interface{}{"SITE": "prod"},
+		}
+	}
+	return rows
+}
+
+func benchmarkJSONEncoder(b *testing.B, encoder string) {
+	b.StopTimer()
+	defer SetJSONEncoder("fast")
+	SetJSONEncoder(encoder)
+	res := &Response{Code: 200, Request: &Request{OutputFormat: "json"}, Result: benchmarkRows(1000)}
+	b.ReportAllocs()
+	b.StartTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := res.JSON()
+		if err != nil {
+			panic(err.Error())
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkJSONEncoderStd(b *testing.B) {
+	benchmarkJSONEncoder(b, "std")
+}
+
+func BenchmarkJSONEncoderFast(b *testing.B) {
+	benchmarkJSONEncoder(b, "fast")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// errClientDisconnected is returned if a request has been aborted because the client went away.
+var errClientDisconnected = errors.New("client disconnected")
+
+// cancelCheckInterval sets after how many rows long running loops check if the request has been canceled.
+const cancelCheckInterval = 1000
+
+// Canceler signals that the client of a request went away, so any remaining
+// work for this request can be aborted.
+// A nil Canceler is never canceled.
+type Canceler struct {
+	done chan bool
+	once sync.Once
+}
+
+// NewCanceler creates a new Canceler.
+func NewCanceler() *Canceler {
+	return &Canceler{done: make(chan bool)}
+}
+
+// Cancel marks the request as canceled, it is safe to call Cancel multiple times.
+func (c *Canceler) Cancel() {
+	if c == nil {
+		return
+	}
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Done returns a channel which is closed once the request has been canceled.
+func (c *Canceler) Done() <-chan bool {
+	if c == nil {
+		return nil
+	}
+	return c.done
+}
+
+// IsCanceled returns true if the request has been canceled.
+func (c *Canceler) IsCanceled() bool {
+	if c == nil {
+		return false
+	}
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	return false
+}
+
+// WatchConnection cancels the request if the client connection breaks while
+// the request is processed. The returned function stops watching and must be
+// called before the response is sent.
+// Clients which only close their write side after sending the request cannot
+// be distinguished from clients which closed the connection, so watching ends
+// without canceling in that case.
+func (c *Canceler) WatchConnection(conn net.Conn) (stop func()) {
+	stopped := make(chan bool)
+	finished := make(chan bool)
+	go func() {
+		// make sure we log panics properly
+		defer logPanicExit()
+		defer close(finished)
+
+		buf := make([]byte, 1)
+		for {
+			_, err := conn.Read(buf)
+			if err == nil {
+				// ignore additional input, the request has been read already
+				continue
+			}
+			select {
+			case <-stopped:
+				return
+			default:
+			}
+			if err == io.EOF {
+				return
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+			log.Debugf("client connection broken: %s", err.Error())
+			c.Cancel()
+			return
+		}
+	}()
+	return func() {
+		close(stopped)
+		// interrupt the pending read
+		conn.SetReadDeadline(time.Now())
+		<-finished
+	}
+}
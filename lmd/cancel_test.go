@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCanceler(t *testing.T) {
+	var nilCanceler *Canceler
+	nilCanceler.Cancel()
+	if err := assertEq(false, nilCanceler.IsCanceled()); err != nil {
+		t.Error(err)
+	}
+
+	c := NewCanceler()
+	if err := assertEq(false, c.IsCanceled()); err != nil {
+		t.Error(err)
+	}
+	c.Cancel()
+	c.Cancel()
+	if err := assertEq(true, c.IsCanceled()); err != nil {
+		t.Error(err)
+	}
+}
+
+// testConnectionPair returns both ends of a local tcp connection.
+func testConnectionPair(t *testing.T) (client *net.TCPConn, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*net.TCPConn), server
+}
+
+func TestCancelerWatchConnection(t *testing.T) {
+	// client aborts the connection mid-query
+	client, server := testConnectionPair(t)
+	c := NewCanceler()
+	stop := c.WatchConnection(server)
+	client.SetLinger(0)
+	client.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(3 * time.Second):
+		t.Errorf("request has not been canceled after client disconnect")
+	}
+	stop()
+	server.Close()
+
+	// clients closing their write side still wait for the response
+	client, server = testConnectionPair(t)
+	c = NewCanceler()
+	stop = c.WatchConnection(server)
+	client.CloseWrite()
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	if err := assertEq(false, c.IsCanceled()); err != nil {
+		t.Error(err)
+	}
+	client.Close()
+	server.Close()
+}
+
+func TestCancelerResponse(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	for _, query := range []string{"GET hosts\nColumns: name\n\n", "GET log\nColumns: time\n\n"} {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		req.canceler = NewCanceler()
+		req.canceler.Cancel()
+		_, err = req.GetResponse()
+		if err = assertEq(errClientDisconnected, err); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// aborted queries must not mark the backend as down
+	req, _, _ := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\n\n")))
+	req.canceler = NewCanceler()
+	req.canceler.Cancel()
+	_, err := DataStore["mockid0"].Query(req)
+	if err = assertEq(errClientDisconnected, err); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(PeerStatusUp, DataStore["mockid0"].StatusGet("PeerStatus")); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// maxQueryComplexity sets the maximum complexity score of a query, negative values disable the limit.
+var maxQueryComplexity int64 = 1000000000
+
+// regexComplexityWeight is the cost of a regular expression filter compared to a simple filter.
+const regexComplexityWeight = 10
+
+// passthroughRowEstimate is the number of rows assumed for each peer of passthrough tables,
+// since there is no cached data to count.
+const passthroughRowEstimate = 1000
+
+// QueryComplexity contains the estimated cost of a query.
+// Each row has to be filtered and its columns or stats have to be computed,
+// so the score is the number of rows multiplied by the cost of each row.
+type QueryComplexity struct {
+	Rows        int
+	Columns     int
+	Filters     int
+	Regexps     int
+	Stats       int
+	complexity  int64
+	largestName string
+}
+
+// NewQueryComplexity calculates the complexity of a request on the given peers.
+func NewQueryComplexity(req *Request, table *Table, columns []Column, peers []string) *QueryComplexity {
+	q := &QueryComplexity{
+		Columns: len(columns),
+		Stats:   len(req.Stats),
+	}
+	q.countFilter(req.Filter, true)
+	// stats are counted already, but their regular expressions are expensive as well
+	q.countFilter(req.Stats, false)
+	q.Rows = estimateRows(table, peers)
+	q.calculate()
+	return q
+}
+
+// countFilter counts regular expressions and optionally all other filter conditions recursively.
+func (q *QueryComplexity) countFilter(filter []Filter, countPlain bool) {
+	for i := range filter {
+		f := &filter[i]
+		if len(f.Filter) > 0 {
+			q.countFilter(f.Filter, countPlain)
+			continue
+		}
+		if f.Regexp != nil {
+			q.Regexps++
+		} else if countPlain {
+			q.Filters++
+		}
+	}
+}
+
+// estimateRows returns the number of rows which have to be processed.
+func estimateRows(table *Table, peers []string) (rows int) {
+	for _, id := range peers {
+		if table.PassthroughOnly {
+			rows += passthroughRowEstimate
+			continue
+		}
+		p := DataStore[id]
+		p.DataLock.RLock()
+		rows += len(p.Tables[table.Name].Data)
+		p.DataLock.RUnlock()
+	}
+	return
+}
+
+// calculate sums up the costs of all dimensions and remembers the most expensive one.
+// Scanning the rows is the baseline which is needed for every query.
+func (q *QueryComplexity) calculate() {
+	rows := int64(q.Rows)
+	dimensions := []struct {
+		name string
+		cost int64
+	}{
+		{"rows", rows},
+		{"columns", rows * int64(q.Columns)},
+		{"filters", rows * int64(q.Filters)},
+		{"regular expressions", rows * int64(q.Regexps) * regexComplexityWeight},
+		{"stats", rows * int64(q.Stats)},
+	}
+	q.complexity = 0
+	var largest int64 = -1
+	for _, d := range dimensions {
+		q.complexity += d.cost
+		if d.cost > largest {
+			largest = d.cost
+			q.largestName = d.name
+		}
+	}
+}
+
+// Check returns an error if the complexity exceeds the configured limit.
+func (q *QueryComplexity) Check() error {
+	max := atomic.LoadInt64(&maxQueryComplexity)
+	if max < 0 || q.complexity <= max {
+		return nil
+	}
+	return fmt.Errorf("bad request: query complexity %d exceeds the limit of %d: %d rows x (columns: %d, filters: %d, regular expressions: %d, stats: %d), reduce the number of %s",
+		q.complexity, max, q.Rows, q.Columns, q.Filters, q.Regexps, q.Stats, q.largestName)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestQueryComplexity(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "MaxQueryComplexity = 15\n")
+	PauseTestPeers(peer)
+
+	// 1 row x (1 + 1 column)
+	_, err := peer.QueryString("GET status\nColumns: program_start\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		cause string
+	}{
+		{"GET hosts\nColumns: name\n\n", "rows"},
+		{"GET hosts\nColumns: name state alias\n\n", "columns"},
+		{"GET hosts\nColumns: name\nFilter: state = 0\nFilter: state = 1\nOr: 2\n\n", "filters"},
+		{"GET hosts\nColumns: name\nFilter: name ~ test\n\n", "regular expressions"},
+		{"GET hosts\nStats: state = 0\nStats: state = 1\nStats: state = 2\n\n", "stats"},
+	}
+	for _, test := range tests {
+		_, err = peer.QueryString(test.query)
+		if err == nil {
+			t.Errorf("expected complexity error for %s", test.query)
+			continue
+		}
+		if err = assertLike("^bad request: query complexity \\d+ exceeds the limit of 15: 10 rows x .*, reduce the number of "+test.cause+"$", err.Error()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestQueryComplexityScore(t *testing.T) {
+	q := &QueryComplexity{Rows: 100, Columns: 3, Filters: 2, Regexps: 1, Stats: 0}
+	q.calculate()
+	// 100 x (1 + 3 + 2 + 10)
+	if err := assertEq(int64(1600), q.complexity); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("regular expressions", q.largestName); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+)
+
+// selectivity estimates for filter operators, used when explaining queries.
+// They are rough guesses, since there are no statistics about the value distribution.
+const (
+	equalSelectivity   = 0.1
+	regexSelectivity   = 0.25
+	compareSelectivity = 0.33
+)
+
+// QueryPlan contains the estimated costs of a query, returned for requests with Explain: on.
+type QueryPlan struct {
+	Table       string       `json:"table"`
+	Peers       []string     `json:"peers"`
+	Passthrough bool         `json:"passthrough"`
+	RowsScanned int          `json:"rows_scanned"`
+	RowsTotal   int          `json:"rows_total"`
+	RowsMatched int          `json:"rows_matched"`
+	Complexity  int64        `json:"complexity"`
+	Filters     []FilterPlan `json:"filters"`
+}
+
+// FilterPlan describes how a single top level filter will be applied.
+// Access is either scan or passthrough if the filter is sent to the backends.
+type FilterPlan struct {
+	Filter      string  `json:"filter"`
+	Access      string  `json:"access"`
+	Selectivity float64 `json:"selectivity"`
+}
+
+// GetExplainResponse returns the query plan for this request without executing it.
+// The request is validated like a normal request, but no backend is contacted.
+func (req *Request) GetExplainResponse() (res *Response, err error) {
+	res = &Response{
+		Code:    200,
+		Request: req,
+	}
+
+	table, ok := Objects.Tables[req.Table]
+	if !ok {
+		err = unknownTableError(req.Table)
+		return
+	}
+
+	err = req.applyAuthFilter(&table)
+	if err != nil {
+		return
+	}
+
+	_, columns, err := req.BuildResponseIndexes(&table)
+	if err != nil {
+		return
+	}
+	res.Columns = columns
+
+	if len(DataStore) == 0 {
+		err = errNoBackends
+		return
+	}
+
+	selectedPeers := []string{}
+	for _, id := range req.BackendsMap {
+		selectedPeers = append(selectedPeers, id)
+	}
+	selectedPeers = req.orderPeers(selectedPeers)
+	if table.Name == "tables" || table.Name == "columns" {
+		selectedPeers = []string{DataStoreOrder[0]}
+	}
+
+	res.Plan = NewQueryPlan(req, &table, columns, selectedPeers)
+	return
+}
+
+// NewQueryPlan estimates the costs of a request on the given peers.
+func NewQueryPlan(req *Request, table *Table, columns []Column, peers []string) *QueryPlan {
+	plan := &QueryPlan{
+		Table:       table.Name,
+		Peers:       peers,
+		Passthrough: table.PassthroughOnly,
+		Complexity:  NewQueryComplexity(req, table, columns, peers).complexity,
+		Filters:     make([]FilterPlan, 0, len(req.Filter)),
+	}
+
+	// all rows are checked against the filter
+	plan.RowsTotal = estimateRows(table, peers)
+	plan.RowsScanned = plan.RowsTotal
+
+	selectivity := 1.0
+	for i := range req.Filter {
+		f := &req.Filter[i]
+		fp := FilterPlan{
+			Filter:      f.Normalized(),
+			Access:      "scan",
+			Selectivity: f.estimateSelectivity(),
+		}
+		if table.PassthroughOnly {
+			fp.Access = "passthrough"
+		}
+		selectivity *= fp.Selectivity
+		plan.Filters = append(plan.Filters, fp)
+	}
+	plan.RowsMatched = int(math.Ceil(float64(plan.RowsTotal) * selectivity))
+	if req.Limit > 0 && plan.RowsMatched > req.Offset+req.Limit {
+		plan.RowsMatched = req.Offset + req.Limit
+	}
+	return plan
+}
+
+// estimateSelectivity returns the estimated fraction of rows matched by this filter.
+func (f *Filter) estimateSelectivity() (selectivity float64) {
+	if len(f.Filter) > 0 {
+		if f.GroupOperator == And {
+			selectivity = 1
+			for i := range f.Filter {
+				selectivity *= f.Filter[i].estimateSelectivity()
+			}
+		} else {
+			for i := range f.Filter {
+				selectivity += f.Filter[i].estimateSelectivity()
+			}
+			selectivity = math.Min(1, selectivity)
+		}
+	} else {
+		switch f.Operator {
+		case Equal, EqualNocase:
+			selectivity = equalSelectivity
+		case Unequal, UnequalNocase:
+			selectivity = 1 - equalSelectivity
+		case RegexMatch, RegexNoCaseMatch:
+			selectivity = regexSelectivity
+		case RegexMatchNot, RegexNoCaseMatchNot:
+			selectivity = 1 - regexSelectivity
+		default:
+			selectivity = compareSelectivity
+		}
+	}
+	if f.Negate {
+		selectivity = 1 - selectivity
+	}
+	return
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// maxFacetValues sets the maximum number of distinct values returned for each facet.
+var maxFacetValues int64 = 100
+
+// FacetCounts contains the number of rows for each distinct value of a column.
+// Each element of list columns is counted separately.
+type FacetCounts map[interface{}]int
+
+// Add counts a single column value.
+func (f FacetCounts) Add(value interface{}) {
+	list := reflect.ValueOf(value)
+	if value == nil || list.Kind() != reflect.Slice {
+		f[facetKey(value)]++
+		return
+	}
+	for i := 0; i < list.Len(); i++ {
+		f[facetKey(list.Index(i).Interface())]++
+	}
+}
+
+// Merge adds all counts from another facet, ex.: from a different peer.
+func (f FacetCounts) Merge(other FacetCounts) {
+	for value, count := range other {
+		f[value] += count
+	}
+}
+
+// Result returns the facet values ordered by their count, most frequent values first.
+// Only the top values are returned, the count of all remaining values is returned as other.
+func (f FacetCounts) Result() map[string]interface{} {
+	values := facetValues{counts: f, values: make([]interface{}, 0, len(f))}
+	for value := range f {
+		values.values = append(values.values, value)
+	}
+	sort.Sort(values)
+	max := int(atomic.LoadInt64(&maxFacetValues))
+	top := make([]interface{}, 0)
+	other := 0
+	for i, value := range values.values {
+		if max > 0 && i >= max {
+			other += f[value]
+			continue
+		}
+		top = append(top, []interface{}{value, f[value]})
+	}
+	return map[string]interface{}{
+		"values": top,
+		"other":  other,
+	}
+}
+
+// facetValues sorts facet values by count descending and by value for equal counts.
+type facetValues struct {
+	counts FacetCounts
+	values []interface{}
+}
+
+func (v facetValues) Len() int      { return len(v.values) }
+func (v facetValues) Swap(i, j int) { v.values[i], v.values[j] = v.values[j], v.values[i] }
+func (v facetValues) Less(i, j int) bool {
+	countA, countB := v.counts[v.values[i]], v.counts[v.values[j]]
+	if countA != countB {
+		return countA > countB
+	}
+	return fmt.Sprintf("%v", v.values[i]) < fmt.Sprintf("%v", v.values[j])
+}
+
+// facetKey returns a value which can be used as map key.
+func facetKey(value interface{}) interface{} {
+	switch value.(type) {
+	case nil, string, float64, int, int64, bool:
+		return value
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// newFacetCounts returns empty counters and the column index for all requested facets.
+func newFacetCounts(req *Request, table *Table) (facets []FacetCounts, indexes []int) {
+	if len(req.Facets) == 0 {
+		return
+	}
+	for _, name := range req.Facets {
+		facets = append(facets, make(FacetCounts))
+		indexes = append(indexes, table.ColumnsIndex[name])
+	}
+	return
+}
+
+// addFacets merges the facet counts of a single peer into the response.
+func (res *Response) addFacets(facets []FacetCounts) {
+	res.facetLock.Lock()
+	defer res.facetLock.Unlock()
+	if res.Facets == nil {
+		res.Facets = make(map[string]FacetCounts)
+	}
+	for i, name := range res.Request.Facets {
+		if _, ok := res.Facets[name]; !ok {
+			res.Facets[name] = make(FacetCounts)
+		}
+		res.Facets[name].Merge(facets[i])
+	}
+}
+
+// facetResult returns the facets structure used in the wrapped_json output.
+func (res *Response) facetResult() map[string]interface{} {
+	result := make(map[string]interface{})
+	for _, name := range res.Request.Facets {
+		counts := res.Facets[name]
+		if counts == nil {
+			counts = make(FacetCounts)
+		}
+		result[name] = counts.Result()
+	}
+	return result
+}
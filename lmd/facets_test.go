@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestFacetCounts(t *testing.T) {
+	facet := make(FacetCounts)
+	facet.Add("b")
+	facet.Add("a")
+	facet.Add("b")
+	facet.Add(nil)
+	facet.Add([]interface{}{"c", "b"})
+	facet.Add([]interface{}{})
+	facet.Add([]string{"c"})
+
+	other := make(FacetCounts)
+	other.Add(1.0)
+	facet.Merge(other)
+
+	expect := map[string]interface{}{
+		"values": []interface{}{
+			[]interface{}{"b", 3},
+			[]interface{}{"c", 2},
+			[]interface{}{1.0, 1},
+			[]interface{}{nil, 1},
+			[]interface{}{"a", 1},
+		},
+		"other": 0,
+	}
+	if err := assertEq(expect, facet.Result()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFacetResponse(t *testing.T) {
+	peer := StartTestPeerExtra(1, 0, 0, "MaxFacetValues = 3\n")
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\nFacet: address contacts\nLimit: 2\nOutputFormat: wrapped_json\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+
+	// facets are calculated from all matching rows, not just the returned ones
+	facets := res.facetResult()
+	expect := map[string]interface{}{
+		"values": []interface{}{
+			[]interface{}{"127.0.0.2", 5},
+			[]interface{}{"127.0.0.1", 3},
+			[]interface{}{"127.0.0.3", 1},
+		},
+		"other": 3,
+	}
+	if err = assertEq(expect, facets["address"]); err != nil {
+		t.Error(err)
+	}
+
+	// list columns count each element, the business process host has no contacts
+	expect = map[string]interface{}{
+		"values": []interface{}{
+			[]interface{}{"demo", 11},
+		},
+		"other": 0,
+	}
+	if err = assertEq(expect, facets["contacts"]); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET hosts\nColumns: name\nFacet: none\n\n")
+	if err = assertEq("bad request: table hosts has no column none", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET hosts\nStats: state = 0\nFacet: address\n\n")
+	if err = assertEq("bad request: facets cannot be used with stats queries", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
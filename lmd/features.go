@@ -0,0 +1,49 @@
+package main
+
+// Features lists the optional features supported by this build of LMD, sorted by name.
+// It is returned by the lmd_features column of the status table, so clients can check
+// for a feature before using it. Add new features here when adding them to LMD.
+var Features = []string{
+	"auth",
+	"availability",
+	"capture_raw",
+	"changed_since",
+	"cluster",
+	"countdistinct",
+	"explain",
+	"facets",
+	"filter_stats",
+	"first_per_group",
+	"hidden_columns",
+	"keepalive",
+	"merge_duplicates",
+	"multiquery",
+	"output_json",
+	"output_json_map",
+	"output_msgpack",
+	"output_ndjson",
+	"output_wrapped_json",
+	"peer_weights",
+	"percentile",
+	"percentile_filter",
+	"progress",
+	"progressive",
+	"prometheus",
+	"query_complexity",
+	"saved_filters",
+	"search",
+	"split_by",
+	"summary",
+	"time_format",
+	"tls",
+	"wait_trigger",
+}
+
+// featureList returns the supported features as list column value.
+func featureList() []interface{} {
+	list := make([]interface{}, len(Features))
+	for i, feature := range Features {
+		list[i] = feature
+	}
+	return list
+}
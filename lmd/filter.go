@@ -5,22 +5,46 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"regexp/syntax"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+var reRelativeDuration = regexp.MustCompile(`^(\d+)([smhd])$`)
+var reFilterListIndex = regexp.MustCompile(`^([a-z0-9_]+)\[(-?\d+)\]$`)
+var reStatsPercentile = regexp.MustCompile(`^percentile(\d+(?:\.\d+)?)$`)
+
+// maxRegexLength sets the maximum length of regular expression filters.
+const maxRegexLength = 1000
+
+// maxRegexInstructions sets the maximum size of compiled regular expression filters.
+const maxRegexInstructions = 10000
+
+// maxRegexCacheSize sets the number of compiled regular expressions kept for later requests.
+const maxRegexCacheSize = 1000
+
+// regexCache contains the compiled regular expression filters by pattern. Clients often send
+// the same filters again and again, ex.: dashboards, so they only have to be compiled once.
+var regexCache = make(map[string]*regexp.Regexp)
+var regexCacheLock = new(sync.RWMutex)
+
 // StatsType is the stats operator.
 type StatsType int
 
-// Besides the Counter, which counts the data rows by using a filter, there are 4 aggregations
-// operators: Sum, Average, Min and Max.
+// Besides the Counter, which counts the data rows by using a filter, there are 7 aggregations
+// operators: Sum, Average, Min, Max, Median, Percentile and CountDistinct.
 const (
 	NoStats StatsType = iota
 	Counter
-	Sum     // sum
-	Average // avg
-	Min     // min
-	Max     // max
+	Sum           // sum
+	Average       // avg
+	Min           // min
+	Max           // max
+	Median        // median
+	Percentile    // percentile<n>
+	CountDistinct // countdistinct
 )
 
 // String converts a StatsType back to the original string.
@@ -34,6 +58,12 @@ func (op *StatsType) String() string {
 		return ("min")
 	case Max:
 		return ("Max")
+	case Median:
+		return ("median")
+	case Percentile:
+		return ("percentile")
+	case CountDistinct:
+		return ("countdistinct")
 	}
 	log.Panicf("not implemented")
 	return ""
@@ -50,14 +80,33 @@ type Filter struct {
 	CustomTag  string
 	IsEmpty    bool
 
+	// match a single element of a list column, ex.: Filter: contacts[0] = admin
+	// negative indexes count from the end of the list
+	IsListIndex bool
+	ListIndex   int
+
+	// regular expressions without special characters are matched as plain substring
+	IsLiteral bool
+	Literal   string
+
 	// or a group of filters
 	Filter        []Filter
 	GroupOperator GroupOperator
 
+	// inverts the result of this filter, ex.: StatsNegate:
+	Negate bool
+
+	// time comparisons match zero timestamps as well, see IncludeNever header
+	IncludeNever bool
+
 	// stats query
-	Stats      float64
-	StatsCount int
-	StatsType  StatsType
+	Stats           float64
+	StatsCount      int
+	StatsType       StatsType
+	StatsPercentile float64         // requested percentile for percentile stats
+	StatsSamples    *StatsSamples   // buffered values for median and percentile stats
+	StatsDistinct   map[string]bool // distinct values for countdistinct stats
+	StatsSource     string          // text of the stats header, used as column header
 }
 
 // Operator defines a filter operator.
@@ -89,6 +138,23 @@ const (
 	GroupContainsNot // !>=
 )
 
+// isComparison returns true for the numeric operators <, <=, > and >=.
+func (op *Operator) isComparison() bool {
+	switch *op {
+	case Less, LessThan, Greater, GreaterThan:
+		return true
+	}
+	return false
+}
+
+// setIncludeNever lets all time comparisons of the given filters match zero timestamps.
+func setIncludeNever(filter []Filter) {
+	for i := range filter {
+		filter[i].IncludeNever = true
+		setIncludeNever(filter[i].Filter)
+	}
+}
+
 // String converts a Operator back to the original string.
 func (op *Operator) String() string {
 	switch *op {
@@ -130,6 +196,9 @@ func (f *Filter) String(prefix string) (str string) {
 			str += f.Filter[i].String(prefix)
 		}
 		str += fmt.Sprintf("%s%s: %d\n", prefix, f.GroupOperator.String(), len(f.Filter))
+		if f.Negate {
+			str += fmt.Sprintf("%sNegate:\n", prefix)
+		}
 		return
 	}
 
@@ -138,23 +207,115 @@ func (f *Filter) String(prefix string) (str string) {
 		strVal = " " + strVal
 	}
 
+	colName := f.Column.Name
+	if f.IsListIndex {
+		colName = fmt.Sprintf("%s[%d]", colName, f.ListIndex)
+	}
+
 	switch f.StatsType {
 	case NoStats:
-		if prefix == "" {
-			prefix = "Filter"
+		header := prefix
+		if header == "" {
+			header = "Filter"
 		}
-		str = fmt.Sprintf("%s: %s %s%s\n", prefix, f.Column.Name, f.Operator.String(), strVal)
+		str = fmt.Sprintf("%s: %s %s%s\n", header, colName, f.Operator.String(), strVal)
 		break
 	case Counter:
-		str = fmt.Sprintf("Stats: %s %s%s\n", f.Column.Name, f.Operator.String(), strVal)
+		str = fmt.Sprintf("Stats: %s %s%s\n", colName, f.Operator.String(), strVal)
+		break
+	case Percentile:
+		str = fmt.Sprintf("Stats: %s%s %s\n", f.StatsType.String(), strconv.FormatFloat(f.StatsPercentile, 'f', -1, 64), f.Column.Name)
 		break
 	default:
 		str = fmt.Sprintf("Stats: %s %s\n", f.StatsType.String(), f.Column.Name)
 		break
 	}
+	if f.Negate {
+		str += fmt.Sprintf("%sNegate:\n", prefix)
+	}
 	return
 }
 
+// NormalizeFilter returns the canonical form of a list of filters, which are combined with "and".
+// Nested groups with the same operator are flattened, ex.:
+// (name = "a" or name = "b") and not (state = 1)
+func NormalizeFilter(filter []Filter) string {
+	switch len(filter) {
+	case 0:
+		return ""
+	case 1:
+		return filter[0].Normalized()
+	}
+	group := Filter{Filter: filter, GroupOperator: And}
+	return group.Normalized()
+}
+
+// Normalized returns the canonical infix representation of this filter.
+func (f *Filter) Normalized() (str string) {
+	if len(f.Filter) == 0 {
+		str = f.normalizedCondition()
+	} else {
+		str = strings.Join(f.normalizedParts(), f.normalizedOperator())
+	}
+	if f.Negate {
+		str = "not (" + str + ")"
+	}
+	return
+}
+
+// StatsLabel returns the column header for a stats filter. This is the text of the stats header
+// unless the filter has been combined or negated afterwards.
+func (f *Filter) StatsLabel() string {
+	if f.StatsSource != "" && !f.Negate {
+		return f.StatsSource
+	}
+	return f.Normalized()
+}
+
+// normalizedParts returns the normalized sub filter of this group. Sub groups using
+// the same operator are merged into this group.
+func (f *Filter) normalizedParts() (parts []string) {
+	for i := range f.Filter {
+		child := &f.Filter[i]
+		if len(child.Filter) == 0 || child.Negate {
+			parts = append(parts, child.Normalized())
+			continue
+		}
+		childParts := child.normalizedParts()
+		if child.GroupOperator == f.GroupOperator || len(childParts) == 1 {
+			parts = append(parts, childParts...)
+			continue
+		}
+		parts = append(parts, "("+strings.Join(childParts, child.normalizedOperator())+")")
+	}
+	return
+}
+
+func (f *Filter) normalizedOperator() string {
+	return " " + strings.ToLower(f.GroupOperator.String()) + " "
+}
+
+func (f *Filter) normalizedCondition() string {
+	colName := f.Column.Name
+	if f.IsListIndex {
+		colName = fmt.Sprintf("%s[%d]", colName, f.ListIndex)
+	}
+	colType := f.Column.Type
+	if colType == VirtCol {
+		colType = VirtKeyMap[f.Column.Name].Type
+	}
+	value := f.strValue()
+	switch colType {
+	case IntCol, IntListCol, FloatCol, TimeCol:
+		if f.IsEmpty {
+			value = strconv.Quote(value)
+		}
+	default:
+		value = strconv.Quote(value)
+	}
+	return fmt.Sprintf("%s %s %s", colName, f.Operator.String(), value)
+}
+
 func (f *Filter) strValue() (str string) {
 	colType := f.Column.Type
 	if f.IsEmpty {
@@ -219,12 +380,43 @@ func (f *Filter) ApplyValue(val float64, count int) {
 			f.Stats = value
 		}
 		break
+	case Median:
+		fallthrough
+	case Percentile:
+		f.StatsSamples.Add(val)
+		break
 	default:
 		panic("not implemented stats type")
 	}
 	f.StatsCount += count
 }
 
+// ApplyDistinct adds the given value to this countdistinct stats filter. Each element
+// of list values is counted on its own, null values are ignored.
+func (f *Filter) ApplyDistinct(val interface{}) {
+	switch v := val.(type) {
+	case nil:
+		return
+	case []interface{}:
+		for _, e := range v {
+			if e != nil {
+				f.StatsDistinct[fmt.Sprintf("%v", e)] = true
+			}
+		}
+	default:
+		f.StatsDistinct[fmt.Sprintf("%v", v)] = true
+	}
+	f.StatsCount++
+}
+
+// MergeDistinct adds the distinct values of another countdistinct stats filter, ex.: from a different peer.
+func (f *Filter) MergeDistinct(other *Filter) {
+	for val := range other.StatsDistinct {
+		f.StatsDistinct[val] = true
+	}
+	f.StatsCount += other.StatsCount
+}
+
 // ParseFilter parses a single line into a filter object.
 // It returns any error encountered.
 func ParseFilter(value string, line *string, table string, stack *[]Filter) (err error) {
@@ -243,7 +435,21 @@ func ParseFilter(value string, line *string, table string, stack *[]Filter) (err
 		return
 	}
 
-	columnName := tmp[0]
+	// only the column name is case insensitive, values are always used as is
+	columnName := strings.ToLower(tmp[0])
+
+	// single list element, ex.: contacts[0]
+	isListIndex := false
+	listIndex := 0
+	if matched := reFilterListIndex.FindStringSubmatch(columnName); len(matched) == 3 {
+		columnName = matched[1]
+		listIndex, err = strconv.Atoi(matched[2])
+		if err != nil {
+			err = errors.New("bad request: invalid list index in " + *line)
+			return
+		}
+		isListIndex = true
+	}
 
 	// convert value to type of column
 	i, Ok := Objects.Tables[table].ColumnsIndex[columnName]
@@ -255,29 +461,147 @@ func ParseFilter(value string, line *string, table string, stack *[]Filter) (err
 		i, _ = Objects.Tables[table].ColumnsIndex[columnName]
 	}
 	col := Objects.Tables[table].Columns[i]
-	filter := Filter{Operator: op, Column: col}
+	filter := Filter{Operator: op, Column: col, IsListIndex: isListIndex, ListIndex: listIndex}
+	if isListIndex && col.Type != StringListCol && col.Type != IntListCol {
+		err = errors.New("bad request: list index is only supported for list columns in " + *line)
+		return
+	}
+
+	if tbl := Objects.Tables[table]; isBooleanColumn(&tbl, &col) {
+		tmp[2] = booleanFilterValue(tmp[2])
+	}
 
 	err = filter.setFilterValue(&col, tmp[2], line)
 	if err != nil {
 		return
 	}
 
+	// regular expressions are not anchored, just like in livestatus itself. So a
+	// pattern matches any substring unless ^ or $ are used explicitly and an
+	// empty pattern matches everything.
 	if isRegex {
 		val := filter.StrValue
+		if isGlobFilter(table, &col, val) {
+			val = globToRegex(val)
+		}
 		if op == RegexNoCaseMatchNot || op == RegexNoCaseMatch {
-			val = strings.ToLower(val)
+			// lowercasing the pattern would break escapes like \D or \S
+			val = "(?i)" + val
 		}
-		regex, rerr := regexp.Compile(val)
+		regex, rerr := compileFilterRegex(val)
 		if rerr != nil {
-			err = errors.New("bad request: invalid regular expression: " + rerr.Error() + " in filter " + *line)
+			err = errors.New("bad request: " + rerr.Error() + " in filter " + *line)
 			return
 		}
 		filter.Regexp = regex
+		// only plain text without anchors or other special characters matches as substring
+		filter.Literal, filter.IsLiteral = regexLiteral(val)
 	}
 	*stack = append(*stack, filter)
 	return
 }
 
+// compileFilterRegex compiles a regular expression from a client filter.
+// Go regular expressions always match in linear time and do not support
+// backreferences, so there is no catastrophic backtracking. Still, large
+// patterns or repetitions like (ab|cd|ef){1000} compile into huge programs
+// which make every single match expensive, so those patterns are rejected.
+func compileFilterRegex(pattern string) (*regexp.Regexp, error) {
+	regexCacheLock.RLock()
+	regex, ok := regexCache[pattern]
+	regexCacheLock.RUnlock()
+	if ok {
+		return regex, nil
+	}
+	if len(pattern) > maxRegexLength {
+		return nil, fmt.Errorf("regular expression too long, at most %d characters are allowed", maxRegexLength)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, errors.New("invalid regular expression: " + err.Error())
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, errors.New("invalid regular expression: " + err.Error())
+	}
+	if len(prog.Inst) > maxRegexInstructions {
+		return nil, errors.New("regular expression too complex, reduce the number of repetitions")
+	}
+	regex, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.New("invalid regular expression: " + err.Error())
+	}
+	regexCacheLock.Lock()
+	if len(regexCache) >= maxRegexCacheSize {
+		regexCache = make(map[string]*regexp.Regexp)
+	}
+	regexCache[pattern] = regex
+	regexCacheLock.Unlock()
+	return regex, nil
+}
+
+// regexLiteral returns the plain text of a case sensitive pattern without
+// anchors or other special characters, which can be matched as substring.
+func regexLiteral(pattern string) (string, bool) {
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	parsed = parsed.Simplify()
+	if parsed.Op != syntax.OpLiteral || parsed.Flags&syntax.FoldCase != 0 {
+		return "", false
+	}
+	return string(parsed.Rune), true
+}
+
+// isGlobFilter returns true if the regular expression filter value should be
+// treated as glob pattern, ex.: Filter: name ~ prod-*
+// This is only the case for the name and key columns of the sites/backends table
+// and only if the pattern contains wildcards but no other regular expression characters.
+func isGlobFilter(table string, col *Column, val string) bool {
+	if table != "sites" && table != "backends" {
+		return false
+	}
+	switch col.Name {
+	case "name", "key", "peer_name", "peer_key":
+	default:
+		return false
+	}
+	if !strings.ContainsAny(val, "*?") {
+		return false
+	}
+	return !strings.ContainsAny(val, `.^$+()[]{}|\`)
+}
+
+// parseRelativeDuration converts durations with a s/m/h/d suffix into seconds.
+// It returns false if the value is not a duration.
+func parseRelativeDuration(val string) (int64, bool) {
+	matched := reRelativeDuration.FindStringSubmatch(val)
+	if len(matched) != 3 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(matched[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	switch matched[2] {
+	case "m":
+		seconds *= 60
+	case "h":
+		seconds *= 3600
+	case "d":
+		seconds *= 86400
+	}
+	return seconds, true
+}
+
+// globToRegex converts a glob pattern into an anchored regular expression.
+func globToRegex(glob string) string {
+	regex := strings.Replace(glob, "*", ".*", -1)
+	regex = strings.Replace(regex, "?", ".", -1)
+	return "^" + regex + "$"
+}
+
 // setFilterValue converts the text value into the given filters type value
 func (f *Filter) setFilterValue(col *Column, strVal string, line *string) (err error) {
 	colType := col.Type
@@ -287,11 +611,18 @@ func (f *Filter) setFilterValue(col *Column, strVal string, line *string) (err e
 	if strVal == "" {
 		f.IsEmpty = true
 	}
+	// human durations like 5m are relative to now, ex.: last_check < 5m
+	if colType == TimeCol || col.Timestamp {
+		if seconds, ok := parseRelativeDuration(strVal); ok {
+			f.FloatValue = float64(time.Now().Unix() - seconds)
+			return
+		}
+	}
 	switch colType {
-	case IntListCol:
-		fallthrough
 	case TimeCol:
 		fallthrough
+	case IntListCol:
+		fallthrough
 	case IntCol:
 		filtervalue, cerr := strconv.Atoi(strVal)
 		if cerr != nil && !f.IsEmpty {
@@ -387,12 +718,22 @@ func parseFilterOp(opStr string, line *string) (op Operator, isRegex bool, err e
 func ParseStats(value string, line *string, table string, stack *[]Filter) (err error) {
 	tmp := strings.SplitN(value, " ", 3)
 	if len(tmp) < 2 {
-		err = errors.New("bad request: stats header, must be Stats: <field> <operator> <value> OR Stats: <sum|avg|min|max> <field>")
+		err = errors.New("bad request: stats header, must be Stats: <field> <operator> <value> OR Stats: <sum|avg|min|max|median|percentile<n>|countdistinct> <field>")
 		return
 	}
 	startWith := float64(0)
+	percentile := float64(0)
 	var op StatsType
-	switch strings.ToLower(tmp[0]) {
+	statsOp := strings.ToLower(tmp[0])
+	if matched := reStatsPercentile.FindStringSubmatch(statsOp); len(matched) > 0 {
+		percentile, _ = strconv.ParseFloat(matched[1], 64)
+		if percentile > 100 {
+			err = errors.New("bad request: percentile must be between 0 and 100 in " + *line)
+			return
+		}
+		statsOp = "percentile"
+	}
+	switch statsOp {
 	case "avg":
 		op = Average
 		break
@@ -406,6 +747,15 @@ func ParseStats(value string, line *string, table string, stack *[]Filter) (err
 	case "sum":
 		op = Sum
 		break
+	case "median":
+		op = Median
+		break
+	case "percentile":
+		op = Percentile
+		break
+	case "countdistinct":
+		op = CountDistinct
+		break
 	default:
 		err = ParseFilter(value, line, table, stack)
 		if err != nil {
@@ -413,9 +763,11 @@ func ParseStats(value string, line *string, table string, stack *[]Filter) (err
 		}
 		// set last one to counter
 		(*stack)[len(*stack)-1].StatsType = Counter
+		(*stack)[len(*stack)-1].StatsSource = strings.TrimSpace(value)
 		return
 	}
 
+	tmp[1] = strings.ToLower(tmp[1])
 	i, Ok := Objects.Tables[table].ColumnsIndex[tmp[1]]
 	if !Ok {
 		err = errors.New("bad request: unrecognized column from stats: " + tmp[1] + " in " + *line)
@@ -423,7 +775,7 @@ func ParseStats(value string, line *string, table string, stack *[]Filter) (err
 	}
 	col := Objects.Tables[table].Columns[i]
 
-	stats := Filter{Column: col, StatsType: op, Stats: startWith, StatsCount: 0}
+	stats := Filter{Column: col, StatsType: op, Stats: startWith, StatsCount: 0, StatsPercentile: percentile, StatsSource: strings.TrimSpace(value)}
 	*stack = append(*stack, stats)
 	return
 }
@@ -456,6 +808,10 @@ func ParseFilterOp(header string, value string, line *string, stack *[]Filter) (
 
 // MatchFilter returns true if the given filter matches the given value.
 func (f *Filter) MatchFilter(value *interface{}) bool {
+	// zero timestamps mean never, ex.: hosts which have not been checked yet
+	if f.Column.IsTimestamp() && !f.IncludeNever && !f.IsEmpty && f.Operator.isComparison() && numberToFloat(value) == 0 {
+		return false
+	}
 	switch f.Column.Type {
 	case StringCol:
 		return matchStringFilter(f, value)
@@ -488,8 +844,14 @@ func (f *Filter) MatchFilter(value *interface{}) bool {
 		}
 		return matchNumberFilter(f.Operator, numberToFloat(value), f.FloatValue)
 	case StringListCol:
+		if f.IsListIndex {
+			return matchListIndexFilter(f, value)
+		}
 		return matchStringListFilter(f, value)
 	case IntListCol:
+		if f.IsListIndex {
+			return matchListIndexFilter(f, value)
+		}
 		return matchIntListFilter(f, value)
 	case VirtCol:
 		// run MatchFilter with a copy of this filter but replace the type
@@ -540,6 +902,17 @@ func matchEmptyFilter(op Operator) bool {
 }
 
 func matchStringFilter(filter *Filter, value *interface{}) bool {
+	// plain substrings do not need the regular expression engine, ex.: Filter: description ~ disk
+	if filter.IsLiteral {
+		if str, ok := (*value).(string); ok {
+			switch filter.Operator {
+			case RegexMatch:
+				return strings.Contains(str, filter.Literal)
+			case RegexMatchNot:
+				return !strings.Contains(str, filter.Literal)
+			}
+		}
+	}
 	return matchStringValueOperator(filter.Operator, value, &filter.StrValue, filter.Regexp)
 }
 
@@ -567,9 +940,9 @@ func matchStringValueOperator(op Operator, valueA *interface{}, valueB *string,
 	case RegexMatchNot:
 		return !(*regex).MatchString(strA)
 	case RegexNoCaseMatch:
-		return (*regex).MatchString(strings.ToLower(strA))
+		return (*regex).MatchString(strA)
 	case RegexNoCaseMatchNot:
-		return !(*regex).MatchString(strings.ToLower(strA))
+		return !(*regex).MatchString(strA)
 	case Less:
 		return strA < strB
 	case LessThan:
@@ -617,6 +990,34 @@ func matchStringListFilter(filter *Filter, value *interface{}) bool {
 	return false
 }
 
+// matchListIndexFilter compares a single element of a list with the filter value.
+// Indexes outside the list, which includes all indexes of empty lists, never match
+// regardless of the operator.
+func matchListIndexFilter(filter *Filter, value *interface{}) bool {
+	if *value == nil {
+		return false
+	}
+	list := reflect.ValueOf(*value)
+	if list.Kind() != reflect.Slice {
+		return false
+	}
+	index := filter.ListIndex
+	if index < 0 {
+		index += list.Len()
+	}
+	if index < 0 || index >= list.Len() {
+		return false
+	}
+	val := list.Index(index).Interface()
+	if filter.Column.Type == IntListCol {
+		if filter.IsEmpty {
+			return matchEmptyFilter(filter.Operator)
+		}
+		return matchNumberFilter(filter.Operator, numberToFloat(&val), filter.FloatValue)
+	}
+	return matchStringValueOperator(filter.Operator, &val, &filter.StrValue, filter.Regexp)
+}
+
 func matchIntListFilter(filter *Filter, value *interface{}) bool {
 	if *value == nil {
 		*value = make([]float64, 0)
@@ -694,6 +1095,14 @@ func numberToFloat(in *interface{}) float64 {
 		return v
 	case int:
 		return float64(v)
+	case int64:
+		return float64(v)
+	case PeerStatus:
+		// used for output, sorting and filtering of the virtual status column
+		return float64(v)
+	case *peerTime:
+		// used for sorting and merging timestamps with TimeFormat: iso
+		return v.Unix
 	case bool:
 		if v {
 			return 1
@@ -702,6 +1111,69 @@ func numberToFloat(in *interface{}) float64 {
 	return 0
 }
 
+// BooleanColumns contains all integer columns which can only be 0 or 1. Filters on these
+// columns accept true, false, yes and no as well and MapBooleans: on returns json booleans.
+var BooleanColumns = map[string]bool{
+	"accept_passive_checks":         true,
+	"acknowledged":                  true,
+	"active_checks_enabled":         true,
+	"can_submit_commands":           true,
+	"check_external_commands":       true,
+	"check_freshness":               true,
+	"check_host_freshness":          true,
+	"check_service_freshness":       true,
+	"checks_enabled":                true,
+	"enable_event_handlers":         true,
+	"enable_flap_detection":         true,
+	"enable_notifications":          true,
+	"event_handler_enabled":         true,
+	"flap_detection_enabled":        true,
+	"got_business_rule":             true,
+	"has_been_checked":              true,
+	"host_notifications_enabled":    true,
+	"in_check_period":               true,
+	"in_notification_period":        true,
+	"is_executing":                  true,
+	"is_flapping":                   true,
+	"is_impact":                     true,
+	"is_problem":                    true,
+	"notifications_enabled":         true,
+	"obsess_over_host":              true,
+	"obsess_over_hosts":             true,
+	"obsess_over_service":           true,
+	"obsess_over_services":          true,
+	"persistent":                    true,
+	"process_performance_data":      true,
+	"service_notifications_enabled": true,
+}
+
+// isBooleanColumn returns true if the column is one of the BooleanColumns. Columns of
+// referenced objects, ex.: host_acknowledged, use the name from the referenced table.
+func isBooleanColumn(table *Table, col *Column) bool {
+	if col.Type != IntCol {
+		return false
+	}
+	name := col.Name
+	if col.Update == RefNoUpdate && col.RefIndex > 0 && col.RefIndex < len(table.Columns) {
+		if ref, ok := Objects.Tables[table.Columns[col.RefIndex].Name]; ok && col.RefColIndex < len(ref.Columns) {
+			name = ref.Columns[col.RefColIndex].Name
+		}
+	}
+	return BooleanColumns[name]
+}
+
+// booleanFilterValue converts the boolean tokens true, false, yes and no into 1 and 0.
+// All other values are returned unchanged.
+func booleanFilterValue(value string) string {
+	switch strings.ToLower(value) {
+	case "true", "yes":
+		return "1"
+	case "false", "no":
+		return "0"
+	}
+	return value
+}
+
 // some broken clients request service_description instead of just description from the services table
 // be nice to them as well...
 func fixBrokenClientsRequestColumn(columnName *string, table string) bool {
@@ -721,3 +1193,46 @@ func fixBrokenClientsRequestColumn(columnName *string, table string) bool {
 
 	return false
 }
+
+// hasTimeFilter returns true if the filter restricts the time column, so backends
+// only have to return the matching time range instead of all rows.
+func hasTimeFilter(filter []Filter) bool {
+	return hasColumnFilter(filter, "time")
+}
+
+// hasColumnFilter returns true if the filter restricts the given column.
+func hasColumnFilter(filter []Filter, name string) bool {
+	for i := range filter {
+		if filter[i].restrictsColumn(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictsColumn returns true if this filter only matches a single value or a range of the column.
+// Or groups are restricted only if all of their filters restrict the column.
+func (f *Filter) restrictsColumn(name string) bool {
+	if f.Negate {
+		return false
+	}
+	if len(f.Filter) > 0 {
+		if f.GroupOperator == And {
+			return hasColumnFilter(f.Filter, name)
+		}
+		for i := range f.Filter {
+			if !f.Filter[i].restrictsColumn(name) {
+				return false
+			}
+		}
+		return true
+	}
+	if f.Column.Name != name {
+		return false
+	}
+	switch f.Operator {
+	case Equal, Less, LessThan, Greater, GreaterThan:
+		return true
+	}
+	return false
+}
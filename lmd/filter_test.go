@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStringFilter(t *testing.T) {
@@ -23,3 +27,528 @@ func TestStringFilter(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRegexFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		value  string
+		match  bool
+	}{
+		{"name ~ web", "webserver", true},
+		{"name ~ web", "mywebserver", true},
+		{"name ~ ^web$", "webserver", false},
+		{"name ~ ^web$", "web", true},
+		{"name ~ ^$", "", true},
+		{"name ~ ^$", "web", false},
+		{"name ~", "web", true},
+		{"name !~ ^web", "webserver", false},
+		{"name !~ ^web", "mywebserver", true},
+		{"name ~~ WEB", "MyWebServer", true},
+		{"name ~~ ^\\D+$", "WebServer", true},
+		{"name !~~ ^web", "WebServer", false},
+		{"name ~ web$", "webserver", false},
+		{"name ~ web.server", "web-server", true},
+		{"name !~ ^web$", "web", false},
+	}
+	for _, test := range tests {
+		line := "Filter: " + test.filter
+		stack := []Filter{}
+		if err := ParseFilter(test.filter, &line, "hosts", &stack); err != nil {
+			t.Fatal(err)
+		}
+		var value interface{} = test.value
+		if err := assertEq(test.match, stack[0].MatchFilter(&value)); err != nil {
+			t.Errorf("%s: %s", line, err)
+		}
+	}
+}
+
+func TestTimeFilterDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		seconds int64
+	}{
+		{"30s", 30},
+		{"5m", 300},
+		{"2h", 7200},
+		{"1d", 86400},
+	}
+	for _, test := range tests {
+		line := "Filter: last_check < " + test.value
+		stack := []Filter{}
+		if err := ParseFilter("last_check < "+test.value, &line, "hosts", &stack); err != nil {
+			t.Fatal(err)
+		}
+		expect := float64(time.Now().Unix() - test.seconds)
+		if stack[0].FloatValue < expect-2 || stack[0].FloatValue > expect {
+			t.Errorf("%s: expected %f, got %f", line, expect, stack[0].FloatValue)
+		}
+		var older interface{} = expect - 60
+		if err := assertEq(true, stack[0].MatchFilter(&older)); err != nil {
+			t.Errorf("%s: %s", line, err)
+		}
+		var newer interface{} = expect + 10
+		if err := assertEq(false, stack[0].MatchFilter(&newer)); err != nil {
+			t.Errorf("%s: %s", line, err)
+		}
+	}
+
+	// absolute timestamps still work
+	line := "Filter: last_check >= 123456789"
+	stack := []Filter{}
+	if err := ParseFilter("last_check >= 123456789", &line, "hosts", &stack); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(float64(123456789), stack[0].FloatValue); err != nil {
+		t.Error(err)
+	}
+
+	// timestamps of referenced and log columns accept durations as well
+	for _, test := range []struct{ table, filter string }{{"services", "host_last_check < 5m"}, {"log", "time > 1h"}} {
+		line = "Filter: " + test.filter
+		stack = []Filter{}
+		if err := ParseFilter(test.filter, &line, test.table, &stack); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// durations are not allowed for plain integer columns
+	line = "Filter: state < 5m"
+	if err := ParseFilter("state < 5m", &line, "hosts", &stack); err == nil {
+		t.Errorf("expected error for %s", line)
+	}
+}
+
+func TestFilterListIndex(t *testing.T) {
+	tests := []struct {
+		filter string
+		value  interface{}
+		match  bool
+	}{
+		{"contacts[0] = admin", []interface{}{"admin", "guest"}, true},
+		{"contacts[1] = admin", []interface{}{"admin", "guest"}, false},
+		{"contacts[1] != admin", []interface{}{"admin", "guest"}, true},
+		{"contacts[-1] = guest", []interface{}{"admin", "guest"}, true},
+		{"contacts[-2] ~ ^adm", []interface{}{"admin", "guest"}, true},
+		{"contacts[2] = admin", []interface{}{"admin", "guest"}, false},
+		{"contacts[2] != admin", []interface{}{"admin", "guest"}, false},
+		{"contacts[-3] != admin", []interface{}{"admin", "guest"}, false},
+		{"contacts[0] =", []interface{}{}, false},
+		{"contacts[0] !=", []interface{}{}, false},
+		{"contacts[0] = admin", nil, false},
+		{"comments[0] = 5", []interface{}{float64(5), float64(7)}, true},
+		{"comments[1] > 5", []interface{}{float64(5), float64(7)}, true},
+		{"comments[-1] < 7", []interface{}{float64(5), float64(7)}, false},
+		{"comments[3] != 5", []interface{}{float64(5), float64(7)}, false},
+	}
+	for _, test := range tests {
+		line := "Filter: " + test.filter
+		stack := []Filter{}
+		if err := ParseFilter(test.filter, &line, "hosts", &stack); err != nil {
+			t.Fatal(err)
+		}
+		value := test.value
+		if err := assertEq(test.match, stack[0].MatchFilter(&value)); err != nil {
+			t.Errorf("%s: %s", line, err)
+		}
+	}
+
+	// list index is kept when converted back into a query
+	line := "Filter: contacts[-1] = admin"
+	stack := []Filter{}
+	if err := ParseFilter("contacts[-1] = admin", &line, "hosts", &stack); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("Filter: contacts[-1] = admin\n", stack[0].String("")); err != nil {
+		t.Error(err)
+	}
+
+	// only list columns support indexes
+	line = "Filter: name[0] = admin"
+	err := ParseFilter("name[0] = admin", &line, "hosts", &stack)
+	if err = assertEq("bad request: list index is only supported for list columns in Filter: name[0] = admin", err.Error()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFilterValueCase(t *testing.T) {
+	tests := []struct {
+		filter string
+		value  string
+		match  bool
+	}{
+		{"name = WebServer", "WebServer", true},
+		{"name = WebServer", "webserver", false},
+		{"Name = WebServer", "WebServer", true},
+		{"NAME != WebServer", "webserver", true},
+		{"name ~ ^Web", "webserver", false},
+		{"name =~ WEBSERVER", "WebServer", true},
+	}
+	for _, test := range tests {
+		line := "Filter: " + test.filter
+		stack := []Filter{}
+		if err := ParseFilter(test.filter, &line, "hosts", &stack); err != nil {
+			t.Fatal(err)
+		}
+		if err := assertEq("name", stack[0].Column.Name); err != nil {
+			t.Error(err)
+		}
+		var value interface{} = test.value
+		if err := assertEq(test.match, stack[0].MatchFilter(&value)); err != nil {
+			t.Errorf("%s: %s", line, err)
+		}
+	}
+
+	// values keep their case when converted back into a query
+	line := "Filter: Name = WebServer"
+	stack := []Filter{}
+	if err := ParseFilter("Name = WebServer", &line, "hosts", &stack); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("Filter: name = WebServer\n", stack[0].String("")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFilterNormalized(t *testing.T) {
+	tests := []struct {
+		filter string
+		expect string
+	}{
+		{"", ""},
+		{"Filter: name = test\n", `name = "test"`},
+		{"Filter: state = 1\nFilter: latency > 0.5\n", `state = 1 and latency > 0.5`},
+		{"Filter: name = a\nFilter: name = b\nOr: 2\nFilter: state != 0\n", `(name = "a" or name = "b") and state != 0`},
+		{"Filter: name = a\nFilter: name = b\nOr: 2\nFilter: name = c\nOr: 2\n", `name = "a" or name = "b" or name = "c"`},
+		{"Filter: state = 1\nFilter: state = 2\nAnd: 2\nFilter: name = x\nAnd: 2\n", `state = 1 and state = 2 and name = "x"`},
+		{"Filter: state = 1\nNegate:\nFilter: contacts >= admin\n", `not (state = 1) and contacts >= "admin"`},
+		{"Filter: name = a\nFilter: name = b\nOr: 2\nNegate:\nFilter: contacts =\n", `not (name = "a" or name = "b") and contacts = ""`},
+		{"Filter: name = a\nFilter: state = 1\nFilter: state = 2\nOr: 2\nNegate:\nAnd: 2\nFilter: name ~ ^b\nOr: 2\n", `(name = "a" and not (state = 1 or state = 2)) or name ~ "^b"`},
+		{"Filter: state = 1\nAnd: 1\nFilter: contacts[0] = admin\n", `state = 1 and contacts[0] = "admin"`},
+	}
+	for _, test := range tests {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\n" + test.filter + "\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.expect, NormalizeFilter(req.Filter)); err != nil {
+			t.Errorf("%s: %s", test.filter, err)
+		}
+	}
+}
+
+func TestFilterTimeBounds(t *testing.T) {
+	tests := []struct {
+		filter string
+		expect bool
+	}{
+		{"", false},
+		{"Filter: time >= 1500000000\n", true},
+		{"Filter: time < 1500000000\n", true},
+		{"Filter: time = 1500000000\n", true},
+		{"Filter: time != 1500000000\n", false},
+		{"Filter: time > 1500000000\nNegate:\n", false},
+		{"Filter: type = ALERT\n", false},
+		{"Filter: type = ALERT\nFilter: time > 1500000000\n", true},
+		{"Filter: type = ALERT\nFilter: time > 1500000000\nAnd: 2\n", true},
+		{"Filter: type = ALERT\nFilter: time > 1500000000\nOr: 2\n", false},
+		{"Filter: time > 1500000000\nFilter: time < 1400000000\nOr: 2\n", true},
+	}
+	for _, test := range tests {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\n" + test.filter + "\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.expect, hasTimeFilter(req.Filter)); err != nil {
+			t.Errorf("%s: %s", test.filter, err)
+		}
+	}
+}
+
+func TestFilterRegexLimits(t *testing.T) {
+	// large repetitions are rejected before they are compiled
+	if _, err := compileFilterRegex("(ab|cd|ef|gh){1000}"); err == nil {
+		t.Errorf("expected error for large repetitions")
+	}
+	if _, err := compileFilterRegex("(ab|cd){500}"); err != nil {
+		t.Error(err)
+	}
+	if _, err := compileFilterRegex(strings.Repeat("a", maxRegexLength+1)); err == nil {
+		t.Errorf("expected error for too long pattern")
+	}
+
+	// classic backtracking pattern matches in linear time
+	regex, err := compileFilterRegex("^(x+x+)+y$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := time.Now()
+	if err = assertEq(false, regex.MatchString(strings.Repeat("x", 100000))); err != nil {
+		t.Error(err)
+	}
+	if duration := time.Since(t1); duration > 2*time.Second {
+		t.Errorf("matching took too long: %s", duration)
+	}
+}
+
+func TestFilterRegexLiteral(t *testing.T) {
+	tests := []struct {
+		filter    string
+		isLiteral bool
+		literal   string
+	}{
+		{"description ~ svc_1", true, "svc_1"},
+		{"description !~ svc_1", true, "svc_1"},
+		{"description ~ svc\\.1", true, "svc.1"},
+		{"description ~ ^svc_1", false, ""},
+		{"description ~ svc_[12]", false, "svc_"},
+		{"description ~~ svc_1", false, ""},
+		{"description ~ svc_1$", false, ""},
+		{"description ~ ^svc_1$", false, ""},
+	}
+	for _, test := range tests {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET services\nFilter: " + test.filter + "\n\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.isLiteral, req.Filter[0].IsLiteral); err != nil {
+			t.Errorf("%s: %s", test.filter, err)
+		}
+		if test.isLiteral {
+			if err = assertEq(test.literal, req.Filter[0].Literal); err != nil {
+				t.Errorf("%s: %s", test.filter, err)
+			}
+		}
+	}
+
+	// substring matches return the same rows as the regular expression
+	peer := StartTestPeer(1, 10, 100)
+	PauseTestPeers(peer)
+
+	for _, pair := range [][]string{
+		{"description ~ svc_1", "description ~ svc_(1)"},
+		{"description !~ svc_1", "description !~ svc_(1)"},
+		{"description ~ testsvc_5", "description ~ testsvc_[5]"},
+	} {
+		literal, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: " + pair[0] + "\nSort: host_name asc\nSort: description asc\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		regex, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: " + pair[1] + "\nSort: host_name asc\nSort: description asc\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(literal) == 0 {
+			t.Errorf("%s: expected matches", pair[0])
+		}
+		if err = assertEq(regex, literal); err != nil {
+			t.Errorf("%s: %s", pair[0], err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestFilterRegexCache(t *testing.T) {
+	regexA, err := compileFilterRegex("cache_test_[0-9]+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regexB, err := compileFilterRegex("cache_test_[0-9]+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regexA != regexB {
+		t.Errorf("expected cached regular expression")
+	}
+
+	// invalid patterns are never cached
+	for i := 0; i < 2; i++ {
+		if _, err = compileFilterRegex("cache_test_[0-9"); err == nil {
+			t.Errorf("expected error for invalid pattern")
+		}
+	}
+}
+
+func TestFilterHostColumnsOnServices(t *testing.T) {
+	peer := StartTestPeer(1, 5, 50)
+	PauseTestPeers(peer)
+
+	// let one host go down, services reference the host row directly
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	nameIndex := hosts.Table.GetColumn("name").Index
+	stateIndex := hosts.Table.GetColumn("state").Index
+	for _, row := range hosts.Data {
+		if row[nameIndex] == "testhost_2" {
+			row[stateIndex] = float64(1)
+		}
+	}
+	p.DataLock.Unlock()
+
+	expect, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: host_name = testhost_2\nSort: description asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expect) == 0 {
+		t.Fatalf("expected services for testhost_2")
+	}
+
+	res, err := peer.QueryString("GET services\nColumns: host_name description\nFilter: host_state = 1\nSort: description asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(expect, res); err != nil {
+		t.Error(err)
+	}
+
+	// host columns are available in the output as well
+	res, err = peer.QueryString("GET services\nColumns: host_name host_state\nFilter: host_state = 1\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"testhost_2", float64(1)}}, res); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET services\nStats: host_state = 1\nStats: host_state = 0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(len(expect)), res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(float64(45-len(expect)), res[0][1]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestFilterTimeNever(t *testing.T) {
+	var never interface{} = 0.0
+	var null interface{}
+	var checked interface{} = 1500000000.0
+	tests := []struct {
+		filter      string
+		expect      bool
+		expectNever bool
+	}{
+		{"last_check < 1600000000", false, true},
+		{"last_check <= 1600000000", false, true},
+		{"last_check > 100", false, false},
+		{"last_check >= 0", false, true},
+		{"last_check = 0", true, true},
+		{"last_check != 1600000000", true, true},
+	}
+	for _, test := range tests {
+		for _, value := range []*interface{}{&never, &null} {
+			line := "Filter: " + test.filter
+			stack := []Filter{}
+			if err := ParseFilter(test.filter, &line, "hosts", &stack); err != nil {
+				t.Fatal(err)
+			}
+			if err := assertEq(test.expect, stack[0].MatchFilter(value)); err != nil {
+				t.Errorf("%s (%v): %s", test.filter, *value, err)
+			}
+			// zero timestamps are compared like any other number on request
+			setIncludeNever(stack)
+			if err := assertEq(test.expectNever, stack[0].MatchFilter(value)); err != nil {
+				t.Errorf("%s (%v) with IncludeNever: %s", test.filter, *value, err)
+			}
+		}
+	}
+
+	// checked objects are not affected
+	line := "Filter: last_check < 1600000000"
+	stack := []Filter{}
+	if err := ParseFilter("last_check < 1600000000", &line, "hosts", &stack); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(true, stack[0].MatchFilter(&checked)); err != nil {
+		t.Error(err)
+	}
+
+	// never checked hosts in queries
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	lastCheckIndex := hosts.Table.ColumnsIndex["last_check"]
+	for i := range hosts.Data {
+		hosts.Data[i][lastCheckIndex] = 1500000000.0
+		if i < 3 {
+			hosts.Data[i][lastCheckIndex] = 0.0
+		}
+	}
+	p.DataLock.Unlock()
+
+	res, err := peer.QueryString("GET hosts\nColumns: name\nFilter: last_check < 1600000000\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(7, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET hosts\nColumns: name\nFilter: last_check < 1600000000\nIncludeNever: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET hosts\nStats: last_check < 1600000000\nStats: last_check = 0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{7.0, 3.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestFilterBooleanTokens(t *testing.T) {
+	tests := []struct {
+		filter string
+		expect float64
+	}{
+		{"GET hosts\nFilter: notifications_enabled = 1", 1},
+		{"GET hosts\nFilter: notifications_enabled = true", 1},
+		{"GET hosts\nFilter: notifications_enabled = TRUE", 1},
+		{"GET hosts\nFilter: notifications_enabled = yes", 1},
+		{"GET hosts\nFilter: notifications_enabled = 0", 0},
+		{"GET hosts\nFilter: notifications_enabled = false", 0},
+		{"GET hosts\nFilter: notifications_enabled = No", 0},
+		{"GET hosts\nFilter: notifications_enabled != no", 0},
+		{"GET services\nFilter: host_acknowledged = yes", 1},
+		{"GET contacts\nFilter: can_submit_commands = true", 1},
+	}
+	for _, test := range tests {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(test.filter + "\n\n")))
+		if err != nil {
+			t.Fatalf("%s: %s", test.filter, err)
+		}
+		if err = assertEq(test.expect, req.Filter[0].FloatValue); err != nil {
+			t.Errorf("%s: %s", test.filter, err)
+		}
+	}
+
+	// boolean tokens are only accepted for boolean columns
+	for _, filter := range []string{"GET hosts\nFilter: state = true", "GET hosts\nFilter: notifications_enabled = maybe"} {
+		if _, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(filter + "\n\n"))); err == nil {
+			t.Errorf("expected error for: %s", filter)
+		}
+	}
+}
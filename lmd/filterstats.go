@@ -0,0 +1,76 @@
+package main
+
+// FilterStageCount contains the number of rows which passed a single top level filter.
+type FilterStageCount struct {
+	Filter string `json:"filter"`
+	Passed int    `json:"passed"`
+}
+
+// FilterStats contains the number of checked rows and the rows which passed each top
+// level filter of a request with FilterStats: on. Filters are applied in order, so each
+// stage only counts rows which passed all previous stages.
+type FilterStats struct {
+	Rows   int                `json:"rows"`
+	Stages []FilterStageCount `json:"stages"`
+}
+
+// filterCounts counts the rows passing each filter stage of a single peer.
+type filterCounts struct {
+	offset int // number of configured peer filters preceding the filters of the request
+	rows   int
+	passed []int
+}
+
+// newFilterCounts returns empty counters for all filters of the request or nil if not requested.
+func newFilterCounts(req *Request, filter []Filter) *filterCounts {
+	if !req.FilterStats {
+		return nil
+	}
+	return &filterCounts{
+		offset: len(filter) - len(req.Filter),
+		passed: make([]int, len(req.Filter)),
+	}
+}
+
+// match returns true if the row matches all filters and counts the rows passing each filter of the request.
+func (c *filterCounts) match(p *Peer, table *Table, refs *map[string][][]interface{}, inputRowLen int, filter []Filter, row *[]interface{}, rowNum int) bool {
+	for i := range filter {
+		if i == c.offset {
+			c.rows++
+		}
+		if !p.MatchRowFilter(table, refs, inputRowLen, &filter[i], row, rowNum) {
+			return false
+		}
+		if i >= c.offset {
+			c.passed[i-c.offset]++
+		}
+	}
+	if len(filter) == c.offset {
+		c.rows++
+	}
+	return true
+}
+
+// addFilterCounts merges the filter counts of a single peer into the response.
+func (res *Response) addFilterCounts(counts *filterCounts) {
+	res.facetLock.Lock()
+	defer res.facetLock.Unlock()
+	if res.FilterStats == nil {
+		res.FilterStats = &FilterStats{Stages: make([]FilterStageCount, len(res.Request.Filter))}
+		for i := range res.Request.Filter {
+			res.FilterStats.Stages[i].Filter = res.Request.Filter[i].Normalized()
+		}
+	}
+	res.FilterStats.Rows += counts.rows
+	for i, passed := range counts.passed {
+		res.FilterStats.Stages[i].Passed += passed
+	}
+}
+
+// filterStatsResult returns the filter stats used in the wrapped_json output.
+func (res *Response) filterStatsResult() *FilterStats {
+	if res.FilterStats == nil {
+		res.addFilterCounts(&filterCounts{})
+	}
+	return res.FilterStats
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// validateHiddenColumns returns an error if hidden columns are required in the output.
+// Hidden columns are fetched like any other column and can be used to sort, filter or
+// deduplicate rows, but they are removed before the rows are sent, ex.:
+// Columns: host_name description last_check hidden
+func (req *Request) validateHiddenColumns() error {
+	if len(req.Stats) > 0 {
+		return errors.New("bad request: hidden columns cannot be used with stats queries")
+	}
+	if len(req.HiddenColumns) >= len(req.Columns) {
+		return errors.New("bad request: at least one column must not be hidden")
+	}
+	if req.SplitBy != "" && req.HiddenColumns[req.splitIndex] {
+		return fmt.Errorf("bad request: split column %s cannot be hidden", req.SplitBy)
+	}
+	if req.OutputFormat == "json_map" {
+		for _, key := range JSONMapKeys[req.Table] {
+			if !req.hasVisibleColumn(key) {
+				return fmt.Errorf("bad request: column %s cannot be hidden in json_map output", key)
+			}
+		}
+	}
+	return nil
+}
+
+// hasVisibleColumn returns true if the column is requested at least once without the hidden marker.
+func (req *Request) hasVisibleColumn(name string) bool {
+	for i, col := range req.Columns {
+		if strings.ToLower(col) == name && !req.HiddenColumns[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// stripHiddenColumns returns the row without the hidden columns.
+func (req *Request) stripHiddenColumns(row []interface{}) []interface{} {
+	if len(req.HiddenColumns) == 0 {
+		return row
+	}
+	stripped := make([]interface{}, 0, len(row))
+	for i, val := range row {
+		if !req.HiddenColumns[i] {
+			stripped = append(stripped, val)
+		}
+	}
+	return stripped
+}
+
+// StripHiddenColumns removes the hidden columns from the result rows and the result columns,
+// so the rows match the column headers. It must be the last step before the result is encoded.
+func (res *Response) StripHiddenColumns() {
+	req := res.Request
+	if len(req.HiddenColumns) == 0 {
+		return
+	}
+	for i, row := range res.Result {
+		res.Result[i] = req.stripHiddenColumns(row)
+	}
+	columns := make([]Column, 0, len(res.Columns))
+	removed := 0
+	for i, col := range res.Columns {
+		if req.HiddenColumns[i] {
+			if i < req.splitIndex {
+				removed++
+			}
+			continue
+		}
+		columns = append(columns, col)
+	}
+	res.Columns = columns
+	// the split column is never hidden but moves to the left
+	if req.SplitBy != "" {
+		req.splitIndex -= removed
+	}
+}
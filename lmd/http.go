@@ -11,13 +11,23 @@ import (
 
 // HTTPServerController is the container object for the rest interface's server.
 type HTTPServerController struct {
+	defaultOutputFormat string
 }
 
 func (c *HTTPServerController) errorOutput(err error, w http.ResponseWriter) {
 	j := make(map[string]interface{})
 	j["error"] = err.Error()
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
+	switch err.(type) {
+	case *UnsupportedTableError:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		if err == errServerBusy || err == errNoBackends {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
 	json.NewEncoder(w).Encode(j)
 }
 
@@ -25,15 +35,18 @@ func (c *HTTPServerController) index(w http.ResponseWriter, request *http.Reques
 	fmt.Fprintf(w, "LMD %s\n", VERSION)
 }
 
-func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map[string]interface{}) {
+// queryTable answers a table request. Client requests are limited to the DefaultLimit,
+// sub-requests from other cluster nodes must return all rows.
+func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map[string]interface{}, clientRequest bool) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Requested table (name)
-	tableName := requestData["table"].(string)
+	// Requested table (name), livestatus table names are always lowercase
+	tableName := strings.ToLower(requestData["table"].(string))
+	requestData["table"] = tableName
 
 	// Check if table exists
 	if _, exists := Objects.Tables[tableName]; !exists {
-		c.errorOutput(fmt.Errorf("table not found: %s", tableName), w)
+		c.errorOutput(unknownTableError(tableName), w)
 		return
 	}
 
@@ -42,10 +55,40 @@ func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map
 		c.errorOutput(err, w)
 		return
 	}
+	if req.OutputFormat == "" {
+		req.OutputFormat = c.defaultOutputFormat
+	}
+
+	if clientRequest {
+		req.applyDefaultLimit()
+	}
 
 	// Fetch backend data
 	req.ExpandRequestedBackends() // ParseRequests()
 
+	// Stop working on the request if the client goes away
+	req.canceler = NewCanceler()
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed := notifier.CloseNotify()
+		finished := make(chan bool)
+		defer close(finished)
+		go func() {
+			select {
+			case <-closed:
+				req.canceler.Cancel()
+			case <-finished:
+			}
+		}()
+	}
+
+	// Send rows as soon as they arrive
+	if req.Progressive {
+		if req.OutputFormat == "ndjson" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		req.progressive = NewProgressiveWriter(w, req)
+	}
+
 	// Ask request object to send query, get response
 	res, err := req.GetResponse()
 	if err != nil {
@@ -53,13 +96,28 @@ func (c *HTTPServerController) queryTable(w http.ResponseWriter, requestData map
 		return
 	}
 
-	// Send JSON
-	j, err := res.JSON()
+	if res.ETag != "" {
+		w.Header().Set("ETag", "\""+res.ETag+"\"")
+	}
+	if res.Code == 304 {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Send JSON or MessagePack
+	j, err := res.Bytes()
 	if err != nil {
 		c.errorOutput(err, w)
 		return
 	}
-	fmt.Fprintf(w, "%s", j)
+	switch req.OutputFormat {
+	case "msgpack":
+		w.Header().Set("Content-Type", "application/msgpack")
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		j = append(j, '\n')
+	}
+	w.Write(j)
 
 }
 
@@ -79,7 +137,12 @@ func (c *HTTPServerController) table(w http.ResponseWriter, request *http.Reques
 		requestData["table"] = tableName
 	}
 
-	c.queryTable(w, requestData)
+	// support standard conditional http requests
+	if etag := strings.Trim(request.Header.Get("If-None-Match"), "\""); etag != "" {
+		requestData["ifnonematch"] = etag
+	}
+
+	c.queryTable(w, requestData, true)
 }
 
 func (c *HTTPServerController) ping(w http.ResponseWriter, request *http.Request, ps httprouter.Params) {
@@ -115,7 +178,7 @@ func (c *HTTPServerController) query(w http.ResponseWriter, request *http.Reques
 	case "ping":
 		c.ping(w, request, ps)
 	case "table":
-		c.queryTable(w, requestData)
+		c.queryTable(w, requestData, false)
 	default:
 		c.errorOutput(fmt.Errorf("unknown request: %s", requestedFunction), w)
 	}
@@ -150,6 +213,15 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 		}
 	}
 
+	// Named filter from the SavedFilters config option
+	if val, ok := requestData["savedfilter"]; ok {
+		err = parseSavedFilter(req.Table, val.(string), &req.savedFilters)
+		if err != nil {
+			return req, err
+		}
+		req.applySavedFilters()
+	}
+
 	// Stats String in livestatus syntax
 	if val, ok := requestData["stats"]; ok {
 		err = parseHTTPFilterRequestData(req, val, "Stats")
@@ -161,6 +233,116 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 		}
 	}
 
+	// Progressive ndjson output
+	if val, ok := requestData["progressive"]; ok {
+		req.Progressive = val.(bool)
+	}
+
+	// Progress lines in progressive output
+	if val, ok := requestData["progress"]; ok {
+		req.Progress = val.(bool)
+	}
+
+	// Normalized filter in wrapped_json output
+	if val, ok := requestData["showfilter"]; ok {
+		req.ShowFilter = val.(bool)
+	}
+
+	// Approximate median and percentile stats
+	if val, ok := requestData["statsapprox"]; ok {
+		req.StatsApprox = val.(bool)
+	}
+
+	// Approximate result totals
+	if val, ok := requestData["approxtotal"]; ok {
+		req.ApproxTotal = val.(bool)
+	}
+
+	// State labels instead of numbers
+	if val, ok := requestData["mapstates"]; ok {
+		req.MapStates = val.(bool)
+	}
+
+	// Json booleans instead of 0 and 1
+	if val, ok := requestData["mapbooleans"]; ok {
+		req.MapBooleans = val.(bool)
+	}
+
+	// Rows passing each filter
+	if val, ok := requestData["filterstats"]; ok {
+		req.FilterStats = val.(bool)
+	}
+
+	// Query plan instead of the result
+	if val, ok := requestData["explain"]; ok {
+		req.Explain = val.(bool)
+	}
+
+	// Min, max and avg of numeric columns in wrapped_json output
+	if val, ok := requestData["summary"]; ok {
+		req.Summary = val.(bool)
+	}
+
+	// Applied limit and offset in wrapped_json output
+	if val, ok := requestData["showlimit"]; ok {
+		req.ShowLimit = val.(bool)
+	}
+
+	// Cached data from idling backends
+	if val, ok := requestData["nospinup"]; ok {
+		req.NoSpinUp = val.(bool)
+	}
+
+	// Time comparisons matching zero timestamps
+	if val, ok := requestData["includenever"]; ok {
+		req.IncludeNever = val.(bool)
+	}
+
+	// Handling of columns requested more than once
+	if val, ok := requestData["duplicatecolumns"]; ok {
+		err = parseDuplicateColumns(&req.DuplicateColumns, fmt.Sprintf("%v", val))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Output format of timestamps
+	if val, ok := requestData["timeformat"]; ok {
+		err = parseTimeFormat(&req.TimeFormat, fmt.Sprintf("%v", val))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Rows grouped by the values of a column
+	if val, ok := requestData["splitby"]; ok {
+		req.SplitBy = strings.ToLower(fmt.Sprintf("%v", val))
+	}
+
+	// State durations from the log table
+	if val, ok := requestData["availability"]; ok {
+		err = parseAvailability(&req.Availability, fmt.Sprintf("%v", val))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Rows within a percentile band of a numeric column
+	if val, ok := requestData["percentilefilter"]; ok {
+		err = parsePercentileFilter(&req.PercentileFilter, fmt.Sprintf("%v", val))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Decimals of float columns
+	if val, ok := requestData["floatprecision"]; ok {
+		err = parseFloatPrecision(&req.FloatPrecision, fmt.Sprintf("%v", val))
+		if err != nil {
+			return req, err
+		}
+	}
+
 	// Sort
 	var requestDataSort []interface{}
 	if val, ok := requestData["sort"]; ok {
@@ -183,7 +365,98 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 			columns = append(columns, column.(string))
 		}
 	}
-	req.Columns = columns
+	if len(columns) > 0 {
+		err = parseColumnsHeader(&req.Columns, &req.ColumnFormats, &req.ColumnAliases, &req.HiddenColumns, strings.Join(columns, " "))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Peer counts in wrapped_json output
+	if val, ok := requestData["peercounts"]; ok {
+		req.SendPeerCounts = val.(bool)
+	}
+
+	// Received bytes per peer in wrapped_json output
+	if val, ok := requestData["peerbytes"]; ok {
+		req.SendPeerBytes = val.(bool)
+	}
+
+	// Stats of each peer in wrapped_json output
+	if val, ok := requestData["peerstats"]; ok {
+		req.SendPeerStats = val.(bool)
+	}
+
+	// Merge duplicate hosts and services
+	if val, ok := requestData["mergeduplicates"]; ok {
+		err = parseMergeDuplicates(&req.MergeDuplicates, &req.MergeKeep, val.(string))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Changed rows only
+	if val, ok := requestData["changedsince"]; ok {
+		req.ChangedSince = int(val.(float64))
+	}
+
+	// Representation of null values
+	if val, ok := requestData["nullvalue"]; ok {
+		err = parseNullValue(&req.NullValue, val.(string))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Order of merged backend results
+	if val, ok := requestData["peerorder"]; ok {
+		err = parsePeerOrder(&req.PeerOrder, val.(string))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Freshness of the backend data
+	if val, ok := requestData["consistency"]; ok {
+		err = parseConsistency(&req.Consistency, val.(string))
+		if err != nil {
+			return req, err
+		}
+	}
+
+	// Expected stats groups
+	if val, ok := requestData["statsgroups"]; ok {
+		for _, group := range val.([]interface{}) {
+			req.StatsGroups = append(req.StatsGroups, group.(string))
+		}
+	}
+
+	// First row of each group
+	if val, ok := requestData["firstpergroup"]; ok {
+		for _, col := range val.([]interface{}) {
+			req.FirstPerGroup = append(req.FirstPerGroup, strings.ToLower(col.(string)))
+		}
+	}
+
+	// Authorization
+	if val, ok := requestData["authuser"]; ok {
+		req.AuthUser = val.(string)
+	}
+	if val, ok := requestData["authgroups"]; ok {
+		for _, group := range val.([]interface{}) {
+			req.AuthGroups = append(req.AuthGroups, group.(string))
+		}
+	}
+
+	// Etag from previous response
+	if val, ok := requestData["ifnonematch"]; ok {
+		req.IfNoneMatch = val.(string)
+	}
+
+	// Etag in wrapped_json output
+	if val, ok := requestData["etag"]; ok {
+		req.SendETag = val.(bool)
+	}
 
 	// Format
 	if val, ok := requestData["outputformat"]; ok {
@@ -201,6 +474,11 @@ func parseRequestDataToRequest(requestData map[string]interface{}) (req *Request
 		}
 	}
 	req.Backends = backends
+
+	// stats requests only send a header row if requested explicitly
+	if _, ok := requestData["sendcolumnsheader"]; !ok && len(req.Stats) > 0 {
+		req.SendColumnsHeader = false
+	}
 	return
 }
 
@@ -230,11 +508,11 @@ func parseHTTPFilterRequestData(req *Request, val interface{}, prefix string) (e
 	return
 }
 
-func initializeHTTPRouter() (handler http.Handler, err error) {
+func initializeHTTPRouter(defaultOutputFormat string) (handler http.Handler, err error) {
 	router := httprouter.New()
 
 	// Controller
-	controller := &HTTPServerController{}
+	controller := &HTTPServerController{defaultOutputFormat: defaultOutputFormat}
 
 	// Routes
 	router.GET("/", controller.index)
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// RowEncoder writes json encoded values followed by a newline, just like json.Encoder.
+type RowEncoder interface {
+	Encode(v interface{}) error
+}
+
+// available json encoders, see JSONEncoder config option
+const (
+	jsonEncoderStd int64 = iota
+	jsonEncoderFast
+)
+
+// jsonEncoder selects the encoder used for responses.
+var jsonEncoder = jsonEncoderFast
+
+// SetJSONEncoder selects the json encoder by name, std uses encoding/json for everything.
+// It returns an error if there is no such encoder.
+func SetJSONEncoder(name string) error {
+	switch name {
+	case "", "fast":
+		atomic.StoreInt64(&jsonEncoder, jsonEncoderFast)
+	case "std":
+		atomic.StoreInt64(&jsonEncoder, jsonEncoderStd)
+	default:
+		return fmt.Errorf("unknown json encoder %s, only std and fast are supported", name)
+	}
+	return nil
+}
+
+// NewRowEncoder returns the configured json encoder writing to w.
+func NewRowEncoder(w io.Writer) RowEncoder {
+	if atomic.LoadInt64(&jsonEncoder) == jsonEncoderStd {
+		return json.NewEncoder(w)
+	}
+	return &FastEncoder{writer: w}
+}
+
+// FastEncoder encodes result rows without reflection and reuses its buffer for all rows.
+// The output is byte compatible with encoding/json, which is used for all types not
+// found in result rows.
+type FastEncoder struct {
+	writer io.Writer
+	buf    []byte
+}
+
+// jsonStringEscapes contains the escape sequence encoding/json uses for each ascii character,
+// empty strings mark characters which do not need to be escaped.
+var jsonStringEscapes = func() (escapes [utf8.RuneSelf]string) {
+	for i := range escapes {
+		quoted, _ := json.Marshal(string(rune(i)))
+		if str := string(quoted[1 : len(quoted)-1]); str != string(rune(i)) {
+			escapes[i] = str
+		}
+	}
+	return
+}()
+
+// jsonInvalidUTF8 contains the replacement encoding/json uses for invalid utf-8 bytes.
+var jsonInvalidUTF8 = func() string {
+	quoted, _ := json.Marshal("\xff")
+	return string(quoted[1 : len(quoted)-1])
+}()
+
+// Encode writes the json encoding of v followed by a newline.
+func (e *FastEncoder) Encode(v interface{}) (err error) {
+	e.buf, err = appendJSON(e.buf[:0], v)
+	if err != nil {
+		return
+	}
+	e.buf = append(e.buf, '\n')
+	_, err = e.writer.Write(e.buf)
+	return
+}
+
+// appendJSON appends the json encoding of v to buf.
+func appendJSON(buf []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch val := v.(type) {
+	case nil:
+		buf = append(buf, "null"...)
+	case string:
+		buf = appendJSONString(buf, val)
+	case float64:
+		return appendJSONFloat(buf, val)
+	case int:
+		buf = strconv.AppendInt(buf, int64(val), 10)
+	case int64:
+		buf = strconv.AppendInt(buf, val, 10)
+	case bool:
+		buf = strconv.AppendBool(buf, val)
+	case []interface{}:
+		if val == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '[')
+		for i := range val {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf, err = appendJSON(buf, val[i])
+			if err != nil {
+				return buf, err
+			}
+		}
+		buf = append(buf, ']')
+	case [][]interface{}:
+		if val == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '[')
+		for i := range val {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf, err = appendJSON(buf, val[i])
+			if err != nil {
+				return buf, err
+			}
+		}
+		buf = append(buf, ']')
+	case []string:
+		if val == nil {
+			return append(buf, "null"...), nil
+		}
+		buf = append(buf, '[')
+		for i := range val {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, val[i])
+		}
+		buf = append(buf, ']')
+	case map[string]interface{}:
+		if val == nil {
+			return append(buf, "null"...), nil
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf = append(buf, '{')
+		for i, k := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, k)
+			buf = append(buf, ':')
+			buf, err = appendJSON(buf, val[k])
+			if err != nil {
+				return buf, err
+			}
+		}
+		buf = append(buf, '}')
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, encoded...)
+	}
+	return buf, nil
+}
+
+// appendJSONFloat appends a float like encoding/json does, small and large numbers use the exponent format.
+func appendJSONFloat(buf []byte, f float64) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		_, err := json.Marshal(f)
+		return buf, err
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(buf)
+		if n >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+			buf[n-2] = buf[n-1]
+			buf = buf[:n-1]
+		}
+	}
+	return buf, nil
+}
+
+// appendJSONString appends a quoted string, invalid utf-8 is replaced like encoding/json does.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if jsonStringEscapes[c] == "" {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, jsonStringEscapes[c]...)
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, jsonInvalidUTF8...)
+			i += size
+			start = i
+			continue
+		}
+		// line and paragraph separators break javascript
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\u202`...)
+			buf = append(buf, "0123456789abcdef"[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
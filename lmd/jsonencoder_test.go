@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestJSONEncoderCompatible(t *testing.T) {
+	values := []interface{}{
+		nil,
+		"",
+		"plain text",
+		"quotes \" and \\ backslashes",
+		"line\nbreak\r\ttab\b\f\x00\x1f\x7f",
+		"<html> & entities",
+		"utf8 äöü € 日本",
+		"line\u2028para\u2029separators",
+		"invalid \xff\xfe utf8",
+		0.0,
+		-0.5,
+		1.0,
+		123456789.0,
+		1e20,
+		1e21,
+		1e-6,
+		1e-7,
+		-3.14159265358979,
+		5,
+		int64(-42),
+		true,
+		false,
+		PeerStatusDown,
+		[]interface{}{},
+		[]interface{}(nil),
+		[]string{"a", "b\"c"},
+		[]string(nil),
+		map[string]interface{}{"z": 1.0, "a": "x", "m": []interface{}{1.0, "2"}},
+		map[string]string{"key": "value"},
+		[][]interface{}{{"host", 1.0}, {"host2", nil}},
+		[]int{1, 2},
+	}
+	for _, v := range values {
+		expect := new(bytes.Buffer)
+		if err := json.NewEncoder(expect).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		got := new(bytes.Buffer)
+		if err := (&FastEncoder{writer: got}).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if err := assertEq(expect.String(), got.String()); err != nil {
+			t.Errorf("%#v: %s", v, err)
+		}
+	}
+
+	// whole rows encode the same way
+	row := make([]interface{}, len(values))
+	copy(row, values)
+	expect, _ := json.Marshal(row)
+	got, err := appendJSON(nil, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(string(expect), string(got)); err != nil {
+		t.Error(err)
+	}
+
+	// unsupported values return an error
+	if _, err := appendJSON(nil, []interface{}{math.NaN()}); err == nil {
+		t.Errorf("expected error for NaN")
+	}
+}
+
+func TestJSONEncoderSwitch(t *testing.T) {
+	defer SetJSONEncoder("fast")
+	if err := SetJSONEncoder("std"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewRowEncoder(new(bytes.Buffer)).(*json.Encoder); !ok {
+		t.Errorf("expected encoding/json encoder")
+	}
+	if err := SetJSONEncoder("fast"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewRowEncoder(new(bytes.Buffer)).(*FastEncoder); !ok {
+		t.Errorf("expected fast encoder")
+	}
+	if err := assertEq("unknown json encoder sonic, only std and fast are supported", SetJSONEncoder("sonic").Error()); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,17 +3,23 @@ package main
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// clientReadTimeout sets the number of seconds clients have to send a complete request.
+var clientReadTimeout int64 = 10
+
 // QueryServer handles a single client connection.
+// Requests without OutputFormat header use the given default format.
 // It returns any error encountered.
-func QueryServer(c net.Conn) error {
+func QueryServer(c net.Conn, defaultOutputFormat string) error {
 	localAddr := c.LocalAddr().String()
 	keepAlive := false
 	remote := c.RemoteAddr().String()
@@ -26,18 +32,25 @@ func QueryServer(c net.Conn) error {
 			promFrontendConnections.WithLabelValues(localAddr).Inc()
 			log.Debugf("incoming request from: %s to %s", remote, localAddr)
 			c.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
+			c.SetReadDeadline(time.Now().Add(time.Duration(atomic.LoadInt64(&clientReadTimeout)) * time.Second))
 		}
 
-		reqs, err := ParseRequests(c)
+		reqs, err := ParseRequests(c, defaultOutputFormat)
 		if err != nil {
 			if err, ok := err.(net.Error); ok {
 				if keepAlive {
 					log.Debugf("closing keepalive connection from %s", remote)
+				} else if err.Timeout() {
+					log.Infof("closing connection from %s, no complete request received within %ds", remote, atomic.LoadInt64(&clientReadTimeout))
 				} else {
 					log.Debugf("network error from %s: %s", remote, err.Error())
 				}
 				return err
 			}
+			if err == errIncompleteRequest && atomic.LoadInt64(&incompleteRequests) == incompleteRequestsClose {
+				log.Debugf("closing connection from %s, incomplete request", remote)
+				return nil
+			}
 			(&Response{Code: 400, Request: &Request{}, Error: err}).Send(c)
 			return err
 		}
@@ -48,12 +61,17 @@ func QueryServer(c net.Conn) error {
 			if keepAlive {
 				log.Debugf("keepalive connection from %s, waiting for more requests", remote)
 				c.SetDeadline(time.Now().Add(time.Duration(10) * time.Second))
+				c.SetReadDeadline(time.Now().Add(time.Duration(atomic.LoadInt64(&clientReadTimeout)) * time.Second))
 				continue
 			}
 		} else if keepAlive {
 			// wait up to deadline after the last keep alive request
 			time.Sleep(100 * time.Millisecond)
 			continue
+		} else if atomic.LoadInt64(&incompleteRequests) == incompleteRequestsClose {
+			// ex.: health probes which only open the connection
+			log.Debugf("closing connection from %s, empty request", remote)
+			return nil
 		} else {
 			err = errors.New("bad request: empty request")
 			(&Response{Code: 400, Request: &Request{}, Error: err}).Send(c)
@@ -83,21 +101,61 @@ func ProcessRequests(reqs []*Request, c net.Conn, remote string) (bool, error) {
 				commandsByPeer = make(map[string][]string)
 				log.Infof("incoming command request from %s to %s finished in %s", remote, c.LocalAddr().String(), time.Since(t1))
 			}
+			if req.Noop {
+				// answer probes with an empty result
+				size, sErr := (&Response{Code: 200, Request: req, Result: make([][]interface{}, 0)}).Send(c)
+				log.Debugf("incoming noop request from %s to %s finished, size: %d", remote, c.LocalAddr().String(), size)
+				if sErr != nil {
+					return false, sErr
+				}
+				if !req.KeepAlive {
+					return false, nil
+				}
+				continue
+			}
+			if err := req.enableDebug(connectionClient(c)); err != nil {
+				(&Response{Code: responseErrorCode(err), Request: req, Error: err}).Send(c)
+				return false, err
+			}
+			req.applyDefaultLimit()
 			if req.WaitTrigger != "" {
 				c.SetDeadline(time.Now().Add(time.Duration(req.WaitTimeout+1000) * time.Millisecond))
 			}
 			if req.Table == "log" {
 				c.SetDeadline(time.Now().Add(time.Duration(60) * time.Second))
 			}
-			response, rErr := req.GetResponse()
+			if req.Progressive {
+				req.progressive = NewProgressiveWriter(c, req)
+			}
+			// keepalive clients may send the next request while this one is processed,
+			// so only watch connections which are closed after the response anyway
+			req.canceler = NewCanceler()
+			stopWatching := func() {}
+			if !req.KeepAlive {
+				stopWatching = req.canceler.WatchConnection(c)
+			}
+			name := req.Table
+			var response *Response
+			var rErr error
+			if len(req.MultiQuery) > 0 {
+				name = fmt.Sprintf("multiquery (%d queries)", len(req.MultiQuery))
+				response, rErr = req.GetMultiQueryResponse()
+			} else {
+				response, rErr = req.GetResponse()
+			}
+			stopWatching()
+			if rErr == errClientDisconnected {
+				log.Infof("incoming %s request from %s to %s aborted after %s, client disconnected", name, remote, c.LocalAddr().String(), time.Since(t1))
+				return false, rErr
+			}
 			if rErr != nil {
-				(&Response{Code: 400, Request: req, Error: rErr}).Send(c)
+				(&Response{Code: responseErrorCode(rErr), Request: req, Error: rErr}).Send(c)
 				return false, rErr
 			}
 
 			size, sErr := response.Send(c)
 			duration := time.Since(t1)
-			log.Infof("incoming %s request from %s to %s finished in %s, size: %.3f kB", req.Table, remote, c.LocalAddr().String(), duration.String(), float64(size)/1024)
+			req.logger().Infof("incoming %s request from %s to %s finished in %s, size: %.3f kB", name, remote, c.LocalAddr().String(), duration.String(), float64(size)/1024)
 			if sErr != nil {
 				return false, sErr
 			}
@@ -117,6 +175,17 @@ func ProcessRequests(reqs []*Request, c net.Conn, remote string) (bool, error) {
 	return reqs[len(reqs)-1].KeepAlive, nil
 }
 
+// responseErrorCode returns the response code for errors of failed requests.
+func responseErrorCode(err error) int {
+	if err == errServerBusy || err == errNoBackends {
+		return 503
+	}
+	if _, ok := err.(*UnsupportedTableError); ok {
+		return 404
+	}
+	return 400
+}
+
 // SendCommands sends commands for this request to all selected remote sites.
 // It returns any error encountered.
 func SendCommands(commandsByPeer *map[string][]string) {
@@ -157,27 +226,28 @@ func SendCommands(commandsByPeer *map[string][]string) {
 func LocalListener(LocalConfig *Config, listen string, waitGroupInit *sync.WaitGroup, waitGroupDone *sync.WaitGroup, shutdownChannel chan bool) {
 	defer waitGroupDone.Done()
 	waitGroupDone.Add(1)
+	outputFormat := LocalConfig.ListenOutputFormat[listen]
 	if strings.HasPrefix(listen, "https://") {
 		listen = strings.TrimPrefix(listen, "https://")
-		LocalListenerHTTP(LocalConfig, "https", listen, waitGroupInit, shutdownChannel)
+		LocalListenerHTTP(LocalConfig, "https", listen, outputFormat, waitGroupInit, shutdownChannel)
 	} else if strings.HasPrefix(listen, "http://") {
 		listen = strings.TrimPrefix(listen, "http://")
-		LocalListenerHTTP(LocalConfig, "http", listen, waitGroupInit, shutdownChannel)
+		LocalListenerHTTP(LocalConfig, "http", listen, outputFormat, waitGroupInit, shutdownChannel)
 	} else if strings.Contains(listen, ":") {
 		listen = strings.TrimPrefix(listen, "*") // * means all interfaces
-		LocalListenerLivestatus(LocalConfig, "tcp", listen, waitGroupInit, shutdownChannel)
+		LocalListenerLivestatus(LocalConfig, "tcp", listen, outputFormat, waitGroupInit, shutdownChannel)
 	} else {
 		// remove stale sockets on start
 		if _, err := os.Stat(listen); err == nil {
 			log.Warnf("removing stale socket: %s", listen)
 			os.Remove(listen)
 		}
-		LocalListenerLivestatus(LocalConfig, "unix", listen, waitGroupInit, shutdownChannel)
+		LocalListenerLivestatus(LocalConfig, "unix", listen, outputFormat, waitGroupInit, shutdownChannel)
 	}
 }
 
 // LocalListenerLivestatus starts a listening socket with livestatus protocol.
-func LocalListenerLivestatus(LocalConfig *Config, connType string, listen string, waitGroupInit *sync.WaitGroup, shutdownChannel chan bool) {
+func LocalListenerLivestatus(LocalConfig *Config, connType string, listen string, outputFormat string, waitGroupInit *sync.WaitGroup, shutdownChannel chan bool) {
 	l, err := net.Listen(connType, listen)
 	if err != nil {
 		log.Fatalf("listen error: %s", err.Error())
@@ -217,7 +287,7 @@ func LocalListenerLivestatus(LocalConfig *Config, connType string, listen string
 			// make sure we log panics properly
 			defer logPanicExit()
 
-			ch <- QueryServer(fd)
+			ch <- QueryServer(fd, outputFormat)
 		}()
 		select {
 		case <-ch:
@@ -232,7 +302,7 @@ func LocalListenerLivestatus(LocalConfig *Config, connType string, listen string
 }
 
 // LocalListenerHTTP starts a listening socket with http protocol.
-func LocalListenerHTTP(LocalConfig *Config, httpType string, listen string, waitGroupInit *sync.WaitGroup, shutdownChannel chan bool) {
+func LocalListenerHTTP(LocalConfig *Config, httpType string, listen string, outputFormat string, waitGroupInit *sync.WaitGroup, shutdownChannel chan bool) {
 	// Parse listener address
 	listen = strings.TrimPrefix(listen, "*") // * means all interfaces
 
@@ -269,7 +339,7 @@ func LocalListenerHTTP(LocalConfig *Config, httpType string, listen string, wait
 	}()
 
 	// Initialize HTTP router
-	router, err := initializeHTTPRouter()
+	router, err := initializeHTTPRouter(outputFormat)
 	if err != nil {
 		log.Fatalf("error initializing http server: %s", err.Error())
 		return
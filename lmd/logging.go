@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/kdar/factorlog"
 )
@@ -16,6 +19,16 @@ const logColorReset = "%{Color \"reset\"}"
 // initialize standard logger which will be configured later from the configuration file options
 var log = factorlog.New(os.Stdout, factorlog.NewStdFormatter("%{Date} %{Time} %{File}:%{Line} %{Message}"))
 
+// logOutput and logOutputFormatter are used for the loggers of single requests, see LogLevel header.
+var logOutput io.Writer = os.Stdout
+var logOutputFormatter factorlog.Formatter = factorlog.NewStdFormatter(logFormat)
+
+// logLevelClients contains the clients which may raise the log level of their requests
+// and capture the raw backend responses.
+var logLevelClients []*net.IPNet
+var logLevelUnixClients bool
+var logLevelClientsLock = new(sync.RWMutex)
+
 // InitLogging initializes the logging system.
 func InitLogging(conf *Config) {
 	var logFormatter factorlog.Formatter
@@ -40,6 +53,8 @@ func InitLogging(conf *Config) {
 	}
 	log.SetFormatter(logFormatter)
 	log.SetOutput(targetWriter)
+	logOutput = targetWriter
+	logOutputFormatter = logFormatter
 	log.SetVerbosity(1)
 	if strings.ToLower(LogLevel) == "off" {
 		log.SetMinMaxSeverity(factorlog.StringToSeverity("PANIC"), factorlog.StringToSeverity("PANIC"))
@@ -54,3 +69,131 @@ func InitLogging(conf *Config) {
 		}
 	}
 }
+
+// SetLogLevelClients sets the clients which may use the LogLevel header. Clients are
+// ip addresses, networks, ex.: 10.0.0.0/8, or unix for all clients of unix sockets.
+func SetLogLevelClients(clients []string) error {
+	networks := []*net.IPNet{}
+	unix := false
+	for _, client := range clients {
+		if client == "unix" {
+			unix = true
+			continue
+		}
+		if !strings.Contains(client, "/") {
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return fmt.Errorf("invalid client address %s", client)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return fmt.Errorf("invalid client network %s", client)
+		}
+		networks = append(networks, network)
+	}
+	logLevelClientsLock.Lock()
+	logLevelClients = networks
+	logLevelUnixClients = unix
+	logLevelClientsLock.Unlock()
+	return nil
+}
+
+// logLevelClientAllowed returns true if the client may raise the log level of its requests.
+func logLevelClientAllowed(client string) bool {
+	logLevelClientsLock.RLock()
+	defer logLevelClientsLock.RUnlock()
+	if client == "unix" {
+		return logLevelUnixClients
+	}
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return false
+	}
+	for _, network := range logLevelClients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connectionClient returns the address of the client used for LogLevelClients,
+// which is unix for all clients of unix sockets.
+func connectionClient(c net.Conn) string {
+	if c.LocalAddr().Network() == "unix" {
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+func parseLogLevel(field *string, value string) (err error) {
+	value = strings.ToLower(value)
+	switch value {
+	case "trace", "debug", "info":
+		*field = value
+	default:
+		err = errors.New("bad request: unrecognized loglevel, only trace, debug and info are supported")
+	}
+	return
+}
+
+// newRequestLogger returns a logger for a single request which logs all messages
+// down to the given level, independent of the configured log level.
+func newRequestLogger(level string) *factorlog.FactorLog {
+	logger := factorlog.New(logOutput, logOutputFormatter)
+	logger.SetMinMaxSeverity(factorlog.StringToSeverity(strings.ToUpper(level)), factorlog.StringToSeverity("PANIC"))
+	switch level {
+	case "trace":
+		logger.SetVerbosity(3)
+	case "debug":
+		logger.SetVerbosity(2)
+	default:
+		logger.SetVerbosity(1)
+	}
+	return logger
+}
+
+// enableDebug raises the log level of this request if requested by the LogLevel header.
+// It returns an error if the client is not listed in LogLevelClients but uses the
+// LogLevel or CaptureRaw header.
+func (req *Request) enableDebug(client string) error {
+	for _, sub := range req.MultiQuery {
+		if sub.Request == nil {
+			continue
+		}
+		if err := sub.Request.enableDebug(client); err != nil {
+			return err
+		}
+	}
+	if req.CaptureRaw && !logLevelClientAllowed(client) {
+		return fmt.Errorf("bad request: CaptureRaw is not allowed for client %s", client)
+	}
+	if req.LogLevel == "" {
+		return nil
+	}
+	if !logLevelClientAllowed(client) {
+		return fmt.Errorf("bad request: LogLevel is not allowed for client %s", client)
+	}
+	req.requestLogger = newRequestLogger(req.LogLevel)
+	return nil
+}
+
+// logger returns the logger used while building and sending the response of this request.
+func (req *Request) logger() *factorlog.FactorLog {
+	if req != nil && req.requestLogger != nil {
+		return req.requestLogger
+	}
+	return log
+}
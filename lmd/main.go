@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -48,6 +49,12 @@ type Connection struct {
 	Source     []string
 	Auth       string
 	RemoteName string
+	Encoding   string
+	Section    string
+	Group      string
+	TimeZone   string
+	Weight     int
+	Filter     map[string][]string
 }
 
 // Equals checks if two connection objects are identical.
@@ -56,28 +63,125 @@ func (c *Connection) Equals(other *Connection) bool {
 	equal = equal && c.Name == other.Name
 	equal = equal && c.Auth == other.Auth
 	equal = equal && c.RemoteName == other.RemoteName
+	equal = equal && c.Encoding == other.Encoding
+	equal = equal && c.Section == other.Section
+	equal = equal && c.Group == other.Group
+	equal = equal && c.TimeZone == other.TimeZone
+	equal = equal && c.Weight == other.Weight
+	equal = equal && fmt.Sprintf("%v", c.Filter) == fmt.Sprintf("%v", other.Filter)
 	equal = equal && strings.Join(c.Source, ":") == strings.Join(other.Source, ":")
 	return equal
 }
 
+// ParseFilters returns the configured filters for each table.
+// All filters of a table are combined with the filters of each query to this connection.
+func (c *Connection) ParseFilters() (filters map[string][]Filter, err error) {
+	filters = make(map[string][]Filter)
+	for name := range c.Filter {
+		filters[name], err = c.ParseTableFilter(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// ParseTableFilter returns the configured filters for a single table.
+// Filters are parsed for each query, so relative durations like last_check > 1h never become stale.
+func (c *Connection) ParseTableFilter(name string) (stack []Filter, err error) {
+	table, ok := Objects.Tables[name]
+	if !ok {
+		return nil, fmt.Errorf("table %s does not exist", name)
+	}
+	if table.Virtual {
+		return nil, fmt.Errorf("filters are not supported for table %s", name)
+	}
+	stack = []Filter{}
+	for _, value := range c.Filter[name] {
+		line := "Filter: " + value
+		err = ParseFilter(value, &line, name, &stack)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// PeerWeight returns the configured weight of this connection, connections without weight use 1.
+func (c *Connection) PeerWeight() int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// Location returns the configured timezone of this connection.
+// Connections without a timezone use the local timezone.
+func (c *Connection) Location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.TimeZone)
+}
+
+// verifyListenOutputFormat returns an error if the listener is not configured or the output format is unknown.
+func verifyListenOutputFormat(listeners []string, listen string, format string) error {
+	found := false
+	for _, l := range listeners {
+		if l == listen {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("listener %s does not exist", listen)
+	}
+	var field string
+	return parseOutputFormat(&field, format)
+}
+
 // Config defines the available configuration options from supplied config files.
 type Config struct {
-	Listen              []string
-	Nodes               []string
-	TLSCertificate      string
-	TLSKey              string
-	Updateinterval      int64
-	FullUpdateInterval  int64
-	Connections         []Connection
-	LogFile             string
-	LogLevel            string
-	NetTimeout          int
-	ListenTimeout       int
-	ListenPrometheus    string
-	SkipSSLCheck        int
-	IdleTimeout         int64
-	IdleInterval        int64
-	StaleBackendTimeout int
+	Listen               []string
+	Nodes                []string
+	TLSCertificate       string
+	TLSKey               string
+	Updateinterval       int64
+	FullUpdateInterval   int64
+	Connections          []Connection
+	LogFile              string
+	LogLevel             string
+	NetTimeout           int
+	ListenTimeout        int
+	ClientReadTimeout    int
+	ListenPrometheus     string
+	SkipSSLCheck         int
+	IdleTimeout          int64
+	IdleInterval         int64
+	StaleBackendTimeout  int
+	StaleDataThreshold   int64
+	MaxQueriesInFlight   int
+	StatsMaxSamples      int
+	StatsApproxSamples   int
+	ApproxTotalSamples   int
+	MaxRowsPerPeer       int
+	MaxFacetValues       int
+	DefaultColumns       map[string][]string
+	AllowedColumns       map[string][]string
+	LogLevelClients      []string
+	DeniedColumns        map[string][]string
+	SavedFilters         map[string]map[string][]string
+	RequiredFilters      map[string][]string
+	MergeDuplicatesKeys  map[string][]string
+	MergePreferredPeers  []string
+	SlowPeerThreshold    float64
+	SlowPeerRecover      float64
+	MaxQueryComplexity   int64
+	MaxRequestLineLength int64
+	IncompleteRequests   string
+	DefaultLimit         int
+	JSONEncoder          string
+	StripControlChars    bool
+	ListenOutputFormat   map[string]string
 }
 
 // DataStore contains a map of available remote peers.
@@ -197,6 +301,91 @@ func mainLoop(mainSignalChannel chan os.Signal) (exitCode int) {
 	// initialize http client
 	initializeHTTPClient(&LocalConfig)
 
+	// clients have to send their request within this timeout
+	atomic.StoreInt64(&clientReadTimeout, int64(LocalConfig.ClientReadTimeout))
+
+	// queries above this limit will be rejected with a server busy error
+	atomic.StoreInt64(&maxQueriesInFlight, int64(LocalConfig.MaxQueriesInFlight))
+
+	// limit memory used by median and percentile stats
+	atomic.StoreInt64(&statsMaxSamples, int64(LocalConfig.StatsMaxSamples))
+	atomic.StoreInt64(&statsApproxSamples, int64(LocalConfig.StatsApproxSamples))
+
+	// number of rows sampled for approximate totals
+	atomic.StoreInt64(&approxTotalSamples, int64(LocalConfig.ApproxTotalSamples))
+
+	// limit the number of rows a single backend may contribute to a result
+	atomic.StoreInt64(&maxRowsPerPeer, int64(LocalConfig.MaxRowsPerPeer))
+
+	// limit of requests without or with a larger limit
+	atomic.StoreInt64(&defaultLimit, int64(LocalConfig.DefaultLimit))
+
+	// number of distinct values returned for each facet
+	atomic.StoreInt64(&maxFacetValues, int64(LocalConfig.MaxFacetValues))
+
+	// reject queries which are too expensive
+	atomic.StoreInt64(&maxQueryComplexity, LocalConfig.MaxQueryComplexity)
+
+	// reject request lines which are too long
+	atomic.StoreInt64(&maxRequestLineLength, LocalConfig.MaxRequestLineLength)
+
+	// requests without terminating blank line
+	if err := SetIncompleteRequests(LocalConfig.IncompleteRequests); err != nil {
+		log.Fatalf("invalid IncompleteRequests: %s", err.Error())
+	}
+
+	// columns used for requests without columns header
+	if err := SetDefaultColumns(LocalConfig.DefaultColumns); err != nil {
+		log.Fatalf("invalid DefaultColumns: %s", err.Error())
+	}
+	if err := SetSavedFilters(LocalConfig.SavedFilters); err != nil {
+		log.Fatalf("invalid SavedFilters: %s", err.Error())
+	}
+	if err := SetRequiredFilters(LocalConfig.RequiredFilters); err != nil {
+		log.Fatalf("invalid RequiredFilters: %s", err.Error())
+	}
+	if err := SetMergeDuplicates(LocalConfig.MergeDuplicatesKeys, LocalConfig.MergePreferredPeers); err != nil {
+		log.Fatalf("invalid MergeDuplicatesKeys: %s", err.Error())
+	}
+	if err := SetColumnAccess(LocalConfig.AllowedColumns, LocalConfig.DeniedColumns); err != nil {
+		log.Fatalf("invalid AllowedColumns or DeniedColumns: %s", err.Error())
+	}
+	if err := SetLogLevelClients(LocalConfig.LogLevelClients); err != nil {
+		log.Fatalf("invalid LogLevelClients: %s", err.Error())
+	}
+
+	// encoder used for json responses
+	if err := SetJSONEncoder(LocalConfig.JSONEncoder); err != nil {
+		log.Fatalf("invalid JSONEncoder: %s", err.Error())
+	}
+
+	// remove control characters from strings in responses
+	if LocalConfig.StripControlChars {
+		atomic.StoreInt32(&stripControlChars, 1)
+	} else {
+		atomic.StoreInt32(&stripControlChars, 0)
+	}
+
+	// default output format for each listener
+	for listen, format := range LocalConfig.ListenOutputFormat {
+		if err := verifyListenOutputFormat(LocalConfig.Listen, listen, format); err != nil {
+			log.Fatalf("invalid ListenOutputFormat: %s", err.Error())
+		}
+	}
+
+	// filters are parsed again for each peer, so fail early on errors
+	for i := range LocalConfig.Connections {
+		if _, err := LocalConfig.Connections[i].ParseFilters(); err != nil {
+			log.Fatalf("invalid Filter in connection %s: %s", LocalConfig.Connections[i].Name, err.Error())
+		}
+		if _, err := LocalConfig.Connections[i].Location(); err != nil {
+			log.Fatalf("invalid TimeZone in connection %s: %s", LocalConfig.Connections[i].Name, err.Error())
+		}
+		if LocalConfig.Connections[i].Weight < 0 {
+			log.Fatalf("invalid Weight in connection %s: must not be negative", LocalConfig.Connections[i].Name)
+		}
+	}
+
 	// start local listeners
 	waitGroupInit.Add(len(LocalConfig.Listen))
 	for _, listen := range LocalConfig.Listen {
@@ -273,6 +462,11 @@ func initializePeers(LocalConfig *Config, waitGroupPeers *sync.WaitGroup, waitGr
 			p = NewPeer(LocalConfig, c, waitGroupPeers, shutdownChannel)
 		}
 
+		// Check for supported input encoding
+		if !isSupportedEncoding(c.Encoding) {
+			log.Fatalf("Unsupported encoding in connection %s: %s", c.ID, c.Encoding)
+		}
+
 		// Check for duplicate id
 		for _, b := range backends {
 			if b == c.ID {
@@ -450,6 +644,9 @@ func setDefaults(conf *Config) {
 	if conf.ListenTimeout <= 0 {
 		conf.ListenTimeout = 60
 	}
+	if conf.ClientReadTimeout <= 0 {
+		conf.ClientReadTimeout = 10
+	}
 	if conf.Updateinterval <= 0 {
 		conf.Updateinterval = 5
 	}
@@ -465,6 +662,30 @@ func setDefaults(conf *Config) {
 	if conf.StaleBackendTimeout <= 0 {
 		conf.StaleBackendTimeout = 30
 	}
+	if conf.StaleDataThreshold <= 0 {
+		conf.StaleDataThreshold = 60
+	}
+	if conf.StatsMaxSamples <= 0 {
+		conf.StatsMaxSamples = 1000000
+	}
+	if conf.StatsApproxSamples <= 0 {
+		conf.StatsApproxSamples = 10000
+	}
+	if conf.ApproxTotalSamples <= 0 {
+		conf.ApproxTotalSamples = 1000
+	}
+	if conf.MaxFacetValues <= 0 {
+		conf.MaxFacetValues = 100
+	}
+	if conf.MaxQueryComplexity == 0 {
+		conf.MaxQueryComplexity = 1000000000
+	}
+	if conf.MaxRequestLineLength <= 0 {
+		conf.MaxRequestLineLength = 1048576
+	}
+	if conf.SlowPeerThreshold > 0 && (conf.SlowPeerRecover <= 0 || conf.SlowPeerRecover > conf.SlowPeerThreshold) {
+		conf.SlowPeerRecover = conf.SlowPeerThreshold / 2
+	}
 }
 
 // PrintVersion prints the version
@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -175,3 +179,191 @@ func TestMainConfig(t *testing.T) {
 	os.Remove("test2.ini")
 	os.Remove("test3.ini")
 }
+
+func TestMainSitesGlobFilter(t *testing.T) {
+	peer := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	tests := []struct {
+		filter string
+		keys   []interface{}
+	}{
+		{"key ~ mockid*", []interface{}{"mockid0", "mockid1", "mockid2"}},
+		{"key ~ mock*1", []interface{}{"mockid1"}},
+		{"key ~ *id?", []interface{}{"mockid0", "mockid1", "mockid2"}},
+		{"peer_key !~ *2", []interface{}{"mockid0", "mockid1"}},
+		{"name ~~ MOCKCON-*", []interface{}{"mockid0", "mockid1", "mockid2"}},
+		{"key ~ id[01]", []interface{}{"mockid0", "mockid1"}},
+	}
+	for _, test := range tests {
+		res, err := peer.QueryString("GET sites\nColumns: key\nFilter: " + test.filter + "\nSort: key asc\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []interface{}{}
+		for _, row := range res {
+			keys = append(keys, row[0])
+		}
+		if err = assertEq(test.keys, keys); err != nil {
+			t.Errorf("Filter: %s: %s", test.filter, err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestMainBackendVersions(t *testing.T) {
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	status, err := peer.QueryString("GET status\nColumns: livestatus_version program_version\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := peer.QueryString("GET sites\nColumns: livestatus_version program_version\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(status, res); err != nil {
+		t.Error(err)
+	}
+
+	DataStore["mockid0"].StatusSet("LivestatusVersion", "2.0.0")
+	DataStore["mockid0"].StatusSet("ProgramVersion", "1.0.8")
+	res, err = peer.QueryString("GET sites\nColumns: livestatus_version program_version\nFilter: program_version = 1.0.8\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"2.0.0", "1.0.8"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestMainBackendSectionGroup(t *testing.T) {
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", Source: []string{"localhost:0"}, Section: "Europe/Berlin", Group: "production"}
+	p := NewPeer(&Config{}, connection, waitGroup, shutdownChannel)
+	if err := assertEq("Europe/Berlin", p.StatusGet("Section")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("production", p.StatusGet("Group")); err != nil {
+		t.Error(err)
+	}
+
+	peer := StartTestPeer(2, 0, 0)
+	PauseTestPeers(peer)
+
+	DataStore["mockid0"].StatusSet("Section", "Europe/Berlin")
+	DataStore["mockid0"].StatusSet("Group", "production")
+	res, err := peer.QueryString("GET sites\nColumns: peer_key section group\nSort: peer_key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"mockid0", "Europe/Berlin", "production"}, {"mockid1", "", ""}}, res); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET sites\nColumns: peer_key\nFilter: group = production\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"mockid0"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestMainClientReadTimeout(t *testing.T) {
+	peer := StartTestPeerExtra(1, 0, 0, "ClientReadTimeout = 1\n")
+	PauseTestPeers(peer)
+
+	if err := assertEq(int64(1), atomic.LoadInt64(&clientReadTimeout)); err != nil {
+		t.Fatal(err)
+	}
+
+	// idle client never sends a request
+	conn, err := net.Dial("unix", "test.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	t1 := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if err = assertEq(io.EOF, err); err != nil {
+		t.Error(err)
+	}
+	if duration := time.Since(t1); duration < 500*time.Millisecond || duration > 5*time.Second {
+		t.Errorf("idle connection closed after %s, expected about 1s", duration)
+	}
+
+	// normal requests are still answered
+	res, err := peer.QueryString("GET hosts\nColumns: name\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestMainListenOutputFormat(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "Listen = [\"test.sock\", \"test_ndjson.sock\"]\nListenOutputFormat = { \"test_ndjson.sock\" = \"ndjson\" }\n")
+	PauseTestPeers(peer)
+
+	query := func(listen string, q string) string {
+		conn, err := net.Dial("unix", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err = conn.Write([]byte(q)); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(res)
+	}
+
+	// each listener uses its own default
+	if err := assertLike(`^\[\["testhost_1"\]`, query("test.sock", "GET hosts\nColumns: name\nLimit: 2\n\n")); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq("[\"testhost_1\"]\n[\"testhost_2\"]\n{\"failed\":{},\"total\":10}\n", query("test_ndjson.sock", "GET hosts\nColumns: name\nLimit: 2\n\n")); err != nil {
+		t.Error(err)
+	}
+
+	// explicit headers always win
+	if err := assertLike(`^\[\["testhost_1"\]`, query("test_ndjson.sock", "GET hosts\nColumns: name\nLimit: 2\nOutputFormat: json\n\n")); err != nil {
+		t.Error(err)
+	}
+
+	// unknown listeners and formats are rejected
+	if err := assertEq("listener none.sock does not exist", fmt.Sprintf("%v", verifyListenOutputFormat([]string{"test.sock"}, "none.sock", "json"))); err != nil {
+		t.Error(err)
+	}
+	if err := assertLike("^bad request: unrecognized outputformat", fmt.Sprintf("%v", verifyListenOutputFormat([]string{"test.sock"}, "test.sock", "csv"))); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
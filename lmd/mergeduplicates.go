@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// mergeKeys contains the configured columns which identify the same object on different backends.
+// Tables which are not configured use the MergeDuplicatesKeys.
+var mergeKeys = make(map[string][]string)
+
+// mergePreferredPeers contains the priority of each backend for the preferred policy, lower is better.
+var mergePreferredPeers = make(map[string]int)
+var mergeLock = new(sync.RWMutex)
+
+// SetMergeDuplicates sets the key columns for each table and the backends preferred when merging duplicates.
+// It returns an error if any table or column does not exist.
+func SetMergeDuplicates(keys map[string][]string, preferred []string) error {
+	parsed := make(map[string][]string)
+	for name, columns := range keys {
+		table, ok := Objects.Tables[name]
+		if !ok {
+			return fmt.Errorf("table %s does not exist", name)
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("no key columns for table %s", name)
+		}
+		for _, col := range columns {
+			if _, ok := table.ColumnsIndex[col]; !ok {
+				return fmt.Errorf("table %s has no column %s", name, col)
+			}
+		}
+		parsed[name] = columns
+	}
+	priority := make(map[string]int)
+	for i, id := range preferred {
+		if _, ok := priority[id]; !ok {
+			priority[id] = i
+		}
+	}
+	mergeLock.Lock()
+	mergeKeys = parsed
+	mergePreferredPeers = priority
+	mergeLock.Unlock()
+	return nil
+}
+
+// getMergeKeys returns the key columns of the table and false if duplicates cannot be identified.
+func getMergeKeys(table string) ([]string, bool) {
+	mergeLock.RLock()
+	keys, ok := mergeKeys[table]
+	mergeLock.RUnlock()
+	if ok {
+		return keys, true
+	}
+	keys, ok = MergeDuplicatesKeys[table]
+	return keys, ok
+}
+
+// column returns the column used to choose between duplicate rows or an empty string if
+// the policy does not need one. Merged rows use the maximum of all state columns instead.
+func (m *MergePolicy) column(keep bool) string {
+	switch *m {
+	case MergeWorst:
+		if keep {
+			return "state"
+		}
+	case MergeLatest:
+		return "last_check"
+	case MergePreferred:
+		return "peer_key"
+	}
+	return ""
+}
+
+// addMergePolicyColumn adds the column required by the merge policy as hidden column,
+// so clients do not have to request it.
+func (req *Request) addMergePolicyColumn(table *Table) {
+	col := req.MergeDuplicates.column(req.MergeKeep)
+	if col == "" || len(req.Columns) == 0 || len(req.Stats) > 0 {
+		return
+	}
+	if _, ok := table.ColumnsIndex[col]; !ok {
+		return
+	}
+	for _, name := range req.Columns {
+		if strings.ToLower(name) == col {
+			return
+		}
+	}
+	if req.HiddenColumns == nil {
+		req.HiddenColumns = make(map[int]bool)
+	}
+	req.HiddenColumns[len(req.Columns)] = true
+	req.Columns = append(req.Columns, col)
+}
+
+// mergePrefer returns true if rowB should be used instead of rowA by the merge policy.
+func (res *Response) mergePrefer(rowB, rowA []interface{}, policyIndex int, preferred map[string]int) bool {
+	if policyIndex < 0 {
+		return false
+	}
+	switch res.Request.MergeDuplicates {
+	case MergeWorst:
+		return compareSortValues(IntCol, rowB[policyIndex], rowA[policyIndex]) > 0
+	case MergeLatest:
+		return compareSortValues(TimeCol, rowB[policyIndex], rowA[policyIndex]) > 0
+	case MergePreferred:
+		return peerPriority(preferred, rowB[policyIndex]) < peerPriority(preferred, rowA[policyIndex])
+	}
+	return false
+}
+
+// peerPriority returns the priority of the backend, backends which are not preferred come last.
+func peerPriority(preferred map[string]int, peerKey interface{}) int {
+	if prio, ok := preferred[fmt.Sprintf("%v", peerKey)]; ok {
+		return prio
+	}
+	return len(preferred)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// msgpackMaxSafeInteger is the largest integer which can be stored exactly in a float64.
+const msgpackMaxSafeInteger = 1 << 53
+
+// MsgPack converts the response into a MessagePack structure.
+// The layout is the same as for the json output format, a list of rows with an
+// optional header row. Float values without fractional part are sent as integers.
+func (res *Response) MsgPack() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	// stats requests use the stats headers as labels
+	sendColumnsHeader := res.Request.SendColumnsHeader
+
+	numRows := len(res.Result)
+	if sendColumnsHeader {
+		numRows++
+	}
+	writeMsgpackArrayHeader(buf, numRows)
+	if sendColumnsHeader {
+		if err := writeMsgpackValue(buf, res.Request.columnHeaders()); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range res.Result {
+		if err := writeMsgpackValue(buf, row); err != nil {
+			log.Errorf("msgpack error: %s in row: %v", err.Error(), row)
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMsgpackValue appends the MessagePack representation of any result value.
+func writeMsgpackValue(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case string:
+		writeMsgpackString(buf, v)
+	case float64:
+		writeMsgpackFloat(buf, v)
+	case float32:
+		writeMsgpackFloat(buf, float64(v))
+	case int:
+		writeMsgpackInt(buf, int64(v))
+	case int64:
+		writeMsgpackInt(buf, v)
+	case PeerStatus:
+		writeMsgpackInt(buf, int64(v))
+	case []interface{}:
+		writeMsgpackArrayHeader(buf, len(v))
+		for _, e := range v {
+			if err := writeMsgpackValue(buf, e); err != nil {
+				return err
+			}
+		}
+	case *map[string]interface{}:
+		if v == nil {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return writeMsgpackValue(buf, *v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeMsgpackMapHeader(buf, len(keys))
+		for _, k := range keys {
+			writeMsgpackString(buf, k)
+			if err := writeMsgpackValue(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return writeMsgpackReflectValue(buf, reflect.ValueOf(value))
+	}
+	return nil
+}
+
+// writeMsgpackReflectValue handles all remaining lists and numbers, ex.: []string or []float64.
+func writeMsgpackReflectValue(buf *bytes.Buffer, value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		writeMsgpackArrayHeader(buf, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			if err := writeMsgpackValue(buf, value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(buf, value.Int())
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		writeMsgpackInt(buf, int64(value.Uint()))
+		return nil
+	case reflect.Ptr:
+		if value.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return writeMsgpackValue(buf, value.Elem().Interface())
+	}
+	return fmt.Errorf("msgpack: unsupported type %T", value.Interface())
+}
+
+func writeMsgpackFloat(buf *bytes.Buffer, v float64) {
+	if v == math.Trunc(v) && math.Abs(v) <= msgpackMaxSafeInteger {
+		writeMsgpackInt(buf, int64(v))
+		return
+	}
+	buf.WriteByte(0xcb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, v int64) {
+	switch {
+	case v >= 0 && v <= 127:
+		buf.WriteByte(byte(v))
+	case v < 0 && v >= -32:
+		buf.WriteByte(byte(int8(v)))
+	case v >= 0 && v <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(v))
+	case v >= 0 && v <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(v))
+	case v >= 0 && v <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(v))
+	case v >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(v))
+	case v >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(v)))
+	case v >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(v))
+	case v >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(v))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, v)
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, v string) {
+	l := len(v)
+	switch {
+	case l < 32:
+		buf.WriteByte(0xa0 | byte(l))
+	case l <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(l))
+	case l <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(l))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+	buf.WriteString(v)
+}
+
+func writeMsgpackArrayHeader(buf *bytes.Buffer, l int) {
+	switch {
+	case l < 16:
+		buf.WriteByte(0x90 | byte(l))
+	case l <= math.MaxUint16:
+		buf.WriteByte(0xdc)
+		binary.Write(buf, binary.BigEndian, uint16(l))
+	default:
+		buf.WriteByte(0xdd)
+		binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+}
+
+func writeMsgpackMapHeader(buf *bytes.Buffer, l int) {
+	switch {
+	case l < 16:
+		buf.WriteByte(0x80 | byte(l))
+	case l <= math.MaxUint16:
+		buf.WriteByte(0xde)
+		binary.Write(buf, binary.BigEndian, uint16(l))
+	default:
+		buf.WriteByte(0xdf)
+		binary.Write(buf, binary.BigEndian, uint32(l))
+	}
+}
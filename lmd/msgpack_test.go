@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// decodeMsgpack is a minimal decoder for all types written by the msgpack output format.
+// Integers are returned as float64, just like the json decoder does.
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	readN := func(n int) []byte {
+		buf := make([]byte, n)
+		io.ReadFull(r, buf)
+		return buf
+	}
+	decodeArray := func(l int) (interface{}, error) {
+		list := make([]interface{}, l)
+		for i := range list {
+			if list[i], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	decodeMap := func(l int) (interface{}, error) {
+		m := make(map[string]interface{}, l)
+		for i := 0; i < l; i++ {
+			k, err := decodeMsgpack(r)
+			if err != nil {
+				return nil, err
+			}
+			if m[k.(string)], err = decodeMsgpack(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	switch {
+	case b <= 0x7f:
+		return float64(b), nil
+	case b >= 0xe0:
+		return float64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return string(readN(int(b & 0x1f))), nil
+	case b&0xf0 == 0x90:
+		return decodeArray(int(b & 0x0f))
+	case b&0xf0 == 0x80:
+		return decodeMap(int(b & 0x0f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcb:
+		return math.Float64frombits(binary.BigEndian.Uint64(readN(8))), nil
+	case 0xcc:
+		return float64(readN(1)[0]), nil
+	case 0xcd:
+		return float64(binary.BigEndian.Uint16(readN(2))), nil
+	case 0xce:
+		return float64(binary.BigEndian.Uint32(readN(4))), nil
+	case 0xcf:
+		return float64(binary.BigEndian.Uint64(readN(8))), nil
+	case 0xd0:
+		return float64(int8(readN(1)[0])), nil
+	case 0xd1:
+		return float64(int16(binary.BigEndian.Uint16(readN(2)))), nil
+	case 0xd2:
+		return float64(int32(binary.BigEndian.Uint32(readN(4)))), nil
+	case 0xd3:
+		return float64(int64(binary.BigEndian.Uint64(readN(8)))), nil
+	case 0xd9:
+		return string(readN(int(readN(1)[0]))), nil
+	case 0xda:
+		return string(readN(int(binary.BigEndian.Uint16(readN(2))))), nil
+	case 0xdb:
+		return string(readN(int(binary.BigEndian.Uint32(readN(4))))), nil
+	case 0xdc:
+		return decodeArray(int(binary.BigEndian.Uint16(readN(2))))
+	case 0xdd:
+		return decodeArray(int(binary.BigEndian.Uint32(readN(4))))
+	case 0xde:
+		return decodeMap(int(binary.BigEndian.Uint16(readN(2))))
+	case 0xdf:
+		return decodeMap(int(binary.BigEndian.Uint32(readN(4))))
+	}
+	return nil, fmt.Errorf("unsupported msgpack type 0x%x", b)
+}
+
+func TestMsgpackValues(t *testing.T) {
+	customVars := map[string]interface{}{"OS": "linux", "RACK": "A1"}
+	row := []interface{}{
+		nil, true, false,
+		"", "short", strings.Repeat("x", 40), strings.Repeat("y", 300), strings.Repeat("z", 70000),
+		0.0, 5.0, 127.0, 128.0, 65535.0, 70000.0, 5000000000.0, -1.0, -33.0, -200.0, -40000.0, -3000000000.0,
+		0.25, -1.5, 1.7976931348623157e308, 1e20,
+		3, int64(-7), PeerStatusDown,
+		[]interface{}{}, []interface{}{"a", 1.0}, []string{"x", "y"}, []float64{1, 2.5},
+		make([]interface{}, 20),
+		customVars, &customVars,
+	}
+	expect := []interface{}{
+		nil, true, false,
+		"", "short", strings.Repeat("x", 40), strings.Repeat("y", 300), strings.Repeat("z", 70000),
+		0.0, 5.0, 127.0, 128.0, 65535.0, 70000.0, 5000000000.0, -1.0, -33.0, -200.0, -40000.0, -3000000000.0,
+		0.25, -1.5, 1.7976931348623157e308, 1e20,
+		3.0, -7.0, 2.0,
+		[]interface{}{}, []interface{}{"a", 1.0}, []interface{}{"x", "y"}, []interface{}{1.0, 2.5},
+		make([]interface{}, 20),
+		customVars, customVars,
+	}
+	buf := new(bytes.Buffer)
+	if err := writeMsgpackValue(buf, row); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeMsgpack(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(expect, decoded); err != nil {
+		t.Error(err)
+	}
+
+	// integral floats are sent as integers
+	buf.Reset()
+	writeMsgpackValue(buf, 5.0)
+	if err = assertEq([]byte{0x05}, buf.Bytes()); err != nil {
+		t.Error(err)
+	}
+
+	if err = writeMsgpackValue(buf, struct{}{}); err == nil {
+		t.Errorf("expected error for unsupported type")
+	}
+}
+
+func TestMsgpackResponse(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	query := "GET hosts\nColumns: name state latency contacts custom_variables\nColumnHeaders: on\nResponseHeader: fixed16\n"
+	expect, err := peer.QueryString("GET hosts\nColumns: name state latency contacts custom_variables\nColumnHeaders: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query + "OutputFormat: msgpack\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send through a connection to verify the fixed16 header
+	server, client := net.Pipe()
+	go func() {
+		res.Send(server)
+		server.Close()
+	}()
+	raw, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := string(raw[0:16])
+	body := raw[16:]
+	if err = assertEq("200", header[0:3]); err != nil {
+		t.Error(err)
+	}
+	size, _ := strconv.Atoi(strings.TrimSpace(header[4:15]))
+	if err = assertEq(len(body), size); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(byte('\n'), body[len(body)-1]); err != nil {
+		t.Error(err)
+	}
+
+	decoded, err := decodeMsgpack(bytes.NewReader(body[:len(body)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := decoded.([]interface{})
+	if err = assertEq(len(expect), len(rows)); err != nil {
+		t.Fatal(err)
+	}
+	for i := range expect {
+		if err = assertEq(expect[i], rows[i]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
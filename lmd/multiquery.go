@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxMultiQueries sets the maximum number of queries in a single MULTIQUERY request.
+const maxMultiQueries = 100
+
+// SubRequest is a single query from a MULTIQUERY request.
+// Queries which could not be parsed keep their error, so the other queries can still be answered.
+type SubRequest struct {
+	Request *Request
+	Error   error
+}
+
+// MultiQueryResult contains the result of a single query from a MULTIQUERY request.
+// Result contains the same data as the query would return on its own.
+type MultiQueryResult struct {
+	Code   int             `json:"code"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// parseMultiQueryAction parses the first line of a MULTIQUERY request, ex.: MULTIQUERY 3
+func (req *Request) parseMultiQueryAction(firstLine string) (err error) {
+	fields := strings.Fields(firstLine)
+	if len(fields) != 2 || fields[0] != "MULTIQUERY" {
+		return errors.New("bad request: MULTIQUERY requires the number of queries, ex.: MULTIQUERY 3")
+	}
+	num, err := strconv.Atoi(fields[1])
+	if err != nil || num < 1 || num > maxMultiQueries {
+		return fmt.Errorf("bad request: MULTIQUERY supports between 1 and %d queries", maxMultiQueries)
+	}
+	req.MultiQuery = make([]*SubRequest, 0, num)
+	return
+}
+
+// parseMultiQueryHeaderLine parses a header of the MULTIQUERY request itself.
+// Only headers which affect the combined response are supported.
+func (req *Request) parseMultiQueryHeaderLine(line *string) (err error) {
+	header := strings.ToLower(strings.TrimSpace(strings.SplitN(*line, ":", 2)[0]))
+	switch header {
+	case "responseheader", "keepalive":
+		return req.ParseRequestHeaderLine(line)
+	}
+	return fmt.Errorf("bad request: only ResponseHeader and KeepAlive headers are supported for MULTIQUERY in %s", *line)
+}
+
+// readMultiQueries reads all queries announced in the MULTIQUERY line.
+// Each query is parsed on its own, so invalid queries do not affect the others.
+// It returns the number of bytes read and any error which breaks the whole request.
+func (req *Request) readMultiQueries(b *bufio.Reader) (size int, err error) {
+	num := cap(req.MultiQuery)
+	for len(req.MultiQuery) < num {
+		block, n, rErr := readRequestBlock(b)
+		size += n
+		if rErr != nil && rErr != io.EOF {
+			return size, rErr
+		}
+		if block == "" {
+			return size, fmt.Errorf("bad request: MULTIQUERY announced %d queries but only %d were sent", num, len(req.MultiQuery))
+		}
+		// the blank line after the last query terminates the whole request
+		req.terminated = rErr == nil
+		sub := &SubRequest{}
+		sub.Request, _, sub.Error = NewRequest(bufio.NewReader(strings.NewReader(block)))
+		if sub.Error == nil {
+			sub.Error = sub.Request.verifySubRequest()
+		}
+		req.MultiQuery = append(req.MultiQuery, sub)
+	}
+	return
+}
+
+// readRequestBlock reads all lines until the next empty line, leading empty lines are skipped.
+func readRequestBlock(b *bufio.Reader) (block string, size int, err error) {
+	lines := []string{}
+	for {
+		line, rErr := readRequestLine(b)
+		size += len(line)
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if rErr != nil {
+			err = rErr
+			break
+		}
+		if line == "" && len(lines) > 0 {
+			break
+		}
+	}
+	if len(lines) > 0 {
+		block = strings.Join(lines, "\n") + "\n\n"
+	}
+	return
+}
+
+// verifySubRequest checks if the request can be answered as part of a MULTIQUERY request.
+func (req *Request) verifySubRequest() error {
+	if req.Table == "" || len(req.MultiQuery) > 0 {
+		return errors.New("bad request: MULTIQUERY only supports GET queries")
+	}
+	switch req.OutputFormat {
+	case "", "json", "wrapped_json":
+	default:
+		return errors.New("bad request: MULTIQUERY only supports json and wrapped_json output")
+	}
+	if req.Progressive {
+		return errors.New("bad request: MULTIQUERY does not support progressive queries")
+	}
+	return nil
+}
+
+// GetMultiQueryResponse answers all queries from a MULTIQUERY request in order.
+// Failed queries return their error without aborting the remaining queries.
+func (req *Request) GetMultiQueryResponse() (*Response, error) {
+	res := &Response{
+		Code:         200,
+		Request:      req,
+		MultiResults: make([]MultiQueryResult, 0, len(req.MultiQuery)),
+	}
+	for _, sub := range req.MultiQuery {
+		if req.canceler.IsCanceled() {
+			return nil, errClientDisconnected
+		}
+		res.MultiResults = append(res.MultiResults, sub.result(req.canceler))
+	}
+	return res, nil
+}
+
+// result builds the result of a single query.
+func (sub *SubRequest) result(canceler *Canceler) MultiQueryResult {
+	if sub.Error != nil {
+		return MultiQueryResult{Code: 400, Error: sub.Error.Error()}
+	}
+	req := sub.Request
+	req.canceler = canceler
+	err := req.ExpandRequestedBackends()
+	var res *Response
+	if err == nil {
+		res, err = req.GetResponse()
+	}
+	if err != nil {
+		return MultiQueryResult{Code: responseErrorCode(err), Error: err.Error()}
+	}
+	data, err := res.Bytes()
+	if err != nil {
+		return MultiQueryResult{Code: 500, Error: err.Error()}
+	}
+	result := MultiQueryResult{Code: res.Code}
+	// not modified responses have no data
+	if len(data) > 0 {
+		result.Result = json.RawMessage(data)
+	}
+	return result
+}
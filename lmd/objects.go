@@ -80,6 +80,12 @@ type Column struct {
 	Update      UpdateType
 	Optional    OptionalFlags
 	Description string
+	Timestamp   bool // integer column containing a unix timestamp, ex.: last_check
+}
+
+// IsTimestamp returns true if the column contains unix timestamps.
+func (c *Column) IsTimestamp() bool {
+	return c.Type == TimeCol || c.Timestamp
 }
 
 // OptionalFlags is used to set flags for optionial columns.
@@ -147,17 +153,40 @@ func (o *ObjectsType) GetTableColumnsData() (data [][]interface{}) {
 			default:
 				log.Panicf("type not handled in table %s: %#v", t.Name, c)
 			}
-			row := make([]interface{}, 4)
+			row := make([]interface{}, 5)
 			row[0] = c.Name
 			row[1] = t.Name
 			row[2] = colTypeName
 			row[3] = c.Description
+			if c.Description == "" && c.Type == VirtCol {
+				row[3] = VirtKeyMap[c.Name].Description
+			}
+			row[4] = 0
+			if c.Type == VirtCol {
+				row[4] = 1
+			}
 			data = append(data, row)
 		}
 	}
 	return
 }
 
+// IsOptional returns true if a backend may lack the given table. Tables which are referenced from other
+// tables and the status table are required to build the object cache.
+func (o *ObjectsType) IsOptional(name string) bool {
+	if name == "status" {
+		return false
+	}
+	for _, t := range o.Tables {
+		for _, i := range t.RefColCacheIndexes {
+			if t.Columns[i].Name == name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // IsDefaultSortOrder returns true if the sortfield is the default for the given table.
 func (t *Table) IsDefaultSortOrder(sort *[]*SortField) bool {
 	if len(*sort) == 0 {
@@ -249,6 +278,18 @@ func (t *Table) AddColumn(Name string, Update UpdateType, Type ColumnType, Descr
 	return t.AddColumnObject(column)
 }
 
+// AddTimeColumn adds a integer column which contains unix timestamps.
+func (t *Table) AddTimeColumn(Name string, Update UpdateType, Description string) int {
+	column := &Column{
+		Name:        Name,
+		Type:        IntCol,
+		Update:      Update,
+		Description: Description,
+		Timestamp:   true,
+	}
+	return t.AddColumnObject(column)
+}
+
 // AddOptColumn adds a optional column.
 func (t *Table) AddOptColumn(Name string, Update UpdateType, Type ColumnType, Restrict OptionalFlags, Description string) int {
 	column := &Column{
@@ -303,6 +344,7 @@ func (t *Table) AddRefColumn(Ref string, Prefix string, Name string, LocalName s
 				RefIndex:    RefIndex,
 				RefColIndex: col.Index,
 				Description: col.Description,
+				Timestamp:   col.Timestamp,
 			}
 			t.AddColumnObject(column)
 		}
@@ -372,6 +414,8 @@ func NewBackendsTable(name string) (t *Table) {
 	t = &Table{Name: name, Virtual: true}
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	t.AddColumn("key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("name", RefNoUpdate, VirtCol, "Name of this peer")
 	t.AddColumn("addr", RefNoUpdate, VirtCol, "Address of this peer")
@@ -385,6 +429,12 @@ func NewBackendsTable(name string) (t *Table) {
 	t.AddColumn("response_time", RefNoUpdate, VirtCol, "Duration of last update in seconds")
 	t.AddColumn("idling", RefNoUpdate, VirtCol, "Idle status of this backend (0 - Not idling, 1 - idling)")
 	t.AddColumn("last_query", RefNoUpdate, VirtCol, "Timestamp of the last incoming request")
+	t.AddColumn("livestatus_version", RefNoUpdate, VirtCol, "The version of the livestatus module of this peer")
+	t.AddColumn("program_version", RefNoUpdate, VirtCol, "The version of the monitoring core of this peer")
+	t.AddColumn("evicted", RefNoUpdate, VirtCol, "Flag wether this peer is excluded from passthrough queries because of its slow response time")
+	t.AddColumn("section", RefNoUpdate, VirtCol, "The section of this peer from the connection configuration")
+	t.AddColumn("group", RefNoUpdate, VirtCol, "The group of this peer from the connection configuration")
+	t.AddColumn("is_stale", RefNoUpdate, VirtCol, "Flag wether the last update of this peer is older than the StaleDataThreshold (0 - fresh, 1 - stale)")
 
 	return
 }
@@ -396,6 +446,7 @@ func NewColumnsTable(name string) (t *Table) {
 	t.AddColumn("table", VirtUpdate, StringCol, "The name of the table")
 	t.AddColumn("type", VirtUpdate, StringCol, "The data type of the column (int, float, string, list)")
 	t.AddColumn("description", VirtUpdate, StringCol, "A description of the column")
+	t.AddColumn("virtual", VirtUpdate, IntCol, "Flag wether this column is computed by LMD instead of fetched from the backends (0/1)")
 
 	return
 }
@@ -403,7 +454,7 @@ func NewColumnsTable(name string) (t *Table) {
 // NewStatusTable returns a new status table
 func NewStatusTable() (t *Table) {
 	t = &Table{Name: "status"}
-	t.AddColumn("program_start", DynamicUpdate, IntCol, "The time of the last program start as UNIX timestamp")
+	t.AddTimeColumn("program_start", DynamicUpdate, "The time of the last program start as UNIX timestamp")
 	t.AddColumn("accept_passive_host_checks", DynamicUpdate, IntCol, "The number of host checks since program start")
 	t.AddColumn("accept_passive_service_checks", DynamicUpdate, IntCol, "The number of completed service checks since program start")
 	t.AddColumn("cached_log_messages", DynamicUpdate, IntCol, "The current number of log messages MK Livestatus keeps in memory")
@@ -422,8 +473,8 @@ func NewStatusTable() (t *Table) {
 	t.AddColumn("host_checks", DynamicUpdate, IntCol, "The number of host checks since program start")
 	t.AddColumn("host_checks_rate", DynamicUpdate, FloatCol, "The number of host checks since program start")
 	t.AddColumn("interval_length", StaticUpdate, IntCol, "The default interval length from the core configuration")
-	t.AddColumn("last_command_check", DynamicUpdate, IntCol, "The time of the last check for a command as UNIX timestamp")
-	t.AddColumn("last_log_rotation", DynamicUpdate, IntCol, "Time time of the last log file rotation")
+	t.AddTimeColumn("last_command_check", DynamicUpdate, "The time of the last check for a command as UNIX timestamp")
+	t.AddTimeColumn("last_log_rotation", DynamicUpdate, "Time time of the last log file rotation")
 	t.AddColumn("livestatus_version", StaticUpdate, StringCol, "The version of the MK Livestatus module")
 	t.AddColumn("log_messages", DynamicUpdate, IntCol, "The number of new log messages since program start")
 	t.AddColumn("log_messages_rate", DynamicUpdate, FloatCol, "The number of new log messages since program start")
@@ -441,6 +492,8 @@ func NewStatusTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	t.AddColumn("peer_addr", RefNoUpdate, VirtCol, "Address of this peer")
 	t.AddColumn("peer_status", RefNoUpdate, VirtCol, "Status of this peer (0 - UP, 1 - Stale, 2 - Down, 4 - Pending)")
 	t.AddColumn("peer_bytes_send", RefNoUpdate, VirtCol, "Bytes send to this peer")
@@ -450,6 +503,9 @@ func NewStatusTable() (t *Table) {
 	t.AddColumn("peer_last_update", RefNoUpdate, VirtCol, "Timestamp of last update")
 	t.AddColumn("peer_last_online", RefNoUpdate, VirtCol, "Timestamp when peer was last online")
 	t.AddColumn("peer_response_time", RefNoUpdate, VirtCol, "Duration of last update in seconds")
+	t.AddColumn("lmd_queries_in_flight", RefNoUpdate, VirtCol, "Number of queries currently processed by LMD")
+	t.AddColumn("lmd_stale_peers", RefNoUpdate, VirtCol, "Number of peers whose last update is older than the StaleDataThreshold")
+	t.AddColumn("lmd_features", RefNoUpdate, VirtCol, "List of optional features supported by this LMD")
 
 	return
 }
@@ -463,6 +519,8 @@ func NewTimeperiodsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -479,8 +537,12 @@ func NewContactsTable() (t *Table) {
 	t.AddColumn("service_notification_period", StaticUpdate, StringCol, "The time period in which the contact will be notified about service problems")
 	t.AddColumn("service_notifications_enabled", StaticUpdate, IntCol, "Wether the contact will be notified about service problems in general (0/1)")
 
+	t.AddColumn("groups", RefNoUpdate, VirtCol, "A list of all contactgroups this contact is a member of")
+
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -493,6 +555,8 @@ func NewContactgroupsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -504,6 +568,8 @@ func NewCommandsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -551,15 +617,15 @@ func NewHostsTable() (t *Table) {
 	t.AddColumn("in_notification_period", DynamicUpdate, IntCol, "Time period in which problems of this host will be notified. If empty then notification will be always")
 	t.AddColumn("is_executing", DynamicUpdate, IntCol, "is there a host check currently running... (0/1)")
 	t.AddColumn("is_flapping", DynamicUpdate, IntCol, "Whether the host state is flapping (0/1)")
-	t.AddColumn("last_check", DynamicUpdate, IntCol, "Time of the last check (Unix timestamp)")
+	t.AddTimeColumn("last_check", DynamicUpdate, "Time of the last check (Unix timestamp)")
 	t.AddColumn("last_hard_state", DynamicUpdate, IntCol, "The effective hard state of the host (eliminates a problem in hard_state)")
-	t.AddColumn("last_hard_state_change", DynamicUpdate, IntCol, "The effective hard state of the host (eliminates a problem in hard_state)")
-	t.AddColumn("last_notification", DynamicUpdate, IntCol, "Time of the last notification (Unix timestamp)")
+	t.AddTimeColumn("last_hard_state_change", DynamicUpdate, "The effective hard state of the host (eliminates a problem in hard_state)")
+	t.AddTimeColumn("last_notification", DynamicUpdate, "Time of the last notification (Unix timestamp)")
 	t.AddColumn("last_state", DynamicUpdate, IntCol, "State before last state change")
-	t.AddColumn("last_state_change", DynamicUpdate, IntCol, "State before last state change")
-	t.AddColumn("last_time_down", DynamicUpdate, IntCol, "The last time the host was DOWN (Unix timestamp)")
-	t.AddColumn("last_time_unreachable", DynamicUpdate, IntCol, "The last time the host was UNREACHABLE (Unix timestamp)")
-	t.AddColumn("last_time_up", DynamicUpdate, IntCol, "The last time the host was UP (Unix timestamp)")
+	t.AddTimeColumn("last_state_change", DynamicUpdate, "State before last state change")
+	t.AddTimeColumn("last_time_down", DynamicUpdate, "The last time the host was DOWN (Unix timestamp)")
+	t.AddTimeColumn("last_time_unreachable", DynamicUpdate, "The last time the host was UNREACHABLE (Unix timestamp)")
+	t.AddTimeColumn("last_time_up", DynamicUpdate, "The last time the host was UP (Unix timestamp)")
 	t.AddColumn("latency", DynamicUpdate, FloatCol, "Time difference between scheduled check time and actual check time")
 	t.AddColumn("long_plugin_output", DynamicUpdate, StringCol, "Complete output from check plugin")
 	t.AddColumn("low_flap_threshold", StaticUpdate, IntCol, "Low threshold of flap detection")
@@ -567,8 +633,8 @@ func NewHostsTable() (t *Table) {
 	t.AddColumn("modified_attributes", DynamicUpdate, IntCol, "A bitmask specifying which attributes have been modified")
 	t.AddColumn("modified_attributes_list", DynamicUpdate, StringListCol, "A bitmask specifying which attributes have been modified")
 	t.AddColumn("name", StaticUpdate, StringCol, "Host name")
-	t.AddColumn("next_check", DynamicUpdate, IntCol, "Scheduled time for the next check (Unix timestamp)")
-	t.AddColumn("next_notification", DynamicUpdate, IntCol, "Time of the next notification (Unix timestamp)")
+	t.AddTimeColumn("next_check", DynamicUpdate, "Scheduled time for the next check (Unix timestamp)")
+	t.AddTimeColumn("next_notification", DynamicUpdate, "Time of the next notification (Unix timestamp)")
 	t.AddColumn("num_services", StaticUpdate, IntCol, "The total number of services of the host")
 	t.AddColumn("num_services_crit", DynamicUpdate, IntCol, "The number of the host's services with the soft state CRIT")
 	t.AddColumn("num_services_ok", DynamicUpdate, IntCol, "The number of the host's services with the soft state OK")
@@ -607,8 +673,11 @@ func NewHostsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	t.AddColumn("last_state_change_order", RefNoUpdate, VirtCol, "The last_state_change of this host suitable for sorting. Returns program_start from the core if host has been never checked.")
 	t.AddColumn("has_long_plugin_output", RefNoUpdate, VirtCol, "Flag wether this host has long_plugin_output or not")
+	t.AddColumn("recent_state_changes", RefNoUpdate, VirtCol, "Estimated number of state changes within the last 21 checks derived from the weighted percent_state_change, null if flap detection is disabled")
 	return
 }
 
@@ -637,6 +706,8 @@ func NewHostgroupsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -682,24 +753,24 @@ func NewServicesTable() (t *Table) {
 	t.AddColumn("initial_state", StaticUpdate, IntCol, "The initial state of the service")
 	t.AddColumn("is_executing", DynamicUpdate, IntCol, "is there a service check currently running... (0/1)")
 	t.AddColumn("is_flapping", DynamicUpdate, IntCol, "Whether the service is flapping (0/1)")
-	t.AddColumn("last_check", DynamicUpdate, IntCol, "The time of the last check (Unix timestamp)")
+	t.AddTimeColumn("last_check", DynamicUpdate, "The time of the last check (Unix timestamp)")
 	t.AddColumn("last_hard_state", DynamicUpdate, IntCol, "The last hard state of the service")
-	t.AddColumn("last_hard_state_change", DynamicUpdate, IntCol, "The last hard state of the service")
-	t.AddColumn("last_notification", DynamicUpdate, IntCol, "The time of the last notification (Unix timestamp)")
+	t.AddTimeColumn("last_hard_state_change", DynamicUpdate, "The last hard state of the service")
+	t.AddTimeColumn("last_notification", DynamicUpdate, "The time of the last notification (Unix timestamp)")
 	t.AddColumn("last_state", DynamicUpdate, IntCol, "The last state of the service")
-	t.AddColumn("last_state_change", DynamicUpdate, IntCol, "The last state of the service")
-	t.AddColumn("last_time_critical", DynamicUpdate, IntCol, "The last time the service was CRITICAL (Unix timestamp)")
-	t.AddColumn("last_time_warning", DynamicUpdate, IntCol, "The last time the service was in WARNING state (Unix timestamp)")
-	t.AddColumn("last_time_ok", DynamicUpdate, IntCol, "The last time the service was OK (Unix timestamp)")
-	t.AddColumn("last_time_unknown", DynamicUpdate, IntCol, "The last time the service was UNKNOWN (Unix timestamp)")
+	t.AddTimeColumn("last_state_change", DynamicUpdate, "The last state of the service")
+	t.AddTimeColumn("last_time_critical", DynamicUpdate, "The last time the service was CRITICAL (Unix timestamp)")
+	t.AddTimeColumn("last_time_warning", DynamicUpdate, "The last time the service was in WARNING state (Unix timestamp)")
+	t.AddTimeColumn("last_time_ok", DynamicUpdate, "The last time the service was OK (Unix timestamp)")
+	t.AddTimeColumn("last_time_unknown", DynamicUpdate, "The last time the service was UNKNOWN (Unix timestamp)")
 	t.AddColumn("latency", DynamicUpdate, FloatCol, "Time difference between scheduled check time and actual check time")
 	t.AddColumn("long_plugin_output", DynamicUpdate, StringCol, "Unabbreviated output of the last check plugin")
 	t.AddColumn("low_flap_threshold", DynamicUpdate, IntCol, "Low threshold of flap detection")
 	t.AddColumn("max_check_attempts", StaticUpdate, IntCol, "The maximum number of check attempts")
 	t.AddColumn("modified_attributes", DynamicUpdate, IntCol, "A bitmask specifying which attributes have been modified")
 	t.AddColumn("modified_attributes_list", DynamicUpdate, StringListCol, "A bitmask specifying which attributes have been modified")
-	t.AddColumn("next_check", DynamicUpdate, IntCol, "The scheduled time of the next check (Unix timestamp)")
-	t.AddColumn("next_notification", DynamicUpdate, IntCol, "The time of the next notification (Unix timestamp)")
+	t.AddTimeColumn("next_check", DynamicUpdate, "The scheduled time of the next check (Unix timestamp)")
+	t.AddTimeColumn("next_notification", DynamicUpdate, "The time of the next notification (Unix timestamp)")
 	t.AddColumn("notes", StaticUpdate, StringCol, "Optional notes about the service")
 	t.AddColumn("notes_expanded", StaticUpdate, StringCol, "Optional notes about the service")
 	t.AddColumn("notes_url", StaticUpdate, StringCol, "Optional notes about the service")
@@ -734,9 +805,12 @@ func NewServicesTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	t.AddColumn("last_state_change_order", RefNoUpdate, VirtCol, "The last_state_change of this host suitable for sorting. Returns program_start from the core if host has been never checked.")
 	t.AddColumn("state_order", RefNoUpdate, VirtCol, "The service state suitable for sorting. Unknown and Critical state are switched.")
 	t.AddColumn("has_long_plugin_output", RefNoUpdate, VirtCol, "Flag wether this service has long_plugin_output or not")
+	t.AddColumn("recent_state_changes", RefNoUpdate, VirtCol, "Estimated number of state changes within the last 21 checks derived from the weighted percent_state_change, null if flap detection is disabled")
 	return
 }
 
@@ -759,6 +833,8 @@ func NewServicegroupsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -767,10 +843,10 @@ func NewCommentsTable() (t *Table) {
 	t = &Table{Name: "comments"}
 	t.AddColumn("author", StaticUpdate, StringCol, "The contact that entered the comment")
 	t.AddColumn("comment", StaticUpdate, StringCol, "A comment text")
-	t.AddColumn("entry_time", StaticUpdate, IntCol, "The time the entry was made as UNIX timestamp")
+	t.AddTimeColumn("entry_time", StaticUpdate, "The time the entry was made as UNIX timestamp")
 	t.AddColumn("entry_type", StaticUpdate, IntCol, "The type of the comment: 1 is user, 2 is downtime, 3 is flap and 4 is acknowledgement")
 	t.AddColumn("expires", StaticUpdate, IntCol, "Whether this comment expires")
-	t.AddColumn("expire_time", StaticUpdate, IntCol, "The time of expiry of this comment as a UNIX timestamp")
+	t.AddTimeColumn("expire_time", StaticUpdate, "The time of expiry of this comment as a UNIX timestamp")
 	t.AddColumn("id", StaticUpdate, IntCol, "The id of the comment")
 	t.AddColumn("is_service", StaticUpdate, IntCol, "0, if this entry is for a host, 1 if it is for a service")
 	t.AddColumn("persistent", StaticUpdate, IntCol, "Whether this comment is persistent (0/1)")
@@ -783,6 +859,8 @@ func NewCommentsTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -792,12 +870,12 @@ func NewDowntimesTable() (t *Table) {
 	t.AddColumn("author", StaticUpdate, StringCol, "The contact that scheduled the downtime")
 	t.AddColumn("comment", StaticUpdate, StringCol, "A comment text")
 	t.AddColumn("duration", StaticUpdate, IntCol, "The duration of the downtime in seconds")
-	t.AddColumn("end_time", StaticUpdate, IntCol, "The end time of the downtime as UNIX timestamp")
-	t.AddColumn("entry_time", StaticUpdate, IntCol, "The time the entry was made as UNIX timestamp")
+	t.AddTimeColumn("end_time", StaticUpdate, "The end time of the downtime as UNIX timestamp")
+	t.AddTimeColumn("entry_time", StaticUpdate, "The time the entry was made as UNIX timestamp")
 	t.AddColumn("fixed", StaticUpdate, IntCol, "1 if the downtime is fixed, a 0 if it is flexible")
 	t.AddColumn("id", StaticUpdate, IntCol, "The id of the downtime")
 	t.AddColumn("is_service", StaticUpdate, IntCol, "0, if this entry is for a host, 1 if it is for a service")
-	t.AddColumn("start_time", StaticUpdate, IntCol, "The start time of the downtime as UNIX timestamp")
+	t.AddTimeColumn("start_time", StaticUpdate, "The start time of the downtime as UNIX timestamp")
 	t.AddColumn("triggered_by", StaticUpdate, IntCol, "The id of the downtime this downtime was triggered by or 0 if it was not triggered by another downtime")
 	t.AddColumn("type", StaticUpdate, IntCol, "The type of the downtime: 0 if it is active, 1 if it is pending")
 	t.AddColumn("host_name", StaticUpdate, StringCol, "Host name")
@@ -807,6 +885,8 @@ func NewDowntimesTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -825,13 +905,15 @@ func NewLogTable() (t *Table) {
 	t.AddColumn("service_description", StaticUpdate, StringCol, "The description of the service log entry is about (might be empty)")
 	t.AddColumn("state", StaticUpdate, IntCol, "The state of the host or service in question")
 	t.AddColumn("state_type", StaticUpdate, StringCol, "The type of the state (varies on different log classes)")
-	t.AddColumn("time", StaticUpdate, IntCol, "Time of the log event (UNIX timestamp)")
+	t.AddTimeColumn("time", StaticUpdate, "Time of the log event (UNIX timestamp)")
 	t.AddColumn("type", StaticUpdate, StringCol, "The type of the message (text before the colon), the message itself for info messages")
 	t.AddColumn("current_service_contacts", StaticUpdate, StringListCol, "A list of all contacts of the service, either direct or via a contact group")
 	t.AddColumn("current_host_contacts", StaticUpdate, StringListCol, "A list of all contacts of this host, either direct or via a contact group")
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -846,6 +928,8 @@ func NewHostsByGroupTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -862,6 +946,8 @@ func NewServicesByGroupTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
 
@@ -878,5 +964,7 @@ func NewServicesByHostgroupTable() (t *Table) {
 
 	t.AddColumn("peer_key", RefNoUpdate, VirtCol, "Id of this peer")
 	t.AddColumn("peer_name", RefNoUpdate, VirtCol, "Name of this peer")
+	t.AddColumn("lmd_time", RefNoUpdate, VirtCol, "Current unix timestamp of LMD when the response was built")
+	t.AddColumn("lmd_row_age", RefNoUpdate, VirtCol, "Age of the data in seconds since the last update of this peer")
 	return
 }
@@ -8,14 +8,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Jeffail/gabs"
 )
@@ -36,10 +40,13 @@ const (
 
 // DataTable contains the actual data with a reference to the table.
 type DataTable struct {
-	Table *Table
-	Data  [][]interface{}
-	Refs  map[string][][]interface{}
-	Index map[string][]interface{}
+	Table        *Table
+	Data         [][]interface{}
+	Refs         map[string][][]interface{}
+	Index        map[string][]interface{}
+	RowIndex     map[string]int // maps the index key to the row number
+	LastModified []int64        // timestamp of the last change for each row, nil if changes are not tracked
+	Unsupported  bool           // set if the backend does not know this table
 }
 
 // Peer is the object which handles collecting and updating data and connections.
@@ -57,8 +64,10 @@ type Peer struct {
 	shutdownChannel chan bool
 	stopChannel     chan bool
 	Config          Connection
+	Location        *time.Location // timezone from the connection config, used for TimeFormat: iso
 	Flags           OptionalFlags
 	LocalConfig     *Config
+	rowAge          int32 // age of the data in seconds, see setRowAge
 }
 
 // PeerStatus contains the different states a peer can have
@@ -156,12 +165,29 @@ func NewPeer(LocalConfig *Config, config Connection, waitGroup *sync.WaitGroup,
 	p.Status["LastError"] = "connecting..."
 	p.Status["LastOnline"] = int64(0)
 	p.Status["ProgramStart"] = 0
-	p.Status["BytesSend"] = 0
-	p.Status["BytesReceived"] = 0
+	p.Status["LivestatusVersion"] = ""
+	p.Status["ProgramVersion"] = ""
+	p.Status["Section"] = config.Section
+	p.Status["Group"] = config.Group
+	p.Status["BytesSend"] = int64(0)
+	p.Status["BytesReceived"] = int64(0)
 	p.Status["Querys"] = 0
 	p.Status["ReponseTime"] = 0
 	p.Status["Idling"] = false
 	p.Status["Updating"] = false
+	p.Status["Evicted"] = false
+
+	_, err := config.ParseFilters()
+	if err != nil {
+		log.Errorf("[%s] invalid filter: %s", p.Name, err.Error())
+	}
+
+	location, err := config.Location()
+	if err != nil {
+		log.Errorf("[%s] invalid timezone: %s", p.Name, err.Error())
+		location = time.Local
+	}
+	p.Location = location
 
 	/* strip of trailing slashes from http backends */
 	for i, s := range p.Source {
@@ -366,6 +392,12 @@ func (p *Peer) StatusGet(key string) interface{} {
 	return value
 }
 
+// isStale returns true if the last successful update of this peer is older than the StaleDataThreshold.
+func (p *Peer) isStale() bool {
+	lastUpdate := p.StatusGet("LastUpdate").(int64)
+	return lastUpdate < time.Now().Unix()-p.LocalConfig.StaleDataThreshold
+}
+
 // ScheduleImmediateUpdate resets all update timer so the next updateloop iteration
 // will performan an update.
 func (p *Peer) ScheduleImmediateUpdate() {
@@ -404,13 +436,18 @@ func (p *Peer) InitAllTables() bool {
 	}
 
 	p.DataLock.RLock()
-	programStart := p.Tables["status"].Data[0][p.Tables["status"].Table.ColumnsIndex["program_start"]]
+	status := p.Tables["status"]
+	programStart := status.Data[0][status.Table.ColumnsIndex["program_start"]]
+	livestatusVersion := status.Data[0][status.Table.ColumnsIndex["livestatus_version"]]
+	programVersion := status.Data[0][status.Table.ColumnsIndex["program_version"]]
 	p.DataLock.RUnlock()
 
 	duration := time.Since(t1)
 	p.PeerLock.Lock()
 	p.Status["ProgramStart"] = programStart
-	p.Status["ReponseTime"] = duration.Seconds()
+	p.Status["LivestatusVersion"] = livestatusVersion
+	p.Status["ProgramVersion"] = programVersion
+	p.setResponseTime(duration.Seconds())
 	p.PeerLock.Unlock()
 	log.Infof("[%s] objects created in: %s", p.Name, duration.String())
 
@@ -467,7 +504,7 @@ func (p *Peer) UpdateAllTables() bool {
 	}
 	p.resetErrors()
 	p.PeerLock.Lock()
-	p.Status["ReponseTime"] = duration.Seconds()
+	p.setResponseTime(duration.Seconds())
 	p.Status["LastUpdate"] = time.Now().Unix()
 	p.Status["LastFullUpdate"] = time.Now().Unix()
 	p.PeerLock.Unlock()
@@ -487,10 +524,7 @@ func (p *Peer) UpdateDeltaTables() bool {
 		return p.InitAllTables()
 	}
 	if err == nil {
-		err = p.UpdateDeltaTableHosts("")
-	}
-	if err == nil {
-		err = p.UpdateDeltaTableServices("")
+		err = p.updateDeltaHostsAndServices()
 	}
 	if err == nil {
 		err = p.UpdateDeltaCommentsOrDowntimes("comments")
@@ -516,71 +550,94 @@ func (p *Peer) UpdateDeltaTables() bool {
 	p.resetErrors()
 	p.PeerLock.Lock()
 	p.Status["LastUpdate"] = time.Now().Unix()
-	p.Status["ReponseTime"] = duration.Seconds()
+	p.setResponseTime(duration.Seconds())
 	p.PeerLock.Unlock()
 	promPeerUpdates.WithLabelValues(p.Name).Inc()
 	promPeerUpdateDuration.WithLabelValues(p.Name).Set(duration.Seconds())
 	return true
 }
 
-// UpdateDeltaTableHosts update services by fetching all dynamic data with a last_check filter on the timestamp since
-// the previous update with additional UpdateAdditionalDelta seconds.
+// updateDeltaHostsAndServices fetches the delta updates of hosts and services first and applies both
+// at once. Services contain references to their hosts, so queries must not see updated hosts along
+// with outdated services.
 // It returns any error encountered.
-func (p *Peer) UpdateDeltaTableHosts(filterStr string) (err error) {
-	// update changed hosts
-	table := Objects.Tables["hosts"]
-	keys, indexes := table.GetDynamicColumns(p.Flags)
-	keys = append(keys, "name")
-	if filterStr == "" {
-		filterStr = fmt.Sprintf("Filter: last_check >= %v\nFilter: is_executing = 1\nOr: 2\n", (p.StatusGet("LastUpdate").(int64) - UpdateAdditionalDelta))
-		// no filter means regular delta update, so lets check if all last_check dates match
-		ok, uErr := p.UpdateDeltaTableFullScan(&table, filterStr)
-		if ok || uErr != nil {
-			return uErr
-		}
-	}
-	req := &Request{
-		Table:           table.Name,
-		Columns:         keys,
-		ResponseFixed16: true,
-		OutputFormat:    "json",
-		FilterStr:       filterStr,
+func (p *Peer) updateDeltaHostsAndServices() (err error) {
+	hosts := Objects.Tables["hosts"]
+	services := Objects.Tables["services"]
+	hostRows, hostIndexes, err := p.fetchDeltaTable(&hosts, "")
+	if err != nil {
+		return
 	}
-	res, err := p.Query(req)
+	serviceRows, serviceIndexes, err := p.fetchDeltaTable(&services, "")
 	if err != nil {
 		return
 	}
+	p.applyDeltaUpdates([]deltaUpdate{
+		{table: &hosts, rows: hostRows, indexes: hostIndexes},
+		{table: &services, rows: serviceRows, indexes: serviceIndexes},
+	})
+	return
+}
+
+// deltaUpdate contains the fetched rows of a delta update for a single table.
+type deltaUpdate struct {
+	table   *Table
+	rows    [][]interface{}
+	indexes []int
+}
+
+// applyDeltaUpdates applies all updates while holding the DataLock once.
+func (p *Peer) applyDeltaUpdates(updates []deltaUpdate) {
 	p.DataLock.Lock()
-	nameindex := p.Tables[table.Name].Index
-	fieldIndex := len(keys) - 1
-	for i := range res {
-		resRow := res[i]
-		dataRow := nameindex[resRow[fieldIndex].(string)]
-		for j, k := range indexes {
-			dataRow[k] = resRow[j]
-		}
+	defer p.DataLock.Unlock()
+	for _, u := range updates {
+		p.applyDeltaTable(u.table, u.rows, u.indexes)
 	}
-	p.DataLock.Unlock()
-	promPeerUpdatedHosts.WithLabelValues(p.Name).Add(float64(len(res)))
-	log.Debugf("[%s] updated %d hosts", p.Name, len(res))
+}
 
-	return
+// UpdateDeltaTableHosts update hosts by fetching all dynamic data with a last_check filter on the timestamp since
+// the previous update with additional UpdateAdditionalDelta seconds.
+// It returns any error encountered.
+func (p *Peer) UpdateDeltaTableHosts(filterStr string) (err error) {
+	return p.updateDeltaTable(Objects.Tables["hosts"], filterStr)
 }
 
 // UpdateDeltaTableServices update services by fetching all dynamic data with a last_check filter on the timestamp since
 // the previous update with additional UpdateAdditionalDelta seconds.
 // It returns any error encountered.
 func (p *Peer) UpdateDeltaTableServices(filterStr string) (err error) {
-	// update changed services
-	table := Objects.Tables["services"]
+	return p.updateDeltaTable(Objects.Tables["services"], filterStr)
+}
+
+// updateDeltaTable fetches and applies a delta update for the hosts or services table.
+func (p *Peer) updateDeltaTable(table Table, filterStr string) (err error) {
+	res, indexes, err := p.fetchDeltaTable(&table, filterStr)
+	if err != nil {
+		return
+	}
+	p.applyDeltaUpdates([]deltaUpdate{{table: &table, rows: res, indexes: indexes}})
+	return
+}
+
+// fetchDeltaTable fetches all dynamic columns of the hosts or services which have changed. Without filter,
+// the last_check timestamp of the previous update is used. The key columns are appended to each row.
+// It returns the fetched rows, the data indexes of the dynamic columns and any error encountered.
+func (p *Peer) fetchDeltaTable(table *Table, filterStr string) (res [][]interface{}, indexes []int, err error) {
 	keys, indexes := table.GetDynamicColumns(p.Flags)
-	keys = append(keys, []string{"host_name", "description"}...)
+	keys = append(keys, rowIndexColumns[table.Name]...)
 	if filterStr == "" {
 		filterStr = fmt.Sprintf("Filter: last_check >= %v\nFilter: is_executing = 1\nOr: 2\n", (p.StatusGet("LastUpdate").(int64) - UpdateAdditionalDelta))
 		// no filter means regular delta update, so lets check if all last_check dates match
-		ok, uErr := p.UpdateDeltaTableFullScan(&table, filterStr)
-		if ok || uErr != nil {
-			return uErr
+		scanned, scanFilter, sErr := p.checkDeltaTableFullScan(table, filterStr)
+		if sErr != nil {
+			err = sErr
+			return
+		}
+		if scanned {
+			if scanFilter == "" {
+				return
+			}
+			filterStr = scanFilter
 		}
 	}
 	req := &Request{
@@ -590,36 +647,47 @@ func (p *Peer) UpdateDeltaTableServices(filterStr string) (err error) {
 		OutputFormat:    "json",
 		FilterStr:       filterStr,
 	}
-	res, err := p.Query(req)
-	if err != nil {
-		return
-	}
-	p.DataLock.Lock()
-	nameindex := p.Tables[table.Name].Index
-	fieldIndex1 := len(keys) - 2
-	fieldIndex2 := len(keys) - 1
+	res, err = p.Query(req)
+	return
+}
+
+// applyDeltaTable copies the rows fetched by fetchDeltaTable into the data table.
+// The caller has to hold the DataLock, so queries never see a partially applied update.
+func (p *Peer) applyDeltaTable(table *Table, res [][]interface{}, indexes []int) {
+	dataTable := p.Tables[table.Name]
+	numKeys := len(rowIndexColumns[table.Name])
+	now := time.Now().Unix()
 	for i := range res {
 		resRow := res[i]
-		dataRow := nameindex[resRow[fieldIndex1].(string)+";"+resRow[fieldIndex2].(string)]
-		for j, k := range indexes {
-			dataRow[k] = resRow[j]
+		keyValues := make([]string, numKeys)
+		for k := range keyValues {
+			keyValues[k] = resRow[len(resRow)-numKeys+k].(string)
+		}
+		key := strings.Join(keyValues, ";")
+		dataRow, ok := dataTable.Index[key]
+		if !ok {
+			// new objects will be added with the next full update
+			continue
+		}
+		if updateRowValues(dataRow, resRow, indexes) {
+			dataTable.setRowModified(dataTable.RowIndex[key], now)
 		}
 	}
-	p.DataLock.Unlock()
-	promPeerUpdatedServices.WithLabelValues(p.Name).Add(float64(len(res)))
-	log.Debugf("[%s] updated %d services", p.Name, len(res))
-
-	return
+	switch table.Name {
+	case "hosts":
+		promPeerUpdatedHosts.WithLabelValues(p.Name).Add(float64(len(res)))
+	case "services":
+		promPeerUpdatedServices.WithLabelValues(p.Name).Add(float64(len(res)))
+	}
+	log.Debugf("[%s] updated %d %s", p.Name, len(res), table.Name)
 }
 
-// UpdateDeltaTableFullScan updates hosts and services tables by fetching some key indicator fields like last_check
-// downtimes or acknowledged status. If an update is required, the last_check timestamp is used as filter for a
-// delta update.
-// The full scan just returns false without any update if the last update was less then MinFullScanInterval seconds
-// ago.
-// It returns true if an update was done and any error encountered.
-func (p *Peer) UpdateDeltaTableFullScan(table *Table, filterStr string) (updated bool, err error) {
-	updated = false
+// checkDeltaTableFullScan checks the hosts and services tables by fetching some key indicator fields like
+// last_check, downtimes or acknowledged status. If an update is required, it returns a filter which extends
+// the delta filter by the last_check timestamps of all changed objects.
+// The full scan is skipped if the last scan was less then MinFullScanInterval seconds ago.
+// It returns true if a scan was done, the filter for the required update and any error encountered.
+func (p *Peer) checkDeltaTableFullScan(table *Table, filterStr string) (scanned bool, scanFilter string, err error) {
 	p.PeerLock.RLock()
 	var lastUpdate int64
 	if table.Name == "services" {
@@ -661,6 +729,10 @@ func (p *Peer) UpdateDeltaTableFullScan(table *Table, filterStr string) (updated
 	missing := make(map[float64]bool)
 	for i := range res {
 		row := res[i]
+		if i >= len(data) {
+			missing[row[0].(float64)] = true
+			continue
+		}
 		for j, index := range indexList {
 			if row[j].(float64) != data[i][index].(float64) {
 				missing[row[0].(float64)] = true
@@ -675,11 +747,7 @@ func (p *Peer) UpdateDeltaTableFullScan(table *Table, filterStr string) (updated
 			filter = append(filter, fmt.Sprintf("Filter: last_check = %d\n", int(lastCheck)))
 		}
 		filter = append(filter, fmt.Sprintf("Or: %d\n", len(filter)))
-		if table.Name == "services" {
-			p.UpdateDeltaTableServices(strings.Join(filter, ""))
-		} else if table.Name == "hosts" {
-			p.UpdateDeltaTableHosts(strings.Join(filter, ""))
-		}
+		scanFilter = strings.Join(filter, "")
 	}
 
 	if table.Name == "services" {
@@ -687,7 +755,7 @@ func (p *Peer) UpdateDeltaTableFullScan(table *Table, filterStr string) (updated
 	} else if table.Name == "hosts" {
 		p.StatusSet("LastFullHostUpdate", time.Now().Unix())
 	}
-	updated = true
+	scanned = true
 	return
 }
 
@@ -696,6 +764,9 @@ func (p *Peer) UpdateDeltaTableFullScan(table *Table, filterStr string) (updated
 // which have to be removed.
 // It returns any error encountered.
 func (p *Peer) UpdateDeltaCommentsOrDowntimes(name string) (err error) {
+	if p.isUnsupportedTable(name) {
+		return
+	}
 	// add new comments / downtimes
 	table := Objects.Tables[name]
 
@@ -796,6 +867,9 @@ func (p *Peer) UpdateDeltaCommentsOrDowntimes(name string) (err error) {
 // query sends the request to a remote livestatus.
 // It returns the unmarshaled result and any error encountered.
 func (p *Peer) query(req *Request) ([][]interface{}, error) {
+	if req.canceler.IsCanceled() {
+		return nil, errClientDisconnected
+	}
 	conn, connType, err := p.GetConnection()
 	if err != nil {
 		return nil, err
@@ -804,6 +878,19 @@ func (p *Peer) query(req *Request) ([][]interface{}, error) {
 		defer conn.Close()
 	}
 
+	// abort the remote query if our client went away
+	if conn != nil && req.canceler != nil {
+		finished := make(chan bool)
+		defer close(finished)
+		go func() {
+			select {
+			case <-req.canceler.Done():
+				conn.Close()
+			case <-finished:
+			}
+		}()
+	}
+
 	query := req.String()
 	if log.IsV(3) {
 		log.Tracef("[%s] query: %s", p.Name, query)
@@ -811,8 +898,8 @@ func (p *Peer) query(req *Request) ([][]interface{}, error) {
 
 	p.PeerLock.Lock()
 	p.Status["Querys"] = p.Status["Querys"].(int) + 1
-	p.Status["BytesSend"] = p.Status["BytesSend"].(int) + len(query)
-	promPeerBytesSend.WithLabelValues(p.Name).Set(float64(p.Status["BytesSend"].(int)))
+	p.Status["BytesSend"] = p.Status["BytesSend"].(int64) + int64(len(query))
+	promPeerBytesSend.WithLabelValues(p.Name).Set(float64(p.Status["BytesSend"].(int64)))
 	peerAddr := p.Status["PeerAddr"].(string)
 	p.PeerLock.Unlock()
 
@@ -823,6 +910,7 @@ func (p *Peer) query(req *Request) ([][]interface{}, error) {
 	if req.Command != "" {
 		return nil, nil
 	}
+	req.rawCapture.Add(p.ID, query, *resBytes)
 
 	if log.IsV(3) {
 		log.Tracef("[%s] result: %s", p.Name, string(*resBytes))
@@ -840,11 +928,15 @@ func (p *Peer) query(req *Request) ([][]interface{}, error) {
 
 func (p *Peer) parseResult(req *Request, resBytes *[]byte) (result [][]interface{}, err error) {
 	p.PeerLock.Lock()
-	p.Status["BytesReceived"] = p.Status["BytesReceived"].(int) + len(*resBytes)
+	p.Status["BytesReceived"] = p.Status["BytesReceived"].(int64) + int64(len(*resBytes))
+	req.peerBytes.Add(p.ID, len(*resBytes))
 	log.Debugf("[%s] got %s answer: size: %d kB", p.Name, req.Table, len(*resBytes)/1024)
-	promPeerBytesReceived.WithLabelValues(p.Name).Set(float64(p.Status["BytesReceived"].(int)))
+	promPeerBytesReceived.WithLabelValues(p.Name).Set(float64(p.Status["BytesReceived"].(int64)))
 	p.PeerLock.Unlock()
 
+	// make sure all strings are valid utf-8 before parsing
+	*resBytes = decodeResult(*resBytes, p.Config.Encoding)
+
 	if len(*resBytes) == 0 || (string((*resBytes)[0]) != "{" && string((*resBytes)[0]) != "[") {
 		err = errors.New(strings.TrimSpace(string(*resBytes)))
 		return nil, &PeerError{msg: err.Error(), kind: ResponseError}
@@ -861,10 +953,17 @@ func (p *Peer) parseResult(req *Request, resBytes *[]byte) (result [][]interface
 		if jErr != nil {
 			return nil, &PeerError{msg: jErr.Error(), kind: ResponseError}
 		}
-		rows := jsonParsed.Data().([]interface{})
+		rows, ok := jsonParsed.Data().([]interface{})
+		if !ok {
+			return nil, &PeerError{msg: "bad response: result is not a list", kind: ResponseError}
+		}
 		result = make([][]interface{}, len(rows))
 		for i := range rows {
-			result[i] = rows[i].([]interface{})
+			row, ok := rows[i].([]interface{})
+			if !ok {
+				return nil, &PeerError{msg: fmt.Sprintf("bad response: row %d is not a list", i), kind: ResponseError}
+			}
+			result[i] = row
 		}
 	}
 
@@ -877,6 +976,62 @@ func (p *Peer) parseResult(req *Request, resBytes *[]byte) (result [][]interface
 	return
 }
 
+// isSupportedEncoding returns true if the given connection encoding can be converted to utf-8.
+func isSupportedEncoding(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case "", "utf8", "utf-8", "latin1", "iso-8859-1":
+		return true
+	}
+	return false
+}
+
+// decodeResult converts a raw result into valid utf-8.
+// Latin1 results are transcoded, otherwise invalid byte sequences are replaced
+// by the unicode replacement character instead of failing the whole response.
+func decodeResult(data []byte, encoding string) []byte {
+	switch strings.ToLower(encoding) {
+	case "latin1", "iso-8859-1":
+		return latin1ToUTF8(data)
+	}
+	if utf8.Valid(data) {
+		return data
+	}
+	buf := make([]byte, 0, len(data)+16)
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, string(utf8.RuneError)...)
+		} else {
+			buf = append(buf, data[:size]...)
+		}
+		data = data[size:]
+	}
+	return buf
+}
+
+// latin1ToUTF8 converts latin1 (iso-8859-1) encoded data to utf-8.
+func latin1ToUTF8(data []byte) []byte {
+	ascii := true
+	for _, b := range data {
+		if b >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return data
+	}
+	buf := make([]byte, 0, len(data)+len(data)/8)
+	for _, b := range data {
+		if b < utf8.RuneSelf {
+			buf = append(buf, b)
+			continue
+		}
+		buf = append(buf, string(rune(b))...)
+	}
+	return buf
+}
+
 func (p *Peer) sendTo(req *Request, query string, peerAddr string, conn net.Conn, connType string) (*[]byte, error) {
 	// http connections
 	if connType == "http" {
@@ -927,11 +1082,36 @@ func (p *Peer) sendTo(req *Request, query string, peerAddr string, conn net.Conn
 	return &res, nil
 }
 
+// setResponseTime stores the duration of the last update and evicts the peer
+// from passthrough queries if it is slower than SlowPeerThreshold. It will be
+// used again once the response time drops below SlowPeerRecover.
+// PeerLock must be held when calling this function.
+func (p *Peer) setResponseTime(seconds float64) {
+	p.Status["ReponseTime"] = seconds
+	threshold := p.LocalConfig.SlowPeerThreshold
+	if threshold <= 0 {
+		p.Status["Evicted"] = false
+		return
+	}
+	evicted := p.Status["Evicted"].(bool)
+	if !evicted && seconds > threshold {
+		log.Warnf("[%s] response time %.2fs exceeds %.2fs, excluding from passthrough queries", p.Name, seconds, threshold)
+		p.Status["Evicted"] = true
+	} else if evicted && seconds < p.LocalConfig.SlowPeerRecover {
+		log.Infof("[%s] response time recovered to %.2fs", p.Name, seconds)
+		p.Status["Evicted"] = false
+	}
+}
+
 // Query sends a livestatus request from a request object.
 // It calls query and logs all errors except connection errors which are logged in GetConnection.
 // It returns the livestatus result and any error encountered.
 func (p *Peer) Query(req *Request) (result [][]interface{}, err error) {
 	result, err = p.query(req)
+	if err != nil && req.canceler.IsCanceled() {
+		// the backend is fine, we closed the connection ourselves
+		return nil, errClientDisconnected
+	}
 	if err != nil {
 		p.setNextAddrFromErr(err)
 	}
@@ -952,6 +1132,19 @@ func (p *Peer) QueryString(str string) ([][]interface{}, error) {
 	return p.Query(req)
 }
 
+// isUnknownTableError returns true if the backend answered that it does not know the requested table.
+func isUnknownTableError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "bad response: 404") || strings.Contains(msg, "no such table")
+}
+
+// isUnsupportedTable returns true if the backend does not know the given table.
+func (p *Peer) isUnsupportedTable(name string) bool {
+	p.DataLock.RLock()
+	defer p.DataLock.RUnlock()
+	return p.Tables[name].Unsupported
+}
+
 // CheckResponseHeader verifies the return code and content length of livestatus answer.
 // It returns an error if something is wrong with the header.
 func (p *Peer) CheckResponseHeader(resBytes *[]byte) (err error) {
@@ -969,13 +1162,18 @@ func (p *Peer) CheckResponseHeader(resBytes *[]byte) (err error) {
 		return
 	}
 	resCode, _ := strconv.Atoi(matched[1])
-	expSize, _ := strconv.Atoi(matched[2])
+	// sizes of multi-gigabyte responses would overflow int on 32-bit builds
+	expSize, err := strconv.ParseInt(matched[2], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("[%s] bad response size: %s", p.Name, matched[2])
+		return
+	}
 
 	if resCode != 200 {
 		err = fmt.Errorf("[%s] bad response: %s", p.Name, string(*resBytes))
 		return
 	}
-	if expSize != resSize {
+	if expSize != int64(resSize) {
 		err = fmt.Errorf("[%s] bad response size, expected %d, got %d", p.Name, expSize, resSize)
 		return
 	}
@@ -1131,6 +1329,13 @@ func (p *Peer) CreateObjectByType(table *Table) (_, err error) {
 		res, err = p.Query(req)
 	}
 	if err != nil {
+		if !table.GroupBy && isUnknownTableError(err) && Objects.IsOptional(table.Name) {
+			log.Infof("[%s] backend does not support table %s", p.Name, table.Name)
+			p.DataLock.Lock()
+			p.Tables[table.Name] = DataTable{Table: table, Data: make([][]interface{}, 0), Refs: refs, Index: index, Unsupported: true}
+			p.DataLock.Unlock()
+			err = nil
+		}
 		return
 	}
 
@@ -1164,9 +1369,10 @@ func (p *Peer) CreateObjectByType(table *Table) (_, err error) {
 
 	p.createIndex(table, &res, &index)
 	p.createFlags(table, &res, &index)
+	rowIndex, lastModified := createModificationTracking(table, &res)
 
 	p.DataLock.Lock()
-	p.Tables[table.Name] = DataTable{Table: table, Data: res, Refs: refs, Index: index}
+	p.Tables[table.Name] = DataTable{Table: table, Data: res, Refs: refs, Index: index, RowIndex: rowIndex, LastModified: lastModified}
 	p.DataLock.Unlock()
 	p.PeerLock.Lock()
 	p.Status["LastUpdate"] = time.Now().Unix()
@@ -1212,6 +1418,68 @@ func (p *Peer) createIndex(table *Table, res *[][]interface{}, index *map[string
 	}
 }
 
+// createModificationTracking returns the row number index and the initial modification
+// timestamps for tables which track changes per row. Only hosts and services do so.
+func createModificationTracking(table *Table, res *[][]interface{}) (rowIndex map[string]int, lastModified []int64) {
+	var keyFields []int
+	switch table.Name {
+	case "hosts":
+		keyFields = []int{table.ColumnsIndex["name"]}
+	case "services":
+		keyFields = []int{table.ColumnsIndex["host_name"], table.ColumnsIndex["description"]}
+	default:
+		return
+	}
+	now := time.Now().Unix()
+	rowIndex = make(map[string]int, len(*res))
+	lastModified = make([]int64, len(*res))
+	for i := range *res {
+		row := (*res)[i]
+		keyValues := make([]string, len(keyFields))
+		for k, field := range keyFields {
+			keyValues[k] = row[field].(string)
+		}
+		rowIndex[strings.Join(keyValues, ";")] = i
+		lastModified[i] = now
+	}
+	return
+}
+
+// updateRowValues copies the values from the result row into the data row.
+// It returns true if any value has changed.
+func updateRowValues(dataRow []interface{}, resRow []interface{}, indexes []int) (changed bool) {
+	for j, k := range indexes {
+		if !changed && !reflect.DeepEqual(dataRow[k], resRow[j]) {
+			changed = true
+		}
+		dataRow[k] = resRow[j]
+	}
+	return
+}
+
+// setRowModified sets the modification timestamp of the given row if changes are tracked for this table.
+func (d *DataTable) setRowModified(rowNum int, now int64) {
+	if d.LastModified == nil || rowNum >= len(d.LastModified) {
+		return
+	}
+	d.LastModified[rowNum] = now
+}
+
+// isModifiedSince returns true if the given row has been changed after the given timestamp.
+// Rows of tables without modification tracking are always considered modified.
+func (d *DataTable) isModifiedSince(rowNum int, since int64) bool {
+	if d.LastModified == nil || rowNum >= len(d.LastModified) {
+		return true
+	}
+	return d.LastModified[rowNum] > since
+}
+
+// rowIndexColumns contains the columns which make up the row index key of each table.
+var rowIndexColumns = map[string][]string{
+	"hosts":    {"name"},
+	"services": {"host_name", "description"},
+}
+
 func (p *Peer) createFlags(table *Table, res *[][]interface{}, index *map[string][]interface{}) {
 	// is this a shinken or icinga backend?
 	if table.Name == "status" && len((*res)) > 0 {
@@ -1296,6 +1564,9 @@ func (p *Peer) UpdateObjectByType(table Table) (restartRequired bool, err error)
 	if table.PassthroughOnly {
 		return
 	}
+	if p.isUnsupportedTable(table.Name) {
+		return
+	}
 	keys, indexes := table.GetDynamicColumns(p.Flags)
 	req := &Request{
 		Table:           table.Name,
@@ -1307,7 +1578,9 @@ func (p *Peer) UpdateObjectByType(table Table) (restartRequired bool, err error)
 	if err != nil {
 		return
 	}
+	p.DataLock.RLock()
 	data := p.Tables[table.Name].Data
+	p.DataLock.RUnlock()
 	if len(res) > len(data) {
 		log.Debugf("[%s] site too large number of objects, assuming backend has been restarted", p.Name)
 		restartRequired = true
@@ -1318,15 +1591,25 @@ func (p *Peer) UpdateObjectByType(table Table) (restartRequired bool, err error)
 		p.updateTimeperiodsData(&table, res, indexes)
 	} else {
 		indexLength := len(indexes)
+		now := time.Now().Unix()
 		p.DataLock.Lock()
+		// the table might have been recreated meanwhile
+		dataTable := p.Tables[table.Name]
+		data = dataTable.Data
+		if len(res) > len(data) {
+			p.DataLock.Unlock()
+			restartRequired = true
+			return
+		}
 		for i := range res {
 			row := res[i]
 			if len(row) < indexLength {
+				p.DataLock.Unlock()
 				err = fmt.Errorf("response list has wrong size, got %d and expexted %d", len(row), indexLength)
 				return
 			}
-			for j, k := range indexes {
-				data[i][k] = row[j]
+			if updateRowValues(data[i], row, indexes) {
+				dataTable.setRowModified(i, now)
 			}
 		}
 		p.DataLock.Unlock()
@@ -1340,7 +1623,10 @@ func (p *Peer) UpdateObjectByType(table Table) (restartRequired bool, err error)
 		promPeerUpdatedServices.WithLabelValues(p.Name).Add(float64(len(res)))
 		break
 	case "status":
-		if p.StatusGet("ProgramStart") != data[0][table.ColumnsIndex["program_start"]] {
+		p.DataLock.RLock()
+		programStart := data[0][table.ColumnsIndex["program_start"]]
+		p.DataLock.RUnlock()
+		if p.StatusGet("ProgramStart") != programStart {
 			log.Infof("[%s] site has been restarted, recreating objects", p.Name)
 			restartRequired = true
 		}
@@ -1416,6 +1702,10 @@ func (p *Peer) GetVirtRowValue(col Column, row *[]interface{}, rowNum int, table
 	p.PeerLock.RUnlock()
 	if !ok {
 		value = p.GetVirtRowComputedValue(col, row, rowNum, table, refs, inputRowLen)
+		// computed values may be unknown, ex.: recent_state_changes
+		if value == nil {
+			return nil
+		}
 	}
 	colType := VirtKeyMap[col.Name].Type
 	switch colType {
@@ -1423,7 +1713,7 @@ func (p *Peer) GetVirtRowValue(col Column, row *[]interface{}, rowNum int, table
 		fallthrough
 	case FloatCol:
 		return numberToFloat(&value)
-	case StringCol:
+	case StringCol, StringListCol:
 		return value
 	case TimeCol:
 		val := value.(int64)
@@ -1459,6 +1749,37 @@ func (p *Peer) GetVirtRowComputedValue(col Column, row *[]interface{}, rowNum in
 			value = lastStateChange
 		}
 		break
+	case "groups":
+		// backends only list the members of contactgroups
+		value = p.contactGroups((*row)[table.ColumnsIndex["name"]])
+		break
+	case "lmd_queries_in_flight":
+		value = int(atomic.LoadInt64(&queriesInFlight))
+		break
+	case "lmd_time":
+		value = time.Now().Unix()
+		break
+	case "is_stale":
+		value = 0
+		if p.isStale() {
+			value = 1
+		}
+		break
+	case "lmd_stale_peers":
+		stale := 0
+		for _, peer := range DataStore {
+			if peer.isStale() {
+				stale++
+			}
+		}
+		value = stale
+		break
+	case "lmd_features":
+		value = featureList()
+		break
+	case "lmd_row_age":
+		value = int(atomic.LoadInt32(&p.rowAge))
+		break
 	case "state_order":
 		// return 4 instead of 2, which makes critical come first
 		// this way we can use this column to sort by state
@@ -1478,6 +1799,9 @@ func (p *Peer) GetVirtRowComputedValue(col Column, row *[]interface{}, rowNum in
 			value = 0
 		}
 		break
+	case "recent_state_changes":
+		value = recentStateChanges((*row)[table.ColumnsIndex["flap_detection_enabled"]], (*row)[table.ColumnsIndex["percent_state_change"]])
+		break
 	case "host_has_long_plugin_output":
 		// return 1 if there is long_plugin_output
 		val := p.GetRowValue(table.GetColumn("long_plugin_output").Index, row, rowNum, table, refs, inputRowLen).(string)
@@ -1494,21 +1818,41 @@ func (p *Peer) GetVirtRowComputedValue(col Column, row *[]interface{}, rowNum in
 	return
 }
 
+// flapHistoryChanges is the number of possible state changes within the state history used for
+// flap detection. The cores keep the last 21 states.
+const flapHistoryChanges = 20
+
+// recentStateChanges estimates the number of state changes within the flap detection history from
+// the percent_state_change. Since this is a weighted percentage of changes within this history, the
+// result is only an estimate and not the exact number of changes.
+// It returns nil if flap detection is disabled, because the history is not kept then.
+func recentStateChanges(flapDetectionEnabled interface{}, percentStateChange interface{}) interface{} {
+	if flapDetectionEnabled == nil || percentStateChange == nil || numberToFloat(&flapDetectionEnabled) == 0 {
+		return nil
+	}
+	return int(math.Floor(numberToFloat(&percentStateChange)*flapHistoryChanges/100 + 0.5))
+}
+
 // WaitCondition waits for a given condition.
 // It returns true if the wait timed out or false if the condition matched successfully.
-func (p *Peer) WaitCondition(req *Request) bool {
-	c := make(chan struct{})
+// If the condition matched but the following update did not finish in time, the
+// wait still counts as matched. Unsupported wait tables or objects return an error.
+func (p *Peer) WaitCondition(req *Request) (timedOut bool, err error) {
+	canceled := make(chan struct{})
+	finished := make(chan struct{})
+	var matched int32
+	var waitErr error
 	go func() {
 		// make sure we log panics properly
 		defer logPanicExit()
+		defer close(finished)
 
 		table := p.Tables[req.Table].Table
 		refs := p.Tables[req.Table].Refs
 		var lastUpdate int64
 		for {
 			select {
-			case <-c:
-				// canceled
+			case <-canceled:
 				return
 			default:
 			}
@@ -1517,7 +1861,6 @@ func (p *Peer) WaitCondition(req *Request) bool {
 				curUpdate := p.StatusGet("LastUpdate").(int64)
 				// wait up to WaitTimeout till the update is complete
 				if curUpdate > lastUpdate {
-					close(c)
 					return
 				}
 				time.Sleep(time.Millisecond * 200)
@@ -1528,11 +1871,11 @@ func (p *Peer) WaitCondition(req *Request) bool {
 			if req.Table == "hosts" || req.Table == "services" {
 				obj = p.Tables[req.Table].Index[req.WaitObject]
 			} else {
-				log.Errorf("unsupported wait table: %s", req.Table)
-				close(c)
+				waitErr = fmt.Errorf("bad request: unsupported wait table: %s", req.Table)
 				return
 			}
 			if p.MatchRowFilter(table, &refs, len(obj), &req.WaitCondition[0], &obj, 0) {
+				atomic.StoreInt32(&matched, 1)
 				// trigger update for all, wait conditions are run against the last object
 				// but multiple commands may have been sent
 				p.ScheduleImmediateUpdate()
@@ -1545,8 +1888,7 @@ func (p *Peer) WaitCondition(req *Request) bool {
 			} else if req.Table == "services" {
 				tmp := strings.SplitN(req.WaitObject, ";", 2)
 				if len(tmp) < 2 {
-					log.Errorf("unsupported service wait object: %s", req.WaitObject)
-					close(c)
+					waitErr = fmt.Errorf("bad request: unsupported service wait object: %s", req.WaitObject)
 					return
 				}
 				p.UpdateDeltaTableServices("Filter: host_name = " + tmp[0] + "\nFilter: description = " + tmp[1] + "\n")
@@ -1554,11 +1896,11 @@ func (p *Peer) WaitCondition(req *Request) bool {
 		}
 	}()
 	select {
-	case <-c:
-		return false // completed normally
+	case <-finished:
+		return false, waitErr // completed normally or failed early
 	case <-time.After(time.Duration(req.WaitTimeout) * time.Millisecond):
-		close(c)
-		return true // timed out
+		close(canceled)
+		return atomic.LoadInt32(&matched) == 0, nil
 	}
 }
 
@@ -1695,20 +2037,62 @@ func SpinUpPeers(peers []string) {
 	log.Debugf("spin up completed")
 }
 
+// freshDataTimeout sets how long requests with Consistency: fresh wait for updates.
+const freshDataTimeout = 5 * time.Second
+
+// RefreshPeers runs a delta update on all given peers and spins up idling peers.
+// It waits at most timeout for the updates, peers which take longer answer from their cached data.
+func RefreshPeers(peers []string, timeout time.Duration) {
+	waitgroup := &sync.WaitGroup{}
+	for _, id := range peers {
+		p := DataStore[id]
+		waitgroup.Add(1)
+		go func(peer *Peer, wg *sync.WaitGroup) {
+			// make sure we log panics properly
+			defer logPanicExit()
+
+			defer wg.Done()
+			if peer.StatusGet("Idling").(bool) {
+				peer.StatusSet("Idling", false)
+				log.Infof("[%s] switched back to normal update interval", peer.Name)
+			}
+			if !peer.isOnline() {
+				return
+			}
+			log.Debugf("[%s] refresh update", peer.Name)
+			peer.UpdateObjectByType(Objects.Tables["timeperiods"])
+			peer.UpdateDeltaTables()
+			log.Debugf("[%s] refresh update done", peer.Name)
+		}(p, waitgroup)
+	}
+	if waitTimeout(waitgroup, timeout) {
+		log.Debugf("refresh did not complete within %s, using cached data", timeout.String())
+	}
+}
+
 // BuildLocalResponseData returnss the result data for a given request
-func (p *Peer) BuildLocalResponseData(res *Response, indexes *[]int) (int, *[][]interface{}, *map[string][]Filter) {
+// It returns an error if this peer cannot provide any data.
+func (p *Peer) BuildLocalResponseData(res *Response, indexes *[]int) (int, *[][]interface{}, *map[string][]Filter, error) {
 	req := res.Request
 	numPerRow := len(*indexes)
 	log.Tracef("BuildLocalResponseData: %s", p.Name)
 	table := p.Tables[req.Table].Table
 	if table == nil || (!p.isOnline() && !table.Virtual) {
-		res.Failed[p.ID] = fmt.Sprintf("%v", p.StatusGet("LastError"))
-		return 0, nil, nil
+		return 0, nil, nil, fmt.Errorf("%v", p.StatusGet("LastError"))
 	}
 
 	// if a WaitTrigger is supplied, wait max ms till the condition is true
+	// the data is returned anyway, so on timeouts clients get the last known state
 	if req.WaitTrigger != "" {
-		p.WaitCondition(req)
+		timedOut, err := p.WaitCondition(req)
+		if err != nil {
+			// the condition has never been checked, so it must not be reported as matched
+			atomic.AddInt32(&res.waitTimeouts, 1)
+			return 0, nil, nil, err
+		}
+		if timedOut {
+			atomic.AddInt32(&res.waitTimeouts, 1)
+		}
 	}
 
 	p.DataLock.RLock()
@@ -1721,14 +2105,69 @@ func (p *Peer) BuildLocalResponseData(res *Response, indexes *[]int) (int, *[][]
 	}
 
 	if len(data) == 0 {
-		return 0, nil, nil
+		return 0, nil, nil, nil
+	}
+
+	// the configured peer filter restricts all queries
+	filter, err := p.scopedFilter(req.Table, req.Filter)
+	if err != nil {
+		return 0, nil, nil, err
 	}
 
 	if len(res.Request.Stats) > 0 {
-		return 0, nil, p.gatherStatsResult(res, table, &data, numPerRow, indexes)
+		return 0, nil, p.gatherStatsResult(res, table, &data, numPerRow, indexes, filter), nil
+	}
+	total, result := p.gatherResultRows(res, table, &data, numPerRow, indexes, filter)
+	return total, result, nil, nil
+}
+
+// contactGroups returns the names of all contactgroups the given contact is a member of.
+// The caller has to hold the DataLock.
+func (p *Peer) contactGroups(contact interface{}) []interface{} {
+	groups := make([]interface{}, 0)
+	dataTable, ok := p.Tables["contactgroups"]
+	if !ok || dataTable.Table == nil {
+		return groups
+	}
+	nameIndex := dataTable.Table.ColumnsIndex["name"]
+	membersIndex := dataTable.Table.ColumnsIndex["members"]
+	for _, row := range dataTable.Data {
+		members, ok := row[membersIndex].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, member := range members {
+			if member == contact {
+				groups = append(groups, row[nameIndex])
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// setRowAge sets the age of the data for the lmd_row_age column. Rows are as old as the
+// last successful update of their peer, so the age is only calculated once per query instead
+// of for each row. Concurrent queries may set a more recent age in between.
+func (p *Peer) setRowAge(now int64) {
+	age := now - p.StatusGet("LastUpdate").(int64)
+	if age < 0 {
+		age = 0
 	}
-	total, result := p.gatherResultRows(res, table, &data, numPerRow, indexes)
-	return total, result, nil
+	atomic.StoreInt32(&p.rowAge, int32(age))
+}
+
+// scopedFilter returns the given filter combined with the configured filter of this peer for a table.
+// The configured filter is parsed for each query, so relative durations are relative to the query time.
+func (p *Peer) scopedFilter(table string, filter []Filter) ([]Filter, error) {
+	if len(p.Config.Filter[table]) == 0 {
+		return filter, nil
+	}
+	scope, err := p.Config.ParseTableFilter(table)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %s", err.Error())
+	}
+	return append(scope, filter...), nil
 }
 
 // isOnline returns true if this peer is online and has data
@@ -1740,33 +2179,74 @@ func (p *Peer) isOnline() bool {
 	return false
 }
 
-func (p *Peer) gatherResultRows(res *Response, table *Table, data *[][]interface{}, numPerRow int, indexes *[]int) (int, *[][]interface{}) {
+func (p *Peer) gatherResultRows(res *Response, table *Table, data *[][]interface{}, numPerRow int, indexes *[]int, filter []Filter) (int, *[][]interface{}) {
 	req := res.Request
-	refs := p.Tables[req.Table].Refs
+	dataTable := p.Tables[req.Table]
+	refs := dataTable.Refs
 	inputRowLen := len((*data)[0])
 	result := make([][]interface{}, 0)
+	changedSince := int64(req.ChangedSince)
 
 	// if there is no sort header or sort by name only,
 	// we can drastically reduce the result set by applying the limit here already
 	limit := optimizeResultLimit(req, table)
 
+	// rows exceeding MaxRowsPerPeer will be dropped anyway
+	maxRows := peerRowLimit(0)
+
+	// facets are counted for all matching rows, regardless of the limit
+	facets, facetIndexes := newFacetCounts(req, table)
+
+	// with ApproxTotal, only a sample of the remaining rows is checked once the limit is reached
+	sampleStart := -1
+	sampleStride := 1
+
+	counts := newFilterCounts(req, filter)
+
 	found := 0
 Rows:
 	for j := range *data {
+		if j%cancelCheckInterval == 0 {
+			// stop early if the client went away
+			if req.canceler.IsCanceled() {
+				break
+			}
+			req.progressive.setPeerRows(p.ID, found)
+		}
+		if sampleStart >= 0 && (j-sampleStart)%sampleStride != 0 {
+			continue Rows
+		}
 		row := &((*data)[j])
+		// skip unchanged rows
+		if changedSince > 0 && !dataTable.isModifiedSince(j, changedSince) {
+			continue Rows
+		}
 		// does our filter match?
-		for i := range req.Filter {
-			f := &(req.Filter[i])
-			if !p.MatchRowFilter(table, &refs, inputRowLen, f, row, j) {
+		if counts != nil {
+			if !counts.match(p, table, &refs, inputRowLen, filter, row, j) {
 				continue Rows
 			}
+		} else {
+			for i := range filter {
+				f := &(filter[i])
+				if !p.MatchRowFilter(table, &refs, inputRowLen, f, row, j) {
+					continue Rows
+				}
+			}
+		}
+		// each sampled row represents sampleStride rows
+		found += sampleStride
+		for k, i := range facetIndexes {
+			facets[k].Add(p.GetRowValue(i, row, j, table, &refs, inputRowLen))
 		}
-		found++
 		// check if we have enough result rows already
 		// we still need to count how many result we would have...
 		if limit > 0 && found > limit {
 			continue Rows
 		}
+		if maxRows > 0 && len(result) >= maxRows {
+			continue Rows
+		}
 
 		// build result row
 		resRow := make([]interface{}, numPerRow)
@@ -1783,12 +2263,20 @@ Rows:
 					resRow[k] = (*row)[i]
 				}
 			}
-			// fill null values with something useful
-			if resRow[k] == nil {
+			// fill null values with something useful, virtual columns may be null
+			if resRow[k] == nil && i >= 0 {
 				resRow[k] = table.Columns[i].GetEmptyValue()
 			}
 		}
 		result = append(result, resRow)
+
+		if req.ApproxTotal && found == limit && len(facetIndexes) == 0 {
+			sampleStride = approxTotalStride(len(*data) - j - 1)
+			if sampleStride > 1 {
+				sampleStart = j + 1
+				atomic.AddInt32(&res.approxTotals, 1)
+			}
+		}
 	}
 
 	// sanitize broken custom var data from icinga2
@@ -1801,25 +2289,58 @@ Rows:
 		}
 	}
 
+	// apply output format directives, ex.: Columns: execution_time:round2
+	for j, f := range req.ColumnFormats {
+		for k := range result {
+			result[k][j] = f.Apply(result[k][j])
+		}
+	}
+
+	if facets != nil {
+		res.addFacets(facets)
+	}
+	if counts != nil {
+		res.addFilterCounts(counts)
+	}
+	req.progressive.setPeerRows(p.ID, found)
+
 	return found, &result
 }
 
-func (p *Peer) gatherStatsResult(res *Response, table *Table, data *[][]interface{}, numPerRow int, indexes *[]int) *map[string][]Filter {
+func (p *Peer) gatherStatsResult(res *Response, table *Table, data *[][]interface{}, numPerRow int, indexes *[]int, filter []Filter) *map[string][]Filter {
 	req := res.Request
-	refs := p.Tables[req.Table].Refs
+	dataTable := p.Tables[req.Table]
+	refs := dataTable.Refs
 	inputRowLen := len((*data)[0])
+	changedSince := int64(req.ChangedSince)
 
 	localStats := make(map[string][]Filter)
 
+	counts := newFilterCounts(req, filter)
+
 Rows:
 	for j := range *data {
+		// stop early if the client went away
+		if j%cancelCheckInterval == 0 && req.canceler.IsCanceled() {
+			break
+		}
 		row := &((*data)[j])
+		// skip unchanged rows
+		if changedSince > 0 && !dataTable.isModifiedSince(j, changedSince) {
+			continue Rows
+		}
 		// does our filter match?
-		for i := range req.Filter {
-			f := &(req.Filter[i])
-			if !p.MatchRowFilter(table, &refs, inputRowLen, f, row, j) {
+		if counts != nil {
+			if !counts.match(p, table, &refs, inputRowLen, filter, row, j) {
 				continue Rows
 			}
+		} else {
+			for i := range filter {
+				f := &(filter[i])
+				if !p.MatchRowFilter(table, &refs, inputRowLen, f, row, j) {
+					continue Rows
+				}
+			}
 		}
 
 		key := ""
@@ -1841,12 +2362,17 @@ Rows:
 					localStats[key][i].Stats++
 					localStats[key][i].StatsCount++
 				}
+			} else if s.StatsType == CountDistinct {
+				localStats[key][i].ApplyDistinct(p.GetRowValue(s.Column.Index, row, j, table, &refs, inputRowLen))
 			} else {
 				val := p.GetRowValue(s.Column.Index, row, j, table, &refs, inputRowLen)
 				localStats[key][i].ApplyValue(numberToFloat(&val), 1)
 			}
 		}
 	}
+	if counts != nil {
+		res.addFilterCounts(counts)
+	}
 
 	return &localStats
 }
@@ -1856,14 +2382,33 @@ func createLocalStatsCopy(stats *[]Filter) []Filter {
 	for i := range *stats {
 		s := (*stats)[i]
 		localStats[i].StatsType = s.StatsType
+		localStats[i].StatsPercentile = s.StatsPercentile
 		if s.StatsType == Min {
 			localStats[i].Stats = -1
 		}
+		if s.StatsSamples != nil {
+			localStats[i].StatsSamples = NewStatsSamples(s.StatsSamples.Approx)
+		}
+		if s.StatsDistinct != nil {
+			localStats[i].StatsDistinct = make(map[string]bool)
+		}
 	}
 	return localStats
 }
+
+// approxTotalStride returns the distance between sampled rows, so the remaining rows
+// can be estimated from at most approxTotalSamples rows.
+// It returns 1 if all remaining rows can be checked.
+func approxTotalStride(remaining int) int {
+	samples := int(atomic.LoadInt64(&approxTotalSamples))
+	if samples <= 0 || remaining <= samples {
+		return 1
+	}
+	return (remaining + samples - 1) / samples
+}
+
 func optimizeResultLimit(req *Request, table *Table) (limit int) {
-	if req.Limit > 0 && table.IsDefaultSortOrder(&req.Sort) {
+	if req.Limit > 0 && table.IsDefaultSortOrder(&req.Sort) && req.MergeDuplicates == MergeNone && req.PercentileFilter == nil && !req.Summary && len(req.FirstPerGroup) == 0 {
 		limit = req.Limit
 		if req.Offset > 0 {
 			limit += req.Offset
@@ -1877,13 +2422,20 @@ func (p *Peer) getStatsKey(columns []string, table *Table, refs *map[string][][]
 	for _, columnName := range columns {
 		index := table.ColumnsIndex[columnName]
 		value := p.GetRowValue(index, row, rowNum, table, refs, inputRowLen)
-		keyValues = append(keyValues, fmt.Sprintf("%s", value))
+		keyValues = append(keyValues, fmt.Sprintf("%v", value))
 	}
 	return strings.Join(keyValues, ";")
 }
 
 // MatchRowFilter returns true if the given filter matches the given datarow.
 func (p *Peer) MatchRowFilter(table *Table, refs *map[string][][]interface{}, inputRowLen int, filter *Filter, row *[]interface{}, rowNum int) bool {
+	if filter.Negate {
+		return !p.matchRowFilter(table, refs, inputRowLen, filter, row, rowNum)
+	}
+	return p.matchRowFilter(table, refs, inputRowLen, filter, row, rowNum)
+}
+
+func (p *Peer) matchRowFilter(table *Table, refs *map[string][][]interface{}, inputRowLen int, filter *Filter, row *[]interface{}, rowNum int) bool {
 	// recursive group filter
 	len := len(filter.Filter)
 	if len > 0 {
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestPeerSource(t *testing.T) {
@@ -44,3 +48,497 @@ func TestPeerHTTPComplete(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestPeerStatusColumn(t *testing.T) {
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", Source: []string{"test.sock"}}
+	peer := NewPeer(&Config{}, connection, waitGroup, shutdownChannel)
+
+	table := Objects.Tables["sites"]
+	col := table.GetColumn("status")
+	for _, status := range []PeerStatus{PeerStatusUp, PeerStatusWarning, PeerStatusDown, PeerStatusPending} {
+		peer.StatusSet("PeerStatus", status)
+
+		value := peer.GetVirtRowValue(col, nil, 0, &table, nil, 0)
+		if err := assertEq(float64(status), value); err != nil {
+			t.Error(err)
+		}
+
+		line := fmt.Sprintf("Filter: status = %d", status)
+		stack := []Filter{}
+		if err := ParseFilter(fmt.Sprintf("status = %d", status), &line, "sites", &stack); err != nil {
+			t.Fatal(err)
+		}
+		if err := assertEq(true, stack[0].MatchFilter(&value)); err != nil {
+			t.Errorf("%s: %s", line, err)
+		}
+
+		// raw status values from the status map must sort the same way
+		var raw interface{} = status
+		if err := assertEq(0, compareSortValues(IntCol, raw, value)); err != nil {
+			t.Error(err)
+		}
+		if err := assertEq(1, compareSortValues(IntCol, raw, -1)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPeerTruncatedResponse(t *testing.T) {
+	responses := []string{
+		// backend closes connection before sending all announced bytes
+		fmt.Sprintf("%d %11d\n%s", 200, 100, "[[\"host1\",0],[\"ho"),
+		// invalid json without fixed16 header
+		"[[\"host1\",0],[\"ho",
+		// valid json but no list of rows
+		"{\"data\":1}",
+		// valid json but row is no list
+		"[[\"host1\",0],\"host2\"]",
+	}
+	listen := "mocktruncated.sock"
+	os.Remove(listen)
+	l, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		l.Close()
+		os.Remove(listen)
+	}()
+	go func() {
+		for _, response := range responses {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ParseRequest(conn)
+			conn.Write([]byte(response))
+			conn.Close()
+		}
+	}()
+
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", Source: []string{listen}}
+	peer := NewPeer(&Config{NetTimeout: 5}, connection, waitGroup, shutdownChannel)
+
+	for i := range responses {
+		req := &Request{Table: "hosts", Columns: []string{"name", "state"}, OutputFormat: "json", ResponseFixed16: i == 0}
+		result, err := peer.Query(req)
+		if err == nil {
+			t.Errorf("expected error for response %d", i)
+		}
+		if err := assertEq(0, len(result)); err != nil {
+			t.Errorf("response %d: %s", i, err)
+		}
+	}
+
+	// rows with missing columns are detected as well
+	if err := assertEq("bad response: row 1 has 1 columns, expected 2", checkResultColumns([][]interface{}{{"host1", 0}, {"host2"}}, 2).Error()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeerUnsupportedTable(t *testing.T) {
+	listen := "mockunsupported.sock"
+	os.Remove(listen)
+	l, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		l.Close()
+		os.Remove(listen)
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ParseRequest(conn)
+			msg := "Invalid GET request, no such table 'x'\n"
+			conn.Write([]byte(fmt.Sprintf("%d %11d\n%s", 404, len(msg), msg)))
+			conn.Close()
+		}
+	}()
+
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", Source: []string{listen}}
+	peer := NewPeer(&Config{NetTimeout: 5}, connection, waitGroup, shutdownChannel)
+
+	// optional tables are marked as unsupported
+	table := Objects.Tables["downtimes"]
+	if _, err = peer.CreateObjectByType(&table); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, peer.isUnsupportedTable("downtimes")); err != nil {
+		t.Error(err)
+	}
+	if err = peer.UpdateDeltaCommentsOrDowntimes("downtimes"); err != nil {
+		t.Error(err)
+	}
+
+	// required tables still fail
+	table = Objects.Tables["hosts"]
+	if _, err = peer.CreateObjectByType(&table); err == nil {
+		t.Error("expected error for hosts table")
+	}
+	if err = assertEq(false, peer.isUnsupportedTable("hosts")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeerResultEncoding(t *testing.T) {
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	req := &Request{Table: "hosts"}
+
+	// latin1 is transcoded
+	connection := Connection{Name: "Test", Source: []string{"test.sock"}, Encoding: "latin1"}
+	peer := NewPeer(&Config{}, connection, waitGroup, shutdownChannel)
+	data := []byte("[[\"caf\xe9 \xb0C\"]]")
+	res, err := peer.parseResult(req, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("café °C", res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// invalid bytes are replaced if no encoding is set
+	connection = Connection{Name: "Test", Source: []string{"test.sock"}}
+	peer = NewPeer(&Config{}, connection, waitGroup, shutdownChannel)
+	data = []byte("[[\"ok \xff\xfe done\", \"ümlaut\"]]")
+	res, err = peer.parseResult(req, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("ok �� done", res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("ümlaut", res[0][1]); err != nil {
+		t.Error(err)
+	}
+
+	if err = assertEq([]byte("plain"), decodeResult([]byte("plain"), "latin1")); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(false, isSupportedEncoding("utf16")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeerSlowEviction(t *testing.T) {
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", Source: []string{"test.sock"}}
+	conf := &Config{SlowPeerThreshold: 2}
+	setDefaults(conf)
+	peer := NewPeer(conf, connection, waitGroup, shutdownChannel)
+
+	// evicted above threshold, recovers only below half of the threshold
+	for _, step := range []struct {
+		duration float64
+		evicted  bool
+	}{
+		{0.5, false},
+		{2.5, true},
+		{1.5, true},
+		{0.9, false},
+		{1.5, false},
+	} {
+		peer.PeerLock.Lock()
+		peer.setResponseTime(step.duration)
+		peer.PeerLock.Unlock()
+		if err := assertEq(step.evicted, peer.StatusGet("Evicted")); err != nil {
+			t.Errorf("response time %.1f: %s", step.duration, err)
+		}
+	}
+}
+
+func TestPeerSlowEvictionResponse(t *testing.T) {
+	peer := StartTestPeerExtra(3, 10, 10, "SlowPeerThreshold = 1.0\n")
+	PauseTestPeers(peer)
+
+	slow := DataStore["mockid1"]
+	slow.PeerLock.Lock()
+	slow.setResponseTime(3.0)
+	slow.PeerLock.Unlock()
+
+	res, err := peer.QueryString("GET sites\nColumns: peer_key evicted\nSort: peer_key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"mockid0", 0.0}, {"mockid1", 1.0}, {"mockid2", 0.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	response := &Response{Request: &Request{}, Failed: make(map[string]string)}
+	used := response.skipEvictedPeers([]string{"mockid0", "mockid1", "mockid2"})
+	if err = assertEq([]string{"mockid0", "mockid2"}, used); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("skipped: slow response time", response.Failed["mockid1"]); err != nil {
+		t.Error(err)
+	}
+
+	// explicitly requested backends are always used
+	response = &Response{Request: &Request{Backends: []string{"mockid1"}}, Failed: make(map[string]string)}
+	used = response.skipEvictedPeers([]string{"mockid1"})
+	if err = assertEq([]string{"mockid1"}, used); err != nil {
+		t.Error(err)
+	}
+
+	// slow peers are still used if there is nothing else left
+	response = &Response{Request: &Request{}, Failed: make(map[string]string)}
+	used = response.skipEvictedPeers([]string{"mockid1"})
+	if err = assertEq([]string{"mockid1"}, used); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerConsistentDeltaUpdate(t *testing.T) {
+	peer := StartTestPeer(1, 10, 50)
+	PauseTestPeers(peer)
+
+	p := DataStore["mockid0"]
+	hosts := Objects.Tables["hosts"]
+	services := Objects.Tables["services"]
+
+	// deltaRows builds delta update rows for all objects of a table with the given state
+	deltaRows := func(table *Table, state float64) deltaUpdate {
+		keys, dynamicIndexes := table.GetDynamicColumns(p.Flags)
+		p.DataLock.RLock()
+		defer p.DataLock.RUnlock()
+		data := p.Tables[table.Name].Data
+		// the mock data does not contain the most recent columns, so only update the available ones
+		indexes := []int{}
+		stateIndex := -1
+		for k, i := range dynamicIndexes {
+			if i >= len(data[0]) {
+				continue
+			}
+			if keys[k] == "state" {
+				stateIndex = len(indexes)
+			}
+			indexes = append(indexes, i)
+		}
+		u := deltaUpdate{table: table, indexes: indexes}
+		for _, row := range data {
+			resRow := make([]interface{}, 0, len(indexes)+2)
+			for _, i := range indexes {
+				resRow = append(resRow, row[i])
+			}
+			resRow[stateIndex] = state
+			for _, key := range rowIndexColumns[table.Name] {
+				resRow = append(resRow, row[table.ColumnsIndex[key]])
+			}
+			u.rows = append(u.rows, resRow)
+		}
+		return u
+	}
+
+	// hosts and services always change their state together
+	p.applyDeltaUpdates([]deltaUpdate{deltaRows(&hosts, 0), deltaRows(&services, 0)})
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			state := float64(i % 2)
+			p.applyDeltaUpdates([]deltaUpdate{deltaRows(&hosts, state), deltaRows(&services, state)})
+		}
+		close(done)
+	}()
+
+	queries := 0
+	for finished := false; !finished; queries++ {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		res, err := peer.QueryString("GET services\nColumns: host_state state\nConsistency: cached\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(40, len(res)); err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range res {
+			if row[0] != res[0][0] || row[1] != res[0][0] {
+				t.Fatalf("query %d returned a partial update: %v", queries, res)
+			}
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerFilter(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	connection := Connection{Filter: map[string][]string{
+		"hosts": {"name ~ ^testhost_[12]$"},
+		"log":   {"host_name ~ ^testhost_[12]$"},
+	}}
+	if _, err := connection.ParseFilters(); err != nil {
+		t.Fatal(err)
+	}
+	scoped := DataStore["mockid0"]
+	scoped.Config.Filter = connection.Filter
+	defer func() { scoped.Config.Filter = nil }()
+
+	// the first backend only exposes two hosts
+	res, err := peer.QueryString("GET hosts\nColumns: name\nFilter: peer_key = mockid0\nSort: name asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"testhost_1"}, {"testhost_2"}}, res); err != nil {
+		t.Error(err)
+	}
+	res, err = peer.QueryString("GET hosts\nColumns: name\nFilter: peer_key = mockid1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// client filters are combined with the peer filter
+	for name, expect := range map[string]int{"testhost_1": 2, "testhost_3": 1} {
+		res, err = peer.QueryString("GET hosts\nColumns: name\nFilter: name = " + name + "\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(expect, len(res)); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	// stats are scoped as well
+	res, err = peer.QueryString("GET hosts\nStats: state >= 0\nFilter: peer_key = mockid0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// passthrough queries send the peer filter to the backend
+	filter, err := scoped.scopedFilter("log", []Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Table: "log", Filter: filter}
+	if err = assertLike("Filter: host_name ~ \\^testhost_\\[12\\]\\$\n", req.String()); err != nil {
+		t.Error(err)
+	}
+
+	// relative durations are relative to the query time
+	scoped.Config.Filter = map[string][]string{"hosts": {"last_check > 1h"}}
+	start := time.Now().Unix()
+	filter, err = scoped.scopedFilter("hosts", []Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter[0].FloatValue < float64(start-3600) {
+		t.Errorf("connection filter uses stale timestamp %f, expected at least %d", filter[0].FloatValue, start-3600)
+	}
+
+	// invalid filters are rejected
+	for table, expect := range map[string]string{
+		"nosuchtable": "table nosuchtable does not exist",
+		"backends":    "filters are not supported for table backends",
+		"hosts":       "bad request: unrecognized column from filter: none in Filter: none = 1",
+	} {
+		connection = Connection{Filter: map[string][]string{table: {"none = 1"}}}
+		_, err = connection.ParseFilters()
+		if err = assertEq(expect, fmt.Sprintf("%v", err)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerRecentStateChanges(t *testing.T) {
+	tests := []struct {
+		flapDetection interface{}
+		percent       interface{}
+		expect        interface{}
+	}{
+		{1.0, 0.0, 0},
+		{1.0, 25.0, 5},
+		{1.0, 12.6, 3},
+		{1, 100.0, 20},
+		{0.0, 25.0, nil},
+		{nil, 25.0, nil},
+		{1.0, nil, nil},
+	}
+	for _, test := range tests {
+		if err := assertEq(test.expect, recentStateChanges(test.flapDetection, test.percent)); err != nil {
+			t.Errorf("%v / %v: %s", test.flapDetection, test.percent, err)
+		}
+	}
+
+	peer := StartTestPeer(1, 10, 20)
+	PauseTestPeers(peer)
+
+	// change the flap detection data of the first two hosts and services
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	for _, name := range []string{"hosts", "services"} {
+		table := p.Tables[name]
+		flapIndex := table.Table.ColumnsIndex["flap_detection_enabled"]
+		percentIndex := table.Table.ColumnsIndex["percent_state_change"]
+		table.Data[0][flapIndex] = 1.0
+		table.Data[0][percentIndex] = 25.0
+		table.Data[1][flapIndex] = 0.0
+		table.Data[1][percentIndex] = 25.0
+	}
+	p.DataLock.Unlock()
+
+	for _, name := range []string{"hosts", "services"} {
+		res, err := peer.QueryString("GET " + name + "\nColumns: recent_state_changes\nLimit: 2\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq([][]interface{}{{5.0}, {nil}}, res); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestPeerResponseHeaderSize(t *testing.T) {
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", Source: []string{"test.sock"}}
+	peer := NewPeer(&Config{}, connection, waitGroup, shutdownChannel)
+
+	resBytes := []byte(fmt.Sprintf("%d %11d\n%s", 200, 3, "[]\n"))
+	if err := peer.CheckResponseHeader(&resBytes); err != nil {
+		t.Error(err)
+	}
+
+	// sizes beyond 32-bit integers must not overflow
+	resBytes = []byte(fmt.Sprintf("%d %11d\n%s", 200, maxFixed16Size, "[]\n"))
+	err := peer.CheckResponseHeader(&resBytes)
+	if err = assertEq("[Test] bad response size, expected 99999999999, got 3", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+}
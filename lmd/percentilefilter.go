@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PercentileFilter keeps only the rows whose value of a numeric column is within the top or
+// bottom percentile band of all matching rows, ex.: PercentileFilter: execution_time 95 top
+type PercentileFilter struct {
+	Column     string
+	Percentile float64
+	Top        bool
+	index      int // position of the column in the result rows
+}
+
+func parsePercentileFilter(field **PercentileFilter, value string) (err error) {
+	tmp := strings.Fields(value)
+	if len(tmp) != 3 {
+		return errors.New("bad request: percentile filter must be PercentileFilter: <column> <percentile> <top|bottom>")
+	}
+	percentile, err := strconv.ParseFloat(tmp[1], 64)
+	if err != nil || percentile < 0 || percentile > 100 {
+		return errors.New("bad request: percentile must be between 0 and 100 in PercentileFilter: " + value)
+	}
+	pf := &PercentileFilter{Column: strings.ToLower(tmp[0]), Percentile: percentile}
+	switch strings.ToLower(tmp[2]) {
+	case "top":
+		pf.Top = true
+	case "bottom":
+	default:
+		return errors.New("bad request: unrecognized percentile filter direction, only top and bottom are supported")
+	}
+	*field = pf
+	return nil
+}
+
+// String returns the filter as used in the PercentileFilter header.
+func (pf *PercentileFilter) String() string {
+	direction := "bottom"
+	if pf.Top {
+		direction = "top"
+	}
+	return fmt.Sprintf("%s %s %s", pf.Column, strconv.FormatFloat(pf.Percentile, 'f', -1, 64), direction)
+}
+
+// validatePercentileFilter checks that the column is a numeric column of the result and stores its position.
+func (req *Request) validatePercentileFilter(table *Table, requestColumnsMap map[string]int, columns []Column) error {
+	pf := req.PercentileFilter
+	switch {
+	case len(req.Stats) > 0:
+		return errors.New("bad request: PercentileFilter cannot be used with stats queries")
+	case table.PassthroughOnly:
+		return fmt.Errorf("bad request: PercentileFilter is not supported for table %s", req.Table)
+	}
+	i, ok := requestColumnsMap[pf.Column]
+	if !ok {
+		return fmt.Errorf("bad request: column %s is required for PercentileFilter", pf.Column)
+	}
+	switch columns[i].Type {
+	case IntCol, FloatCol, TimeCol:
+	default:
+		return fmt.Errorf("bad request: column %s cannot be used for PercentileFilter, only number and time columns are supported", pf.Column)
+	}
+	pf.index = i
+	return nil
+}
+
+// ApplyPercentileFilter removes all rows outside of the percentile band. The threshold is
+// interpolated between the closest ranks like the percentile stats. Rows equal to the threshold
+// are kept, so all rows tied at the boundary are included.
+func (res *Response) ApplyPercentileFilter() {
+	pf := res.Request.PercentileFilter
+	if len(res.Result) == 0 {
+		return
+	}
+	samples := &StatsSamples{Values: make([]float64, len(res.Result))}
+	for i := range res.Result {
+		samples.Values[i] = numberToFloat(&(res.Result[i][pf.index]))
+	}
+	threshold := samples.Percentile(pf.Percentile)
+	result := make([][]interface{}, 0)
+	for i, row := range res.Result {
+		value := samples.Values[i]
+		if (pf.Top && value >= threshold) || (!pf.Top && value <= threshold) {
+			result = append(result, row)
+		}
+	}
+	res.Result = result
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPercentileFilter(t *testing.T) {
+	columns := []Column{
+		{Name: "name", Type: StringCol},
+		{Name: "execution_time", Type: FloatCol},
+	}
+	rows := func(values ...float64) [][]interface{} {
+		result := make([][]interface{}, len(values))
+		for i, val := range values {
+			result[i] = []interface{}{fmt.Sprintf("svc%d", i), val}
+		}
+		return result
+	}
+	uniform := make([]float64, 100)
+	for i := range uniform {
+		uniform[i] = float64(100 - i)
+	}
+
+	tests := []struct {
+		filter PercentileFilter
+		values []float64
+		expect []float64
+	}{
+		// threshold 95.05, interpolated between 95 and 96
+		{PercentileFilter{Percentile: 95, Top: true, index: 1}, uniform, []float64{100, 99, 98, 97, 96}},
+		// threshold 10.9, interpolated between 10 and 11
+		{PercentileFilter{Percentile: 10, Top: false, index: 1}, uniform, []float64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}},
+		// threshold 1.9, interpolated between 1 and 2
+		{PercentileFilter{Percentile: 10, Top: false, index: 1}, uniform[90:], []float64{1}},
+		// all rows tied at the boundary are kept
+		{PercentileFilter{Percentile: 50, Top: true, index: 1}, []float64{1, 3, 2, 3, 5, 3, 4, 3}, []float64{3, 3, 5, 3, 4, 3}},
+		{PercentileFilter{Percentile: 50, Top: false, index: 1}, []float64{1, 3, 2, 3, 5, 3, 4, 3}, []float64{1, 3, 2, 3, 3, 3}},
+		{PercentileFilter{Percentile: 100, Top: true, index: 1}, []float64{1, 2, 2}, []float64{2, 2}},
+		{PercentileFilter{Percentile: 0, Top: true, index: 1}, []float64{1, 2, 2}, []float64{1, 2, 2}},
+		{PercentileFilter{Percentile: 99, Top: true, index: 1}, []float64{7}, []float64{7}},
+		{PercentileFilter{Percentile: 99, Top: true, index: 1}, []float64{}, []float64{}},
+	}
+	for _, test := range tests {
+		filter := test.filter
+		res := Response{Request: &Request{PercentileFilter: &filter}, Columns: columns, Result: rows(test.values...)}
+		res.ApplyPercentileFilter()
+		values := make([]float64, 0)
+		for _, row := range res.Result {
+			values = append(values, row[1].(float64))
+		}
+		if err := assertEq(test.expect, values); err != nil {
+			t.Errorf("%s of %v: %s", filter.String(), test.values, err)
+		}
+	}
+}
+
+func TestPercentileFilterRequest(t *testing.T) {
+	peer := StartTestPeer(2, 20, 20)
+	PauseTestPeers(peer)
+
+	all, err := peer.QueryString("GET hosts\nColumns: name latency\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := NewStatsSamples(false)
+	for _, row := range all {
+		samples.Add(numberToFloat(&row[1]))
+	}
+	threshold := samples.Percentile(75)
+	expect := 0
+	for _, row := range all {
+		if numberToFloat(&row[1]) >= threshold {
+			expect++
+		}
+	}
+
+	getResponse := func(query string) *Response {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := getResponse("GET hosts\nColumns: name latency\nPercentileFilter: latency 75 top\nSort: latency desc\n\n")
+	if err = assertEq(expect, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	for _, row := range res.Result {
+		if numberToFloat(&row[1]) < threshold {
+			t.Errorf("%s: latency %v is below the threshold %v", row[0], row[1], threshold)
+		}
+	}
+
+	// the band is calculated before the limit is applied
+	res = getResponse("GET hosts\nColumns: name latency\nPercentileFilter: latency 75 top\nLimit: 2\n\n")
+	if err = assertEq(2, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(expect, res.ResultTotal); err != nil {
+		t.Error(err)
+	}
+
+	for _, test := range []struct {
+		query string
+		err   string
+	}{
+		{"GET hosts\nColumns: name\nPercentileFilter: latency 95 top\n\n", "bad request: column latency is required for PercentileFilter"},
+		{"GET hosts\nColumns: name\nPercentileFilter: name 95 top\n\n", "bad request: column name cannot be used for PercentileFilter, only number and time columns are supported"},
+		{"GET hosts\nColumns: state\nStats: avg latency\nPercentileFilter: latency 95 top\n\n", "bad request: PercentileFilter cannot be used with stats queries"},
+		{"GET log\nColumns: time\nFilter: time > 0\nPercentileFilter: time 95 top\n\n", "bad request: PercentileFilter is not supported for table log"},
+	} {
+		_, err = peer.QueryString(test.query)
+		if err == nil {
+			t.Errorf("expected error for %s", test.query)
+			continue
+		}
+		if err = assertEq(test.err, err.Error()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// progressInterval sets how often progress lines are sent for requests with Progress: on.
+var progressInterval = 1 * time.Second
+
+// ProgressLine is sent periodically between the result rows in progressive mode with Progress: on.
+// It contains the seconds since the collection started, the number of rows collected so far
+// for each peer and the peers which have finished, ex.:
+// {"progress":{"elapsed":2.001,"rows":{"id1":1000,"id2":35},"done":["id2"]}}
+type ProgressLine struct {
+	Progress ProgressInfo `json:"progress"`
+}
+
+// ProgressInfo contains the progress of all peers of a request.
+type ProgressInfo struct {
+	Elapsed float64        `json:"elapsed"`
+	Rows    map[string]int `json:"rows"`
+	Done    []string       `json:"done"`
+}
+
+// progressCounter counts the rows collected by each peer.
+type progressCounter struct {
+	lock    sync.Mutex
+	start   time.Time
+	rows    map[string]int
+	done    map[string]bool
+	stop    chan bool
+	stopped chan bool
+}
+
+// StartProgress sends progress lines until StopProgress is called.
+func (pw *ProgressiveWriter) StartProgress() {
+	pc := &progressCounter{
+		start:   time.Now(),
+		rows:    make(map[string]int),
+		done:    make(map[string]bool),
+		stop:    make(chan bool),
+		stopped: make(chan bool),
+	}
+	pw.progress = pc
+	go func() {
+		// make sure we log panics properly
+		defer logPanicExit()
+		defer close(pc.stopped)
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pc.stop:
+				return
+			case <-pw.request.canceler.Done():
+				return
+			case <-ticker.C:
+				pw.writeProgress()
+			}
+		}
+	}()
+}
+
+// StopProgress stops sending progress lines and waits until the last line has been written.
+func (pw *ProgressiveWriter) StopProgress() {
+	if pw == nil || pw.progress == nil {
+		return
+	}
+	close(pw.progress.stop)
+	<-pw.progress.stopped
+}
+
+// setPeerRows sets the number of rows collected so far by the peer.
+func (pw *ProgressiveWriter) setPeerRows(id string, rows int) {
+	if pw == nil || pw.progress == nil {
+		return
+	}
+	pw.progress.lock.Lock()
+	pw.progress.rows[id] = rows
+	pw.progress.lock.Unlock()
+}
+
+// peerDone marks the peer as finished, regardless of wether it succeeded or failed.
+func (pw *ProgressiveWriter) peerDone(id string) {
+	if pw == nil || pw.progress == nil {
+		return
+	}
+	pw.progress.lock.Lock()
+	if _, ok := pw.progress.rows[id]; !ok {
+		pw.progress.rows[id] = 0
+	}
+	pw.progress.done[id] = true
+	pw.progress.lock.Unlock()
+}
+
+// writeProgress sends the current progress as a single line.
+func (pw *ProgressiveWriter) writeProgress() {
+	pc := pw.progress
+	pc.lock.Lock()
+	info := ProgressInfo{
+		Elapsed: float64(time.Since(pc.start).Nanoseconds()/int64(time.Millisecond)) / 1000,
+		Rows:    make(map[string]int, len(pc.rows)),
+		Done:    make([]string, 0, len(pc.done)),
+	}
+	for id, rows := range pc.rows {
+		info.Rows[id] = rows
+	}
+	for id := range pc.done {
+		info.Done = append(info.Done, id)
+	}
+	pc.lock.Unlock()
+	sort.Strings(info.Done)
+
+	line, err := json.Marshal(ProgressLine{Progress: info})
+	if err != nil {
+		log.Errorf("json error: %s in progress: %v", err.Error(), info)
+		return
+	}
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	pw.write(append(line, '\n'))
+}
@@ -35,6 +35,22 @@ var (
 		},
 		[]string{"listen"},
 	)
+	promFrontendQueriesInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "queries_in_flight",
+			Help:      "Number of Frontend Queries currently in Progress",
+		},
+	)
+	promFrontendQueriesRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: NAME,
+			Subsystem: "frontend",
+			Name:      "rejected_queries",
+			Help:      "Frontend Queries Rejected because of too many Queries in Progress",
+		},
+	)
 
 	promPeerUpdateInterval = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -157,6 +173,8 @@ func initPrometheus(LocalConfig *Config) (prometheusListener net.Listener) {
 	prometheus.Register(promFrontendConnections)
 	prometheus.Register(promFrontendBytesSend)
 	prometheus.Register(promFrontendBytesReceived)
+	prometheus.Register(promFrontendQueriesInFlight)
+	prometheus.Register(promFrontendQueriesRejected)
 	prometheus.Register(promPeerUpdateInterval)
 	prometheus.Register(promPeerConnections)
 	prometheus.Register(promPeerFailedConnections)
@@ -5,22 +5,31 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/kdar/factorlog"
 )
 
 // Request defines a livestatus request object.
 type Request struct {
 	Table             string
 	Command           string
+	Noop              bool
 	Columns           []string
+	ColumnFormats     map[int]*ColumnFormat
+	ColumnAliases     map[int]string
+	HiddenColumns     map[int]bool // columns used for sorting or grouping only, removed from the output
 	Filter            []Filter
 	FilterStr         string
+	savedFilters      []Filter // filters from SavedFilter headers, added to Filter once the request is parsed
 	Stats             []Filter
 	StatsResult       map[string][]Filter
 	Limit             int
@@ -37,6 +46,52 @@ type Request struct {
 	WaitCondition     []Filter
 	WaitObject        string
 	KeepAlive         bool
+	IfNoneMatch       string
+	SendETag          bool
+	SendPeerCounts    bool
+	SendPeerBytes     bool
+	SendPeerStats     bool
+	peerBytes         *PeerBytes
+	MergeDuplicates   MergePolicy
+	MergeKeep         bool // keep a single row of duplicates instead of merging them
+	ChangedSince      int
+	StatsApprox       bool
+	Progressive       bool
+	progressive       *ProgressiveWriter
+	canceler          *Canceler
+	AuthUser          string
+	AuthGroups        []string
+	ShowFilter        bool
+	Facets            []string
+	NullValue         string
+	PeerOrder         string
+	StatsGroups       []string
+	MultiQuery        []*SubRequest
+	ApproxTotal       bool
+	Consistency       string
+	MapStates         bool
+	MapBooleans       bool
+	Explain           bool
+	Summary           bool
+	ShowLimit         bool
+	NoSpinUp          bool
+	IncludeNever      bool
+	FloatPrecision    *ColumnFormat // rounds all float columns, nil keeps the full precision
+	DuplicateColumns  string
+	TimeFormat        string
+	Availability      *AvailabilityRange
+	SplitBy           string
+	splitIndex        int
+	FirstPerGroup     []string
+	groupIndexes      []int
+	LogLevel          string
+	requestLogger     *factorlog.FactorLog // raised log level from the LogLevel header, nil uses the global logger
+	CaptureRaw        bool
+	rawCapture        *RawCapture
+	terminated        bool // request has been terminated by a blank line
+	FilterStats       bool
+	Progress          bool
+	PercentileFilter  *PercentileFilter
 }
 
 // SortDirection can be either Asc or Desc
@@ -62,12 +117,123 @@ func (s *SortDirection) String() string {
 	return ""
 }
 
+// SortTransform defines an optional transformation applied to values before sorting.
+type SortTransform int
+
+// Numeric columns can be sorted by their absolute value, ex.: Sort: latency:abs asc
+const (
+	SortTransformNone SortTransform = iota
+	SortTransformAbs
+)
+
+// String converts a SortTransform back to the original string.
+func (t *SortTransform) String() string {
+	switch *t {
+	case SortTransformNone:
+		return ""
+	case SortTransformAbs:
+		return "abs"
+	}
+	log.Panicf("not implemented")
+	return ""
+}
+
+// MergePolicy defines how duplicate objects from different backends will be merged.
+type MergePolicy int
+
+// Duplicate hosts and services can either be merged by using the worst state, by
+// using the most recent check result or by using the row of the most preferred
+// backend, ex.: MergeDuplicates: worst
+const (
+	MergeNone MergePolicy = iota
+	MergeWorst
+	MergeLatest
+	MergePreferred
+)
+
+// String converts a MergePolicy back to the original string.
+func (m *MergePolicy) String() string {
+	switch *m {
+	case MergeNone:
+		return ""
+	case MergeWorst:
+		return "worst"
+	case MergeLatest:
+		return "latest"
+	case MergePreferred:
+		return "preferred"
+	}
+	log.Panicf("not implemented")
+	return ""
+}
+
 // SortField defines a single sort entry
 type SortField struct {
 	Name      string
 	Direction SortDirection
 	Index     int
 	Args      string
+	Transform SortTransform
+}
+
+// ColumnFormatType defines how a column value will be formatted in the output.
+type ColumnFormatType int
+
+// Numeric columns can be rounded and string columns can be truncated.
+const (
+	_ ColumnFormatType = iota
+	FormatRound
+	FormatTruncate
+)
+
+// ColumnFormat defines a single output format directive, ex.: Columns: execution_time:round2
+type ColumnFormat struct {
+	Type   ColumnFormatType
+	Length int
+}
+
+// String converts a ColumnFormat back to the original string.
+func (f *ColumnFormat) String() string {
+	switch f.Type {
+	case FormatRound:
+		return fmt.Sprintf("round%d", f.Length)
+	case FormatTruncate:
+		return fmt.Sprintf("trunc%d", f.Length)
+	}
+	log.Panicf("not implemented")
+	return ""
+}
+
+// IsSupported returns true if this format can be applied to columns of the given type.
+func (f *ColumnFormat) IsSupported(colType ColumnType) bool {
+	switch f.Type {
+	case FormatRound:
+		return colType == FloatCol || colType == IntCol
+	case FormatTruncate:
+		return colType == StringCol
+	}
+	return false
+}
+
+// Apply returns the formatted value.
+func (f *ColumnFormat) Apply(value interface{}) interface{} {
+	switch f.Type {
+	case FormatRound:
+		val := numberToFloat(&value)
+		pow := math.Pow(10, float64(f.Length))
+		if val < 0 {
+			return -math.Floor(-val*pow+0.5) / pow
+		}
+		return math.Floor(val*pow+0.5) / pow
+	case FormatTruncate:
+		if str, ok := value.(string); ok {
+			runes := []rune(str)
+			if len(runes) > f.Length {
+				return string(runes[0:f.Length])
+			}
+		}
+	}
+	return value
 }
 
 // GroupOperator is the operator used to combine multiple filter or stats header.
@@ -92,8 +258,69 @@ func (op *GroupOperator) String() string {
 	return ""
 }
 
-var reRequestAction = regexp.MustCompile(`^GET ([a-z]+)$`)
+var reRequestAction = regexp.MustCompile(`^GET ([a-zA-Z]+)$`)
 var reRequestCommand = regexp.MustCompile(`^COMMAND (\[\d+\].*)$`)
+var reColumnFormat = regexp.MustCompile(`^(round|trunc)(\d+)$`)
+
+// SearchColumns contains the columns used by the Search header for each table.
+var SearchColumns = map[string][]string{
+	"hosts":    {"name", "alias", "display_name"},
+	"services": {"host_name", "description", "display_name"},
+}
+
+// queriesInFlight contains the number of requests currently being processed.
+var queriesInFlight int64
+
+// maxQueriesInFlight sets the maximum number of parallel requests, 0 means unlimited.
+var maxQueriesInFlight int64
+
+// maxRequestLineLength sets the maximum number of bytes of a single request line.
+var maxRequestLineLength int64 = 1048576
+
+// handling of requests which are not terminated by a blank line, see IncompleteRequests config option
+const (
+	incompleteRequestsAccept int64 = iota
+	incompleteRequestsError
+	incompleteRequestsClose
+)
+
+// incompleteRequests sets how requests are handled if the connection is closed before the terminating blank line.
+var incompleteRequests = incompleteRequestsAccept
+
+// errIncompleteRequest is returned if the connection is closed before the blank line which terminates a request.
+var errIncompleteRequest = errors.New("bad request: incomplete request, connection closed before the blank line terminating the request")
+
+// SetIncompleteRequests sets the handling of requests without terminating blank line by name.
+// accept runs them anyway, error returns a bad request and close closes the connection quietly.
+// It returns an error if the name is unknown.
+func SetIncompleteRequests(name string) error {
+	switch name {
+	case "", "accept":
+		atomic.StoreInt64(&incompleteRequests, incompleteRequestsAccept)
+	case "error":
+		atomic.StoreInt64(&incompleteRequests, incompleteRequestsError)
+	case "close":
+		atomic.StoreInt64(&incompleteRequests, incompleteRequestsClose)
+	default:
+		return fmt.Errorf("unknown value %s, only accept, error and close are supported", name)
+	}
+	return nil
+}
+
+// errServerBusy is returned if there are too many requests in progress already.
+var errServerBusy = errors.New("server busy: too many queries in progress, please retry later")
+
+// errNoBackends is returned if there are no backends configured at all.
+var errNoBackends = errors.New("no backends configured: add at least one [[Connections]] entry to the lmd.ini")
+
+// UnsupportedTableError is returned if the table exists, but none of the selected backends provides it.
+type UnsupportedTableError struct {
+	Table string
+}
+
+func (e *UnsupportedTableError) Error() string {
+	return fmt.Sprintf("not found: table %s is not supported by any of the selected backends", e.Table)
+}
 
 // ParseRequest reads from a connection and returns a single requests.
 // It returns a the requests and any errors encountered.
@@ -106,8 +333,9 @@ func ParseRequest(c net.Conn) (req *Request, err error) {
 }
 
 // ParseRequests reads from a connection and returns all requests read.
+// Requests without OutputFormat header use the given default format.
 // It returns a list of requests and any errors encountered.
-func ParseRequests(c net.Conn) (reqs []*Request, err error) {
+func ParseRequests(c net.Conn, defaultOutputFormat string) (reqs []*Request, err error) {
 	b := bufio.NewReader(c)
 	localAddr := c.LocalAddr().String()
 	for {
@@ -119,6 +347,12 @@ func ParseRequests(c net.Conn) (reqs []*Request, err error) {
 		if req == nil {
 			break
 		}
+		if !req.terminated && atomic.LoadInt64(&incompleteRequests) != incompleteRequestsAccept {
+			return nil, errIncompleteRequest
+		}
+		if req.OutputFormat == "" {
+			req.OutputFormat = defaultOutputFormat
+		}
 		err = req.ExpandRequestedBackends()
 		if err != nil {
 			return nil, err
@@ -139,6 +373,27 @@ func (req *Request) String() (str string) {
 		str = req.Command + "\n\n"
 		return
 	}
+	if req.Noop {
+		str = "NOOP\n"
+		if req.ResponseFixed16 {
+			str += "ResponseHeader: fixed16\n"
+		}
+		str += "\n"
+		return
+	}
+	if req.MultiQuery != nil {
+		str = fmt.Sprintf("MULTIQUERY %d\n", len(req.MultiQuery))
+		if req.ResponseFixed16 {
+			str += "ResponseHeader: fixed16\n"
+		}
+		str += "\n"
+		for _, sub := range req.MultiQuery {
+			if sub.Request != nil {
+				str += sub.Request.String()
+			}
+		}
+		return
+	}
 	str = "GET " + req.Table + "\n"
 	if req.ResponseFixed16 {
 		str += "ResponseHeader: fixed16\n"
@@ -147,7 +402,11 @@ func (req *Request) String() (str string) {
 		str += "OutputFormat: " + req.OutputFormat + "\n"
 	}
 	if len(req.Columns) > 0 {
-		str += "Columns: " + strings.Join(req.Columns, " ") + "\n"
+		str += "Columns: " + strings.Join(req.columnsWithOptions(true), " ") + "\n"
+	}
+	// stats queries without columns have a header row as well
+	if req.SendColumnsHeader {
+		str += "ColumnHeaders: on\n"
 	}
 	if len(req.Backends) > 0 {
 		str += "Backends: " + strings.Join(req.Backends, " ") + "\n"
@@ -167,6 +426,9 @@ func (req *Request) String() (str string) {
 	for _, s := range req.Stats {
 		str += s.String("Stats")
 	}
+	if req.StatsApprox {
+		str += "StatsApprox: on\n"
+	}
 	if req.WaitTrigger != "" {
 		str += fmt.Sprintf("WaitTrigger: %s\n", req.WaitTrigger)
 		str += fmt.Sprintf("WaitObject: %s\n", req.WaitObject)
@@ -176,26 +438,309 @@ func (req *Request) String() (str string) {
 		}
 	}
 	for _, s := range req.Sort {
-		str += fmt.Sprintf("Sort: %s %s\n", s.Name, s.Direction.String())
+		name := s.Name
+		if s.Transform != SortTransformNone {
+			name += ":" + s.Transform.String()
+		}
+		str += fmt.Sprintf("Sort: %s %s\n", name, s.Direction.String())
+	}
+	if req.IfNoneMatch != "" {
+		str += fmt.Sprintf("IfNoneMatch: %s\n", req.IfNoneMatch)
+	}
+	if req.SendETag {
+		str += "ETag: on\n"
+	}
+	if req.SendPeerCounts {
+		str += "PeerCounts: on\n"
+	}
+	if req.SendPeerBytes {
+		str += "PeerBytes: on\n"
+	}
+	if req.SendPeerStats {
+		str += "PeerStats: on\n"
+	}
+	if req.MergeDuplicates != MergeNone {
+		str += fmt.Sprintf("MergeDuplicates: %s\n", req.mergeDuplicatesValue())
+	}
+	if req.ChangedSince > 0 {
+		str += fmt.Sprintf("ChangedSince: %d\n", req.ChangedSince)
+	}
+	if req.Progressive {
+		str += "Progressive: on\n"
+	}
+	if req.AuthUser != "" {
+		str += fmt.Sprintf("AuthUser: %s\n", req.AuthUser)
+	}
+	if len(req.AuthGroups) > 0 {
+		str += "AuthGroups: " + strings.Join(req.AuthGroups, " ") + "\n"
+	}
+	if req.ShowFilter {
+		str += "ShowFilter: on\n"
+	}
+	for _, facet := range req.Facets {
+		str += fmt.Sprintf("Facet: %s\n", facet)
+	}
+	if req.NullValue != "" {
+		str += fmt.Sprintf("NullValue: %s\n", req.NullValue)
+	}
+	if req.PeerOrder != "" {
+		str += fmt.Sprintf("PeerOrder: %s\n", req.PeerOrder)
+	}
+	for _, group := range req.StatsGroups {
+		str += fmt.Sprintf("StatsGroup: %s\n", group)
+	}
+	if req.ApproxTotal {
+		str += "ApproxTotal: on\n"
+	}
+	if req.Consistency != "" {
+		str += fmt.Sprintf("Consistency: %s\n", req.Consistency)
+	}
+	if req.MapStates {
+		str += "MapStates: on\n"
+	}
+	if req.MapBooleans {
+		str += "MapBooleans: on\n"
+	}
+	if req.Explain {
+		str += "Explain: on\n"
+	}
+	if req.Summary {
+		str += "Summary: on\n"
+	}
+	if req.ShowLimit {
+		str += "ShowLimit: on\n"
+	}
+	if req.NoSpinUp {
+		str += "NoSpinUp: on\n"
+	}
+	if req.IncludeNever {
+		str += "IncludeNever: on\n"
+	}
+	if req.FloatPrecision != nil {
+		str += fmt.Sprintf("FloatPrecision: %d\n", req.FloatPrecision.Length)
+	}
+	if req.DuplicateColumns != "" {
+		str += fmt.Sprintf("DuplicateColumns: %s\n", req.DuplicateColumns)
+	}
+	if req.TimeFormat != "" {
+		str += fmt.Sprintf("TimeFormat: %s\n", req.TimeFormat)
+	}
+	if req.Availability != nil {
+		str += fmt.Sprintf("Availability: %s\n", req.Availability.String())
+	}
+	if req.SplitBy != "" {
+		str += fmt.Sprintf("SplitBy: %s\n", req.SplitBy)
+	}
+	if len(req.FirstPerGroup) > 0 {
+		str += "FirstPerGroup: " + strings.Join(req.FirstPerGroup, " ") + "\n"
+	}
+	if req.LogLevel != "" {
+		str += fmt.Sprintf("LogLevel: %s\n", req.LogLevel)
+	}
+	if req.CaptureRaw {
+		str += "CaptureRaw: on\n"
+	}
+	if req.FilterStats {
+		str += "FilterStats: on\n"
+	}
+	if req.Progress {
+		str += "Progress: on\n"
+	}
+	if req.PercentileFilter != nil {
+		str += "PercentileFilter: " + req.PercentileFilter.String() + "\n"
 	}
 	str += "\n"
 	return
 }
 
+// authColumns contains the contact and contact group columns used to restrict a table
+// with AuthUser and AuthGroups. The contacts of comments, downtimes and log entries
+// already contain the members of the contact groups, there are no group columns.
+var authColumns = map[string]struct {
+	contacts []string
+	groups   []string
+}{
+	"hosts":               {[]string{"contacts"}, []string{"contact_groups"}},
+	"hostsbygroup":        {[]string{"contacts"}, []string{"contact_groups"}},
+	"services":            {[]string{"contacts"}, []string{"contact_groups"}},
+	"servicesbygroup":     {[]string{"contacts"}, []string{"contact_groups"}},
+	"servicesbyhostgroup": {[]string{"contacts"}, []string{"contact_groups"}},
+	"comments":            {[]string{"host_contacts", "service_contacts"}, nil},
+	"downtimes":           {[]string{"host_contacts", "service_contacts"}, nil},
+	"log":                 {[]string{"current_host_contacts", "current_service_contacts"}, nil},
+}
+
+// authUnrestrictedTables contains the tables which are not related to single hosts or
+// services and are therefore not restricted by AuthUser and AuthGroups.
+var authUnrestrictedTables = map[string]bool{
+	"status":        true,
+	"contacts":      true,
+	"contactgroups": true,
+	"commands":      true,
+	"timeperiods":   true,
+	"columns":       true,
+	"tables":        true,
+	"sites":         true,
+	"backends":      true,
+}
+
+// applyDefaultLimit reduces the limit of client requests to the configured DefaultLimit.
+// It is applied by the client listeners only, internal requests and sub-requests from
+// other cluster nodes stay unlimited, so merged cluster results are not truncated.
+func (req *Request) applyDefaultLimit() {
+	max := int(atomic.LoadInt64(&defaultLimit))
+	if max > 0 && (req.Limit <= 0 || req.Limit > max) {
+		req.Limit = max
+	}
+	for _, sub := range req.MultiQuery {
+		if sub.Request != nil {
+			sub.Request.applyDefaultLimit()
+		}
+	}
+}
+
+// applySavedFilters combines the parsed filters with all saved filters. Saved filters are kept
+// apart until all filter lines are parsed, so client And:, Or: and Negate: lines cannot
+// widen or negate them.
+func (req *Request) applySavedFilters() {
+	req.Filter = append(req.Filter, req.savedFilters...)
+	req.savedFilters = nil
+}
+
+// applyAuthFilter restricts the result to objects the AuthUser is a contact of or
+// which belong to one of the AuthGroups. Both are combined with OR.
+// Queries which cannot be restricted, ex.: hostgroups or AuthGroups for comments, are rejected.
+func (req *Request) applyAuthFilter(table *Table) (err error) {
+	if req.AuthUser == "" && len(req.AuthGroups) == 0 {
+		return
+	}
+	if authUnrestrictedTables[table.Name] {
+		return
+	}
+	columns, ok := authColumns[table.Name]
+	if !ok {
+		err = errors.New("bad request: table " + table.Name + " cannot be restricted by AuthUser or AuthGroups")
+		return
+	}
+	if len(req.AuthGroups) > 0 && len(columns.groups) == 0 {
+		err = errors.New("bad request: table " + table.Name + " cannot be restricted by AuthGroups, use AuthUser instead")
+		return
+	}
+	line := "AuthUser: " + req.AuthUser
+	stack := []Filter{}
+	if req.AuthUser != "" {
+		for _, col := range columns.contacts {
+			err = ParseFilter(col+" >= "+req.AuthUser, &line, table.Name, &stack)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if len(req.AuthGroups) > 0 {
+		line = "AuthGroups: " + strings.Join(req.AuthGroups, " ")
+	}
+	for _, group := range req.AuthGroups {
+		for _, col := range columns.groups {
+			err = ParseFilter(col+" >= "+group, &line, table.Name, &stack)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = ParseFilterOp("or", fmt.Sprintf("%d", len(stack)), &line, &stack)
+	if err != nil {
+		return
+	}
+	req.Filter = append(req.Filter, stack...)
+	return
+}
+
+// columnsWithOptions returns the list of columns including their format directives and aliases.
+func (req *Request) columnsWithOptions(withHidden bool) []string {
+	if len(req.ColumnFormats) == 0 && len(req.ColumnAliases) == 0 && (!withHidden || len(req.HiddenColumns) == 0) {
+		return req.Columns
+	}
+	columns := make([]string, len(req.Columns))
+	for i, col := range req.Columns {
+		columns[i] = col
+		if f, ok := req.ColumnFormats[i]; ok {
+			columns[i] += ":" + f.String()
+		}
+		if alias, ok := req.ColumnAliases[i]; ok {
+			columns[i] += " as " + alias
+		}
+		if withHidden && req.HiddenColumns[i] {
+			columns[i] += " hidden"
+		}
+	}
+	return columns
+}
+
+// columnHeaders returns the column names used in the header row, which are either the
+// requested columns or their aliases followed by the labels of all stats.
+func (req *Request) columnHeaders() []interface{} {
+	cols := make([]interface{}, 0, len(req.Columns)+len(req.Stats))
+	for i, col := range req.Columns {
+		if req.HiddenColumns[i] {
+			continue
+		}
+		if alias, ok := req.ColumnAliases[i]; ok {
+			cols = append(cols, alias)
+			continue
+		}
+		cols = append(cols, col)
+	}
+	// stats values follow the group by columns
+	for i := range req.Stats {
+		cols = append(cols, req.Stats[i].StatsLabel())
+	}
+	return cols
+}
+
+// readRequestLine reads the next line including the newline. Lines longer than
+// maxRequestLineLength are rejected without reading them completely, so a single
+// huge line cannot exhaust the memory.
+func readRequestLine(b *bufio.Reader) (line string, err error) {
+	max := int(atomic.LoadInt64(&maxRequestLineLength))
+	var buf []byte
+	for {
+		chunk, rErr := b.ReadSlice('\n')
+		if len(buf)+len(chunk) > max {
+			return "", fmt.Errorf("bad request: request line exceeds the maximum length of %d bytes", max)
+		}
+		buf = append(buf, chunk...)
+		if rErr != bufio.ErrBufferFull {
+			return string(buf), rErr
+		}
+	}
+}
+
 // NewRequest reads a buffer and creates a new request object.
 // It returns the request as long with the number of bytes read and any error.
 func NewRequest(b *bufio.Reader) (req *Request, size int, err error) {
 	req = &Request{SendColumnsHeader: false, KeepAlive: false}
-	firstLine, err := b.ReadString('\n')
-	if err != nil {
-		// Network errors will be logged in the listener
-		if _, ok := err.(net.Error); ok {
-			req = nil
-			return
+	var firstLine string
+	// skip leading blank lines, some proxies send them before the actual query
+	for {
+		firstLine, err = readRequestLine(b)
+		if err != nil {
+			// Network errors will be logged in the listener
+			if _, ok := err.(net.Error); ok {
+				req = nil
+				return
+			}
+			// ex.: lines exceeding the maximum length
+			if err != io.EOF {
+				req = nil
+				return
+			}
+		}
+		size += len(firstLine)
+		firstLine = strings.TrimSpace(firstLine)
+		if firstLine != "" || err != nil {
+			break
 		}
 	}
-	size += len(firstLine)
-	firstLine = strings.TrimSpace(firstLine)
 	// probably a open connection without new data from a keepalive request
 	if log.IsV(2) && firstLine != "" {
 		log.Debugf("request: %s", firstLine)
@@ -208,7 +753,7 @@ func NewRequest(b *bufio.Reader) (req *Request, size int, err error) {
 	}
 
 	for {
-		line, berr := b.ReadString('\n')
+		line, berr := readRequestLine(b)
 		if berr != nil && berr != io.EOF {
 			err = berr
 			return
@@ -216,13 +761,19 @@ func NewRequest(b *bufio.Reader) (req *Request, size int, err error) {
 		size += len(line)
 		line = strings.TrimSpace(line)
 		if line == "" {
+			req.terminated = berr == nil
 			break
 		}
 
 		if log.IsV(2) {
 			log.Debugf("request: %s", line)
 		}
-		perr := req.ParseRequestHeaderLine(&line)
+		var perr error
+		if req.MultiQuery != nil {
+			perr = req.parseMultiQueryHeaderLine(&line)
+		} else {
+			perr = req.ParseRequestHeaderLine(&line)
+		}
 		if perr != nil {
 			err = perr
 			return
@@ -232,6 +783,18 @@ func NewRequest(b *bufio.Reader) (req *Request, size int, err error) {
 		}
 	}
 
+	// the queries of a MULTIQUERY request follow its headers
+	if req.MultiQuery != nil {
+		n, merr := req.readMultiQueries(b)
+		size += n
+		if merr != nil {
+			err = merr
+			return
+		}
+	}
+
+	req.applySavedFilters()
+
 	err = req.VerifyRequestIntegrity()
 	return
 }
@@ -249,15 +812,30 @@ func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error
 			return
 		}
 
-		req.Table = matched[1]
+		// livestatus table names are always lowercase
+		req.Table = strings.ToLower(matched[1])
 		_, ok := Objects.Tables[req.Table]
 		if !ok {
-			err = fmt.Errorf("bad request: table %s does not exist", req.Table)
+			err = unknownTableError(req.Table)
 		}
 		valid = true
 		return
 	}
 
+	// batch of queries answered with a single response
+	if strings.HasPrefix(*firstLine, "MULTIQUERY") {
+		err = req.parseMultiQueryAction(*firstLine)
+		valid = true
+		return
+	}
+
+	// no-op request used by health probes and keepalive pings
+	if *firstLine == "NOOP" {
+		req.Noop = true
+		valid = true
+		return
+	}
+
 	// or a command
 	if strings.HasPrefix(*firstLine, "COMMAND ") {
 		matched := reRequestCommand.FindStringSubmatch(*firstLine)
@@ -275,6 +853,12 @@ func (req *Request) ParseRequestAction(firstLine *string) (valid bool, err error
 	return
 }
 
+// unknownTableError returns the error for requests against a table which does not exist.
+// The list of valid tables is appended to help the client.
+func unknownTableError(name string) error {
+	return fmt.Errorf("bad request: table %s does not exist, available tables: %s", name, strings.Join(Objects.Order, ", "))
+}
+
 // VerifyRequestIntegrity checks for logical errors in the request
 // It returns any error encountered.
 func (req *Request) VerifyRequestIntegrity() (err error) {
@@ -298,6 +882,28 @@ func (req *Request) VerifyRequestIntegrity() (err error) {
 func (req *Request) GetResponse() (*Response, error) {
 	log.Tracef("GetResponse")
 
+	// make sure the table exists before doing anything else
+	if _, ok := Objects.Tables[req.Table]; !ok {
+		return nil, unknownTableError(req.Table)
+	}
+
+	// explained requests are never executed, so they are not limited either
+	if req.Explain {
+		return req.GetExplainResponse()
+	}
+
+	// shed load early instead of slowing down all queries
+	inFlight := atomic.AddInt64(&queriesInFlight, 1)
+	promFrontendQueriesInFlight.Set(float64(inFlight))
+	defer func() {
+		promFrontendQueriesInFlight.Set(float64(atomic.AddInt64(&queriesInFlight, -1)))
+	}()
+	max := atomic.LoadInt64(&maxQueriesInFlight)
+	if max > 0 && inFlight > max {
+		promFrontendQueriesRejected.Inc()
+		return nil, errServerBusy
+	}
+
 	// Run single request if possible
 	if !nodeAccessor.IsClustered() {
 		// Single mode (send request and return response)
@@ -328,11 +934,31 @@ func (req *Request) GetResponse() (*Response, error) {
 func (req *Request) getDistributedResponse() (*Response, error) {
 	// Columns for sub-requests
 	// Define request columns if not specified
-	table, _ := Objects.Tables[req.Table]
+	table, ok := Objects.Tables[req.Table]
+	if !ok {
+		return nil, unknownTableError(req.Table)
+	}
 	_, resultColumns, err := req.BuildResponseIndexes(&table)
 	if err != nil {
 		return nil, err
 	}
+	for _, s := range req.Stats {
+		if s.StatsSamples != nil || s.StatsDistinct != nil {
+			return nil, fmt.Errorf("bad request: %s stats are not supported in cluster mode", s.StatsType.String())
+		}
+	}
+	if req.Progressive {
+		return nil, errors.New("bad request: progressive mode is not supported in cluster mode")
+	}
+	if len(req.Facets) > 0 {
+		return nil, errors.New("bad request: facets are not supported in cluster mode")
+	}
+	if req.FilterStats {
+		return nil, errors.New("bad request: FilterStats is not supported in cluster mode")
+	}
+	if req.PercentileFilter != nil {
+		return nil, errors.New("bad request: PercentileFilter is not supported in cluster mode")
+	}
 
 	// Type of request
 	allBackendsRequested := len(req.Backends) == 0
@@ -454,9 +1080,10 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 
 	// Columns
 	// Columns need to be defined or else response will add them
+	// Hidden columns are removed after merging the results of all nodes
 	isStatsRequest := len(req.Stats) != 0
 	if len(req.Columns) != 0 {
-		requestData["columns"] = req.Columns
+		requestData["columns"] = req.columnsWithOptions(false)
 	} else if !isStatsRequest {
 		panic("columns undefined for dispatched request")
 	}
@@ -485,10 +1112,69 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 	// Limit
 	// An upper limit is used to make sorting possible
 	// Offset is 0 for sub-request (sorting)
-	if req.Limit != 0 {
+	// Merging duplicates requires all rows, so no limit can be used then
+	if req.Limit != 0 && req.MergeDuplicates == MergeNone {
 		requestData["limit"] = req.Limit + req.Offset
 	}
 
+	// Merge duplicates
+	if req.MergeDuplicates != MergeNone {
+		requestData["mergeduplicates"] = req.mergeDuplicatesValue()
+	}
+
+	// Changed rows only
+	if req.ChangedSince > 0 {
+		requestData["changedsince"] = req.ChangedSince
+	}
+
+	// Representation of null values
+	if req.NullValue != "" {
+		requestData["nullvalue"] = req.NullValue
+	}
+
+	// Order of merged backend results
+	if req.PeerOrder != "" {
+		requestData["peerorder"] = req.PeerOrder
+	}
+
+	// Estimate totals from a sample of rows
+	if req.ApproxTotal {
+		requestData["approxtotal"] = req.ApproxTotal
+	}
+
+	// Freshness of the backend data
+	if req.Consistency != "" {
+		requestData["consistency"] = req.Consistency
+	}
+
+	// Cached data from idling backends
+	if req.NoSpinUp {
+		requestData["nospinup"] = req.NoSpinUp
+	}
+
+	// Time comparisons matching zero timestamps
+	if req.IncludeNever {
+		requestData["includenever"] = req.IncludeNever
+	}
+
+	// Expected stats groups
+	if len(req.StatsGroups) > 0 {
+		requestData["statsgroups"] = req.StatsGroups
+	}
+
+	// First row of each group
+	if len(req.FirstPerGroup) > 0 {
+		requestData["firstpergroup"] = req.FirstPerGroup
+	}
+
+	// Authorization
+	if req.AuthUser != "" {
+		requestData["authuser"] = req.AuthUser
+	}
+	if len(req.AuthGroups) > 0 {
+		requestData["authgroups"] = req.AuthGroups
+	}
+
 	// Sort order
 	if len(req.Sort) != 0 {
 		var sort []string
@@ -501,7 +1187,11 @@ func (req *Request) buildDistributedRequestData(subBackends []string) (requestDa
 			case Asc:
 				direction = "asc"
 			}
-			line = sortField.Name + " " + direction
+			line = sortField.Name
+			if sortField.Transform != SortTransformNone {
+				line += ":" + sortField.Transform.String()
+			}
+			line += " " + direction
 			sort = append(sort, line)
 		}
 		requestData["sort"] = sort
@@ -538,7 +1228,7 @@ func (req *Request) mergeDistributedResponse(collectedDatasets chan [][]interfac
 				if hasColumns > 0 {
 					keys := []string{}
 					for x := 0; x < hasColumns; x++ {
-						keys = append(keys, row[x].(string))
+						keys = append(keys, fmt.Sprintf("%v", row[x]))
 					}
 					key = strings.Join(keys, ";")
 				}
@@ -571,6 +1261,10 @@ func (req *Request) mergeDistributedResponse(collectedDatasets chan [][]interfac
 // It returns any error encountered.
 func (req *Request) ParseRequestHeaderLine(line *string) (err error) {
 	matched := strings.SplitN(*line, ": ", 2)
+	if len(matched) == 1 && strings.HasSuffix(*line, ":") {
+		// headers without value, ex.: StatsNegate:
+		matched = []string{strings.TrimSuffix(*line, ":"), ""}
+	}
 	if len(matched) != 2 {
 		err = fmt.Errorf("bad request header: %s", *line)
 		return
@@ -586,6 +1280,32 @@ func (req *Request) ParseRequestHeaderLine(line *string) (err error) {
 	case "or":
 		err = ParseFilterOp(matched[0], matched[1], line, &req.Filter)
 		return
+	case "negate":
+		err = parseFilterNegate(line, &req.Filter)
+		return
+	case "nullvalue":
+		err = parseNullValue(&req.NullValue, matched[1])
+		return
+	case "peerorder":
+		err = parsePeerOrder(&req.PeerOrder, matched[1])
+		return
+	case "consistency":
+		err = parseConsistency(&req.Consistency, matched[1])
+		return
+	case "statsgroup":
+		req.StatsGroups = append(req.StatsGroups, matched[1])
+		return
+	case "facet":
+		for _, facet := range strings.Fields(matched[1]) {
+			req.Facets = append(req.Facets, strings.ToLower(facet))
+		}
+		return
+	case "search":
+		err = parseSearchHeader(req.Table, matched[1], line, &req.Filter)
+		return
+	case "savedfilter":
+		err = parseSavedFilter(req.Table, matched[1], &req.savedFilters)
+		return
 	case "stats":
 		err = ParseStats(matched[1], line, req.Table, &req.Stats)
 		return
@@ -595,6 +1315,74 @@ func (req *Request) ParseRequestHeaderLine(line *string) (err error) {
 	case "statsor":
 		err = parseStatsOp("or", matched[1], line, &req.Stats)
 		return
+	case "statsnegate":
+		err = parseStatsNegate(line, &req.Stats)
+		return
+	case "statsapprox":
+		err = parseOnOff(&req.StatsApprox, line, matched[1])
+		return
+	case "approxtotal":
+		err = parseOnOff(&req.ApproxTotal, line, matched[1])
+		return
+	case "mapstates":
+		err = parseOnOff(&req.MapStates, line, matched[1])
+		return
+	case "mapbooleans":
+		err = parseOnOff(&req.MapBooleans, line, matched[1])
+		return
+	case "explain":
+		err = parseOnOff(&req.Explain, line, matched[1])
+		return
+	case "summary":
+		err = parseOnOff(&req.Summary, line, matched[1])
+		return
+	case "showlimit":
+		err = parseOnOff(&req.ShowLimit, line, matched[1])
+		return
+	case "nospinup":
+		err = parseOnOff(&req.NoSpinUp, line, matched[1])
+		return
+	case "includenever":
+		err = parseOnOff(&req.IncludeNever, line, matched[1])
+		return
+	case "floatprecision":
+		err = parseFloatPrecision(&req.FloatPrecision, matched[1])
+		return
+	case "duplicatecolumns":
+		err = parseDuplicateColumns(&req.DuplicateColumns, matched[1])
+		return
+	case "timeformat":
+		err = parseTimeFormat(&req.TimeFormat, matched[1])
+		return
+	case "availability":
+		err = parseAvailability(&req.Availability, matched[1])
+		return
+	case "splitby":
+		req.SplitBy = strings.ToLower(strings.TrimSpace(matched[1]))
+		return
+	case "loglevel":
+		err = parseLogLevel(&req.LogLevel, matched[1])
+		return
+	case "captureraw":
+		err = parseOnOff(&req.CaptureRaw, line, matched[1])
+		return
+	case "filterstats":
+		err = parseOnOff(&req.FilterStats, line, matched[1])
+		return
+	case "firstpergroup":
+		for _, col := range strings.Fields(matched[1]) {
+			req.FirstPerGroup = append(req.FirstPerGroup, strings.ToLower(col))
+		}
+		return
+	case "progressive":
+		err = parseOnOff(&req.Progressive, line, matched[1])
+		return
+	case "progress":
+		err = parseOnOff(&req.Progress, line, matched[1])
+		return
+	case "percentilefilter":
+		err = parsePercentileFilter(&req.PercentileFilter, matched[1])
+		return
 	case "sort":
 		err = parseSortHeader(&req.Sort, matched[1])
 		return
@@ -608,7 +1396,10 @@ func (req *Request) ParseRequestHeaderLine(line *string) (err error) {
 		req.Backends = strings.Split(matched[1], " ")
 		return
 	case "columns":
-		req.Columns = strings.Split(matched[1], " ")
+		err = parseColumnsHeader(&req.Columns, &req.ColumnFormats, &req.ColumnAliases, &req.HiddenColumns, matched[1])
+		return
+	case "columnheaders":
+		err = parseOnOff(&req.SendColumnsHeader, line, matched[1])
 		return
 	case "responseheader":
 		err = parseResponseHeader(&req.ResponseFixed16, matched[1])
@@ -631,6 +1422,36 @@ func (req *Request) ParseRequestHeaderLine(line *string) (err error) {
 	case "keepalive":
 		err = parseOnOff(&req.KeepAlive, line, matched[1])
 		return
+	case "ifnonematch":
+		req.IfNoneMatch = matched[1]
+		return
+	case "etag":
+		err = parseOnOff(&req.SendETag, line, matched[1])
+		return
+	case "peercounts":
+		err = parseOnOff(&req.SendPeerCounts, line, matched[1])
+		return
+	case "peerbytes":
+		err = parseOnOff(&req.SendPeerBytes, line, matched[1])
+		return
+	case "peerstats":
+		err = parseOnOff(&req.SendPeerStats, line, matched[1])
+		return
+	case "mergeduplicates":
+		err = parseMergeDuplicates(&req.MergeDuplicates, &req.MergeKeep, matched[1])
+		return
+	case "changedsince":
+		err = parseIntHeader(&req.ChangedSince, matched[0], matched[1], 0)
+		return
+	case "authuser":
+		req.AuthUser = matched[1]
+		return
+	case "authgroups":
+		req.AuthGroups = strings.Fields(matched[1])
+		return
+	case "showfilter":
+		err = parseOnOff(&req.ShowFilter, line, matched[1])
+		return
 	default:
 		err = fmt.Errorf("bad request: unrecognized header %s", *line)
 		return
@@ -656,6 +1477,16 @@ func parseIntHeader(field *int, header string, value string, minValue int) (err
 	return
 }
 
+func parseFloatPrecision(field **ColumnFormat, value string) (err error) {
+	precision := 0
+	err = parseIntHeader(&precision, "floatprecision", value, 0)
+	if err != nil {
+		return
+	}
+	*field = &ColumnFormat{Type: FormatRound, Length: precision}
+	return
+}
+
 func parseSortHeader(field *[]*SortField, value string) (err error) {
 	args := ""
 	tmp := strings.SplitN(value, " ", 3)
@@ -671,6 +1502,17 @@ func parseSortHeader(field *[]*SortField, value string) (err error) {
 		args = strings.ToUpper(tmp[1])
 		tmp[1] = tmp[2]
 	}
+	transform := SortTransformNone
+	if parts := strings.SplitN(tmp[0], ":", 2); len(parts) == 2 {
+		switch strings.ToLower(parts[1]) {
+		case "abs":
+			transform = SortTransformAbs
+		default:
+			err = fmt.Errorf("bad request: unknown sort transform %s, only abs is supported", parts[1])
+			return
+		}
+		tmp[0] = parts[0]
+	}
 	var direction SortDirection
 	switch strings.ToLower(tmp[1]) {
 	case "asc":
@@ -683,7 +1525,63 @@ func parseSortHeader(field *[]*SortField, value string) (err error) {
 		err = errors.New("bad request: unrecognized sort direction, must be asc or desc")
 		return
 	}
-	*field = append(*field, &SortField{Name: strings.ToLower(tmp[0]), Direction: direction, Args: args})
+	*field = append(*field, &SortField{Name: strings.ToLower(tmp[0]), Direction: direction, Args: args, Transform: transform})
+	return
+}
+
+// parseColumnsHeader parses the columns header along with optional format directives,
+// aliases and hidden markers, ex.: Columns: host_name as node latency:round2 last_check hidden
+// It returns any error encountered.
+func parseColumnsHeader(field *[]string, formats *map[int]*ColumnFormat, aliases *map[int]string, hidden *map[int]bool, value string) (err error) {
+	columns := []string{}
+	tokens := strings.Split(value, " ")
+	for x := 0; x < len(tokens); x++ {
+		col := tokens[x]
+		if strings.ToLower(col) == "hidden" {
+			if len(columns) == 0 {
+				err = fmt.Errorf("bad request: hidden must follow a column in Columns: %s", value)
+				return
+			}
+			if *hidden == nil {
+				*hidden = make(map[int]bool)
+			}
+			(*hidden)[len(columns)-1] = true
+			continue
+		}
+		if strings.ToLower(col) == "as" {
+			if len(columns) == 0 || x+1 >= len(tokens) || tokens[x+1] == "" {
+				err = fmt.Errorf("bad request: alias must have form '<column> as <alias>' in Columns: %s", value)
+				return
+			}
+			if *aliases == nil {
+				*aliases = make(map[int]string)
+			}
+			(*aliases)[len(columns)-1] = tokens[x+1]
+			x++
+			continue
+		}
+		i := len(columns)
+		columns = append(columns, col)
+		tmp := strings.SplitN(col, ":", 2)
+		if len(tmp) == 2 {
+			matched := reColumnFormat.FindStringSubmatch(tmp[1])
+			if len(matched) != 3 {
+				err = fmt.Errorf("bad request: unknown column format directive %s in Columns: %s", tmp[1], value)
+				return
+			}
+			length, _ := strconv.Atoi(matched[2])
+			format := &ColumnFormat{Type: FormatRound, Length: length}
+			if matched[1] == "trunc" {
+				format.Type = FormatTruncate
+			}
+			if *formats == nil {
+				*formats = make(map[int]*ColumnFormat)
+			}
+			(*formats)[i] = format
+			columns[i] = tmp[0]
+		}
+	}
+	*field = columns
 	return
 }
 
@@ -696,6 +1594,63 @@ func parseStatsOp(op string, value string, line *string, stats *[]Filter) (err e
 	return
 }
 
+// parseStatsNegate inverts the last stats filter on the stack.
+// It returns any error encountered.
+func parseStatsNegate(line *string, stats *[]Filter) (err error) {
+	if len(*stats) == 0 {
+		err = errors.New("bad request: not enough filter on stack in " + *line)
+		return
+	}
+	last := &(*stats)[len(*stats)-1]
+	if last.StatsType != Counter {
+		err = errors.New("bad request: only filter stats can be negated in " + *line)
+		return
+	}
+	last.Negate = !last.Negate
+	return
+}
+
+// parseFilterNegate inverts the last filter on the stack.
+// It returns any error encountered.
+func parseFilterNegate(line *string, filter *[]Filter) (err error) {
+	if len(*filter) == 0 {
+		err = errors.New("bad request: not enough filter on stack in " + *line)
+		return
+	}
+	last := &(*filter)[len(*filter)-1]
+	last.Negate = !last.Negate
+	return
+}
+
+// parseSearchHeader expands a search term into a group of case insensitive
+// substring filter over all SearchColumns of the table, combined with OR.
+// It returns any error encountered.
+func parseSearchHeader(table string, value string, line *string, stack *[]Filter) (err error) {
+	columns, ok := SearchColumns[table]
+	if !ok {
+		err = fmt.Errorf("bad request: search is not supported for table %s", table)
+		return
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		err = errors.New("bad request: search term must not be empty in " + *line)
+		return
+	}
+	search := []Filter{}
+	for _, col := range columns {
+		err = ParseFilter(col+" ~~ "+regexp.QuoteMeta(value), line, table, &search)
+		if err != nil {
+			return
+		}
+	}
+	err = ParseFilterOp("or", fmt.Sprintf("%d", len(search)), line, &search)
+	if err != nil {
+		return
+	}
+	*stack = append(*stack, search...)
+	return
+}
+
 func parseOutputFormat(field *string, value string) (err error) {
 	switch value {
 	case "wrapped_json":
@@ -704,13 +1659,103 @@ func parseOutputFormat(field *string, value string) (err error) {
 	case "json":
 		*field = value
 		break
+	case "msgpack":
+		*field = value
+		break
+	case "ndjson":
+		*field = value
+		break
+	case "json_map":
+		*field = value
+		break
 	default:
-		err = errors.New("bad request: unrecognized outputformat, only json and wrapped_json is supported")
+		err = errors.New("bad request: unrecognized outputformat, only json, wrapped_json, ndjson, json_map and msgpack is supported")
 		return
 	}
 	return
 }
 
+func parseDuplicateColumns(field *string, value string) (err error) {
+	switch value {
+	case "dedup", "reject":
+		*field = value
+	default:
+		err = errors.New("bad request: unrecognized duplicatecolumns, only dedup and reject are supported")
+	}
+	return
+}
+
+// parseMergeDuplicates parses the merge policy, optionally followed by keep, ex.: MergeDuplicates: preferred keep
+func parseMergeDuplicates(field *MergePolicy, keep *bool, value string) (err error) {
+	tmp := strings.Fields(strings.ToLower(value))
+	if len(tmp) == 2 && tmp[1] == "keep" {
+		*keep = true
+		tmp = tmp[:1]
+	}
+	if len(tmp) != 1 {
+		return errors.New("bad request: merge duplicates must be MergeDuplicates: <policy> [keep]")
+	}
+	switch tmp[0] {
+	case "worst":
+		*field = MergeWorst
+	case "latest":
+		*field = MergeLatest
+	case "preferred":
+		*field = MergePreferred
+	default:
+		err = errors.New("bad request: unrecognized merge policy, only worst, latest and preferred are supported")
+	}
+	return
+}
+
+// mergeDuplicatesValue returns the value of the MergeDuplicates header.
+func (req *Request) mergeDuplicatesValue() string {
+	if req.MergeKeep {
+		return req.MergeDuplicates.String() + " keep"
+	}
+	return req.MergeDuplicates.String()
+}
+
+func parseNullValue(field *string, value string) (err error) {
+	switch value {
+	case "null", "empty", "zero":
+		*field = value
+	default:
+		err = errors.New("bad request: unrecognized null value, only null, empty and zero are supported")
+	}
+	return
+}
+
+func parseTimeFormat(field *string, value string) (err error) {
+	switch value {
+	case "epoch", "iso":
+		*field = value
+	default:
+		err = errors.New("bad request: unrecognized timeformat, only epoch and iso are supported")
+	}
+	return
+}
+
+func parsePeerOrder(field *string, value string) (err error) {
+	switch value {
+	case "config", "reverse", "latency":
+		*field = value
+	default:
+		err = errors.New("bad request: unrecognized peer order, only config, reverse and latency are supported")
+	}
+	return
+}
+
+func parseConsistency(field *string, value string) (err error) {
+	switch value {
+	case "cached", "fresh":
+		*field = value
+	default:
+		err = errors.New("bad request: unrecognized consistency, only cached and fresh are supported")
+	}
+	return
+}
+
 // parseOnOff parses a on/off header
 // It returns any error encountered.
 func parseOnOff(field *bool, line *string, value string) (err error) {
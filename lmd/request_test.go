@@ -3,7 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRequestHeader(t *testing.T) {
@@ -26,12 +35,53 @@ func TestRequestHeader(t *testing.T) {
 		"GET hosts\nColumns: name\nFilter: custom_variables = TAGS\n\n",
 		"GET hosts\nColumns: name\nFilter: name !=\n\n",
 		"COMMAND [123456] TEST\n\n",
+		"NOOP\n\n",
 		"GET hosts\nColumns: name\nFilter: name = test\nWaitTrigger: all\nWaitObject: test\nWaitTimeout: 10000\nWaitCondition: last_check > 1473760401\n\n",
 		"GET hosts\nColumns: name\nFilter: latency != 1.23456789012345\n\n",
 		"GET hosts\nColumns: name comments\nFilter: comments >= 1\n\n",
 		"GET hosts\nColumns: name contact_groups\nFilter: contact_groups >= test\n\n",
 		"GET hosts\nColumns: name\nFilter: last_check >= 123456789\n\n",
 		"GET hosts\nColumns: name\nFilter: last_check =\n\n",
+		"GET hosts\nColumns: name:trunc3 latency:round2\n\n",
+		"GET hosts\nColumns: name\nIfNoneMatch: 0123456789abcdef\n\n",
+		"GET hosts\nColumns: name latency\nSort: latency:abs desc\n\n",
+		"GET hosts\nColumns: name as node latency:round2 as lat state\nColumnHeaders: on\n\n",
+		"GET hosts\nColumns: name state\nMergeDuplicates: worst\n\n",
+		"GET hosts\nColumns: name\nChangedSince: 1500000000\n\n",
+		"GET hosts\nStats: median latency\nStats: percentile95 latency\nStats: percentile99.9 latency\nStatsApprox: on\n\n",
+		"GET hosts\nStats: countdistinct contacts\n\n",
+		"GET hosts\nStats: state = 0\nStatsNegate:\nStats: state = 1\nStats: state = 2\nStatsOr: 2\nStatsNegate:\n\n",
+		"GET hosts\nColumns: name\nFilter: state = 1\nNegate:\n\n",
+		"GET hosts\nColumns: name\nAuthUser: demo\nAuthGroups: admins demo\n\n",
+		"GET hosts\nColumns: name\nFilter: state = 1\nFilter: state = 2\nOr: 2\nNegate:\nShowFilter: on\n\n",
+		"GET hosts\nColumns: name\nFacet: address\nFacet: contacts\n\n",
+		"GET hosts\nColumns: name state\nNullValue: zero\n\n",
+		"GET hosts\nColumns: name state\nPeerOrder: reverse\n\n",
+		"GET hosts\nColumns: state\nStats: state >= 0\nStatsGroup: 0\nStatsGroup: 1\n\n",
+		"GET hosts\nColumns: name\nLimit: 10\nApproxTotal: on\n\n",
+		"GET hosts\nColumns: name state\nMapStates: on\n\n",
+		"GET hosts\nColumns: name\nFilter: name = test\nExplain: on\n\n",
+		"GET hosts\nColumns: name latency\nSummary: on\n\n",
+		"GET hosts\nColumns: name\nLimit: 10\nShowLimit: on\n\n",
+		"GET hosts\nColumns: name state\nNoSpinUp: on\n\n",
+		"GET hosts\nStats: state = 2\nPeerStats: on\n\n",
+		"GET hosts\nColumns: name\nFilter: last_check < 1600000000\nIncludeNever: on\n\n",
+		"GET hosts\nColumns: name latency\nFloatPrecision: 2\n\n",
+		"GET hosts\nColumns: name state\nDuplicateColumns: reject\n\n",
+		"GET hosts\nColumns: name last_check\nTimeFormat: iso\n\n",
+		"GET log\nFilter: host_name = test\nAvailability: 1000 2000\n\n",
+		"GET hosts\nColumns: name state\nSplitBy: state\n\n",
+		"GET services\nColumns: host_name last_check\nFirstPerGroup: host_name\n\n",
+		"GET hosts\nColumns: name\nLogLevel: debug\n\n",
+		"GET log\nColumns: time\nLimit: 5\nCaptureRaw: on\n\n",
+		"GET hosts\nColumns: name notifications_enabled\nMapBooleans: on\n\n",
+		"GET hosts\nColumns: name\nFilter: state = 0\nFilterStats: on\n\n",
+		"GET services\nColumns: host_name description\nMergeDuplicates: preferred keep\n\n",
+		"GET hosts\nOutputFormat: ndjson\nColumns: name\nProgressive: on\nProgress: on\n\n",
+		"GET services\nColumns: host_name description execution_time\nPercentileFilter: execution_time 99.5 top\n\n",
+		"GET hosts\nColumns: name as node latency:round2 hidden state\nSort: latency desc\n\n",
+		"GET hosts\nColumns: name\nConsistency: fresh\n\n",
+		"MULTIQUERY 2\nResponseHeader: fixed16\n\nGET hosts\nColumns: name\n\nGET services\nColumns: description\n\n",
 	}
 	for _, str := range testRequestStrings {
 		buf := bufio.NewReader(bytes.NewBufferString(str))
@@ -53,6 +103,60 @@ func TestRequestHeaderTable(t *testing.T) {
 	}
 }
 
+func TestRequestHeaderTableCase(t *testing.T) {
+	buf := bufio.NewReader(bytes.NewBufferString("GET Hosts\n"))
+	req, _, err := NewRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("hosts", req.Table); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestLeadingBlankLines(t *testing.T) {
+	buf := bufio.NewReader(bytes.NewBufferString("\n\r\n\nGET hosts\nLimit: 10\n\n"))
+	req, size, err := NewRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq("hosts", req.Table); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(10, req.Limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(25, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestNoop(t *testing.T) {
+	buf := bufio.NewReader(bytes.NewBufferString("\nNOOP\n\n"))
+	req, _, err := NewRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(true, req.Noop); err != nil {
+		t.Fatal(err)
+	}
+
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("\n\nNOOP\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestRequestHeaderLimit(t *testing.T) {
 	buf := bufio.NewReader(bytes.NewBufferString("GET hosts\nLimit: 10\n"))
 	req, _, _ := NewRequest(buf)
@@ -198,10 +302,12 @@ func TestResponseErrorsFunc(t *testing.T) {
 	testRequestStrings := []ErrorRequest{
 		{"", "bad request: empty request"},
 		{"NOE", "bad request: NOE"},
-		{"GET none\nColumns: none", "bad request: table none does not exist"},
+		{"\n\nNOE", "bad request: NOE"},
+		{"\n\n", "bad request: empty request"},
+		{"GET none\nColumns: none", unknownTableError("none").Error()},
 		{"GET backends\nColumns: status none", "bad request: table backends has no column none"},
 		{"GET hosts\nColumns: name\nFilter: none = 1", "bad request: unrecognized column from filter: none in Filter: none = 1"},
-		{"GET hosts\nBackends: none", "bad request: backend none does not exist"},
+		{"GET hosts\nBackends: none", "bad request: backend none does not exist, available backends: mockid0"},
 		{"GET hosts\nnone", "bad request header: none"},
 		{"GET hosts\nNone: blah", "bad request: unrecognized header None: blah"},
 		{"GET hosts\nLimit: x", "bad request: limit must be a positive number"},
@@ -213,19 +319,91 @@ func TestResponseErrorsFunc(t *testing.T) {
 		{"GET hosts\nSort: name", "bad request: invalid sort header, must be 'Sort: <field> <asc|desc>' or 'Sort: custom_variables <name> <asc|desc>'"},
 		{"GET hosts\nColumns: name\nSort: state asc", "bad request: sort column state not in result set"},
 		{"GET hosts\nResponseheader: none", "bad request: unrecognized responseformat, only fixed16 is supported"},
-		{"GET hosts\nOutputFormat: csv: none", "bad request: unrecognized outputformat, only json and wrapped_json is supported"},
+		{"GET hosts\nOutputFormat: csv: none", "bad request: unrecognized outputformat, only json, wrapped_json, ndjson, json_map and msgpack is supported"},
+		{"GET hosts\nColumns: state\nOutputFormat: json_map", "bad request: column name is required for json_map output"},
+		{"GET services\nColumns: host_name state\nOutputFormat: json_map", "bad request: column description is required for json_map output"},
+		{"GET hostsbygroup\nColumns: name\nOutputFormat: json_map", "bad request: json_map output is not supported for table hostsbygroup"},
+		{"GET hosts\nStats: state = 0\nOutputFormat: json_map", "bad request: json_map output is not supported for stats queries"},
+		{"GET hosts\nStats: state = 0\nSummary: on", "bad request: summary cannot be used with stats queries"},
+		{"GET hosts\nNoSpinUp: on\nConsistency: fresh", "bad request: NoSpinUp cannot be used with Consistency: fresh"},
+		{"GET hosts\nColumns: name\nPeerStats: on", "bad request: PeerStats requires Stats headers"},
+		{"GET hosts\nColumns: * as all", "bad request: Columns: * cannot have a format or an alias"},
+		{"GET hosts\nFloatPrecision: -1", "bad request: floatprecision must be a positive number"},
+		{"GET hosts\nDuplicateColumns: keep", "bad request: unrecognized duplicatecolumns, only dedup and reject are supported"},
+		{"GET hosts\nColumns: name state name:trunc2 state\nDuplicateColumns: reject", "bad request: column state is requested more than once"},
+		{"GET hosts\nTimeFormat: rfc822", "bad request: unrecognized timeformat, only epoch and iso are supported"},
+		{"GET log\nAvailability: 1000", "bad request: availability must be Availability: <start> <end>"},
+		{"GET log\nAvailability: 2000 1000", "bad request: availability requires two timestamps with start before end"},
+		{"GET hosts\nAvailability: 1000 2000", "bad request: Availability is only supported for the log table"},
+		{"GET log\nColumns: time\nAvailability: 1000 2000", "bad request: Availability cannot be used with Columns or Stats"},
+		{"GET log\nSort: time asc\nAvailability: 1000 2000", "bad request: Availability cannot be used with Sort, rows are sorted by host and service"},
+		{"GET hosts\nColumns: name\nSplitBy: state", "bad request: split column state not in result set"},
+		{"GET hosts\nColumns: name contacts\nSplitBy: contacts", "bad request: column contacts cannot be used to split rows, only string, number and time columns are supported"},
+		{"GET hosts\nColumns: state\nStats: state = 0\nSplitBy: state", "bad request: SplitBy cannot be used with stats queries"},
+		{"GET hosts\nColumns: name state\nOutputFormat: ndjson\nSplitBy: state", "bad request: SplitBy is only supported for json and wrapped_json output"},
+		{"GET services\nColumns: description\nFirstPerGroup: host_name", "bad request: group column host_name not in result set"},
+		{"GET hosts\nLogLevel: verbose", "bad request: unrecognized loglevel, only trace, debug and info are supported"},
+		{"GET log\nColumns: time\nLimit: 5\nFilterStats: on", "bad request: FilterStats is not supported for table log, filters are applied by the backends"},
+		{"GET hosts\nColumns: name\nApproxTotal: on\nFilterStats: on", "bad request: FilterStats cannot be used with ApproxTotal"},
+		{"GET hosts\nColumns: name\nMergeDuplicates: worst all", "bad request: merge duplicates must be MergeDuplicates: <policy> [keep]"},
+		{"GET commands\nColumns: name\nMergeDuplicates: preferred", "bad request: merging duplicates is not supported for table commands"},
+		{"GET hosts\nColumns: name\nOutputFormat: ndjson\nProgress: on", "bad request: Progress requires Progressive: on"},
+		{"GET hosts\nColumns: latency\nPercentileFilter: latency 95", "bad request: percentile filter must be PercentileFilter: <column> <percentile> <top|bottom>"},
+		{"GET hosts\nColumns: latency\nPercentileFilter: latency 101 top", "bad request: percentile must be between 0 and 100 in PercentileFilter: latency 101 top"},
+		{"GET hosts\nColumns: latency\nPercentileFilter: latency 95 high", "bad request: unrecognized percentile filter direction, only top and bottom are supported"},
+		{"GET hosts\nColumns: hidden name", "bad request: hidden must follow a column in Columns: hidden name"},
+		{"GET hosts\nColumns: name hidden", "bad request: at least one column must not be hidden"},
+		{"GET hosts\nColumns: * hidden", "bad request: Columns: * cannot be hidden"},
+		{"GET hosts\nColumns: state hidden\nStats: latency > 1", "bad request: hidden columns cannot be used with stats queries"},
+		{"GET hosts\nColumns: name state hidden\nSplitBy: state", "bad request: split column state cannot be hidden"},
+		{"GET hosts\nColumns: name hidden state\nOutputFormat: json_map", "bad request: column name cannot be hidden in json_map output"},
+		{"GET services\nColumns: host_name\nStats: state = 0\nFirstPerGroup: host_name", "bad request: FirstPerGroup cannot be used with stats queries"},
+		{"GET log\nColumns: host_name time\nLimit: 10\nFirstPerGroup: host_name", "bad request: FirstPerGroup queries on table log require a time filter, ex.: Filter: time >= <timestamp>"},
+		{"GET hosts\nColumns: *\nStats: state = 0", "bad request: Columns: * cannot be used with stats queries"},
 		{"GET hosts\nStatsAnd: 1", "bad request: not enough filter on stack in StatsAnd: 1"},
 		{"GET hosts\nStatsOr: 1", "bad request: not enough filter on stack in StatsOr: 1"},
+		{"GET hosts\nColumns: name\nStatsGroup: test", "bad request: StatsGroup requires Stats and Columns headers"},
+		{"GET hosts\nColumns: name state\nStats: state = 0\nStatsGroup: test", "bad request: StatsGroup test must contain 2 values separated by ;"},
+		{"GET hosts\nConsistency: latest", "bad request: unrecognized consistency, only cached and fresh are supported"},
 		{"GET hosts\nWaitTrigger: all", "bad request: WaitTrigger without WaitCondition"},
 		{"GET hosts\nWaitTrigger: all\nWaitCondition: last_check > 0", "bad request: WaitTrigger without WaitTimeout"},
 		{"GET hosts\nWaitTrigger: all\nWaitCondition: last_check > 0\nWaitTimeout: 10000", "bad request: WaitTrigger without WaitObject"},
 		{"GET hosts\nFilter: name", "bad request: filter header, must be Filter: <field> <operator> <value>"},
 		{"GET hosts\nFilter: name ~~ *^", "bad request: invalid regular expression: error parsing regexp: missing argument to repetition operator: `*` in filter Filter: name ~~ *^"},
-		{"GET hosts\nStats: name", "bad request: stats header, must be Stats: <field> <operator> <value> OR Stats: <sum|avg|min|max> <field>"},
+		{"GET hosts\nFilter: name ~ (ab|cd|ef|gh){1000}", "bad request: regular expression too complex, reduce the number of repetitions in filter Filter: name ~ (ab|cd|ef|gh){1000}"},
+		{"GET hosts\nFilter: name ~ (a)\\1", "bad request: invalid regular expression: error parsing regexp: invalid escape sequence: `\\1` in filter Filter: name ~ (a)\\1"},
+		{"GET hosts\nStats: name", "bad request: stats header, must be Stats: <field> <operator> <value> OR Stats: <sum|avg|min|max|median|percentile<n>|countdistinct> <field>"},
 		{"GET hosts\nStats: avg none", "bad request: unrecognized column from stats: none in Stats: avg none"},
 		{"GET hosts\nFilter: name !=\nAnd: x", "bad request: and must be a positive number in: And: x"},
 		{"GET hosts\nColumns: name\nFilter: custom_variables =", `bad request: custom variable filter must have form "Filter: custom_variables <op> <variable> [<value>]" in Filter: custom_variables =`},
 		{"GET hosts\nKeepalive: broke", `bad request: must be 'on' or 'off' in Keepalive: broke`},
+		{"GET hosts\nColumns: name:none", "bad request: unknown column format directive none in Columns: name:none"},
+		{"GET hosts\nColumns: name:round2", "bad request: column format round2 is not supported for column name"},
+		{"GET hosts\nColumns: as node", "bad request: alias must have form '<column> as <alias>' in Columns: as node"},
+		{"GET hosts\nColumns: name as", "bad request: alias must have form '<column> as <alias>' in Columns: name as"},
+		{"GET hosts\nColumns: name\nSort: name:sqrt asc", "bad request: unknown sort transform sqrt, only abs is supported"},
+		{"GET hosts\nColumns: name\nSort: name:abs asc", "bad request: sort transform abs is not supported for column name"},
+		{"GET hosts\nColumns: name\nMergeDuplicates: best", "bad request: unrecognized merge policy, only worst, latest and preferred are supported"},
+		{"GET hosts\nStats: percentile101 latency", "bad request: percentile must be between 0 and 100 in Stats: percentile101 latency"},
+		{"GET hosts\nStatsNegate:", "bad request: not enough filter on stack in StatsNegate:"},
+		{"GET hosts\nStats: avg latency\nStatsNegate:", "bad request: only filter stats can be negated in StatsNegate:"},
+		{"GET hosts\nNegate:", "bad request: not enough filter on stack in Negate:"},
+		{"GET hosts\nSearch:", "bad request: search term must not be empty in Search:"},
+		{"GET status\nSearch: test", "bad request: search is not supported for table status"},
+		{"GET hosts\nColumns: contacts\nStats: state = 0", "bad request: column contacts cannot be used to group stats, only string, number and time columns are supported"},
+		{"GET hosts\nColumns: name custom_variables\nStats: state = 0", "bad request: column custom_variables cannot be used to group stats, only string, number and time columns are supported"},
+		{"GET hosts\nColumns: latency:round1\nStats: state = 0", "bad request: column format directives cannot be used to group stats in column latency"},
+		{"GET log\nStats: state = 0", "bad request: stats are not supported for table log"},
+		{"GET hosts\nNullValue: none", "bad request: unrecognized null value, only null, empty and zero are supported"},
+		{"GET log\nColumns: time\nStats: median time", "bad request: stats are not supported for table log"},
+		{"GET hosts\nMapStates: yes", "bad request: must be 'on' or 'off' in MapStates: yes"},
+		{"GET log\nColumns: time\nLimit: 5", "bad request: queries on table log require a filter on column time, ex.: Filter: time >= <value>"},
+		{"GET log\nColumns: time", "bad request: queries on table log require a filter on column time, ex.: Filter: time >= <value>"},
+		{"GET log\nColumns: time\nFilter: time > 0\nNegate:", "bad request: queries on table log require a filter on column time, ex.: Filter: time >= <value>"},
+		{"MULTIQUERY", "bad request: MULTIQUERY requires the number of queries, ex.: MULTIQUERY 3"},
+		{"MULTIQUERY 0", "bad request: MULTIQUERY supports between 1 and 100 queries"},
+		{"MULTIQUERY 1\nColumns: name", "bad request: only ResponseHeader and KeepAlive headers are supported for MULTIQUERY in Columns: name"},
+		{"MULTIQUERY 2\n\nGET hosts\nColumns: name", "bad request: MULTIQUERY announced 2 queries but only 1 were sent"},
 	}
 
 	for _, er := range testRequestStrings {
@@ -321,6 +499,372 @@ func TestRequestStats(t *testing.T) {
 	}
 }
 
+func TestRequestStatsNegate(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET hosts\nStats: state >= 0\nStats: name = testhost_1\nStats: name = testhost_1\nStatsNegate:\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(1.0, res[0][1]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(res[0][0].(float64)-res[0][1].(float64), res[0][2]); err != nil {
+		t.Error(err)
+	}
+
+	// negating a group
+	res, err = peer.QueryString("GET hosts\nStats: name = testhost_1\nStats: name = testhost_2\nStatsOr: 2\nStatsNegate:\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(8.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestSearch(t *testing.T) {
+	peer := StartTestPeer(1, 5, 50)
+	PauseTestPeers(peer)
+
+	// give some hosts a distinct alias and display name
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	nameIndex := hosts.Table.GetColumn("name").Index
+	aliasIndex := hosts.Table.GetColumn("alias").Index
+	displayIndex := hosts.Table.GetColumn("display_name").Index
+	for _, row := range hosts.Data {
+		switch row[nameIndex] {
+		case "testhost_2":
+			row[aliasIndex] = "Primary Database"
+		case "testhost_4":
+			row[displayIndex] = "Web Frontend (prod)"
+		}
+	}
+	p.DataLock.Unlock()
+
+	tests := map[string][]string{
+		"testhost_3":  {"testhost_3"},
+		"database":    {"testhost_2"},
+		"FRONTEND":    {"testhost_4"},
+		"end (prod)":  {"testhost_4"},
+		"nonexisting": {},
+	}
+	for term, expect := range tests {
+		res, err := peer.QueryString("GET hosts\nColumns: name\nSearch: " + term + "\nSort: name asc\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, row := range res {
+			names = append(names, row[0].(string))
+		}
+		if err = assertEq(expect, names); err != nil {
+			t.Errorf("search %s: %s", term, err)
+		}
+	}
+
+	// search is combined with other filter
+	res, err := peer.QueryString("GET hosts\nColumns: name\nSearch: testhost\nFilter: name != testhost_1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(4, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET services\nColumns: host_name description\nSearch: TESTHOST_2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(9, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET services\nColumns: host_name description\nSearch: testsvc_3\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(5, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET contacts\nColumns: name\nSearch: test\n\n")
+	if err = assertEq("bad request: search is not supported for table contacts", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestStatsGroupColumns(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// columns are used as group by keys
+	res, err := peer.QueryString("GET hosts\nColumns: state\nStats: state >= 0\nStats: avg latency\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	// numeric group columns keep their type
+	if err = assertEq([]interface{}{0.0, 10.0}, res[0][0:2]); err != nil {
+		t.Error(err)
+	}
+
+	// virtual columns can be used as well
+	res, err = peer.QueryString("GET hosts\nColumns: peer_key\nStats: state >= 0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"mockid0", 10.0}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestStatsGroupsZeroFill(t *testing.T) {
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET hosts\nColumns: address\nStats: state >= 0\nStats: avg latency\nStatsGroup: 127.0.0.1\nStatsGroup: 10.0.0.9\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(7, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	// expected groups without matches are sorted like any other group
+	if err = assertEq([]interface{}{"10.0.0.9", 0.0, 0.0}, res[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]interface{}{"127.0.0.1", 3.0}, res[1][0:2]); err != nil {
+		t.Error(err)
+	}
+
+	// groups with multiple columns are sorted by all columns
+	res, err = peer.QueryString("GET hosts\nColumns: address state\nStats: state >= 0\nStatsGroup: 127.0.0.1;3\nStatsGroup: 127.0.0.1;2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for i, row := range res {
+		if row[0] != "127.0.0.1" || (row[1] != 2.0 && row[1] != 3.0) {
+			continue
+		}
+		found++
+		if err = assertEq(0.0, row[2]); err != nil {
+			t.Error(err)
+		}
+		if row[1] == 3.0 {
+			if err = assertEq([]interface{}{"127.0.0.1", 2.0, 0.0}, res[i-1]); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err = assertEq(2, found); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestAuthGroups(t *testing.T) {
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	all, err := peer.QueryString("GET hosts\nColumns: name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the business process host has no contacts and no contact groups
+	visible := len(all) - 1
+
+	queries := map[string]int{
+		"AuthUser: demo\n":                        visible,
+		"AuthUser: nobody\n":                      0,
+		"AuthGroups: demo\n":                      visible,
+		"AuthGroups: nogroup\n":                   0,
+		"AuthGroups: nogroup demo\n":              visible,
+		"AuthUser: nobody\nAuthGroups: demo\n":    visible,
+		"AuthUser: demo\nAuthGroups: nogroup\n":   visible,
+		"AuthUser: nobody\nAuthGroups: nogroup\n": 0,
+	}
+	for auth, expect := range queries {
+		res, err := peer.QueryString("GET hosts\nColumns: name\n" + auth + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(expect, len(res)); err != nil {
+			t.Errorf("%s: %s", strings.TrimSpace(auth), err)
+		}
+	}
+
+	// services are restricted by their own contact groups
+	res, err := peer.QueryString("GET services\nStats: state >= 0\nAuthGroups: nogroup\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// tables without contacts are not restricted
+	res, err = peer.QueryString("GET status\nColumns: program_start\nAuthGroups: nogroup\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// comments are restricted by the contacts of their host and service
+	res, err = peer.QueryString("GET comments\nColumns: id\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) == 0 {
+		t.Fatal("test requires comments")
+	}
+	res, err = peer.QueryString("GET comments\nColumns: id\nAuthUser: demo\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// queries which cannot be restricted are rejected
+	for _, query := range []string{
+		"GET hostgroups\nColumns: name\nAuthUser: demo\n\n",
+		"GET servicegroups\nColumns: name\nAuthGroups: demo\n\n",
+		"GET downtimes\nColumns: id\nAuthGroups: demo\n\n",
+	} {
+		if _, err = peer.QueryString(query); err == nil {
+			t.Errorf("expected error for %q", query)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestStatsPercentile(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "StatsMaxSamples = 5\n")
+	PauseTestPeers(peer)
+
+	query := "GET hosts\nStats: median latency\nStats: percentile100 latency\nStats: max latency\nStats: percentile0 latency\nStats: min latency\nFilter: name ~ testhost_[1-5]$\n"
+	res, err := peer.QueryString(query + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(res[0][2], res[0][1]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(res[0][4], res[0][3]); err != nil {
+		t.Error(err)
+	}
+
+	// approximate mode is exact for small sets
+	resApprox, err := peer.QueryString(query + "StatsApprox: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(res, resApprox); err != nil {
+		t.Error(err)
+	}
+
+	// exact mode exceeds the sample limit
+	_, err = peer.QueryString("GET hosts\nStats: median latency\n\n")
+	if err == nil {
+		t.Fatalf("expected too many samples error")
+	}
+	if err = assertEq(errTooManySamples.Error(), err.Error()); err != nil {
+		t.Error(err)
+	}
+	_, err = peer.QueryString("GET hosts\nStats: median latency\nStatsApprox: on\n\n")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestStatsCountDistinct(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// both backends contain the same hosts
+	res, err := peer.QueryString("GET hosts\nStats: countdistinct name\nStats: countdistinct peer_key\nStats: name ~ testhost\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{float64(10), float64(2), float64(20)}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET hosts\nStats: countdistinct name\nFilter: name ~ testhost_[1-3]$\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(3), res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// list columns count the distinct elements of all rows
+	rows, err := peer.QueryString("GET hosts\nColumns: contacts\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts := make(map[string]bool)
+	for _, row := range rows {
+		for _, contact := range row[0].([]interface{}) {
+			contacts[contact.(string)] = true
+		}
+	}
+	res, err = peer.QueryString("GET hosts\nStats: countdistinct contacts\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(len(contacts)), res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// grouped stats count for each group on its own
+	res, err = peer.QueryString("GET hosts\nColumns: peer_key\nStats: countdistinct name\nFilter: name != testhost_1\nFilter: peer_key = mockid0\nOr: 2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"mockid0", float64(10)}, {"mockid1", float64(9)}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
 func TestRequestStatsGroupBy(t *testing.T) {
 	peer := StartTestPeer(4, 0, 0)
 	PauseTestPeers(peer)
@@ -458,3 +1002,293 @@ func TestRequestGroupByTable(t *testing.T) {
 		panic(err.Error())
 	}
 }
+
+func TestRequestColumnFormats(t *testing.T) {
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET hosts\nColumns: name:trunc4 latency:round2 execution_time:round0\nFilter: name = gearman\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"gear", 0.05, float64(4)}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestRequestNoBackends(t *testing.T) {
+	dataStore, dataStoreOrder := DataStore, DataStoreOrder
+	DataStore = make(map[string]*Peer)
+	DataStoreOrder = make([]string, 0)
+	defer func() {
+		DataStore, DataStoreOrder = dataStore, dataStoreOrder
+	}()
+
+	req := &Request{Table: "hosts", Columns: []string{"name"}}
+	if err := req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := req.GetResponse()
+	if err = assertEq(errNoBackends, err); err != nil {
+		t.Error(err)
+	}
+
+	// tables and columns would use the first backend otherwise
+	req = &Request{Table: "columns"}
+	_, err = req.GetResponse()
+	if err = assertEq(errNoBackends, err); err != nil {
+		t.Error(err)
+	}
+
+	// bad requests are still reported as such
+	req = &Request{Table: "hosts", Columns: []string{"test"}}
+	_, err = req.GetResponse()
+	if err = assertEq("bad request: table hosts has no column test", fmt.Sprint(err)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestUnknownBackendList(t *testing.T) {
+	dataStore, dataStoreOrder := DataStore, DataStoreOrder
+	DataStore = make(map[string]*Peer)
+	DataStoreOrder = make([]string, 0)
+	defer func() {
+		DataStore, DataStoreOrder = dataStore, dataStoreOrder
+	}()
+	for i := 0; i < maxListedBackends+5; i++ {
+		DataStoreOrder = append(DataStoreOrder, fmt.Sprintf("id%d", i))
+	}
+
+	req := &Request{Table: "hosts", Columns: []string{"name"}, Backends: []string{"none"}}
+	err := req.ExpandRequestedBackends()
+	if err == nil {
+		t.Fatal("expected error for unknown backend")
+	}
+	if err = assertLike(`^bad request: backend none does not exist, available backends: id0, id1, .*, id19 and 5 more$`, err.Error()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestBusyShedding(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "MaxQueriesInFlight = 1\n")
+	PauseTestPeers(peer)
+
+	if err := assertEq(int64(1), atomic.LoadInt64(&maxQueriesInFlight)); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a long running query blocking the only slot
+	atomic.AddInt64(&queriesInFlight, 1)
+	req := &Request{Table: "hosts", Columns: []string{"name"}}
+	_, err := req.GetResponse()
+	if err = assertEq(errServerBusy, err); err != nil {
+		t.Error(err)
+	}
+	_, err = peer.QueryString("GET hosts\nColumns: name\n\n")
+	if err == nil {
+		t.Fatalf("expected server busy error")
+	}
+	if err = assertEq(errServerBusy.Error(), err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	// status table reports the blocked slot
+	atomic.AddInt64(&queriesInFlight, -1)
+	res, err := peer.QueryString("GET status\nColumns: lmd_queries_in_flight\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(int64(0), atomic.LoadInt64(&queriesInFlight)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+	atomic.StoreInt64(&maxQueriesInFlight, 0)
+}
+
+func TestRequestMultiQuery(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	conn, err := net.Dial("unix", "test.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := "MULTIQUERY 3\nResponseHeader: fixed16\n\n" +
+		"GET hosts\nColumns: name\nSort: name asc\nLimit: 2\n\n" +
+		"GET none\nColumns: name\n\n" +
+		"GET hosts\nStats: state >= 0\nOutputFormat: wrapped_json\n\n"
+	if _, err = conn.Write([]byte(query)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike(`^200\s+\d+\n$`, header); err != nil {
+		t.Error(err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []MultiQueryResult{}
+	if err = json.Unmarshal(body, &results); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(results)); err != nil {
+		t.Fatal(err)
+	}
+
+	// results are returned in order of the queries
+	var rows [][]interface{}
+	if err = json.Unmarshal(results[0].Result, &rows); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(200, results[0].Code); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([][]interface{}{{"testhost_1"}, {"testhost_2"}}, rows); err != nil {
+		t.Error(err)
+	}
+
+	// failed queries do not affect the other queries
+	if err = assertEq(MultiQueryResult{Code: 400, Error: unknownTableError("none").Error()}, results[1]); err != nil {
+		t.Error(err)
+	}
+
+	var wrapped struct {
+		Data  [][]interface{} `json:"data"`
+		Total int             `json:"total"`
+	}
+	if err = json.Unmarshal(results[2].Result, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(200, results[2].Code); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([][]interface{}{{float64(10)}}, wrapped.Data); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+// endlessReader returns the same byte forever without sending a newline.
+type endlessReader struct{}
+
+func (r endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestRequestMaxLineLength(t *testing.T) {
+	defaultLength := atomic.LoadInt64(&maxRequestLineLength)
+	atomic.StoreInt64(&maxRequestLineLength, 1000)
+	defer atomic.StoreInt64(&maxRequestLineLength, defaultLength)
+
+	// lines below the limit are fine
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nFilter: name = " + strings.Repeat("x", 900) + "\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("hosts", req.Table); err != nil {
+		t.Error(err)
+	}
+
+	// a huge header line
+	_, _, err = NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nFilter: name = " + strings.Repeat("x", 1000000) + "\n\n")))
+	if err = assertEq("bad request: request line exceeds the maximum length of 1000 bytes", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+
+	// a first line which never ends must not be read completely
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	req, _, err = NewRequest(bufio.NewReader(io.MultiReader(bytes.NewBufferString("GET "), endlessReader{})))
+	runtime.ReadMemStats(&after)
+	if req != nil {
+		t.Errorf("expected no request, got: %v", req)
+	}
+	if err = assertEq("bad request: request line exceeds the maximum length of 1000 bytes", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+		t.Errorf("reading the request allocated %d bytes", allocated)
+	}
+}
+
+// parseRequestsFromPipe sends the query through a pipe which is closed afterwards.
+func parseRequestsFromPipe(query string) ([]*Request, error) {
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write([]byte(query))
+		client.Close()
+	}()
+	return ParseRequests(server, "")
+}
+
+func TestRequestTerminator(t *testing.T) {
+	defer SetIncompleteRequests("accept")
+
+	tests := []struct {
+		mode     string
+		query    string
+		complete bool
+	}{
+		{"accept", "GET hosts\nColumns: name\n\n", true},
+		{"accept", "GET hosts\nColumns: name\n", true},
+		{"accept", "GET hosts\nColumns: name", true},
+		{"error", "GET hosts\nColumns: name\n\n", true},
+		{"error", "GET hosts\nColumns: name\n", false},
+		{"error", "GET hosts\nColumns: name", false},
+		{"error", "GET hosts", false},
+		{"close", "GET hosts\nColumns: name\n\n", true},
+		{"close", "GET hosts\nColumns: name", false},
+		{"error", "COMMAND [1473627610] TEST\n\n", true},
+		{"error", "COMMAND [1473627610] TEST\n", false},
+		{"error", "MULTIQUERY 1\n\nGET hosts\nColumns: name\n\n", true},
+		{"error", "MULTIQUERY 1\n\nGET hosts\nColumns: name\n", false},
+	}
+
+	for _, test := range tests {
+		if err := SetIncompleteRequests(test.mode); err != nil {
+			t.Fatal(err)
+		}
+		reqs, err := parseRequestsFromPipe(test.query)
+		if test.complete {
+			if err != nil {
+				t.Errorf("%s: %q: %s", test.mode, test.query, err)
+				continue
+			}
+			if err = assertEq(1, len(reqs)); err != nil {
+				t.Errorf("%s: %q: %s", test.mode, test.query, err)
+			}
+			continue
+		}
+		if err = assertEq(errIncompleteRequest, err); err != nil {
+			t.Errorf("%s: %q: %s", test.mode, test.query, err)
+		}
+	}
+
+	if err := assertEq("unknown value strict, only accept, error and close are supported", fmt.Sprintf("%v", SetIncompleteRequests("strict"))); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// defaultRequiredFilters are used unless the RequiredFilters config section is set.
+var defaultRequiredFilters = map[string][]string{"log": {"time"}}
+
+// requiredFilters contains the columns which must be restricted by a filter for each passthrough table.
+// Queries without such filters would fetch the complete table from all backends.
+var requiredFilters = defaultRequiredFilters
+var requiredFiltersLock = new(sync.RWMutex)
+
+// SetRequiredFilters sets the columns which must be filtered in queries on passthrough tables, ex.: log = ["time"]
+// Nil filters restore the defaults, tables with an empty list of columns do not require any filter.
+// It returns an error if any table does not exist, is not a passthrough table or has no such column.
+func SetRequiredFilters(filters map[string][]string) error {
+	if filters == nil {
+		filters = defaultRequiredFilters
+	}
+	parsed := make(map[string][]string)
+	for name, columns := range filters {
+		table, ok := Objects.Tables[name]
+		if !ok {
+			return fmt.Errorf("table %s does not exist", name)
+		}
+		if !table.PassthroughOnly {
+			return fmt.Errorf("table %s is not a passthrough table", name)
+		}
+		for _, col := range columns {
+			if _, ok := table.ColumnsIndex[col]; !ok {
+				return fmt.Errorf("table %s has no column %s", name, col)
+			}
+		}
+		parsed[name] = columns
+	}
+	requiredFiltersLock.Lock()
+	requiredFilters = parsed
+	requiredFiltersLock.Unlock()
+	return nil
+}
+
+// checkRequiredFilters returns an error if the request does not filter all required columns of its table.
+// A limit does not replace a required filter, the backends would still have to scan the complete table.
+func (req *Request) checkRequiredFilters() error {
+	requiredFiltersLock.RLock()
+	columns := requiredFilters[req.Table]
+	requiredFiltersLock.RUnlock()
+	for _, col := range columns {
+		if !hasColumnFilter(req.Filter, col) {
+			return fmt.Errorf("bad request: queries on table %s require a filter on column %s, ex.: Filter: %s >= <value>", req.Table, col, col)
+		}
+	}
+	return nil
+}
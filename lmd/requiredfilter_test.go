@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRequiredFilters(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	if err := SetRequiredFilters(map[string][]string{"log": {"time", "host_name"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRequiredFilters(nil)
+
+	// compliant queries are passed to the backends
+	for _, query := range []string{
+		"GET log\nColumns: time message\nFilter: time >= 1500000000\nFilter: host_name = test\n\n",
+		"GET log\nColumns: time message\nFilter: host_name = test\nFilter: time >= 1500000000\nFilter: time < 1600000000\nAnd: 2\n\n",
+	} {
+		if _, err := peer.QueryString(query); err != nil {
+			t.Errorf("%q: %s", query, err)
+		}
+	}
+
+	tests := []struct {
+		query  string
+		column string
+	}{
+		{"GET log\nColumns: time message\nFilter: host_name = test\n\n", "time"},
+		// a limit does not replace a required filter
+		{"GET log\nColumns: time message\nFilter: time >= 1500000000\nLimit: 5\n\n", "host_name"},
+		{"GET log\nColumns: time message\nFilter: time >= 1500000000\nFilter: host_name != test\n\n", "host_name"},
+		{"GET log\nColumns: time message\nFilter: time >= 1500000000\nFilter: host_name = test\nFilter: type = ALERT\nOr: 2\n\n", "host_name"},
+	}
+	for _, test := range tests {
+		_, err := peer.QueryString(test.query)
+		if err == nil {
+			t.Errorf("%q: expected error", test.query)
+			continue
+		}
+		expect := "bad request: queries on table log require a filter on column " + test.column + ", ex.: Filter: " + test.column + " >= <value>"
+		if err = assertEq(expect, err.Error()); err != nil {
+			t.Errorf("%q: %s", test.query, err)
+		}
+	}
+
+	// log queries require a time filter by default, unless the default is relaxed
+	if err := SetRequiredFilters(nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := peer.QueryString("GET log\nColumns: time message\nLimit: 5\n\n")
+	if err = assertEq("bad request: queries on table log require a filter on column time, ex.: Filter: time >= <value>", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+	if err := SetRequiredFilters(map[string][]string{"log": {}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.QueryString("GET log\nColumns: time message\nLimit: 5\n\n"); err != nil {
+		t.Error(err)
+	}
+
+	// only passthrough tables can require filters
+	for _, filters := range []map[string][]string{
+		{"hosts": {"name"}},
+		{"log": {"unknown"}},
+		{"unknown": {"time"}},
+	} {
+		if err := SetRequiredFilters(filters); err == nil {
+			t.Errorf("expected error for %v", filters)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
@@ -5,39 +5,126 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"net"
+	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // VirtKeyMapTupel is used to define the virtual key mapping in the VirtKeyMap
 type VirtKeyMapTupel struct {
-	Index int
-	Key   string
-	Type  ColumnType
+	Index       int
+	Key         string
+	Type        ColumnType
+	Description string
 }
 
 // VirtKeyMap maps the virtual columns with the peer status map entry.
 // If the entry is empty, then there must be a corresponding resolve function in the GetRowValue() function.
 var VirtKeyMap = map[string]VirtKeyMapTupel{
-	"key":                     {Index: -1, Key: "PeerKey", Type: StringCol},
-	"name":                    {Index: -2, Key: "PeerName", Type: StringCol},
-	"addr":                    {Index: -4, Key: "PeerAddr", Type: StringCol},
-	"status":                  {Index: -5, Key: "PeerStatus", Type: IntCol},
-	"bytes_send":              {Index: -6, Key: "BytesSend", Type: IntCol},
-	"bytes_received":          {Index: -7, Key: "BytesReceived", Type: IntCol},
-	"queries":                 {Index: -8, Key: "Querys", Type: IntCol},
-	"last_error":              {Index: -9, Key: "LastError", Type: StringCol},
-	"last_online":             {Index: -10, Key: "LastOnline", Type: TimeCol},
-	"last_update":             {Index: -11, Key: "LastUpdate", Type: TimeCol},
-	"response_time":           {Index: -12, Key: "ReponseTime", Type: FloatCol},
-	"state_order":             {Index: -13, Key: "", Type: IntCol},
-	"last_state_change_order": {Index: -14, Key: "", Type: IntCol},
-	"has_long_plugin_output":  {Index: -15, Key: "", Type: IntCol},
-	"idling":                  {Index: -16, Key: "Idling", Type: IntCol},
-	"last_query":              {Index: -17, Key: "LastQuery", Type: TimeCol},
+	"key":                     {Index: -1, Key: "PeerKey", Type: StringCol, Description: "Id of this peer"},
+	"name":                    {Index: -2, Key: "PeerName", Type: StringCol, Description: "Name of this peer"},
+	"addr":                    {Index: -4, Key: "PeerAddr", Type: StringCol, Description: "Address of this peer"},
+	"status":                  {Index: -5, Key: "PeerStatus", Type: IntCol, Description: "Status of this peer (0 - UP, 1 - Stale, 2 - Down, 4 - Pending)"},
+	"bytes_send":              {Index: -6, Key: "BytesSend", Type: IntCol, Description: "Bytes send to this peer"},
+	"bytes_received":          {Index: -7, Key: "BytesReceived", Type: IntCol, Description: "Bytes received from this peer"},
+	"queries":                 {Index: -8, Key: "Querys", Type: IntCol, Description: "Number of queries sent to this peer"},
+	"last_error":              {Index: -9, Key: "LastError", Type: StringCol, Description: "Last error message or empty if up"},
+	"last_online":             {Index: -10, Key: "LastOnline", Type: TimeCol, Description: "Timestamp when peer was last online"},
+	"last_update":             {Index: -11, Key: "LastUpdate", Type: TimeCol, Description: "Timestamp of last update"},
+	"response_time":           {Index: -12, Key: "ReponseTime", Type: FloatCol, Description: "Duration of last update in seconds"},
+	"state_order":             {Index: -13, Key: "", Type: IntCol, Description: "The state suitable for sorting. Unknown and Critical state are switched."},
+	"last_state_change_order": {Index: -14, Key: "", Type: IntCol, Description: "The last_state_change suitable for sorting. Returns program_start from the core if never checked."},
+	"has_long_plugin_output":  {Index: -15, Key: "", Type: IntCol, Description: "Flag wether this object has long_plugin_output or not"},
+	"idling":                  {Index: -16, Key: "Idling", Type: IntCol, Description: "Idle status of this backend (0 - Not idling, 1 - idling)"},
+	"last_query":              {Index: -17, Key: "LastQuery", Type: TimeCol, Description: "Timestamp of the last incoming request"},
+	"lmd_queries_in_flight":   {Index: -18, Key: "", Type: IntCol, Description: "Number of queries currently processed by LMD"},
+	"lmd_time":                {Index: -19, Key: "", Type: TimeCol, Description: "Current unix timestamp of LMD when the response was built"},
+	"livestatus_version":      {Index: -20, Key: "LivestatusVersion", Type: StringCol, Description: "The version of the livestatus module of this peer"},
+	"program_version":         {Index: -21, Key: "ProgramVersion", Type: StringCol, Description: "The version of the monitoring core of this peer"},
+	"evicted":                 {Index: -22, Key: "Evicted", Type: IntCol, Description: "Flag wether this peer is excluded from passthrough queries because of its slow response time"},
+	"section":                 {Index: -23, Key: "Section", Type: StringCol, Description: "The section of this peer from the connection configuration"},
+	"group":                   {Index: -24, Key: "Group", Type: StringCol, Description: "The group of this peer from the connection configuration"},
+	"lmd_row_age":             {Index: -25, Key: "", Type: IntCol, Description: "Age of the data in seconds since the last update of this peer"},
+	"recent_state_changes":    {Index: -26, Key: "", Type: IntCol, Description: "Estimated number of state changes within the last 21 checks derived from the weighted percent_state_change, null if flap detection is disabled"},
+	"groups":                  {Index: -27, Key: "", Type: StringListCol, Description: "A list of all contactgroups this contact is a member of"},
+	"is_stale":                {Index: -28, Key: "", Type: IntCol, Description: "Flag wether the last update of this peer is older than the StaleDataThreshold (0 - fresh, 1 - stale)"},
+	"lmd_stale_peers":         {Index: -29, Key: "", Type: IntCol, Description: "Number of peers whose last update is older than the StaleDataThreshold"},
+	"lmd_features":            {Index: -30, Key: "", Type: StringListCol, Description: "List of optional features supported by this LMD"},
+}
+
+// MergeDuplicatesKeys contains the columns which identify the same object on different backends.
+var MergeDuplicatesKeys = map[string][]string{
+	"hosts":         {"name"},
+	"services":      {"host_name", "description"},
+	"contacts":      {"name"},
+	"contactgroups": {"name"},
+}
+
+// JSONMapKeys contains the columns used as key for each object in the json_map output format.
+// Multiple columns are joined by a semicolon, ex.: host;service.
+var JSONMapKeys = map[string][]string{
+	"backends":      {"peer_key"},
+	"sites":         {"peer_key"},
+	"status":        {"peer_key"},
+	"timeperiods":   {"name"},
+	"contacts":      {"name"},
+	"contactgroups": {"name"},
+	"commands":      {"name"},
+	"hosts":         {"name"},
+	"hostgroups":    {"name"},
+	"services":      {"host_name", "description"},
+	"servicegroups": {"name"},
+	"comments":      {"id"},
+	"downtimes":     {"id"},
+	"columns":       {"table", "name"},
+	"tables":        {"table", "name"},
+}
+
+// hostStateLabels contains the labels of all host states.
+var hostStateLabels = []string{"UP", "DOWN", "UNREACHABLE"}
+
+// serviceStateLabels contains the labels of all service states.
+var serviceStateLabels = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// StateLabelColumns contains the labels for each state column per table, used with MapStates: on.
+var StateLabelColumns = map[string]map[string][]string{
+	"hosts": {
+		"state":           hostStateLabels,
+		"hard_state":      hostStateLabels,
+		"last_state":      hostStateLabels,
+		"last_hard_state": hostStateLabels,
+	},
+	"services": {
+		"state":           serviceStateLabels,
+		"last_state":      serviceStateLabels,
+		"last_hard_state": serviceStateLabels,
+		"host_state":      hostStateLabels,
+		"host_hard_state": hostStateLabels,
+	},
+}
+
+// mergeStateColumns will use the maximum value when merging duplicates with the worst policy.
+var mergeStateColumns = map[string]bool{
+	"state":           true,
+	"hard_state":      true,
+	"last_hard_state": true,
+	"last_state":      true,
+}
+
+// mergeListColumns contain the entries from all rows when merging duplicates, ex.: contactgroup
+// members differ between backends. All other lists, like the custom variable names and values
+// which have to stay aligned, are taken from a single row.
+var mergeListColumns = map[string]map[string]bool{
+	"contacts":      {"groups": true},
+	"contactgroups": {"members": true},
 }
 
 // Response contains the livestatus response data as long with some meta data
@@ -49,18 +136,212 @@ type Response struct {
 	Error       error
 	Failed      map[string]string
 	Columns     []Column
+	ETag        string
+	PeersRows   int // number of peers which returned at least one row
+	PeersEmpty  int // number of peers which returned no rows
+	Warnings    map[string]string
+	Facets      map[string]FacetCounts
+	facetLock   *sync.Mutex // protects Facets and FilterStats while merging the counts of all peers
+	// number of peers which timed out waiting for the WaitCondition
+	waitTimeouts int32
+	// number of peers which estimated their total from a sample
+	approxTotals int32
+	// results of all queries from a MULTIQUERY request
+	MultiResults []MultiQueryResult
+	// estimated costs for requests with Explain: on
+	Plan *QueryPlan
+	// min, max and avg of all numeric columns for requests with Summary: on
+	Summary map[string]*ColumnSummary
+	// limit and offset actually applied to the result
+	AppliedLimit  int
+	AppliedOffset int
+	// stats accumulators and final stats rows of each peer for requests with PeerStats: on
+	peerStats map[string]map[string][]Filter
+	PeerStats map[string][][]interface{}
+	// rows passing each filter for requests with FilterStats: on
+	FilterStats *FilterStats
+}
+
+// ColumnSummary contains the minimum, maximum and average value of a numeric column.
+// All values are nil if the column contains no values.
+type ColumnSummary struct {
+	Min interface{} `json:"min"`
+	Max interface{} `json:"max"`
+	Avg interface{} `json:"avg"`
+}
+
+// approxTotalSamples sets how many rows are sampled to estimate the total with ApproxTotal: on.
+var approxTotalSamples int64 = 1000
+
+// stripControlChars removes control characters from all strings in responses if set to 1.
+var stripControlChars int32
+
+// defaultLimit sets the limit of client requests without limit, larger limits are reduced to it as well.
+// 0 means unlimited.
+var defaultLimit int64
+
+// maxRowsPerPeer sets the maximum number of rows a single peer may add to a result, 0 means unlimited.
+var maxRowsPerPeer int64
+
+// defaultColumns contains the columns returned for requests without columns header.
+var defaultColumns = make(map[string][]string)
+var defaultColumnsLock = new(sync.RWMutex)
+
+// SetDefaultColumns sets the columns used for requests without columns header.
+// Tables without default columns still return all columns.
+// It returns an error if any table or column does not exist.
+func SetDefaultColumns(columns map[string][]string) error {
+	for name, cols := range columns {
+		table, ok := Objects.Tables[name]
+		if !ok {
+			return fmt.Errorf("table %s does not exist", name)
+		}
+		for _, col := range cols {
+			if _, ok := table.ColumnsIndex[col]; !ok {
+				return fmt.Errorf("table %s has no column %s", name, col)
+			}
+		}
+	}
+	defaultColumnsLock.Lock()
+	defaultColumns = columns
+	defaultColumnsLock.Unlock()
+	return nil
+}
+
+func getDefaultColumns(table string) []string {
+	defaultColumnsLock.RLock()
+	defer defaultColumnsLock.RUnlock()
+	return defaultColumns[table]
+}
+
+// allowedColumns and deniedColumns restrict the columns clients may request for each table.
+var allowedColumns = make(map[string]map[string]bool)
+var deniedColumns = make(map[string]map[string]bool)
+var columnAccessLock = new(sync.RWMutex)
+
+// SetColumnAccess sets the columns clients may use in requests. Tables with allowed
+// columns only permit those columns, denied columns are never permitted.
+// It returns an error if any table or column does not exist.
+func SetColumnAccess(allowed map[string][]string, denied map[string][]string) error {
+	allowedMap, err := columnAccessMap(allowed)
+	if err != nil {
+		return err
+	}
+	deniedMap, err := columnAccessMap(denied)
+	if err != nil {
+		return err
+	}
+	columnAccessLock.Lock()
+	allowedColumns = allowedMap
+	deniedColumns = deniedMap
+	columnAccessLock.Unlock()
+	return nil
+}
+
+func columnAccessMap(columns map[string][]string) (map[string]map[string]bool, error) {
+	access := make(map[string]map[string]bool)
+	for name, cols := range columns {
+		table, ok := Objects.Tables[name]
+		if !ok {
+			return nil, fmt.Errorf("table %s does not exist", name)
+		}
+		access[name] = make(map[string]bool)
+		for _, col := range cols {
+			if _, ok := table.ColumnsIndex[col]; !ok {
+				return nil, fmt.Errorf("table %s has no column %s", name, col)
+			}
+			access[name][col] = true
+		}
+	}
+	return access, nil
+}
+
+// columnPermitted returns true if clients may use the column of the given table.
+func columnPermitted(table string, column string) bool {
+	columnAccessLock.RLock()
+	defer columnAccessLock.RUnlock()
+	if deniedColumns[table][column] {
+		return false
+	}
+	if allowed, ok := allowedColumns[table]; ok && !allowed[column] {
+		return false
+	}
+	return true
+}
+
+func columnNotPermittedError(table string, column string) error {
+	return fmt.Errorf("bad request: column %s is not permitted for table %s", column, table)
+}
+
+// checkColumnAccess returns an error if any filter, stats, sort or facet uses a column
+// which is not permitted, otherwise those could be used to guess hidden values.
+func (req *Request) checkColumnAccess(table *Table) error {
+	for _, filter := range [][]Filter{req.Filter, req.Stats, req.WaitCondition} {
+		if err := checkFilterColumnAccess(table.Name, filter); err != nil {
+			return err
+		}
+	}
+	for _, s := range req.Sort {
+		if !columnPermitted(table.Name, s.Name) {
+			return columnNotPermittedError(table.Name, s.Name)
+		}
+	}
+	for _, col := range req.Facets {
+		if !columnPermitted(table.Name, col) {
+			return columnNotPermittedError(table.Name, col)
+		}
+	}
+	return nil
+}
+
+func checkFilterColumnAccess(table string, filter []Filter) error {
+	for i := range filter {
+		f := &filter[i]
+		if len(f.Filter) > 0 {
+			if err := checkFilterColumnAccess(table, f.Filter); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Column.Name != "" && !columnPermitted(table, f.Column.Name) {
+			return columnNotPermittedError(table, f.Column.Name)
+		}
+	}
+	return nil
 }
 
 // NewResponse creates a new response object for a given request
 // It returns the Response object and any error encountered.
 func NewResponse(req *Request) (res *Response, err error) {
 	res = &Response{
-		Code:    200,
-		Failed:  make(map[string]string),
-		Request: req,
+		Code:      200,
+		Failed:    make(map[string]string),
+		Warnings:  make(map[string]string),
+		Request:   req,
+		facetLock: &sync.Mutex{},
+	}
+
+	table, ok := Objects.Tables[req.Table]
+	if !ok {
+		err = unknownTableError(req.Table)
+		return
+	}
+
+	if req.canceler.IsCanceled() {
+		err = errClientDisconnected
+		return
+	}
+
+	// check the client filters before the auth filters are added
+	err = req.checkColumnAccess(&table)
+	if err != nil {
+		return
 	}
 
-	table, _ := Objects.Tables[req.Table]
+	err = req.applyAuthFilter(&table)
+	if err != nil {
+		return
+	}
 
 	indexes, columns, err := req.BuildResponseIndexes(&table)
 	if err != nil {
@@ -68,6 +349,27 @@ func NewResponse(req *Request) (res *Response, err error) {
 	}
 	res.Columns = columns
 
+	// an empty result without any backend would be misleading
+	if len(DataStore) == 0 {
+		err = errNoBackends
+		return
+	}
+
+	// never checked objects have zero timestamps, time comparisons skip them by default
+	if req.IncludeNever {
+		setIncludeNever(req.Filter)
+		setIncludeNever(req.Stats)
+		setIncludeNever(req.WaitCondition)
+	}
+
+	// progressive responses send the header row before any peer has finished
+	if req.progressive != nil {
+		err = req.progressive.Start(res)
+		if err != nil {
+			return
+		}
+	}
+
 	// check if we have to spin up updates, if so, do it parallel
 	selectedPeers := []string{}
 	spinUpPeers := []string{}
@@ -75,21 +377,77 @@ func NewResponse(req *Request) (res *Response, err error) {
 		selectedPeers = append(selectedPeers, id)
 		p := DataStore[id]
 
-		// spin up required?
-		if p.StatusGet("Idling").(bool) && len(table.DynamicColCacheIndexes) > 0 {
+		// spin up required? slow peers would delay the response, so use their cached data
+		if p.StatusGet("Idling").(bool) && !p.StatusGet("Evicted").(bool) && len(table.DynamicColCacheIndexes) > 0 {
 			spinUpPeers = append(spinUpPeers, id)
 		}
 	}
 
+	selectedPeers = req.orderPeers(selectedPeers)
+
+	if !table.PassthroughOnly && !table.Virtual {
+		selectedPeers, err = res.skipUnsupportedPeers(table.Name, selectedPeers)
+		if err != nil {
+			return
+		}
+	}
+
+	// reject expensive queries before doing any work
+	err = NewQueryComplexity(req, &table, columns, selectedPeers).Check()
+	if err != nil {
+		return
+	}
+
 	// only use the first backend when requesting table or columns table
 	if table.Name == "tables" || table.Name == "columns" {
 		selectedPeers = []string{DataStoreOrder[0]}
-	} else if !table.PassthroughOnly && len(spinUpPeers) > 0 {
-		SpinUpPeers(spinUpPeers)
+	} else if !table.PassthroughOnly {
+		switch req.Consistency {
+		case "fresh":
+			// virtual tables are not fetched from the backends
+			if !table.Virtual {
+				RefreshPeers(selectedPeers, freshDataTimeout)
+			}
+		case "cached":
+			// use the cached data, even from idling peers
+		default:
+			// background queries may prefer cached data over waiting for idling peers
+			if len(spinUpPeers) > 0 && !req.NoSpinUp {
+				SpinUpPeers(spinUpPeers)
+			}
+		}
 	}
 
-	if table.PassthroughOnly {
+	// bytes are counted for all used peers, local data is answered from the cache
+	if req.SendPeerBytes {
+		req.peerBytes = NewPeerBytes(selectedPeers)
+	}
+
+	// raw backend requests and responses for debugging passthrough queries
+	if req.CaptureRaw {
+		req.rawCapture = NewRawCapture()
+	}
+
+	// periodic progress lines while the peers are collecting rows
+	if req.Progress && req.progressive != nil {
+		req.progressive.StartProgress()
+		defer req.progressive.StopProgress()
+	}
+
+	if req.Availability != nil {
+		// state durations calculated from the log table
+		selectedPeers = res.skipEvictedPeers(selectedPeers)
+		err = res.BuildAvailabilityResult(selectedPeers)
+		if err != nil {
+			return
+		}
+	} else if table.PassthroughOnly {
 		// passthrough requests, ex.: log table
+		err = req.checkRequiredFilters()
+		if err != nil {
+			return
+		}
+		selectedPeers = res.skipEvictedPeers(selectedPeers)
 		err = res.BuildPassThroughResult(selectedPeers, &table, &columns)
 		if err != nil {
 			return
@@ -99,89 +457,383 @@ func NewResponse(req *Request) (res *Response, err error) {
 		if err != nil {
 			return
 		}
+		err = checkStatsSamples(res.Request.StatsResult)
+		if err != nil {
+			return
+		}
+	}
+	// no need for post processing if nobody is waiting for the result
+	if req.canceler.IsCanceled() {
+		err = errClientDisconnected
+		return
 	}
 	if res.Result == nil {
 		res.Result = make([][]interface{}, 0)
 	}
 	res.PostProcessing()
+	if req.OutputFormat == "json_map" {
+		_, err = res.mapKeys()
+	}
 	return
 }
 
+// PeerBytes counts the bytes received from each peer while answering a single request.
+type PeerBytes struct {
+	lock  sync.Mutex
+	bytes map[string]int
+}
+
+// NewPeerBytes creates a new PeerBytes counter starting with zero bytes for all given peers.
+func NewPeerBytes(peers []string) *PeerBytes {
+	b := &PeerBytes{bytes: make(map[string]int, len(peers))}
+	for _, id := range peers {
+		b.bytes[id] = 0
+	}
+	return b
+}
+
+// Add adds the received bytes of the given peer. Nothing is counted if there is no counter.
+func (b *PeerBytes) Add(id string, bytes int) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.bytes[id] += bytes
+	b.lock.Unlock()
+}
+
+// Get returns a copy of the received bytes by peer id.
+func (b *PeerBytes) Get() map[string]int {
+	result := make(map[string]int)
+	if b == nil {
+		return result
+	}
+	b.lock.Lock()
+	for id, bytes := range b.bytes {
+		result[id] = bytes
+	}
+	b.lock.Unlock()
+	return result
+}
+
+// maxRawCaptureSize sets the maximum number of bytes kept from each raw backend response.
+const maxRawCaptureSize = 4096
+
+// RawCapture keeps the raw request sent to each peer and the beginning of its raw response.
+type RawCapture struct {
+	lock     sync.Mutex
+	captures map[string]*RawExchange
+}
+
+// RawExchange contains the raw request sent to a single peer and a sample of its response.
+type RawExchange struct {
+	Request      string `json:"request"`
+	Response     string `json:"response"`
+	ResponseSize int    `json:"response_size"`
+}
+
+// NewRawCapture creates a new empty RawCapture.
+func NewRawCapture() *RawCapture {
+	return &RawCapture{captures: make(map[string]*RawExchange)}
+}
+
+// Add stores the request and a sample of the response of the given peer. Nothing is stored if there is no capture.
+func (r *RawCapture) Add(id string, request string, response []byte) {
+	if r == nil {
+		return
+	}
+	sample := response
+	if len(sample) > maxRawCaptureSize {
+		sample = sample[:maxRawCaptureSize]
+	}
+	r.lock.Lock()
+	r.captures[id] = &RawExchange{Request: request, Response: string(sample), ResponseSize: len(response)}
+	r.lock.Unlock()
+}
+
+// Get returns a copy of the captured exchanges by peer id.
+func (r *RawCapture) Get() map[string]RawExchange {
+	result := make(map[string]RawExchange)
+	if r == nil {
+		return result
+	}
+	r.lock.Lock()
+	for id, exchange := range r.captures {
+		result[id] = *exchange
+	}
+	r.lock.Unlock()
+	return result
+}
+
+// orderPeers returns the selected peers in the order their results will be merged.
+// Peers are used in the order of the config file, unless PeerOrder is set to
+// reverse or latency, which puts the peers with the fastest response first.
+func (req *Request) orderPeers(peers []string) []string {
+	selected := make(map[string]bool)
+	for _, id := range peers {
+		selected[id] = true
+	}
+	ordered := make([]string, 0, len(peers))
+	for _, id := range DataStoreOrder {
+		if selected[id] {
+			ordered = append(ordered, id)
+			delete(selected, id)
+		}
+	}
+	// peers not listed in the config, ex.: from tests
+	remaining := make([]string, 0, len(selected))
+	for id := range selected {
+		remaining = append(remaining, id)
+	}
+	sort.Strings(remaining)
+	ordered = append(ordered, remaining...)
+
+	switch req.PeerOrder {
+	case "reverse":
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	case "latency":
+		sort.Stable(peersByLatency(ordered))
+	}
+	return ordered
+}
+
+// mergePeerResults appends the rows of all peers to the result. Rows are grouped by peer,
+// unless an unsorted result is limited and the peers have different weights. Then rows are
+// drawn from all peers in proportion to their weight, so the limited result is a
+// representative sample of all peers.
+func (res *Response) mergePeerResults(peers []string, peerResults [][][]interface{}) {
+	weights := res.peerWeights(peers)
+	if weights == nil {
+		for _, result := range peerResults {
+			res.Result = append(res.Result, result...)
+		}
+		return
+	}
+	res.Result = append(res.Result, weightedRoundRobin(peerResults, weights)...)
+}
+
+// peerWeights returns the weight of each peer or nil if all peers have the same weight
+// or the rows are not drawn by weight at all.
+func (res *Response) peerWeights(peers []string) []int {
+	req := res.Request
+	if req.Limit <= 0 || len(req.Sort) > 0 || len(peers) < 2 {
+		return nil
+	}
+	weights := make([]int, len(peers))
+	equal := true
+	for i, id := range peers {
+		weights[i] = DataStore[id].Config.PeerWeight()
+		if weights[i] != weights[0] {
+			equal = false
+		}
+	}
+	if equal {
+		return nil
+	}
+	return weights
+}
+
+// weightedRoundRobin merges the rows of all peers with a smooth weighted round-robin, which
+// spreads the rows of each peer evenly. Peers without remaining rows are skipped, ties are
+// resolved in the order of the peers.
+func weightedRoundRobin(peerResults [][][]interface{}, weights []int) [][]interface{} {
+	total := 0
+	for _, rows := range peerResults {
+		total += len(rows)
+	}
+	merged := make([][]interface{}, 0, total)
+	positions := make([]int, len(peerResults))
+	current := make([]int, len(peerResults))
+	for len(merged) < total {
+		sum := 0
+		next := -1
+		for i, rows := range peerResults {
+			if positions[i] >= len(rows) {
+				continue
+			}
+			current[i] += weights[i]
+			sum += weights[i]
+			if next < 0 || current[i] > current[next] {
+				next = i
+			}
+		}
+		current[next] -= sum
+		merged = append(merged, peerResults[next][positions[next]])
+		positions[next]++
+	}
+	return merged
+}
+
+// skipEvictedPeers removes peers with a slow response time unless the backends
+// have been requested explicitly. Skipped peers are listed as failed.
+// If all peers are slow, all of them will be used.
+func (res *Response) skipEvictedPeers(peers []string) []string {
+	if len(res.Request.Backends) > 0 {
+		return peers
+	}
+	used := make([]string, 0, len(peers))
+	skipped := []string{}
+	for _, id := range peers {
+		if DataStore[id].StatusGet("Evicted").(bool) {
+			skipped = append(skipped, id)
+			continue
+		}
+		used = append(used, id)
+	}
+	if len(used) == 0 {
+		return peers
+	}
+	for _, id := range skipped {
+		res.Failed[id] = "skipped: slow response time"
+	}
+	return used
+}
+
+// skipUnsupportedPeers removes all peers which do not provide the given table and adds a warning for them.
+// It returns an error if none of the peers supports this table.
+func (res *Response) skipUnsupportedPeers(name string, peers []string) ([]string, error) {
+	used := make([]string, 0, len(peers))
+	for _, id := range peers {
+		if DataStore[id].isUnsupportedTable(name) {
+			res.Warnings[id] = fmt.Sprintf("table %s is not supported by this backend", name)
+			continue
+		}
+		used = append(used, id)
+	}
+	if len(used) == 0 && len(peers) > 0 {
+		return peers, &UnsupportedTableError{Table: name}
+	}
+	return used, nil
+}
+
+// peersByLatency sorts peer ids by their last response time.
+type peersByLatency []string
+
+func (p peersByLatency) Len() int      { return len(p) }
+func (p peersByLatency) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p peersByLatency) Less(i, j int) bool {
+	return peerLatency(p[i]) < peerLatency(p[j])
+}
+
+func peerLatency(id string) float64 {
+	duration := DataStore[id].StatusGet("ReponseTime")
+	return numberToFloat(&duration)
+}
+
 // Len returns the result length used for sorting results.
 func (res Response) Len() int {
 	return len(res.Result)
 }
 
-// Less returns the sort result of two data rows
+// Less returns the sort result of two data rows.
+// Null values are handled the same way for all column types, they are
+// considered lower than any other value, so they come first when sorting
+// ascending and last when sorting descending.
 func (res Response) Less(i, j int) bool {
 	for _, s := range res.Request.Sort {
 		Type := StringFakeSortCol
 		if s.Index != -1 {
 			Type = res.Columns[s.Index].Type
 		}
-		switch Type {
-		case TimeCol:
-			fallthrough
-		case IntCol:
-			fallthrough
-		case FloatCol:
-			valueA := numberToFloat(&(res.Result[i][s.Index]))
-			valueB := numberToFloat(&(res.Result[j][s.Index]))
-			if valueA == valueB {
-				continue
-			}
-			if s.Direction == Asc {
-				return valueA < valueB
-			}
-			return valueA > valueB
-		case StringCol:
-			if s1, ok := res.Result[i][s.Index].(string); ok {
-				if s2, ok := res.Result[j][s.Index].(string); ok {
-					if s1 == s2 {
-						continue
-					}
-					if s.Direction == Asc {
-						return s1 < s2
-					}
-					return s1 > s2
-				}
-			}
-			// not implemented
-			return s.Direction == Asc
-		case StringListCol:
-			// not implemented
-			return s.Direction == Asc
-		case IntListCol:
-			// not implemented
-			return s.Direction == Asc
-		case CustomVarCol:
-			s1, _ := ((*(res.Result[i][s.Index]).(*map[string]interface{}))[s.Args]).(string)
-			s2, _ := ((*(res.Result[j][s.Index]).(*map[string]interface{}))[s.Args]).(string)
-			if s1 == s2 {
-				continue
-			}
-			if s.Direction == Asc {
-				return s1 < s2
-			}
-			return s1 > s2
-		case StringFakeSortCol:
-			if s1, ok := res.Result[i][0].(string); ok {
-				if s2, ok := res.Result[j][0].(string); ok {
-					if s1 == s2 {
-						continue
-					}
-					if s.Direction == Asc {
-						return s1 < s2
-					}
-					return s1 > s2
-				}
-			}
-			// not implemented
-			return s.Direction == Asc
+		valueA := getSortValue(res.Result[i], s, Type)
+		valueB := getSortValue(res.Result[j], s, Type)
+		cmp := compareSortValues(Type, valueA, valueB)
+		if cmp == 0 {
+			// equal values, try next sort key
+			continue
+		}
+		if s.Direction == Asc {
+			return cmp < 0
 		}
-		panic(fmt.Sprintf("sorting not implemented for type %d", Type))
+		return cmp > 0
 	}
-	return true
+	// rows with equal sort keys are ordered by all remaining columns, so the order does not
+	// depend on the order of the backends and pages from offset/limit never overlap.
+	return res.compareRows(i, j) < 0
+}
+
+// compareRows compares all columns of two data rows and returns -1, 0 or 1 like compareSortValues.
+func (res Response) compareRows(i, j int) int {
+	rowA := res.Result[i]
+	rowB := res.Result[j]
+	for k := range res.Columns {
+		if k >= len(rowA) || k >= len(rowB) {
+			break
+		}
+		var cmp int
+		switch colType := res.Columns[k].Type; colType {
+		case TimeCol, IntCol, FloatCol, StringCol:
+			cmp = compareSortValues(colType, rowA[k], rowB[k])
+		default:
+			// lists, custom variables and virtual columns are compared by their string representation
+			cmp = strings.Compare(fmt.Sprintf("%v", rowA[k]), fmt.Sprintf("%v", rowB[k]))
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// getSortValue returns the value from a data row used to sort by the given sort field.
+// Optional sort transformations will be applied to the value.
+func getSortValue(row []interface{}, s *SortField, colType ColumnType) (value interface{}) {
+	switch colType {
+	case StringFakeSortCol:
+		value = row[0]
+	case CustomVarCol:
+		if custommap, ok := row[s.Index].(*map[string]interface{}); ok && custommap != nil {
+			value = (*custommap)[s.Args]
+		}
+	default:
+		value = row[s.Index]
+	}
+	if s.Transform == SortTransformAbs && value != nil {
+		value = math.Abs(numberToFloat(&value))
+	}
+	return
+}
+
+// compareSortValues compares two values of the given column type and returns
+// -1 if a is lower than b, 1 if a is greater than b and 0 if both are equal.
+// Null values are lower than any other value.
+func compareSortValues(colType ColumnType, a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch colType {
+	case TimeCol, IntCol, FloatCol:
+		valueA := numberToFloat(&a)
+		valueB := numberToFloat(&b)
+		switch {
+		case valueA < valueB:
+			return -1
+		case valueA > valueB:
+			return 1
+		}
+		return 0
+	case StringCol, CustomVarCol, StringFakeSortCol:
+		s1, ok1 := a.(string)
+		s2, ok2 := b.(string)
+		if !ok1 {
+			s1 = fmt.Sprintf("%v", a)
+		}
+		if !ok2 {
+			s2 = fmt.Sprintf("%v", b)
+		}
+		return strings.Compare(s1, s2)
+	case StringListCol, IntListCol:
+		// not implemented, treat lists as equal
+		return 0
+	}
+	panic(fmt.Sprintf("sorting not implemented for type %d", colType))
 }
 
 // Swap replaces two data rows while sorting.
@@ -204,7 +856,7 @@ func (req *Request) ExpandRequestedBackends() (err error) {
 	for _, b := range req.Backends {
 		_, Ok := DataStore[b]
 		if !Ok {
-			err = errors.New("bad request: backend " + b + " does not exist")
+			err = unknownBackendError(b)
 			return
 		}
 		req.BackendsMap[b] = b
@@ -212,29 +864,69 @@ func (req *Request) ExpandRequestedBackends() (err error) {
 	return
 }
 
+// maxListedBackends sets how many backends are listed in errors about unknown backends.
+const maxListedBackends = 20
+
+// unknownBackendError returns the error for requests against a backend which does not exist.
+// The valid backends are appended to help the client, long lists are shortened.
+func unknownBackendError(name string) error {
+	available := DataStoreOrder
+	more := ""
+	if len(available) > maxListedBackends {
+		more = fmt.Sprintf(" and %d more", len(available)-maxListedBackends)
+		available = available[:maxListedBackends]
+	}
+	return fmt.Errorf("bad request: backend %s does not exist, available backends: %s%s", name, strings.Join(available, ", "), more)
+}
+
 // PostProcessing does all the post processing required for a request like sorting
 // and cutting of limits, applying offsets and calculating final stats.
 func (res *Response) PostProcessing() {
-	log.Tracef("PostProcessing")
+	logger := res.Request.logger()
+	logger.Tracef("PostProcessing")
+	res.setServerTime()
+
+	// merge duplicate objects from different backends
+	if res.Request.MergeDuplicates != MergeNone {
+		res.MergeDuplicates()
+	}
+
+	// percentile bands are calculated over all matching rows, before sorting and limits
+	if res.Request.PercentileFilter != nil {
+		res.ApplyPercentileFilter()
+		res.ResultTotal = len(res.Result)
+	}
+
 	// sort our result
 	if len(res.Request.Sort) > 0 {
 		// skip sorting if there is only one backend requested and we want the default sort order
 		table := Objects.Tables[res.Request.Table]
 		if len(res.Request.BackendsMap) >= 1 || !table.IsDefaultSortOrder(&res.Request.Sort) {
 			t1 := time.Now()
-			sort.Sort(res)
+			sort.Stable(res)
 			duration := time.Since(t1)
-			log.Debugf("sorting result took %s", duration.String())
+			logger.Debugf("sorting result took %s", duration.String())
 		}
 	}
 
+	// keep the first row of each group, the total is the number of groups
+	if len(res.Request.FirstPerGroup) > 0 {
+		res.FirstPerGroup()
+		res.ResultTotal = len(res.Result)
+	}
+
 	if res.ResultTotal == 0 {
 		res.ResultTotal = len(res.Result)
 	}
 
-	// apply request offset
+	// summary covers all rows, not only the current page
+	if res.Request.Summary {
+		res.CalculateSummary()
+	}
+
+	// apply request offset, progressive responses have sent and counted their rows already
 	if res.Request.Offset > 0 {
-		if res.Request.Offset > res.ResultTotal {
+		if res.Request.Offset > len(res.Result) {
 			res.Result = make([][]interface{}, 0)
 		} else {
 			res.Result = res.Result[res.Request.Offset:]
@@ -245,59 +937,572 @@ func (res *Response) PostProcessing() {
 	if res.Request.Limit > 0 && res.Request.Limit < len(res.Result) {
 		res.Result = res.Result[0:res.Request.Limit]
 	}
+	res.AppliedLimit = res.Request.Limit
+	res.AppliedOffset = res.Request.Offset
 
 	// final calculation of stats querys
 	res.CalculateFinalStats()
-	return
-}
+
+	// replace state numbers with labels if requested
+	res.MapStates()
+
+	// replace 0 and 1 of boolean columns with json booleans if requested
+	res.MapBooleans()
+
+	// round float columns if requested
+	res.RoundFloats()
+
+	// render timestamps in the timezone of their peer if requested
+	res.FormatTimes()
+
+	// replace null values if requested
+	res.ReplaceNullValues()
+
+	// remove control characters if configured
+	res.StripControlChars()
+
+	// remove columns which were only requested for sorting or filtering
+	res.StripHiddenColumns()
+
+	// etags are expensive for large results, so they are only calculated for conditional requests or on demand
+	if res.Request.IfNoneMatch != "" || res.Request.SendETag {
+		res.CalculateETag()
+		if res.Request.IfNoneMatch == res.ETag {
+			// not modified, send empty response
+			res.Code = 304
+			res.Result = make([][]interface{}, 0)
+		}
+	}
+	return
+}
+
+// CalculateSummary calculates the minimum, maximum and average value of each numeric column.
+// Null values are ignored.
+func (res *Response) CalculateSummary() {
+	req := res.Request
+	res.Summary = make(map[string]*ColumnSummary)
+	for i, col := range res.Columns {
+		if i >= len(req.Columns) {
+			break
+		}
+		if req.HiddenColumns[i] {
+			continue
+		}
+		switch col.Type {
+		case IntCol, FloatCol, TimeCol:
+		default:
+			continue
+		}
+		header := req.Columns[i]
+		if alias, ok := req.ColumnAliases[i]; ok {
+			header = alias
+		}
+		summary := &ColumnSummary{}
+		res.Summary[header] = summary
+		count := 0
+		sum := 0.0
+		min := 0.0
+		max := 0.0
+		for _, row := range res.Result {
+			if row[i] == nil {
+				continue
+			}
+			value := numberToFloat(&row[i])
+			if count == 0 || value < min {
+				min = value
+			}
+			if count == 0 || value > max {
+				max = value
+			}
+			sum += value
+			count++
+		}
+		if count > 0 {
+			summary.Min = min
+			summary.Max = max
+			summary.Avg = sum / float64(count)
+		}
+	}
+}
+
+// ReplaceNullValues replaces all null values in the result according to the NullValue header.
+// Null values will be replaced by an empty string or by the zero value of the column type.
+func (res *Response) ReplaceNullValues() {
+	res.replaceNullValues(res.Result)
+}
+
+// replaceNullValues replaces the null values of the given rows.
+func (res *Response) replaceNullValues(rows [][]interface{}) {
+	mode := res.Request.NullValue
+	if mode == "" || mode == "null" {
+		return
+	}
+	for _, row := range rows {
+		for i := range row {
+			if row[i] != nil {
+				continue
+			}
+			if mode == "empty" {
+				row[i] = ""
+				continue
+			}
+			// stats values are always numbers
+			colType := FloatCol
+			if i < len(res.Columns) {
+				colType = res.Columns[i].Type
+			}
+			row[i] = zeroValue(colType)
+		}
+	}
+}
+
+// RoundFloats rounds all float columns to the number of decimals from the FloatPrecision
+// header. Columns with their own format directive and stats values are not changed.
+func (res *Response) RoundFloats() {
+	res.roundFloats(res.Result)
+}
+
+// roundFloats rounds the float columns of the given rows.
+func (res *Response) roundFloats(rows [][]interface{}) {
+	format := res.Request.FloatPrecision
+	if format == nil {
+		return
+	}
+	floatColumns := []int{}
+	for i, col := range res.Columns {
+		if _, ok := res.Request.ColumnFormats[i]; ok {
+			continue
+		}
+		if col.Type == FloatCol {
+			floatColumns = append(floatColumns, i)
+		}
+	}
+	for _, row := range rows {
+		for _, i := range floatColumns {
+			if i < len(row) && row[i] != nil {
+				row[i] = format.Apply(row[i])
+			}
+		}
+	}
+}
+
+// peerTime is a timestamp along with the timezone of the peer it belongs to.
+// It keeps the numeric value for sorting and merging until the response is formatted.
+type peerTime struct {
+	Unix     float64
+	Location *time.Location
+}
+
+// String returns the timestamp as ISO 8601 string with the offset of its timezone.
+func (t *peerTime) String() string {
+	sec := int64(t.Unix)
+	nsec := int64((t.Unix - float64(sec)) * 1e9)
+	return time.Unix(sec, nsec).In(t.Location).Format(time.RFC3339)
+}
+
+// MarshalJSON is used for rows which are sent before FormatTimes, ex.: progressive responses.
+func (t *peerTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// timeColumns returns the indexes of all timestamp columns without format directive,
+// if timestamps should be returned as ISO strings.
+func (res *Response) timeColumns() (indexes []int) {
+	if res.Request.TimeFormat != "iso" || len(res.Request.Stats) > 0 {
+		return
+	}
+	for i, col := range res.Columns {
+		if _, ok := res.Request.ColumnFormats[i]; ok {
+			continue
+		}
+		if col.IsTimestamp() {
+			indexes = append(indexes, i)
+		}
+	}
+	return
+}
+
+// localizeTimes attaches the timezone of the peer to all timestamps of its result.
+// Zero timestamps mean never and are replaced by null.
+func (res *Response) localizeTimes(peer *Peer, result [][]interface{}) {
+	indexes := res.timeColumns()
+	if len(indexes) == 0 {
+		return
+	}
+	for _, row := range result {
+		for _, i := range indexes {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			value := numberToFloat(&row[i])
+			if value == 0 {
+				row[i] = nil
+				continue
+			}
+			row[i] = &peerTime{Unix: value, Location: peer.Location}
+		}
+	}
+}
+
+// FormatTimes replaces all timestamps by ISO 8601 strings if requested by TimeFormat: iso.
+// Timestamps without a peer, ex.: lmd_time, use the local timezone.
+func (res *Response) FormatTimes() {
+	indexes := res.timeColumns()
+	if len(indexes) == 0 {
+		return
+	}
+	for _, row := range res.Result {
+		for _, i := range indexes {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			switch v := row[i].(type) {
+			case *peerTime:
+				row[i] = v.String()
+			case int64:
+				local := peerTime{Unix: float64(v), Location: time.Local}
+				row[i] = local.String()
+			case string:
+			default:
+				local := peerTime{Unix: numberToFloat(&row[i]), Location: time.Local}
+				row[i] = local.String()
+			}
+		}
+	}
+}
+
+// MapBooleans replaces the values of all BooleanColumns with json booleans if requested
+// by MapBooleans: on. Columns with a format directive and stats results are never mapped.
+func (res *Response) MapBooleans() {
+	res.mapBooleans(res.Result)
+}
+
+// mapBooleans replaces the boolean columns of the given rows with json booleans.
+func (res *Response) mapBooleans(rows [][]interface{}) {
+	if !res.Request.MapBooleans || len(res.Request.Stats) > 0 {
+		return
+	}
+	table, ok := Objects.Tables[res.Request.Table]
+	if !ok {
+		return
+	}
+	booleanColumns := []int{}
+	for i := range res.Columns {
+		if _, ok := res.Request.ColumnFormats[i]; ok {
+			continue
+		}
+		col, ok := table.ColumnsIndex[res.Columns[i].Name]
+		if ok && isBooleanColumn(&table, &table.Columns[col]) {
+			booleanColumns = append(booleanColumns, i)
+		}
+	}
+	for _, row := range rows {
+		for _, i := range booleanColumns {
+			if i < len(row) && row[i] != nil {
+				row[i] = numberToFloat(&row[i]) != 0
+			}
+		}
+	}
+}
+
+// MapStates replaces the values of known state columns with their labels if requested
+// by MapStates: on. Unknown states and all other columns keep their numeric values.
+// Stats results are never mapped.
+func (res *Response) MapStates() {
+	res.mapStates(res.Result)
+}
+
+// mapStates replaces the states of the given rows with their labels.
+func (res *Response) mapStates(rows [][]interface{}) {
+	if !res.Request.MapStates || len(res.Request.Stats) > 0 {
+		return
+	}
+	labelColumns, ok := StateLabelColumns[res.Request.Table]
+	if !ok {
+		return
+	}
+	labels := make(map[int][]string)
+	for i, col := range res.Columns {
+		if l, ok := labelColumns[col.Name]; ok {
+			labels[i] = l
+		}
+	}
+	if len(labels) == 0 {
+		return
+	}
+	for _, row := range rows {
+		for i, l := range labels {
+			if i >= len(row) {
+				continue
+			}
+			var state int
+			switch v := row[i].(type) {
+			case float64:
+				if v != math.Trunc(v) {
+					continue
+				}
+				state = int(v)
+			case int:
+				state = v
+			default:
+				continue
+			}
+			if state < 0 || state >= len(l) {
+				continue
+			}
+			row[i] = l[state]
+		}
+	}
+}
+
+// StripControlChars removes control characters from all strings in the result if enabled by StripControlChars.
+// Stats results contain numbers only.
+func (res *Response) StripControlChars() {
+	if atomic.LoadInt32(&stripControlChars) == 0 || len(res.Request.Stats) > 0 {
+		return
+	}
+	for _, row := range res.Result {
+		stripRowControlChars(row)
+	}
+}
+
+// stripRowControlChars removes control characters from all string values of the row.
+func stripRowControlChars(row []interface{}) {
+	for i := range row {
+		if s, ok := row[i].(string); ok {
+			row[i] = removeControlChars(s)
+		}
+	}
+}
+
+// removeControlChars replaces newlines, carriage returns and tabs by a space and removes all other control characters.
+func removeControlChars(s string) string {
+	found := false
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// zeroValue returns the zero value for the given column type.
+func zeroValue(colType ColumnType) interface{} {
+	switch colType {
+	case IntCol, FloatCol, TimeCol:
+		return 0.0
+	case StringListCol, IntListCol:
+		return make([]interface{}, 0)
+	case CustomVarCol:
+		return make(map[string]interface{})
+	}
+	return ""
+}
+
+// MergeDuplicates merges rows of the same object returned by multiple backends.
+// Timestamps always use the latest value and the group lists of contacts and contactgroups
+// contain the entries from all rows. The worst policy uses the maximum of all state columns,
+// the latest policy uses the row with the most recent last_check and the preferred policy
+// uses the row of the backend listed first in MergePreferredPeers. With keep, the row chosen
+// by the policy is kept unchanged, the worst policy keeps the row with the highest state then.
+// If rows are equal by the policy, the first row is used.
+func (res *Response) MergeDuplicates() {
+	keys, _ := getMergeKeys(res.Request.Table)
+	policyColumn := res.Request.MergeDuplicates.column(res.Request.MergeKeep)
+	keyIndexes := []int{}
+	policyIndex := -1
+	for i, col := range res.Columns {
+		for _, key := range keys {
+			if col.Name == key {
+				keyIndexes = append(keyIndexes, i)
+			}
+		}
+		if col.Name == policyColumn && policyIndex == -1 {
+			policyIndex = i
+		}
+	}
+
+	mergeLock.RLock()
+	preferred := mergePreferredPeers
+	mergeLock.RUnlock()
+
+	merged := make([][]interface{}, 0, len(res.Result))
+	seen := make(map[string]int)
+	for _, row := range res.Result {
+		keyValues := make([]string, len(keyIndexes))
+		for k, i := range keyIndexes {
+			keyValues[k] = fmt.Sprintf("%v", row[i])
+		}
+		key := strings.Join(keyValues, ";")
+		pos, ok := seen[key]
+		if !ok {
+			seen[key] = len(merged)
+			merged = append(merged, row)
+			continue
+		}
+		if res.Request.MergeKeep {
+			if res.mergePrefer(row, merged[pos], policyIndex, preferred) {
+				merged[pos] = row
+			}
+			continue
+		}
+		merged[pos] = res.mergeRows(merged[pos], row, policyIndex, preferred)
+	}
+	res.Result = merged
+	res.ResultTotal = len(merged)
+}
+
+// mergeRows returns a new row build from two rows of the same object.
+func (res *Response) mergeRows(rowA, rowB []interface{}, policyIndex int, preferred map[string]int) []interface{} {
+	if res.mergePrefer(rowB, rowA, policyIndex, preferred) {
+		rowA, rowB = rowB, rowA
+	}
+	row := make([]interface{}, len(rowA))
+	copy(row, rowA)
+	listColumns := mergeListColumns[res.Request.Table]
+	for i, col := range res.Columns {
+		switch {
+		case listColumns[col.Name]:
+			row[i] = mergeStringLists(row[i], rowB[i])
+			continue
+		case col.IsTimestamp():
+		case res.Request.MergeDuplicates == MergeWorst && mergeStateColumns[col.Name]:
+		default:
+			continue
+		}
+		if compareSortValues(col.Type, rowB[i], row[i]) > 0 {
+			row[i] = rowB[i]
+		}
+	}
+	return row
+}
+
+// mergeStringLists returns the union of both lists, entries keep their first position.
+func mergeStringLists(listA, listB interface{}) []interface{} {
+	merged := make([]interface{}, 0)
+	seen := make(map[interface{}]bool)
+	for _, list := range []interface{}{listA, listB} {
+		values, ok := list.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, val := range values {
+			if !seen[val] {
+				seen[val] = true
+				merged = append(merged, val)
+			}
+		}
+	}
+	return merged
+}
+
+// CalculateETag sets the etag of this response which is a hash over the final result.
+// Clients may send it back in the IfNoneMatch header and will get an empty response
+// with code 304 if the result has not changed.
+func (res *Response) CalculateETag() {
+	hash := fnv.New64a()
+	enc := NewRowEncoder(hash)
+	enc.Encode(res.ResultTotal)
+	enc.Encode(res.Result)
+	res.ETag = fmt.Sprintf("%016x", hash.Sum64())
+}
 
 // CalculateFinalStats calculates final averages and sums from stats queries
 func (res *Response) CalculateFinalStats() {
 	if len(res.Request.Stats) == 0 {
 		return
 	}
+
+	// the breakdown of each peer is built like the final result
+	if res.Request.SendPeerStats {
+		res.PeerStats = make(map[string][][]interface{})
+		for id, statsResult := range res.peerStats {
+			res.Result = res.statsRows(statsResult)
+			res.sortStatsRows()
+			res.PeerStats[id] = res.Result
+		}
+	}
+
+	res.Result = res.statsRows(res.Request.StatsResult)
+	res.sortStatsRows()
+}
+
+// statsRows converts stats accumulators into result rows. Expected StatsGroups without
+// any matches and the single row of ungrouped stats are added with empty stats.
+func (res *Response) statsRows(statsResult map[string][]Filter) [][]interface{} {
 	hasColumns := len(res.Request.Columns)
-	if hasColumns == 0 && len(res.Request.StatsResult) == 0 {
-		if res.Request.StatsResult == nil {
-			res.Request.StatsResult = make(map[string][]Filter)
+	keys := []string{}
+	for key := range statsResult {
+		keys = append(keys, key)
+	}
+	if hasColumns == 0 && len(statsResult) == 0 {
+		keys = append(keys, "")
+	}
+	// add expected groups without any matches
+	for _, group := range res.Request.StatsGroups {
+		if _, ok := statsResult[group]; !ok {
+			keys = append(keys, group)
 		}
-		res.Request.StatsResult[""] = createLocalStatsCopy(&res.Request.Stats)
 	}
-	res.Result = make([][]interface{}, len(res.Request.StatsResult))
 
-	j := 0
-	for key, stats := range res.Request.StatsResult {
-		rowSize := len(stats)
-		rowSize += hasColumns
-		res.Result[j] = make([]interface{}, rowSize)
+	rows := make([][]interface{}, 0, len(keys))
+	added := make(map[string]bool)
+	for _, key := range keys {
+		if added[key] {
+			continue
+		}
+		added[key] = true
+		stats, ok := statsResult[key]
+		if !ok {
+			stats = createLocalStatsCopy(&res.Request.Stats)
+		}
+		row := make([]interface{}, len(stats)+hasColumns)
 		if hasColumns > 0 {
 			for i, keyPart := range strings.Split(key, ";") {
-				res.Result[j][i] = keyPart
+				row[i] = res.statsKeyValue(i, keyPart)
 			}
 		}
 		for i, s := range stats {
 			i += hasColumns
 
-			finalStatsApply(s, &res.Result[j][i])
+			finalStatsApply(s, &row[i])
 
 			if res.Request.SendStatsData {
-				res.Result[j][i] = []interface{}{s.Stats, s.StatsCount}
+				row[i] = []interface{}{s.Stats, s.StatsCount}
 				continue
 			}
 
 		}
-		j++
+		rows = append(rows, row)
 	}
+	return rows
+}
 
-	/* sort by columns for grouped stats */
+// sortStatsRows sorts the result rows of grouped stats by all group columns.
+func (res *Response) sortStatsRows() {
+	hasColumns := len(res.Request.Columns)
 	if hasColumns > 0 {
 		t1 := time.Now()
-		// fake sort column
-		if hasColumns > 0 {
-			res.Request.Sort = []*SortField{}
-			for x := 0; x < hasColumns; x++ {
-				res.Request.Sort = append(res.Request.Sort, &SortField{Name: "name", Index: -1, Direction: Asc})
+		// sort by all group columns, so the order is stable for multiple columns as well
+		res.Request.Sort = []*SortField{}
+		for x := 0; x < hasColumns; x++ {
+			index := x
+			if x >= len(res.Columns) {
+				index = -1
 			}
+			res.Request.Sort = append(res.Request.Sort, &SortField{Name: "name", Index: index, Direction: Asc})
 		}
 		sort.Sort(res)
 		duration := time.Since(t1)
@@ -306,6 +1511,20 @@ func (res *Response) CalculateFinalStats() {
 	}
 }
 
+// statsKeyValue converts a part of the stats group key back into the type of the group column.
+func (res *Response) statsKeyValue(i int, keyPart string) interface{} {
+	if i >= len(res.Columns) {
+		return keyPart
+	}
+	switch res.Columns[i].Type {
+	case IntCol, FloatCol, TimeCol:
+		if value, err := strconv.ParseFloat(keyPart, 64); err == nil {
+			return value
+		}
+	}
+	return keyPart
+}
+
 func finalStatsApply(s Filter, res *interface{}) {
 	switch s.StatsType {
 	case Counter:
@@ -327,6 +1546,15 @@ func finalStatsApply(s Filter, res *interface{}) {
 			*res = 0
 		}
 		break
+	case Median:
+		*res = s.StatsSamples.Percentile(50)
+		break
+	case Percentile:
+		*res = s.StatsSamples.Percentile(s.StatsPercentile)
+		break
+	case CountDistinct:
+		*res = float64(len(s.StatsDistinct))
+		break
 	default:
 		log.Panicf("not implemented")
 		break
@@ -336,20 +1564,196 @@ func finalStatsApply(s Filter, res *interface{}) {
 	}
 }
 
+// checkStatsSamples returns an error if exact median or percentile stats had to drop values.
+func checkStatsSamples(statsResult map[string][]Filter) error {
+	for _, stats := range statsResult {
+		for i := range stats {
+			if stats[i].StatsSamples != nil && stats[i].StatsSamples.Overflow {
+				return errTooManySamples
+			}
+		}
+	}
+	return nil
+}
+
+// expandColumnsWildcard replaces the * column by all columns of the table, except the
+// ones requested explicitly, which keep their position, alias and format.
+func (req *Request) expandColumnsWildcard(table *Table) error {
+	hasWildcard := false
+	explicit := make(map[string]bool)
+	for j, col := range req.Columns {
+		if col != "*" {
+			explicit[strings.ToLower(col)] = true
+			continue
+		}
+		hasWildcard = true
+		_, hasFormat := req.ColumnFormats[j]
+		_, hasAlias := req.ColumnAliases[j]
+		if hasFormat || hasAlias {
+			return errors.New("bad request: Columns: * cannot have a format or an alias")
+		}
+		if req.HiddenColumns[j] {
+			return errors.New("bad request: Columns: * cannot be hidden")
+		}
+	}
+	if !hasWildcard {
+		return nil
+	}
+	if len(req.Stats) > 0 {
+		return errors.New("bad request: Columns: * cannot be used with stats queries")
+	}
+
+	columns := []string{}
+	var formats map[int]*ColumnFormat
+	var aliases map[int]string
+	var hidden map[int]bool
+	expanded := false
+	for j, col := range req.Columns {
+		if col == "*" {
+			// multiple wildcards are expanded only once
+			if !expanded {
+				for _, c := range table.Columns {
+					if c.Update != RefUpdate && !explicit[c.Name] && columnPermitted(table.Name, c.Name) {
+						columns = append(columns, c.Name)
+					}
+				}
+				expanded = true
+			}
+			continue
+		}
+		if format, ok := req.ColumnFormats[j]; ok {
+			if formats == nil {
+				formats = make(map[int]*ColumnFormat)
+			}
+			formats[len(columns)] = format
+		}
+		if alias, ok := req.ColumnAliases[j]; ok {
+			if aliases == nil {
+				aliases = make(map[int]string)
+			}
+			aliases[len(columns)] = alias
+		}
+		if req.HiddenColumns[j] {
+			if hidden == nil {
+				hidden = make(map[int]bool)
+			}
+			hidden[len(columns)] = true
+		}
+		columns = append(columns, col)
+	}
+	req.Columns = columns
+	req.ColumnFormats = formats
+	req.ColumnAliases = aliases
+	req.HiddenColumns = hidden
+	// like requests without columns, clients do not know the order of the columns
+	req.SendColumnsHeader = true
+	return nil
+}
+
+// removeDuplicateColumns removes columns which are requested more than once with the same
+// format and alias, or rejects them with DuplicateColumns: reject.
+func (req *Request) removeDuplicateColumns(table *Table) error {
+	seen := make(map[string]bool)
+	duplicates := make(map[int]bool)
+	for j, col := range req.Columns {
+		col = strings.ToLower(col)
+		if _, ok := table.ColumnsIndex[col]; !ok {
+			fixBrokenClientsRequestColumn(&col, table.Name)
+		}
+		key := col
+		if format, ok := req.ColumnFormats[j]; ok {
+			key += ":" + format.String()
+		}
+		if alias, ok := req.ColumnAliases[j]; ok {
+			key += " as " + alias
+		}
+		if req.HiddenColumns[j] {
+			key += " hidden"
+		}
+		if !seen[key] {
+			seen[key] = true
+			continue
+		}
+		if req.DuplicateColumns == "reject" {
+			return fmt.Errorf("bad request: column %s is requested more than once", col)
+		}
+		duplicates[j] = true
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+
+	columns := []string{}
+	var formats map[int]*ColumnFormat
+	var aliases map[int]string
+	var hidden map[int]bool
+	for j, col := range req.Columns {
+		if duplicates[j] {
+			continue
+		}
+		if format, ok := req.ColumnFormats[j]; ok {
+			if formats == nil {
+				formats = make(map[int]*ColumnFormat)
+			}
+			formats[len(columns)] = format
+		}
+		if alias, ok := req.ColumnAliases[j]; ok {
+			if aliases == nil {
+				aliases = make(map[int]string)
+			}
+			aliases[len(columns)] = alias
+		}
+		if req.HiddenColumns[j] {
+			if hidden == nil {
+				hidden = make(map[int]bool)
+			}
+			hidden[len(columns)] = true
+		}
+		columns = append(columns, col)
+	}
+	req.Columns = columns
+	req.ColumnFormats = formats
+	req.ColumnAliases = aliases
+	req.HiddenColumns = hidden
+	return nil
+}
+
 // BuildResponseIndexes returns a list of used indexes and columns for this request.
 func (req *Request) BuildResponseIndexes(table *Table) (indexes []int, columns []Column, err error) {
-	log.Tracef("BuildResponseIndexes")
+	req.logger().Tracef("BuildResponseIndexes")
+	if req.Availability != nil {
+		columns, err = req.availabilityIndexes(table)
+		return
+	}
 	requestColumnsMap := make(map[string]int)
+	err = req.expandColumnsWildcard(table)
+	if err != nil {
+		return
+	}
+	err = req.removeDuplicateColumns(table)
+	if err != nil {
+		return
+	}
 	// if no column header was given, return all columns
 	// but only if this is no stats query
 	if len(req.Columns) == 0 && len(req.Stats) == 0 {
 		req.SendColumnsHeader = true
-		for _, col := range table.Columns {
-			if col.Update != RefUpdate {
-				req.Columns = append(req.Columns, col.Name)
+		for _, col := range getDefaultColumns(table.Name) {
+			if columnPermitted(table.Name, col) {
+				req.Columns = append(req.Columns, col)
+			}
+		}
+		if len(req.Columns) == 0 {
+			for _, col := range table.Columns {
+				if col.Update != RefUpdate && columnPermitted(table.Name, col.Name) {
+					req.Columns = append(req.Columns, col.Name)
+				}
 			}
 		}
 	}
+	// the column used to choose between duplicates does not have to be requested
+	req.addMergePolicyColumn(table)
+
 	// build array of requested columns as Column objects list
 	for j, col := range req.Columns {
 		col = strings.ToLower(col)
@@ -361,15 +1765,41 @@ func (req *Request) BuildResponseIndexes(table *Table) (indexes []int, columns [
 			}
 			i, _ = table.ColumnsIndex[col]
 		}
+		if !columnPermitted(table.Name, col) {
+			err = columnNotPermittedError(table.Name, col)
+			return
+		}
+		// sort and key columns refer to the first occurrence of a column
+		if _, ok := requestColumnsMap[col]; !ok {
+			requestColumnsMap[col] = j
+		}
 		if table.Columns[i].Type == VirtCol {
 			indexes = append(indexes, VirtKeyMap[col].Index)
 			columns = append(columns, Column{Name: col, Type: VirtKeyMap[col].Type, Index: j, RefIndex: i})
-			requestColumnsMap[col] = j
 			continue
 		}
 		indexes = append(indexes, i)
-		columns = append(columns, Column{Name: col, Type: table.Columns[i].Type, Index: j})
-		requestColumnsMap[col] = j
+		columns = append(columns, Column{Name: col, Type: table.Columns[i].Type, Index: j, Timestamp: table.Columns[i].Timestamp})
+	}
+
+	// check wether our format directives can be applied
+	for j, f := range req.ColumnFormats {
+		if !f.IsSupported(columns[j].Type) {
+			err = fmt.Errorf("bad request: column format %s is not supported for column %s", f.String(), req.Columns[j])
+			return
+		}
+	}
+
+	// columns are used as group by keys for stats queries
+	if len(req.Stats) > 0 {
+		err = req.validateStatsColumns(table, columns)
+		if err != nil {
+			return
+		}
+	}
+	err = req.validateStatsGroups()
+	if err != nil {
+		return
 	}
 
 	// check wether our sort columns do exist in the output
@@ -384,36 +1814,279 @@ func (req *Request) BuildResponseIndexes(table *Table) (indexes []int, columns [
 			err = errors.New("bad request: sort column " + s.Name + " not in result set")
 			return
 		}
-		s.Index = i
+		s.Index = i
+		if s.Transform != SortTransformNone {
+			switch columns[i].Type {
+			case IntCol, FloatCol, TimeCol:
+			default:
+				err = fmt.Errorf("bad request: sort transform %s is not supported for column %s", s.Transform.String(), s.Name)
+				return
+			}
+		}
+	}
+
+	// keep only the first row of each group
+	if len(req.FirstPerGroup) > 0 {
+		err = req.validateFirstPerGroup(requestColumnsMap)
+		if err != nil {
+			return
+		}
+	}
+
+	// keep only rows within the percentile band of a numeric column
+	if req.PercentileFilter != nil {
+		err = req.validatePercentileFilter(table, requestColumnsMap, columns)
+		if err != nil {
+			return
+		}
+	}
+
+	// split rows by the values of a column of the result
+	if req.SplitBy != "" {
+		err = req.validateSplitBy(requestColumnsMap, columns)
+		if err != nil {
+			return
+		}
+	}
+
+	// median and percentile stats buffer their values, countdistinct stats collect all distinct values
+	for i := range req.Stats {
+		s := &(req.Stats[i])
+		switch s.StatsType {
+		case Median, Percentile:
+			s.StatsSamples = NewStatsSamples(req.StatsApprox)
+		case CountDistinct:
+			s.StatsDistinct = make(map[string]bool)
+		}
+	}
+
+	// rows are sent unsorted as soon as they arrive in progressive mode
+	if req.Progressive {
+		switch {
+		case req.OutputFormat != "ndjson":
+			err = errors.New("bad request: progressive mode requires OutputFormat: ndjson")
+		case len(req.Sort) > 0:
+			err = errors.New("bad request: progressive mode cannot be used with Sort")
+		case len(req.Stats) > 0:
+			err = errors.New("bad request: progressive mode cannot be used with Stats")
+		case req.ResponseFixed16:
+			err = errors.New("bad request: progressive mode cannot be used with ResponseHeader: fixed16")
+		case req.MergeDuplicates != MergeNone:
+			err = errors.New("bad request: progressive mode cannot be used with MergeDuplicates")
+		case req.IfNoneMatch != "":
+			err = errors.New("bad request: progressive mode cannot be used with IfNoneMatch")
+		case len(req.FirstPerGroup) > 0:
+			err = errors.New("bad request: progressive mode cannot be used with FirstPerGroup")
+		case req.PercentileFilter != nil:
+			err = errors.New("bad request: progressive mode cannot be used with PercentileFilter")
+		}
+		if err != nil {
+			return
+		}
+	}
+	if req.Progress && !req.Progressive {
+		err = errors.New("bad request: Progress requires Progressive: on")
+		return
+	}
+
+	// facets count the distinct values of a column
+	for _, name := range req.Facets {
+		i, ok := table.ColumnsIndex[name]
+		switch {
+		case !ok:
+			err = fmt.Errorf("bad request: table %s has no column %s", req.Table, name)
+		case table.PassthroughOnly:
+			err = fmt.Errorf("bad request: facets are not supported for table %s", req.Table)
+		case len(req.Stats) > 0:
+			err = errors.New("bad request: facets cannot be used with stats queries")
+		case table.Columns[i].Type == CustomVarCol:
+			err = fmt.Errorf("bad request: facets are not supported for column %s", name)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// check wether duplicates can be merged
+	if req.MergeDuplicates != MergeNone {
+		keys, ok := getMergeKeys(req.Table)
+		if !ok {
+			err = fmt.Errorf("bad request: merging duplicates is not supported for table %s", req.Table)
+			return
+		}
+		if len(req.Stats) > 0 {
+			err = errors.New("bad request: merging duplicates is not supported for stats queries")
+			return
+		}
+		// the policy column is added as hidden column if the table has it
+		if col := req.MergeDuplicates.column(req.MergeKeep); col != "" {
+			if _, ok := table.ColumnsIndex[col]; !ok {
+				err = fmt.Errorf("bad request: merging duplicates by %s is not supported for table %s", col, req.Table)
+				return
+			}
+		}
+		for _, col := range keys {
+			if _, ok := requestColumnsMap[col]; !ok {
+				err = fmt.Errorf("bad request: column %s is required to merge duplicates", col)
+				return
+			}
+		}
+	}
+
+	// the breakdown is only available for stats queries
+	if req.SendPeerStats && len(req.Stats) == 0 {
+		err = errors.New("bad request: PeerStats requires Stats headers")
+		return
+	}
+
+	// fresh data requires updating idling peers
+	if req.NoSpinUp && req.Consistency == "fresh" {
+		err = errors.New("bad request: NoSpinUp cannot be used with Consistency: fresh")
+		return
+	}
+
+	// summaries are calculated from result rows only
+	if req.Summary && len(req.Stats) > 0 {
+		err = errors.New("bad request: summary cannot be used with stats queries")
+		return
+	}
+
+	// the json_map output uses the key columns as object keys
+	if req.OutputFormat == "json_map" {
+		keys, ok := JSONMapKeys[req.Table]
+		if !ok {
+			err = fmt.Errorf("bad request: json_map output is not supported for table %s", req.Table)
+			return
+		}
+		if len(req.Stats) > 0 {
+			err = errors.New("bad request: json_map output is not supported for stats queries")
+			return
+		}
+		for _, col := range keys {
+			if _, ok := requestColumnsMap[col]; !ok {
+				err = fmt.Errorf("bad request: column %s is required for json_map output", col)
+				return
+			}
+		}
+	}
+
+	// hidden columns are removed from the rows after all other processing
+	if len(req.HiddenColumns) > 0 {
+		err = req.validateHiddenColumns()
+		if err != nil {
+			return
+		}
+	}
+
+	// filters of passthrough queries are applied by the backends
+	if req.FilterStats && table.PassthroughOnly {
+		err = fmt.Errorf("bad request: FilterStats is not supported for table %s, filters are applied by the backends", req.Table)
+		return
+	}
+	// sampled rows would not be counted
+	if req.FilterStats && req.ApproxTotal {
+		err = errors.New("bad request: FilterStats cannot be used with ApproxTotal")
+		return
+	}
+	// only passthrough queries send requests to the backends while answering
+	if req.CaptureRaw && !table.PassthroughOnly {
+		err = fmt.Errorf("bad request: CaptureRaw is not supported for table %s, only for passthrough tables", req.Table)
+		return
+	}
+	// the limit applies to the groups, so it cannot restrict the rows fetched from the backends
+	if table.PassthroughOnly && len(req.FirstPerGroup) > 0 && !hasTimeFilter(req.Filter) {
+		err = fmt.Errorf("bad request: FirstPerGroup queries on table %s require a time filter, ex.: Filter: time >= <timestamp>", req.Table)
+		return
+	}
+
+	return
+}
+
+// validateStatsColumns returns an error if the requested columns cannot be used to group stats.
+// Passthrough tables are answered by the backends directly and their stats results cannot be merged,
+// so stats are rejected for them instead of returning the stats of the empty local result.
+func (req *Request) validateStatsColumns(table *Table, columns []Column) error {
+	if table.PassthroughOnly {
+		return fmt.Errorf("bad request: stats are not supported for table %s", req.Table)
+	}
+	for j, col := range columns {
+		switch col.Type {
+		case StringCol, IntCol, FloatCol, TimeCol:
+		default:
+			return fmt.Errorf("bad request: column %s cannot be used to group stats, only string, number and time columns are supported", col.Name)
+		}
+		if _, ok := req.ColumnFormats[j]; ok {
+			return fmt.Errorf("bad request: column format directives cannot be used to group stats in column %s", col.Name)
+		}
+	}
+	return nil
+}
+
+// validateStatsGroups returns an error if the expected stats groups do not match the group columns.
+func (req *Request) validateStatsGroups() error {
+	if len(req.StatsGroups) == 0 {
+		return nil
+	}
+	if len(req.Stats) == 0 || len(req.Columns) == 0 {
+		return errors.New("bad request: StatsGroup requires Stats and Columns headers")
+	}
+	for _, group := range req.StatsGroups {
+		if len(strings.Split(group, ";")) != len(req.Columns) {
+			return fmt.Errorf("bad request: StatsGroup %s must contain %d values separated by ;", group, len(req.Columns))
+		}
 	}
+	return nil
+}
 
-	return
+// maxFixed16Size is the largest response size which fits into the 11 digits of the fixed16 header.
+const maxFixed16Size int64 = 99999999999
+
+// fixed16Header returns the fixed16 response header for the given response code and size.
+// It returns an error if the size does not fit into the header, which would break the
+// fixed length of 16 bytes.
+func fixed16Header(code int, size int64) (string, error) {
+	if code < 100 || code > 999 {
+		return "", fmt.Errorf("response code %d does not fit into the fixed16 header", code)
+	}
+	if size < 0 || size > maxFixed16Size {
+		return "", fmt.Errorf("response size of %d bytes exceeds the maximum of %d bytes for fixed16 headers", size, maxFixed16Size)
+	}
+	return fmt.Sprintf("%d %11d\n", code, size), nil
 }
 
 // Send writes converts the result object to a livestatus answer and writes the resulting bytes back to the client.
-func (res *Response) Send(c net.Conn) (size int, err error) {
-	resBytes, err := res.JSON()
+func (res *Response) Send(c net.Conn) (size int64, err error) {
+	logger := res.Request.logger()
+	resBytes, err := res.Bytes()
 	if err != nil {
 		return
 	}
-	size = len(resBytes) + 1
+	size = int64(len(resBytes)) + 1
 	if res.Request.ResponseFixed16 {
-		if log.IsV(3) {
-			log.Tracef("write: %s", fmt.Sprintf("%d %11d", res.Code, size))
+		header, hErr := fixed16Header(res.Code, size)
+		if hErr != nil {
+			// clients would misread a longer header, so send an error instead
+			logger.Warnf("%s", hErr.Error())
+			resBytes, _ = (&Response{Code: 413, Request: res.Request, Error: fmt.Errorf("response too large: %s", hErr.Error())}).Bytes()
+			size = int64(len(resBytes)) + 1
+			header, _ = fixed16Header(413, size)
+		}
+		if logger.IsV(3) {
+			logger.Tracef("write: %s", strings.TrimSpace(header))
 		}
-		_, err = c.Write([]byte(fmt.Sprintf("%d %11d\n", res.Code, size)))
+		_, err = c.Write([]byte(header))
 		if err != nil {
 			log.Warnf("write error: %s", err.Error())
 		}
 	}
-	if log.IsV(3) {
-		log.Tracef("write: %s", resBytes)
+	if logger.IsV(3) {
+		logger.Tracef("write: %s", resBytes)
 	}
 	written, err := c.Write(resBytes)
 	if err != nil {
 		log.Warnf("write error: %s", err.Error())
 	}
-	if written != size-1 {
+	if int64(written) != size-1 {
 		log.Warnf("write error: written %d, size: %d", written, size)
 	}
 	localAddr := c.LocalAddr().String()
@@ -422,77 +2095,568 @@ func (res *Response) Send(c net.Conn) (size int, err error) {
 	return
 }
 
+// Bytes converts the response into the requested output format.
+// Errors are always returned as plain text.
+func (res *Response) Bytes() ([]byte, error) {
+	if res.Error == nil && res.Code != 304 && res.Plan == nil {
+		switch res.Request.OutputFormat {
+		case "msgpack":
+			return res.MsgPack()
+		case "ndjson":
+			return res.NDJSON()
+		}
+	}
+	return res.JSON()
+}
+
+// NDJSON converts the response into newline delimited json. Each row is sent as a
+// single line followed by a last line containing a hash with the total number of
+// rows and the failed backends. In progressive mode the rows have been sent already
+// and only the last line remains.
+func (res *Response) NDJSON() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := NewRowEncoder(buf)
+	if res.Request.progressive == nil {
+		if res.Request.SendColumnsHeader {
+			err := enc.Encode(res.Request.columnHeaders())
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, row := range res.Result {
+			err := enc.Encode(row)
+			if err != nil {
+				log.Errorf("json error: %s in row: %v", err.Error(), row)
+				return nil, err
+			}
+		}
+	}
+	err := enc.Encode(map[string]interface{}{
+		"total":  res.ResultTotal,
+		"failed": res.Failed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the final newline is added when sending the response
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// ProgressiveWriter sends result rows to the client as soon as a peer has finished.
+// Offset and limit are applied in the order the rows arrive.
+type ProgressiveWriter struct {
+	lock     sync.Mutex
+	writer   io.Writer
+	request  *Request
+	received int
+	sent     int
+	err      error
+	progress *progressCounter // rows collected by each peer, nil unless Progress: on
+	response *Response        // provides the columns to format the rows like the final result
+}
+
+// NewProgressiveWriter creates a new ProgressiveWriter for the given request.
+func NewProgressiveWriter(writer io.Writer, req *Request) *ProgressiveWriter {
+	return &ProgressiveWriter{writer: writer, request: req}
+}
+
+// Start sends the optional columns header row.
+func (pw *ProgressiveWriter) Start(res *Response) error {
+	pw.response = res
+	if !pw.request.SendColumnsHeader {
+		return nil
+	}
+	line, err := json.Marshal(pw.request.columnHeaders())
+	if err != nil {
+		return err
+	}
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	pw.write(append(line, '\n'))
+	return pw.err
+}
+
+// WriteRows sends a batch of rows to the client.
+func (pw *ProgressiveWriter) WriteRows(rows [][]interface{}) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	send := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		pw.received++
+		if pw.received <= pw.request.Offset {
+			continue
+		}
+		if pw.request.Limit > 0 && pw.sent+len(send) >= pw.request.Limit {
+			continue
+		}
+		send = append(send, row)
+	}
+	// rows are formatted like in PostProcessing, timestamps are formatted when encoding them
+	pw.response.mapStates(send)
+	pw.response.mapBooleans(send)
+	pw.response.roundFloats(send)
+	pw.response.replaceNullValues(send)
+	buf := new(bytes.Buffer)
+	enc := NewRowEncoder(buf)
+	for _, row := range send {
+		if atomic.LoadInt32(&stripControlChars) != 0 {
+			stripRowControlChars(row)
+		}
+		row = pw.request.stripHiddenColumns(row)
+		err := enc.Encode(row)
+		if err != nil {
+			log.Errorf("json error: %s in row: %v", err.Error(), row)
+			continue
+		}
+		pw.sent++
+	}
+	if buf.Len() > 0 {
+		pw.write(buf.Bytes())
+	}
+}
+
+func (pw *ProgressiveWriter) write(data []byte) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = pw.writer.Write(data)
+	if pw.err != nil {
+		log.Warnf("write error: %s", pw.err.Error())
+		// the client is gone, stop sending queries to the backends
+		pw.request.canceler.Cancel()
+		return
+	}
+	if flusher, ok := pw.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // JSON converts the response into a json structure
 func (res *Response) JSON() ([]byte, error) {
 	if res.Error != nil {
 		log.Warnf("client error: %s", res.Error.Error())
 		return []byte(res.Error.Error()), nil
 	}
+	if res.MultiResults != nil {
+		return json.Marshal(res.MultiResults)
+	}
+	if res.Plan != nil {
+		return json.Marshal(res.Plan)
+	}
+	if res.Code == 304 {
+		return []byte{}, nil
+	}
 
 	outputFormat := res.Request.OutputFormat
 	if outputFormat == "" {
 		outputFormat = "json"
 	}
+	if outputFormat == "json_map" {
+		return res.JSONMap()
+	}
 
 	buf := new(bytes.Buffer)
-	enc := json.NewEncoder(buf)
+	enc := NewRowEncoder(buf)
 
 	if outputFormat == "wrapped_json" {
 		buf.Write([]byte("{\"data\":"))
 	}
 
-	// enable header row for regular requests, not for stats requests
-	isStatsRequest := len(res.Request.Stats) != 0
-	sendColumnsHeader := res.Request.SendColumnsHeader && !isStatsRequest
+	// stats requests use the stats headers as labels
+	sendColumnsHeader := res.Request.SendColumnsHeader
+
+	if res.Request.SplitBy != "" {
+		err := res.encodeSplitRows(buf, enc, sendColumnsHeader)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := res.encodeRows(buf, enc, res.Result, sendColumnsHeader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if outputFormat == "wrapped_json" {
+		// always send an object, even for responses which did not query any backend
+		failed := res.Failed
+		if failed == nil {
+			failed = map[string]string{}
+		}
+		buf.Write([]byte("\n,\"failed\":"))
+		enc.Encode(failed)
+		buf.Write([]byte(fmt.Sprintf("\n,\"etag\":\"%s\"", res.ETag)))
+		if len(res.Request.Facets) > 0 {
+			buf.Write([]byte("\n,\"facets\":"))
+			enc.Encode(res.facetResult())
+		}
+		if len(res.Warnings) > 0 {
+			buf.Write([]byte("\n,\"warnings\":"))
+			enc.Encode(res.Warnings)
+		}
+		if res.Request.Summary {
+			buf.Write([]byte("\n,\"summary\":"))
+			summary, err := json.Marshal(res.Summary)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(summary)
+		}
+		if res.Request.ShowFilter {
+			buf.Write([]byte("\n,\"filter\":"))
+			enc.Encode(NormalizeFilter(res.Request.Filter))
+		}
+		if res.Request.FilterStats {
+			buf.Write([]byte("\n,\"filter_stats\":"))
+			filterStats, err := json.Marshal(res.filterStatsResult())
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(filterStats)
+		}
+		if res.Request.SendPeerCounts {
+			buf.Write([]byte(fmt.Sprintf("\n,\"peer_counts\":{\"rows\":%d,\"empty\":%d,\"failed\":%d}", res.PeersRows, res.PeersEmpty, len(res.Failed))))
+		}
+		if res.Request.SendPeerBytes {
+			buf.Write([]byte("\n,\"peer_bytes\":"))
+			enc.Encode(res.Request.peerBytes.Get())
+		}
+		if res.Request.CaptureRaw {
+			buf.Write([]byte("\n,\"raw\":"))
+			raw, err := json.Marshal(res.Request.rawCapture.Get())
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(raw)
+		}
+		if res.Request.SendPeerStats {
+			buf.Write([]byte("\n,\"peer_stats\":"))
+			peerStats, err := json.Marshal(res.PeerStats)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(peerStats)
+		}
+		if res.Request.WaitTrigger != "" {
+			buf.Write([]byte(fmt.Sprintf("\n,\"wait_result\":\"%s\"", res.WaitResult())))
+		}
+		if res.Request.ApproxTotal {
+			buf.Write([]byte(fmt.Sprintf("\n,\"total_approx\":%t", res.IsApproxTotal())))
+		}
+		if res.Request.ShowLimit {
+			buf.Write([]byte(fmt.Sprintf("\n,\"limit\":%d,\"offset\":%d", res.AppliedLimit, res.AppliedOffset)))
+		}
+		buf.Write([]byte(fmt.Sprintf("\n,\"total\":%d}", res.ResultTotal)))
+	}
+	return buf.Bytes(), nil
+}
 
+// encodeRows writes the rows as json array with the optional columns header as first row.
+func (res *Response) encodeRows(buf *bytes.Buffer, enc RowEncoder, rows [][]interface{}, sendColumnsHeader bool) error {
 	buf.Write([]byte("["))
 	// add optional columns header as first row
 	if sendColumnsHeader {
-		cols := make([]interface{}, len(res.Request.Columns))
-		for i, v := range res.Request.Columns {
-			cols[i] = v
-		}
+		cols := res.Request.columnHeaders()
 		err := enc.Encode(cols)
 		if err != nil {
 			log.Errorf("json error: %s in column header: %v", err.Error(), cols)
-			return nil, err
+			return err
 		}
 	}
 	// append result row by row
-	if outputFormat == "wrapped_json" || outputFormat == "json" {
-		for i, row := range res.Result {
-			if i == 0 {
-				if sendColumnsHeader {
-					buf.Write([]byte(",\n"))
-				}
-			} else {
-				buf.Write([]byte(","))
+	for i, row := range rows {
+		if i == 0 {
+			if sendColumnsHeader {
+				buf.Write([]byte(",\n"))
 			}
-			err := enc.Encode(row)
-			if err != nil {
-				log.Errorf("json error: %s in row: %v", err.Error(), row)
-				return nil, err
+		} else {
+			buf.Write([]byte(","))
+		}
+		err := enc.Encode(row)
+		if err != nil {
+			log.Errorf("json error: %s in row: %v", err.Error(), row)
+			return err
+		}
+	}
+	buf.Write([]byte("]"))
+	return nil
+}
+
+// encodeSplitRows writes the rows as json object with an array for each value of the
+// SplitBy column. The values are used in the order of their first row.
+func (res *Response) encodeSplitRows(buf *bytes.Buffer, enc RowEncoder, sendColumnsHeader bool) error {
+	keys := []string{}
+	groups := make(map[string][][]interface{})
+	for _, row := range res.Result {
+		key := splitKey(row[res.Request.splitIndex])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], row)
+	}
+	buf.Write([]byte("{"))
+	for i, key := range keys {
+		if i > 0 {
+			buf.Write([]byte(","))
+		}
+		label, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		buf.Write(label)
+		buf.Write([]byte(":"))
+		err = res.encodeRows(buf, enc, groups[key], sendColumnsHeader)
+		if err != nil {
+			return err
+		}
+	}
+	buf.Write([]byte("}"))
+	return nil
+}
+
+// splitKey returns the json object key for a value of the SplitBy column.
+func splitKey(value interface{}) string {
+	if value == nil {
+		return "null"
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// validateFirstPerGroup checks that all group columns are part of the result and stores their positions.
+func (req *Request) validateFirstPerGroup(requestColumnsMap map[string]int) error {
+	if len(req.Stats) > 0 {
+		return errors.New("bad request: FirstPerGroup cannot be used with stats queries")
+	}
+	req.groupIndexes = make([]int, 0, len(req.FirstPerGroup))
+	for _, col := range req.FirstPerGroup {
+		i, ok := requestColumnsMap[col]
+		if !ok {
+			return fmt.Errorf("bad request: group column %s not in result set", col)
+		}
+		req.groupIndexes = append(req.groupIndexes, i)
+	}
+	return nil
+}
+
+// backendLimit returns the limit passed to the backends. Rows are grouped after
+// all rows have been fetched, so the backends cannot apply the limit for FirstPerGroup.
+func (req *Request) backendLimit() int {
+	if len(req.FirstPerGroup) > 0 {
+		return 0
+	}
+	return req.Limit
+}
+
+// FirstPerGroup keeps only the first row for each distinct combination of the
+// FirstPerGroup columns. Rows have to be sorted already, so the first row is the top row of its group.
+func (res *Response) FirstPerGroup() {
+	seen := make(map[string]bool)
+	result := make([][]interface{}, 0)
+	for _, row := range res.Result {
+		keyValues := make([]string, len(res.Request.groupIndexes))
+		for k, i := range res.Request.groupIndexes {
+			keyValues[k] = fmt.Sprintf("%v", row[i])
+		}
+		key := strings.Join(keyValues, ";")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, row)
+	}
+	res.Result = result
+}
+
+// validateSplitBy checks that the SplitBy column is a single value column of the
+// result and stores its position.
+func (req *Request) validateSplitBy(requestColumnsMap map[string]int, columns []Column) error {
+	switch {
+	case len(req.Stats) > 0:
+		return errors.New("bad request: SplitBy cannot be used with stats queries")
+	case req.OutputFormat != "" && req.OutputFormat != "json" && req.OutputFormat != "wrapped_json":
+		return errors.New("bad request: SplitBy is only supported for json and wrapped_json output")
+	}
+	i, ok := requestColumnsMap[req.SplitBy]
+	if !ok {
+		return fmt.Errorf("bad request: split column %s not in result set", req.SplitBy)
+	}
+	switch columns[i].Type {
+	case StringCol, IntCol, FloatCol, TimeCol:
+	default:
+		return fmt.Errorf("bad request: column %s cannot be used to split rows, only string, number and time columns are supported", req.SplitBy)
+	}
+	req.splitIndex = i
+	return nil
+}
+
+// JSONMap converts the response into a single json object with an entry for each row.
+// The rows are converted into objects using the column names as keys.
+func (res *Response) JSONMap() ([]byte, error) {
+	keys, err := res.mapKeys()
+	if err != nil {
+		return nil, err
+	}
+	headers := res.Request.columnHeaders()
+	objects := make(map[string]interface{}, len(res.Result))
+	for n, row := range res.Result {
+		obj := make(map[string]interface{}, len(headers))
+		for i := range headers {
+			if i < len(row) {
+				obj[fmt.Sprintf("%v", headers[i])] = row[i]
 			}
 		}
-		buf.Write([]byte("]"))
+		objects[keys[n]] = obj
 	}
-	if outputFormat == "wrapped_json" {
-		buf.Write([]byte("\n,\"failed\":"))
-		enc.Encode(res.Failed)
-		buf.Write([]byte(fmt.Sprintf("\n,\"total\":%d}", res.ResultTotal)))
+	buf := new(bytes.Buffer)
+	err = NewRowEncoder(buf).Encode(objects)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// mapKeys returns the json_map key for each result row.
+// It returns an error if the same key is used more than once, ex.: if a host exists on multiple backends.
+func (res *Response) mapKeys() ([]string, error) {
+	keyIndexes := []int{}
+	for _, key := range JSONMapKeys[res.Request.Table] {
+		for i, col := range res.Columns {
+			if col.Name == key {
+				keyIndexes = append(keyIndexes, i)
+				break
+			}
+		}
+	}
+	keys := make([]string, len(res.Result))
+	seen := make(map[string]bool, len(res.Result))
+	for n, row := range res.Result {
+		keyValues := make([]string, len(keyIndexes))
+		for k, i := range keyIndexes {
+			keyValues[k] = fmt.Sprintf("%v", row[i])
+		}
+		key := strings.Join(keyValues, ";")
+		if seen[key] {
+			return nil, fmt.Errorf("bad request: duplicate key %s in json_map output, use MergeDuplicates or select a single backend", key)
+		}
+		seen[key] = true
+		keys[n] = key
+	}
+	return keys, nil
+}
+
+// IsApproxTotal returns true if the total has been estimated by at least one peer.
+func (res *Response) IsApproxTotal() bool {
+	return atomic.LoadInt32(&res.approxTotals) > 0
+}
+
+// WaitResult returns timeout if any peer gave up or failed waiting for the WaitCondition, matched otherwise.
+func (res *Response) WaitResult() string {
+	if atomic.LoadInt32(&res.waitTimeouts) > 0 {
+		return "timeout"
+	}
+	return "matched"
+}
+
+// checkResultColumns returns an error if any row does not contain the expected number of columns,
+// which happens ex.: if the response got truncated.
+func checkResultColumns(result [][]interface{}, numColumns int) error {
+	for i, row := range result {
+		if len(row) != numColumns {
+			return fmt.Errorf("bad response: row %d has %d columns, expected %d", i, len(row), numColumns)
+		}
+	}
+	return nil
+}
+
+// peerRowLimit returns the maximum number of rows gathered from a single peer. With
+// MaxRowsPerPeer, one more row than allowed is gathered to detect truncated results.
+func peerRowLimit(limit int) int {
+	max := int(atomic.LoadInt64(&maxRowsPerPeer))
+	if max <= 0 || (limit > 0 && limit <= max) {
+		return limit
+	}
+	return max + 1
+}
+
+// capPeerRows truncates the result of a single peer to the configured maximum
+// number of rows and adds a warning for that peer if rows have been dropped.
+// Peers stop gathering rows once the maximum is exceeded, see peerRowLimit.
+// The result lock must be held while calling this function.
+func (res *Response) capPeerRows(peer *Peer, result [][]interface{}) [][]interface{} {
+	max := int(atomic.LoadInt64(&maxRowsPerPeer))
+	if max <= 0 || len(result) <= max {
+		return result
+	}
+	log.Warnf("[%s] result truncated to %d rows for table %s", peer.Name, max, res.Request.Table)
+	if res.Warnings == nil {
+		res.Warnings = make(map[string]string)
+	}
+	res.Warnings[peer.ID] = fmt.Sprintf("result truncated to %d rows", max)
+	return result[:max]
+}
+
+// countPeerResult increases the number of peers which did or did not contribute rows.
+func (res *Response) countPeerResult(hasRows bool) {
+	if hasRows {
+		res.PeersRows++
+	} else {
+		res.PeersEmpty++
+	}
+}
+
+// hasStatsMatches returns true if any of the stats matched at least one row.
+func hasStatsMatches(statsResult *map[string][]Filter) bool {
+	if statsResult == nil {
+		return false
+	}
+	for _, stats := range *statsResult {
+		for i := range stats {
+			if stats[i].StatsCount > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setServerTime sets all lmd_time columns to the same timestamp, so all rows
+// of a response share one value even if the peers finished at different times.
+func (res *Response) setServerTime() {
+	indexes := []int{}
+	for i, col := range res.Columns {
+		if col.Name == "lmd_time" {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	for _, row := range res.Result {
+		for _, i := range indexes {
+			if i < len(row) {
+				row[i] = now
+			}
+		}
 	}
-	return buf.Bytes(), nil
 }
 
 // BuildLocalResponse builds local data table result for all selected peers
 func (res *Response) BuildLocalResponse(peers []string, indexes *[]int) (err error) {
+	logger := res.Request.logger()
 	res.Result = make([][]interface{}, 0)
 
 	waitgroup := &sync.WaitGroup{}
 	resultLock := sync.Mutex{}
 
-	for _, id := range peers {
+	// rows are merged in the order of the peers once all peers are done
+	peerResults := make([][][]interface{}, len(peers))
+
+	// the age of all rows is relative to the same time, like lmd_time
+	now := time.Now().Unix()
+
+	for n, id := range peers {
 		p := DataStore[id]
+		p.setRowAge(now)
 
 		if res.Request.Table != "tables" && res.Request.Table != "columns" && res.Request.Table != "backends" {
 			p.StatusSet("LastQuery", time.Now().Unix())
@@ -506,20 +2670,41 @@ func (res *Response) BuildLocalResponse(peers []string, indexes *[]int) (err err
 		}
 
 		waitgroup.Add(1)
-		go func(peer *Peer, wg *sync.WaitGroup) {
+		go func(peer *Peer, wg *sync.WaitGroup, n int) {
 			// make sure we log panics properly
 			defer logPanicExit()
 
-			log.Tracef("[%s] starting local data computation", p.Name)
+			logger.Tracef("[%s] starting local data computation", p.Name)
 			defer wg.Done()
+			defer res.Request.progressive.peerDone(peer.ID)
+
+			if res.Request.canceler.IsCanceled() {
+				return
+			}
 
-			total, result, statsResult := p.BuildLocalResponseData(res, indexes)
-			log.Tracef("[%s] result ready", p.Name)
+			total, result, statsResult, err := p.BuildLocalResponseData(res, indexes)
+			logger.Tracef("[%s] result ready", p.Name)
 			resultLock.Lock()
+			if err != nil {
+				res.Failed[peer.ID] = err.Error()
+				resultLock.Unlock()
+				return
+			}
+			if res.Request.SendPeerStats && result == nil {
+				res.storePeerStats(peer.ID, statsResult)
+			}
+			res.countPeerResult(total > 0 || hasStatsMatches(statsResult))
 			res.ResultTotal += total
 			if result != nil {
+				*result = res.capPeerRows(peer, *result)
+				res.localizeTimes(peer, *result)
+			}
+			if result != nil && res.Request.progressive != nil {
+				// send rows right away
+				res.Request.progressive.WriteRows(*result)
+			} else if result != nil {
 				// data results rows
-				res.Result = append(res.Result, (*result)...)
+				peerResults[n] = *result
 			} else if statsResult != nil {
 				if res.Request.StatsResult == nil {
 					res.Request.StatsResult = make(map[string][]Filter)
@@ -531,43 +2716,103 @@ func (res *Response) BuildLocalResponse(peers []string, indexes *[]int) (err err
 					} else {
 						for i := range stats {
 							s := stats[i]
+							if s.StatsSamples != nil {
+								res.Request.StatsResult[key][i].StatsSamples.Merge(s.StatsSamples)
+								res.Request.StatsResult[key][i].StatsCount += s.StatsCount
+								continue
+							}
+							if s.StatsDistinct != nil {
+								res.Request.StatsResult[key][i].MergeDistinct(&s)
+								continue
+							}
 							res.Request.StatsResult[key][i].ApplyValue(s.Stats, s.StatsCount)
 						}
 					}
 				}
 			}
 			resultLock.Unlock()
-		}(p, waitgroup)
+		}(p, waitgroup, n)
 	}
-	log.Tracef("waiting...")
+	logger.Tracef("waiting...")
 	waitgroup.Wait()
-	log.Tracef("waiting for all local data computations done")
+	logger.Tracef("waiting for all local data computations done")
+	res.mergePeerResults(peers, peerResults)
+	return
+}
+
+// storePeerStats keeps a copy of the stats of a single peer, because merging
+// the stats of all peers changes the stats of the first peer.
+func (res *Response) storePeerStats(id string, statsResult *map[string][]Filter) {
+	if res.peerStats == nil {
+		res.peerStats = make(map[string]map[string][]Filter)
+	}
+	stats := make(map[string][]Filter)
+	if statsResult != nil {
+		for key, peerStats := range *statsResult {
+			stats[key] = make([]Filter, len(peerStats))
+			copy(stats[key], peerStats)
+			for i := range peerStats {
+				if peerStats[i].StatsSamples != nil {
+					stats[key][i].StatsSamples = NewStatsSamples(peerStats[i].StatsSamples.Approx)
+					stats[key][i].StatsSamples.Merge(peerStats[i].StatsSamples)
+				}
+				if peerStats[i].StatsDistinct != nil {
+					stats[key][i].StatsDistinct = make(map[string]bool, len(peerStats[i].StatsDistinct))
+					for val := range peerStats[i].StatsDistinct {
+						stats[key][i].StatsDistinct[val] = true
+					}
+				}
+			}
+		}
+	}
+	res.peerStats[id] = stats
+}
+
+// passthroughColumns returns the distinct list of columns which have to be requested from
+// the backends, along with the position of each requested column in the backend result.
+// Virtual columns are computed locally and have a position of -1.
+func passthroughColumns(columns *[]Column) (backendColumns []string, backendIndexes []int) {
+	backendColumns = []string{}
+	backendIndexes = make([]int, len(*columns))
+	positions := make(map[string]int)
+	for k, col := range *columns {
+		if col.RefIndex > 0 {
+			backendIndexes[k] = -1
+			continue
+		}
+		i, ok := positions[col.Name]
+		if !ok {
+			i = len(backendColumns)
+			positions[col.Name] = i
+			backendColumns = append(backendColumns, col.Name)
+		}
+		backendIndexes[k] = i
+	}
 	return
 }
 
 // BuildPassThroughResult passes a query transparently to one or more remote sites and builds the response
 // from that.
 func (res *Response) BuildPassThroughResult(peers []string, table *Table, columns *[]Column) (err error) {
+	logger := res.Request.logger()
 	req := res.Request
 	res.Result = make([][]interface{}, 0)
 
-	// build columns list
-	backendColumns := []string{}
-	virtColumns := []Column{}
-	for _, col := range *columns {
-		if col.RefIndex > 0 {
-			virtColumns = append(virtColumns, col)
-		} else {
-			backendColumns = append(backendColumns, col.Name)
-		}
-	}
+	backendColumns, backendIndexes := passthroughColumns(columns)
 
 	numPerRow := len(*columns)
 	waitgroup := &sync.WaitGroup{}
 	resultLock := sync.Mutex{}
 
-	for _, id := range peers {
+	// rows are merged in the order of the peers once all peers are done
+	peerResults := make([][][]interface{}, len(peers))
+
+	// the age of all rows is relative to the same time, like lmd_time
+	now := time.Now().Unix()
+
+	for n, id := range peers {
 		p := DataStore[id]
+		p.setRowAge(now)
 
 		p.PeerLock.RLock()
 		if p.Status["PeerStatus"].(PeerStatus) == PeerStatusDown {
@@ -580,51 +2825,85 @@ func (res *Response) BuildPassThroughResult(peers []string, table *Table, column
 		p.PeerLock.RUnlock()
 
 		waitgroup.Add(1)
-		go func(peer *Peer, wg *sync.WaitGroup) {
+		go func(peer *Peer, wg *sync.WaitGroup, n int) {
 			// make sure we log panics properly
 			defer logPanicExit()
 
-			log.Debugf("[%s] starting passthrough request", p.Name)
+			logger.Debugf("[%s] starting passthrough request", p.Name)
 			defer wg.Done()
+			defer req.progressive.peerDone(peer.ID)
+			req.progressive.setPeerRows(peer.ID, 0)
+			// do not fetch and parse more rows than allowed by MaxRowsPerPeer
+			limit := peerRowLimit(req.backendLimit())
+			filter, err := peer.scopedFilter(req.Table, req.Filter)
+			if err != nil {
+				resultLock.Lock()
+				res.Failed[p.ID] = err.Error()
+				resultLock.Unlock()
+				return
+			}
 			passthroughRequest := &Request{
 				Table:           req.Table,
-				Filter:          req.Filter,
-				Stats:           req.Stats,
+				Filter:          filter,
 				Columns:         backendColumns,
-				Limit:           req.Limit,
+				Limit:           limit,
 				OutputFormat:    "json",
 				ResponseFixed16: true,
+				canceler:        req.canceler,
+				peerBytes:       req.peerBytes,
+				rawCapture:      req.rawCapture,
 			}
-			var result [][]interface{}
-			result, err = peer.Query(passthroughRequest)
-			log.Tracef("[%s] req done", p.Name)
-			if err != nil {
-				log.Tracef("[%s] req errored", err.Error())
+			result, qErr := peer.Query(passthroughRequest)
+			if qErr == nil {
+				qErr = checkResultColumns(result, len(backendColumns))
+			}
+			logger.Tracef("[%s] req done", p.Name)
+			if qErr != nil {
+				// discard partial results and continue with the other peers
+				logger.Tracef("[%s] req errored", qErr.Error())
 				resultLock.Lock()
-				res.Failed[p.ID] = err.Error()
+				res.Failed[p.ID] = qErr.Error()
 				resultLock.Unlock()
 				return
 			}
-			// insert virtual values
-			if len(virtColumns) > 0 {
+			// insert virtual values and duplicate columns
+			if len(backendColumns) != numPerRow {
 				for j, row := range result {
-					for _, col := range virtColumns {
-						i := col.Index
-						row = append(row, 0)
-						copy(row[i+1:], row[i:])
-						row[i] = peer.GetRowValue(col.RefIndex, &row, j, table, nil, numPerRow)
+					resRow := make([]interface{}, numPerRow)
+					for k, i := range backendIndexes {
+						if i < 0 {
+							resRow[k] = peer.GetRowValue((*columns)[k].RefIndex, &row, j, table, nil, numPerRow)
+						} else {
+							resRow[k] = row[i]
+						}
 					}
-					result[j] = row
+					result[j] = resRow
+				}
+			}
+			// apply output format directives, ex.: Columns: execution_time:round2
+			for j, f := range req.ColumnFormats {
+				for k := range result {
+					result[k][j] = f.Apply(result[k][j])
 				}
 			}
-			log.Tracef("[%s] result ready", p.Name)
+			logger.Tracef("[%s] result ready", p.Name)
 			resultLock.Lock()
-			res.Result = append(res.Result, result...)
+			res.countPeerResult(len(result) > 0)
+			result = res.capPeerRows(peer, result)
+			res.localizeTimes(peer, result)
+			if req.progressive != nil {
+				res.ResultTotal += len(result)
+				req.progressive.setPeerRows(peer.ID, len(result))
+				req.progressive.WriteRows(result)
+			} else {
+				peerResults[n] = result
+			}
 			resultLock.Unlock()
-		}(p, waitgroup)
+		}(p, waitgroup, n)
 	}
-	log.Tracef("waiting...")
+	logger.Tracef("waiting...")
 	waitgroup.Wait()
-	log.Debugf("waiting for passed through requests done")
+	logger.Debugf("waiting for passed through requests done")
+	res.mergePeerResults(peers, peerResults)
 	return
 }
@@ -3,14 +3,42 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRequestHeaderTableFail(t *testing.T) {
 	buf := bufio.NewReader(bytes.NewBufferString("GET none\n"))
 	_, _, err := NewRequest(buf)
-	if err = assertEq(errors.New("bad request: table none does not exist"), err); err != nil {
+	if err := assertEq(unknownTableError("none"), err); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike("available tables: backends, status, ", err.Error()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestUnknownTable(t *testing.T) {
+	req := &Request{Table: "none"}
+	_, err := req.GetResponse()
+	if err = assertEq(unknownTableError("none"), err); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewResponse(&Request{Table: "Hosts"})
+	if err = assertEq(unknownTableError("Hosts"), err); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(0, len(res.Result)); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -40,3 +68,3412 @@ func TestRequestHeaderSort2Fail(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestResponseSortNullValues(t *testing.T) {
+	res := Response{
+		Request: &Request{Sort: []*SortField{
+			{Name: "state", Direction: Asc, Index: 1},
+			{Name: "name", Direction: Desc, Index: 0},
+			{Name: "latency", Direction: Asc, Index: 2},
+		}},
+		Columns: []Column{
+			{Name: "name", Type: StringCol},
+			{Name: "state", Type: IntCol},
+			{Name: "latency", Type: FloatCol},
+		},
+		Result: [][]interface{}{
+			{"b", 1, 0.5},
+			{nil, 1, 0.1},
+			{"a", nil, 0.3},
+			{"b", 1, nil},
+			{"c", 0, 0.2},
+			{"a", 1, 0.4},
+		},
+	}
+	sort.Sort(res)
+	expect := [][]interface{}{
+		{"a", nil, 0.3},
+		{"c", 0, 0.2},
+		{"b", 1, nil},
+		{"b", 1, 0.5},
+		{"a", 1, 0.4},
+		{nil, 1, 0.1},
+	}
+	if err := assertEq(expect, res.Result); err != nil {
+		t.Fatal(err)
+	}
+
+	// reversing all directions must reverse the null ordering as well
+	for _, s := range res.Request.Sort {
+		if s.Direction == Asc {
+			s.Direction = Desc
+		} else {
+			s.Direction = Asc
+		}
+	}
+	sort.Sort(res)
+	for i := range expect {
+		if err := assertEq(expect[len(expect)-1-i], res.Result[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestColumnsTableDescriptions(t *testing.T) {
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	for name, dat := range VirtKeyMap {
+		if dat.Description == "" {
+			t.Errorf("virtual column %s has no description", name)
+		}
+	}
+
+	res, err := peer.QueryString("GET columns\nColumns: table name description\nFilter: table = hosts\nFilter: name = peer_name\nFilter: name = state\nOr: 2\nSort: name asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"hosts", "peer_name", "Name of this peer"}, res[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([]interface{}{"hosts", "state", "The current state of the host (0: up, 1: down, 2: unreachable)"}, res[1]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseColumnsVirtual(t *testing.T) {
+	peer := StartTestPeer(1, 0, 0)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET columns\nColumns: name\nFilter: table = sites\nFilter: virtual = 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, row := range res {
+		names[row[0].(string)] = true
+	}
+	for name := range VirtKeyMap {
+		if _, ok := Objects.Tables["sites"].ColumnsIndex[name]; !ok {
+			continue
+		}
+		if !names[name] {
+			t.Errorf("virtual column %s is missing in the columns table", name)
+		}
+	}
+	for _, name := range []string{"key", "name", "addr", "status"} {
+		if !names[name] {
+			t.Errorf("virtual column %s is missing in the columns table", name)
+		}
+	}
+
+	res, err = peer.QueryString("GET columns\nColumns: name virtual\nFilter: table = hosts\nFilter: name = peer_name\nFilter: name = state\nOr: 2\nSort: name asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"peer_name", float64(1)}, {"state", float64(0)}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseETag(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	getResponse := func(query string) *Response {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// etags are not calculated unless requested
+	res := getResponse("GET hosts\nColumns: name\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq("", res.ETag); err != nil {
+		t.Error(err)
+	}
+
+	res = getResponse("GET hosts\nColumns: name\nOutputFormat: wrapped_json\nETag: on\n\n")
+	etag := res.ETag
+	if err := assertLike("^[0-9a-f]{16}$", etag); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := res.JSON()
+	if err := assertLike(`"etag":"`+etag+`"`, string(body)); err != nil {
+		t.Error(err)
+	}
+
+	// matching etag returns an empty not modified response
+	res = getResponse("GET hosts\nColumns: name\nOutputFormat: wrapped_json\nIfNoneMatch: " + etag + "\n\n")
+	if err := assertEq(304, res.Code); err != nil {
+		t.Error(err)
+	}
+	body, _ = res.JSON()
+	if err := assertEq("", string(body)); err != nil {
+		t.Error(err)
+	}
+
+	// changed result, ex. by a different filter, returns data
+	res = getResponse("GET hosts\nColumns: name\nFilter: name != testhost_1\nOutputFormat: wrapped_json\nIfNoneMatch: " + etag + "\n\n")
+	if err := assertEq(200, res.Code); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(9, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	if res.ETag == etag {
+		t.Errorf("etag should change with the result")
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseSortAbs(t *testing.T) {
+	res := Response{
+		Request: &Request{Sort: []*SortField{
+			{Name: "deviation", Direction: Asc, Index: 1, Transform: SortTransformAbs},
+		}},
+		Columns: []Column{
+			{Name: "name", Type: StringCol},
+			{Name: "deviation", Type: FloatCol},
+		},
+		Result: [][]interface{}{
+			{"a", -5.0},
+			{"b", 3.0},
+			{"c", nil},
+			{"d", -1.5},
+			{"e", 4},
+		},
+	}
+	sort.Sort(res)
+	expect := [][]interface{}{
+		{"c", nil},
+		{"d", -1.5},
+		{"b", 3.0},
+		{"e", 4},
+		{"a", -5.0},
+	}
+	if err := assertEq(expect, res.Result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResponsePeerCounts(t *testing.T) {
+	peer := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	tests := []struct {
+		query string
+		rows  int
+		empty int
+	}{
+		{"GET hosts\nColumns: name\n", 3, 0},
+		{"GET hosts\nColumns: name\nFilter: peer_key = mockid0\n", 1, 2},
+		{"GET hosts\nColumns: name\nFilter: peer_key != mockid2\nLimit: 1\n", 2, 1},
+		{"GET hosts\nColumns: name\nFilter: name = none\n", 0, 3},
+		{"GET hosts\nStats: name = testhost_1\nFilter: peer_key = mockid1\n", 1, 2},
+	}
+	for _, test := range tests {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(test.query + "OutputFormat: wrapped_json\nPeerCounts: on\n\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := res.JSON()
+		expect := fmt.Sprintf(`"peer_counts":\{"rows":%d,"empty":%d,"failed":0\}`, test.rows, test.empty)
+		if err = assertLike(expect, string(body)); err != nil {
+			t.Errorf("%s: %s", test.query, err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseColumnAliases(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name as node state latency:round2 AS lat\nColumnHeaders: on\nLimit: 1\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]string{"name", "state", "latency"}, req.Columns); err != nil {
+		t.Error(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := res.JSON()
+	if err = assertLike(`^\[\["node","state","lat"\]`, string(body)); err != nil {
+		t.Error(err)
+	}
+
+	// data is still fetched by the real column names
+	res2, err := peer.QueryString("GET hosts\nColumns: name as node\nFilter: name = testhost_1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("testhost_1", res2[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseHiddenColumns(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	expect, err := peer.QueryString("GET hosts\nColumns: name latency state\nSort: latency desc\nSort: name asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name latency hidden state\nColumnHeaders: on\nSort: latency desc\nSort: name asc\nSummary: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rows are sorted by the hidden column, but do not contain it
+	if err = assertEq(len(expect), len(res.Result)); err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range res.Result {
+		if err = assertEq(2, len(row)); err != nil {
+			t.Error(err)
+		}
+		if err = assertEq(expect[i][0], row[0]); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = assertEq([]interface{}{"name", "state"}, req.columnHeaders()); err != nil {
+		t.Error(err)
+	}
+	if _, ok := res.Summary["latency"]; ok {
+		t.Errorf("summary contains hidden column latency")
+	}
+	body, _ := res.JSON()
+	if err = assertLike(`^\[\["name","state"\]`, string(body)); err != nil {
+		t.Error(err)
+	}
+
+	// hidden columns can be used in filters and keep their position when the same column is visible as well
+	res2, err := peer.QueryString("GET hosts\nColumns: name:trunc3 hidden name\nFilter: name = testhost_1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"testhost_1"}}, res2); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseMergeDuplicates(t *testing.T) {
+	InitObjects()
+	table := Objects.Tables["hosts"]
+	columns := []Column{}
+	for _, name := range []string{"name", "state", "last_check", "plugin_output", "last_state_change"} {
+		columns = append(columns, table.GetColumn(name))
+	}
+	rows := func() [][]interface{} {
+		return [][]interface{}{
+			{"host1", 0, 200, "OK - backend a", 50},
+			{"host2", 0, 100, "OK - backend a", 80},
+			{"host1", 2, 100, "CRITICAL - backend b", 90},
+			{"host2", 1, 300, "WARNING - backend b", 60},
+		}
+	}
+
+	// timestamps always use the latest value
+	res := Response{Request: &Request{Table: "hosts", MergeDuplicates: MergeWorst}, Columns: columns, Result: rows()}
+	res.MergeDuplicates()
+	expect := [][]interface{}{
+		{"host1", 2, 200, "OK - backend a", 90},
+		{"host2", 1, 300, "OK - backend a", 80},
+	}
+	if err := assertEq(expect, res.Result); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(2, res.ResultTotal); err != nil {
+		t.Error(err)
+	}
+
+	res = Response{Request: &Request{Table: "hosts", MergeDuplicates: MergeLatest}, Columns: columns, Result: rows()}
+	res.MergeDuplicates()
+	expect = [][]interface{}{
+		{"host1", 0, 200, "OK - backend a", 90},
+		{"host2", 1, 300, "WARNING - backend b", 80},
+	}
+	if err := assertEq(expect, res.Result); err != nil {
+		t.Error(err)
+	}
+
+	// lists of hosts are taken from the chosen row, custom variable names and values stay aligned
+	columns = []Column{table.GetColumn("name"), table.GetColumn("last_check"), table.GetColumn("custom_variable_names"), table.GetColumn("custom_variable_values")}
+	res = Response{Request: &Request{Table: "hosts", MergeDuplicates: MergeLatest}, Columns: columns, Result: [][]interface{}{
+		{"host1", 100, []interface{}{"A", "B"}, []interface{}{"1", "1"}},
+		{"host1", 200, []interface{}{"B"}, []interface{}{"2"}},
+	}}
+	res.MergeDuplicates()
+	if err := assertEq([][]interface{}{{"host1", 200, []interface{}{"B"}, []interface{}{"2"}}}, res.Result); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseMergeContacts(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// the contact demo is a member of different groups on both backends
+	groups := map[string][][]interface{}{
+		"mockid0": {{"admins", []interface{}{"demo", "alice"}}, {"all", []interface{}{"alice"}}},
+		"mockid1": {{"ops", []interface{}{"demo"}}, {"all", []interface{}{"demo", "alice"}}},
+	}
+	for id, rows := range groups {
+		p := DataStore[id]
+		p.DataLock.Lock()
+		contacts := p.Tables["contacts"]
+		contacts.Data = [][]interface{}{}
+		for _, name := range []string{"demo", "alice"} {
+			row := make([]interface{}, len(contacts.Table.StaticColCacheNames))
+			row[contacts.Table.ColumnsIndex["name"]] = name
+			contacts.Data = append(contacts.Data, row)
+		}
+		p.Tables["contacts"] = contacts
+		contactgroups := p.Tables["contactgroups"]
+		contactgroups.Data = [][]interface{}{}
+		for _, group := range rows {
+			row := make([]interface{}, len(contactgroups.Table.StaticColCacheNames))
+			row[contactgroups.Table.ColumnsIndex["name"]] = group[0]
+			row[contactgroups.Table.ColumnsIndex["alias"]] = group[0]
+			row[contactgroups.Table.ColumnsIndex["members"]] = group[1]
+			contactgroups.Data = append(contactgroups.Data, row)
+		}
+		p.Tables["contactgroups"] = contactgroups
+		p.DataLock.Unlock()
+	}
+
+	res, err := peer.QueryString("GET contacts\nColumns: name groups\nSort: name asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(4, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET contacts\nColumns: name groups\nSort: name asc\nMergeDuplicates: worst\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := [][]interface{}{
+		{"alice", []interface{}{"admins", "all"}},
+		{"demo", []interface{}{"admins", "ops", "all"}},
+	}
+	if err = assertEq(expect, res); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET contactgroups\nColumns: name members\nSort: name asc\nMergeDuplicates: worst\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = [][]interface{}{
+		{"admins", []interface{}{"demo", "alice"}},
+		{"all", []interface{}{"alice", "demo"}},
+		{"ops", []interface{}{"demo"}},
+	}
+	if err = assertEq(expect, res); err != nil {
+		t.Error(err)
+	}
+
+	// contacts of a group
+	res, err = peer.QueryString("GET contacts\nColumns: name\nFilter: groups >= ops\nMergeDuplicates: worst\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"demo"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseMergeDuplicatesPeers(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET hosts\nColumns: name state\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(20, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString("GET hosts\nColumns: name state\nMergeDuplicates: worst\nLimit: 5\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(5, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	all, err := peer.QueryString("GET services\nColumns: host_name description\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = peer.QueryString("GET services\nColumns: host_name description\nMergeDuplicates: worst\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(all)/2, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// timestamps of the real hosts table use the latest value of all backends
+	var name string
+	for id, values := range map[string][]interface{}{"mockid0": {0.0, 200.0, 50.0}, "mockid1": {2.0, 100.0, 90.0}} {
+		p := DataStore[id]
+		p.DataLock.Lock()
+		hosts := p.Tables["hosts"]
+		name = hosts.Data[0][hosts.Table.ColumnsIndex["name"]].(string)
+		for i, col := range []string{"state", "last_check", "last_state_change"} {
+			hosts.Data[0][hosts.Table.ColumnsIndex[col]] = values[i]
+		}
+		p.DataLock.Unlock()
+	}
+	res, err = peer.QueryString("GET hosts\nColumns: name state last_check last_state_change\nFilter: name = " + name + "\nMergeDuplicates: worst\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{name, 2.0, 200.0, 90.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET hosts\nColumns: state\nMergeDuplicates: worst\n\n")
+	if err = assertEq("bad request: column name is required to merge duplicates", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	// the last_check column is added as hidden column
+	res, err = peer.QueryString("GET hosts\nColumns: name state\nMergeDuplicates: latest\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(2, len(res[0])); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET timeperiods\nColumns: name\nMergeDuplicates: worst\n\n")
+	if err = assertEq("bad request: merging duplicates is not supported for table timeperiods", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET contacts\nColumns: name\nMergeDuplicates: latest\n\n")
+	if err = assertEq("bad request: merging duplicates by last_check is not supported for table contacts", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseMergeDuplicatesKeep(t *testing.T) {
+	columns := []Column{
+		{Name: "host_name", Type: StringCol},
+		{Name: "description", Type: StringCol},
+		{Name: "state", Type: IntCol},
+		{Name: "last_check", Type: TimeCol},
+		{Name: "peer_key", Type: StringCol},
+	}
+	rows := func() [][]interface{} {
+		return [][]interface{}{
+			{"host1", "svc1", 0, 200, "a"},
+			{"host1", "svc2", 0, 100, "a"},
+			{"host1", "svc1", 2, 100, "b"},
+			{"host1", "svc2", 1, 300, "b"},
+			{"host1", "svc1", 1, 300, "c"},
+			{"host2", "svc1", 0, 100, "c"},
+		}
+	}
+
+	if err := SetMergeDuplicates(nil, []string{"c", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMergeDuplicates(nil, nil)
+
+	tests := []struct {
+		policy MergePolicy
+		expect [][]interface{}
+	}{
+		{MergeWorst, [][]interface{}{{"host1", "svc1", 2, 100, "b"}, {"host1", "svc2", 1, 300, "b"}, {"host2", "svc1", 0, 100, "c"}}},
+		{MergeLatest, [][]interface{}{{"host1", "svc1", 1, 300, "c"}, {"host1", "svc2", 1, 300, "b"}, {"host2", "svc1", 0, 100, "c"}}},
+		// backend a is not preferred at all
+		{MergePreferred, [][]interface{}{{"host1", "svc1", 1, 300, "c"}, {"host1", "svc2", 1, 300, "b"}, {"host2", "svc1", 0, 100, "c"}}},
+	}
+	for _, test := range tests {
+		res := Response{Request: &Request{Table: "services", MergeDuplicates: test.policy, MergeKeep: true}, Columns: columns, Result: rows()}
+		res.MergeDuplicates()
+		if err := assertEq(test.expect, res.Result); err != nil {
+			t.Errorf("%s: %s", test.policy.String(), err)
+		}
+		if err := assertEq(3, res.ResultTotal); err != nil {
+			t.Errorf("%s: %s", test.policy.String(), err)
+		}
+	}
+
+	// merged rows of the preferred backend still use the latest timestamps
+	if err := SetMergeDuplicates(nil, []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	res := Response{Request: &Request{Table: "services", MergeDuplicates: MergePreferred}, Columns: columns, Result: rows()}
+	res.MergeDuplicates()
+	expect := [][]interface{}{{"host1", "svc1", 2, 300, "b"}, {"host1", "svc2", 1, 300, "b"}, {"host2", "svc1", 0, 100, "c"}}
+	if err := assertEq(expect, res.Result); err != nil {
+		t.Error(err)
+	}
+
+	// configured keys replace the default keys
+	if err := SetMergeDuplicates(map[string][]string{"services": {"host_name"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	res = Response{Request: &Request{Table: "services", MergeDuplicates: MergeWorst, MergeKeep: true}, Columns: columns, Result: rows()}
+	res.MergeDuplicates()
+	expect = [][]interface{}{{"host1", "svc1", 2, 100, "b"}, {"host2", "svc1", 0, 100, "c"}}
+	if err := assertEq(expect, res.Result); err != nil {
+		t.Error(err)
+	}
+
+	for _, keys := range []map[string][]string{{"unknown": {"name"}}, {"hosts": {"unknown"}}, {"hosts": {}}} {
+		if err := SetMergeDuplicates(keys, nil); err == nil {
+			t.Errorf("expected error for %v", keys)
+		}
+	}
+}
+
+func TestResponseMergeDuplicatesPreferred(t *testing.T) {
+	peer := StartTestPeer(2, 10, 20)
+	PauseTestPeers(peer)
+
+	if err := SetMergeDuplicates(nil, []string{"mockid1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetMergeDuplicates(nil, nil)
+
+	// services of the preferred backend are kept, peer_key is not required in the columns
+	all, err := peer.QueryString("GET services\nColumns: host_name description\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("test requires services")
+	}
+	res, err := peer.QueryString("GET services\nColumns: host_name description\nMergeDuplicates: preferred keep\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(all)/2, len(res)); err != nil {
+		t.Error(err)
+	}
+	for _, row := range res {
+		if err = assertEq(2, len(row)); err != nil {
+			t.Errorf("%v: %s", row, err)
+		}
+	}
+	res, err = peer.QueryString("GET services\nColumns: host_name description peer_key\nMergeDuplicates: preferred keep\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res {
+		if err = assertEq("mockid1", row[2]); err != nil {
+			t.Errorf("%s - %s: %s", row[0], row[1], err)
+		}
+	}
+
+	// the limit applies after merging duplicates
+	res, err = peer.QueryString("GET hosts\nColumns: name\nMergeDuplicates: worst keep\nLimit: 5\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(5, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	_, err = peer.QueryString("GET contacts\nColumns: name\nMergeDuplicates: worst keep\n\n")
+	if err = assertEq("bad request: merging duplicates by state is not supported for table contacts", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseChangedSince(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	since := time.Now().Unix() - 60
+	res, err := peer.QueryString(fmt.Sprintf("GET hosts\nColumns: name\nChangedSince: %d\n\n", since))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// mark all hosts as unchanged except the first one
+	backend := DataStore["mockid0"]
+	backend.DataLock.Lock()
+	lastModified := backend.Tables["hosts"].LastModified
+	for i := range lastModified {
+		lastModified[i] = since - 60
+	}
+	lastModified[0] = since + 30
+	backend.DataLock.Unlock()
+
+	res, err = peer.QueryString(fmt.Sprintf("GET hosts\nColumns: name\nChangedSince: %d\n\n", since))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	res, err = peer.QueryString(fmt.Sprintf("GET hosts\nStats: state >= 0\nChangedSince: %d\n\n", since))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1.0, res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// tables without modification tracking return all rows
+	all, err := peer.QueryString("GET contacts\nColumns: name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = peer.QueryString(fmt.Sprintf("GET contacts\nColumns: name\nChangedSince: %d\n\n", time.Now().Unix()+60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(all), len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+// chunkRecorder remembers each single write call.
+type chunkRecorder struct {
+	chunks []string
+}
+
+func (c *chunkRecorder) Write(p []byte) (int, error) {
+	c.chunks = append(c.chunks, string(p))
+	return len(p), nil
+}
+
+func TestResponseProgressive(t *testing.T) {
+	peer := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name state\nColumnHeaders: on\nOutputFormat: ndjson\nProgressive: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &chunkRecorder{}
+	req.progressive = NewProgressiveWriter(recorder, req)
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// header row and one chunk for each peer
+	if err = assertEq(4, len(recorder.chunks)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("[\"name\",\"state\"]\n", recorder.chunks[0]); err != nil {
+		t.Error(err)
+	}
+	for _, chunk := range recorder.chunks[1:] {
+		if err = assertEq(10, strings.Count(chunk, "\n")); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// only the meta data is left for the final response
+	body, err := res.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(`{"failed":{},"total":30}`, string(body)); err != nil {
+		t.Error(err)
+	}
+
+	// limit and offset apply in order of arrival
+	req, _, _ = NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\nOutputFormat: ndjson\nProgressive: on\nOffset: 5\nLimit: 10\n\n")))
+	req.ExpandRequestedBackends()
+	recorder = &chunkRecorder{}
+	req.progressive = NewProgressiveWriter(recorder, req)
+	if _, err = req.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, strings.Count(strings.Join(recorder.chunks, ""), "\n")); err != nil {
+		t.Error(err)
+	}
+
+	for _, query := range []struct {
+		query string
+		err   string
+	}{
+		{"GET hosts\nColumns: name\nProgressive: on\n\n", "bad request: progressive mode requires OutputFormat: ndjson"},
+		{"GET hosts\nColumns: name\nOutputFormat: ndjson\nProgressive: on\nSort: name asc\n\n", "bad request: progressive mode cannot be used with Sort"},
+		{"GET hosts\nStats: state = 0\nOutputFormat: ndjson\nProgressive: on\n\n", "bad request: progressive mode cannot be used with Stats"},
+	} {
+		_, err = peer.QueryString(query.query)
+		if err == nil {
+			t.Errorf("expected error for %s", query.query)
+			continue
+		}
+		if err = assertEq(query.err, err.Error()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseProgress(t *testing.T) {
+	// slow backend answers each request with a single row after a delay
+	listen := "mockslow.sock"
+	os.Remove(listen)
+	l, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		l.Close()
+		os.Remove(listen)
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ParseRequest(conn)
+			time.Sleep(300 * time.Millisecond)
+			data, _ := json.Marshal([][]interface{}{{1500000000, "test"}})
+			conn.Write([]byte(fmt.Sprintf("%d %11d\n%s\n", 200, len(data)+1, data)))
+			conn.Close()
+		}
+	}()
+
+	dataStore, dataStoreOrder := DataStore, DataStoreOrder
+	defer func() {
+		DataStore, DataStoreOrder = dataStore, dataStoreOrder
+	}()
+	interval := progressInterval
+	progressInterval = 50 * time.Millisecond
+	defer func() {
+		progressInterval = interval
+	}()
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", ID: "slowid", Source: []string{listen}}
+	p := NewPeer(&Config{NetTimeout: 5}, connection, waitGroup, shutdownChannel)
+	p.StatusSet("PeerStatus", PeerStatusUp)
+	DataStore = map[string]*Peer{p.ID: p}
+	DataStoreOrder = []string{p.ID}
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\nColumns: time message\nFilter: time > 0\nOutputFormat: ndjson\nProgressive: on\nProgress: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &chunkRecorder{}
+	req.progressive = NewProgressiveWriter(recorder, req)
+	if _, err = req.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+
+	// progress lines are sent while the backend is still collecting rows
+	progress := 0
+	rowsSent := false
+	for _, chunk := range recorder.chunks {
+		if !strings.HasPrefix(chunk, `{"progress":`) {
+			if err = assertEq("[1500000000,\"test\"]\n", chunk); err != nil {
+				t.Error(err)
+			}
+			rowsSent = true
+			continue
+		}
+		var line ProgressLine
+		if err = json.Unmarshal([]byte(chunk), &line); err != nil {
+			t.Fatal(err)
+		}
+		if rowsSent {
+			continue
+		}
+		progress++
+		if err = assertEq(map[string]int{"slowid": 0}, line.Progress.Rows); err != nil {
+			t.Error(err)
+		}
+		if err = assertEq([]string{}, line.Progress.Done); err != nil {
+			t.Error(err)
+		}
+	}
+	if !rowsSent {
+		t.Errorf("expected result row, got %v", recorder.chunks)
+	}
+	if progress < 2 {
+		t.Errorf("expected at least 2 progress lines before the result, got %d", progress)
+	}
+
+	// no more progress lines once the response is complete
+	sent := len(recorder.chunks)
+	time.Sleep(3 * progressInterval)
+	if err = assertEq(sent, len(recorder.chunks)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseNDJSON(t *testing.T) {
+	res := Response{
+		Request: &Request{OutputFormat: "ndjson", Columns: []string{"name", "state"}, SendColumnsHeader: true},
+		Result: [][]interface{}{
+			{"host1", 0},
+			{"host2", 1},
+		},
+		ResultTotal: 2,
+		Failed:      map[string]string{"mockid1": "connection refused"},
+	}
+	body, err := res.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `["name","state"]` + "\n" + `["host1",0]` + "\n" + `["host2",1]` + "\n" + `{"failed":{"mockid1":"connection refused"},"total":2}`
+	if err = assertEq(expect, string(body)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseColumnsWildcard(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	all, err := peer.QueryString("GET hosts\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := all[0]
+
+	res, err := peer.QueryString("GET hosts\nColumns: *\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(header, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	// explicit columns keep their position and are not repeated
+	res, err = peer.QueryString("GET hosts\nColumns: name as host * peer_name\nLimit: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(header), len(res[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("host", res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("peer_name", res[0][len(res[0])-1]); err != nil {
+		t.Error(err)
+	}
+	seen := make(map[interface{}]bool)
+	for _, col := range res[0] {
+		if seen[col] {
+			t.Errorf("column %v returned twice", col)
+		}
+		seen[col] = true
+	}
+	for i, col := range header {
+		if col == "name" {
+			if err = assertEq(all[1][i], res[1][0]); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseDuplicateColumns(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	expect, err := peer.QueryString("GET hosts\nColumns: name state\nSort: name desc\nLimit: 3\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// duplicates are removed
+	res, err := peer.QueryString("GET hosts\nColumns: name state name host_name\nSort: name desc\nLimit: 3\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(expect, res); err != nil {
+		t.Error(err)
+	}
+
+	// columns with different aliases are no duplicates, sorting uses the first one
+	res, err = peer.QueryString("GET hosts\nColumns: state name as a name as b\nSort: name desc\nLimit: 3\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range res {
+		if err = assertEq([]interface{}{expect[i][1], expect[i][0], expect[i][0]}, row); err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err = peer.QueryString("GET hosts\nColumns: name state name\nDuplicateColumns: reject\n\n")
+	if err = assertEq("bad request: column name is requested more than once", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseShowFilter(t *testing.T) {
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\nFilter: name = a\nFilter: name = b\nOr: 2\nFilter: state = 0\nNegate:\nOutputFormat: wrapped_json\nShowFilter: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := Response{
+		Request:     req,
+		Result:      [][]interface{}{{"a"}},
+		ResultTotal: 1,
+		Failed:      map[string]string{},
+	}
+	body, err := res.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped map[string]interface{}
+	if err = json.Unmarshal(body, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(`(name = "a" or name = "b") and not (state = 0)`, wrapped["filter"]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseMaxRowsPerPeer(t *testing.T) {
+	peer := StartTestPeerExtra(2, 10, 10, "MaxRowsPerPeer = 20\n")
+	PauseTestPeers(peer)
+
+	// let the second backend return far more hosts than the first one
+	big := DataStore["mockid1"]
+	big.DataLock.Lock()
+	hosts := big.Tables["hosts"]
+	rows := hosts.Data
+	for i := 0; i < 4; i++ {
+		hosts.Data = append(hosts.Data, rows...)
+	}
+	big.Tables["hosts"] = hosts
+	big.DataLock.Unlock()
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name peer_key\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(30, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(map[string]string{"mockid1": "result truncated to 20 rows"}, res.Warnings); err != nil {
+		t.Error(err)
+	}
+	perPeer := map[string]int{}
+	for _, row := range res.Result {
+		perPeer[row[1].(string)]++
+	}
+	if err = assertEq(map[string]int{"mockid0": 10, "mockid1": 20}, perPeer); err != nil {
+		t.Error(err)
+	}
+
+	// small results are not affected, testhost_1 exists 5 times on the second backend
+	result, err := peer.QueryString("GET hosts\nColumns: name\nFilter: name = testhost_1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(6, len(result)); err != nil {
+		t.Error(err)
+	}
+
+	// passthrough queries send the cap as limit to the backend
+	for limit, expect := range map[int]int{0: 21, 10: 10, 20: 20, 50: 21} {
+		if err = assertEq(expect, peerRowLimit(limit)); err != nil {
+			t.Errorf("limit %d: %s", limit, err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseNullValue(t *testing.T) {
+	columns := []Column{
+		{Name: "name", Type: StringCol},
+		{Name: "state", Type: IntCol},
+		{Name: "latency", Type: FloatCol},
+		{Name: "last_check", Type: TimeCol},
+		{Name: "contacts", Type: StringListCol},
+		{Name: "comments", Type: IntListCol},
+		{Name: "custom_variables", Type: CustomVarCol},
+	}
+	tests := map[string][]interface{}{
+		"":      {nil, nil, nil, nil, nil, nil, nil},
+		"null":  {nil, nil, nil, nil, nil, nil, nil},
+		"empty": {"", "", "", "", "", "", ""},
+		"zero":  {"", 0.0, 0.0, 0.0, []interface{}{}, []interface{}{}, map[string]interface{}{}},
+	}
+	for mode, expect := range tests {
+		res := Response{
+			Request: &Request{NullValue: mode},
+			Columns: columns,
+			Result: [][]interface{}{
+				{nil, nil, nil, nil, nil, nil, nil},
+				{"host", 1.0, 0.5, 1500000000.0, []interface{}{"admin"}, []interface{}{1.0}, map[string]interface{}{"OS": "linux"}},
+			},
+		}
+		res.ReplaceNullValues()
+		if err := assertEq(expect, res.Result[0]); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+		// non null values are never changed
+		if err := assertEq("host", res.Result[1][0]); err != nil {
+			t.Errorf("mode %s: %s", mode, err)
+		}
+	}
+
+	// stats values are numbers
+	res := Response{
+		Request: &Request{NullValue: "zero", Stats: []Filter{{StatsType: Counter}}},
+		Columns: []Column{{Name: "name", Type: StringCol}},
+		Result:  [][]interface{}{{nil, nil}},
+	}
+	res.ReplaceNullValues()
+	if err := assertEq([]interface{}{"", 0.0}, res.Result[0]); err != nil {
+		t.Error(err)
+	}
+
+	// progressive rows are replaced before they are sent
+	req := &Request{NullValue: "empty"}
+	recorder := &chunkRecorder{}
+	progressive := NewProgressiveWriter(recorder, req)
+	if err := progressive.Start(&Response{Request: req, Columns: columns[:2]}); err != nil {
+		t.Fatal(err)
+	}
+	progressive.WriteRows([][]interface{}{{"host", nil}})
+	if err := assertEq([]string{"[\"host\",\"\"]\n"}, recorder.chunks); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseDefaultColumns(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "Listen = [\"test.sock\"]\n\n[DefaultColumns]\nhosts = [\"name\", \"state\", \"peer_key\"]\n\n")
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET hosts\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"name", "state", "peer_key"}, res[0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(11, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// explicit columns are not affected
+	res, err = peer.QueryString("GET hosts\nColumns: name alias\nColumnHeaders: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"name", "alias"}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	// tables without default columns return all columns
+	res, err = peer.QueryString("GET services\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(true, len(res[0]) > 50); err != nil {
+		t.Error(err)
+	}
+
+	if err = assertLike("has no column none", SetDefaultColumns(map[string][]string{"hosts": {"none"}}).Error()); err != nil {
+		t.Error(err)
+	}
+	if err = assertLike("table none does not exist", SetDefaultColumns(map[string][]string{"none": {"name"}}).Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+	SetDefaultColumns(nil)
+}
+
+func TestResponseColumnAccess(t *testing.T) {
+	peer := StartTestPeerExtra(1, 10, 10, "Listen = [\"test.sock\"]\n\n[AllowedColumns]\ncontacts = [\"name\", \"alias\"]\n\n[DeniedColumns]\nhosts = [\"custom_variable_values\"]\n\n")
+	PauseTestPeers(peer)
+
+	// allowed columns
+	res, err := peer.QueryString("GET hosts\nColumns: name state\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+	_, err = peer.QueryString("GET contacts\nColumns: name alias\n\n")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// denied in output, filters, stats and sorts
+	denied := []string{
+		"GET hosts\nColumns: name custom_variable_values\n\n",
+		"GET hosts\nColumns: name custom_variable_values\nSort: custom_variable_values asc\n\n",
+		"GET hosts\nColumns: name\nFilter: custom_variable_values >= secret\n\n",
+		"GET hosts\nColumns: name\nFilter: name = test\nFilter: custom_variable_values >= secret\nOr: 2\n\n",
+		"GET hosts\nStats: custom_variable_values >= secret\n\n",
+		"GET hosts\nColumns: name\nFacet: custom_variable_values\n\n",
+	}
+	for _, query := range denied {
+		_, err = peer.QueryString(query)
+		if err == nil {
+			t.Errorf("expected error for: %s", query)
+			continue
+		}
+		if err = assertEq("bad request: column custom_variable_values is not permitted for table hosts", err.Error()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// columns not in the allowed list
+	_, err = peer.QueryString("GET contacts\nColumns: name email\n\n")
+	if err == nil {
+		t.Fatal("expected error for email column")
+	}
+	if err = assertEq("bad request: column email is not permitted for table contacts", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	// implicit columns skip the denied columns
+	for _, query := range []string{"GET hosts\n\n", "GET hosts\nColumns: *\n\n"} {
+		res, err = peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, col := range res[0] {
+			if col == "custom_variable_values" {
+				t.Errorf("denied column returned for: %s", query)
+			}
+		}
+	}
+	res, err = peer.QueryString("GET contacts\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"alias", "name"}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	if err = assertLike("has no column none", SetColumnAccess(nil, map[string][]string{"hosts": {"none"}}).Error()); err != nil {
+		t.Error(err)
+	}
+	if err = assertLike("table none does not exist", SetColumnAccess(map[string][]string{"none": {"name"}}, nil).Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+	SetColumnAccess(nil, nil)
+}
+
+func TestResponsePeerOrder(t *testing.T) {
+	peer := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	DataStore["mockid0"].StatusSet("ReponseTime", 0.3)
+	DataStore["mockid1"].StatusSet("ReponseTime", 0.5)
+	DataStore["mockid2"].StatusSet("ReponseTime", 0.1)
+
+	tests := []struct {
+		order  string
+		expect []string
+	}{
+		{"", []string{"mockid0", "mockid1", "mockid2"}},
+		{"PeerOrder: config\n", []string{"mockid0", "mockid1", "mockid2"}},
+		{"PeerOrder: reverse\n", []string{"mockid2", "mockid1", "mockid0"}},
+		{"PeerOrder: latency\n", []string{"mockid2", "mockid0", "mockid1"}},
+	}
+	for _, test := range tests {
+		res, err := peer.QueryString("GET hosts\nColumns: peer_key\n" + test.order + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// rows of each backend are kept together
+		order := []string{}
+		for _, row := range res {
+			key := row[0].(string)
+			if len(order) == 0 || order[len(order)-1] != key {
+				order = append(order, key)
+			}
+		}
+		if err = assertEq(test.expect, order); err != nil {
+			t.Errorf("%s: %s", test.order, err)
+		}
+	}
+
+	_, err := peer.QueryString("GET hosts\nColumns: peer_key\nPeerOrder: random\n\n")
+	if err = assertEq("bad request: unrecognized peer order, only config, reverse and latency are supported", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseServerTime(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	start := time.Now().Unix()
+	res, err := peer.QueryString("GET hosts\nColumns: name lmd_time\nFilter: lmd_time > 0\nSort: lmd_time asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(20, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	now := res[0][1].(float64)
+	if now < float64(start) || now > float64(time.Now().Unix()) {
+		t.Errorf("lmd_time %f is not the current time", now)
+	}
+	for _, row := range res {
+		if err = assertEq(now, row[1]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	res, err = peer.QueryString("GET status\nColumns: peer_key lmd_time\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(res[0][1], res[1][1]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseWaitResult(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	tests := []struct {
+		condition string
+		expect    string
+	}{
+		{"name = testhost_1", "matched"},
+		{"state = 99", "timeout"},
+	}
+	for _, test := range tests {
+		query := "GET hosts\nColumns: name state\nFilter: name = testhost_1\nWaitTrigger: state\nWaitObject: testhost_1\nWaitTimeout: 500\nWaitCondition: " + test.condition + "\nOutputFormat: wrapped_json\n\n"
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.expect, res.WaitResult()); err != nil {
+			t.Errorf("%s: %s", test.condition, err)
+		}
+		// the last known state is returned after timeouts as well
+		if err = assertEq(1, len(res.Result)); err != nil {
+			t.Errorf("%s: %s", test.condition, err)
+		}
+		body, _ := res.JSON()
+		if err = assertLike(`"wait_result":"`+test.expect+`"`, string(body)); err != nil {
+			t.Errorf("%s: %s", test.condition, err)
+		}
+	}
+
+	// service wait objects without a host name cannot be checked and must not report a match
+	query := "GET services\nColumns: description\nWaitTrigger: state\nWaitObject: testhost_1\nWaitTimeout: 500\nWaitCondition: state = 99\n\n"
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("timeout", res.WaitResult()); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("bad request: unsupported service wait object: testhost_1", res.Failed["mockid0"]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseApproxTotal(t *testing.T) {
+	peer := StartTestPeer(1, 100, 100)
+	PauseTestPeers(peer)
+
+	defaultSamples := atomic.LoadInt64(&approxTotalSamples)
+	atomic.StoreInt64(&approxTotalSamples, 10)
+	defer atomic.StoreInt64(&approxTotalSamples, defaultSamples)
+
+	getResponse := func(query string) *Response {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, filter := range []string{"name ~ testhost", "name ~ testhost_1", "name ~ testhost_[2-5]"} {
+		query := "GET hosts\nColumns: name\nFilter: " + filter + "\nLimit: 5\nOutputFormat: wrapped_json\n"
+		exact := getResponse(query + "\n")
+		if err := assertEq(false, exact.IsApproxTotal()); err != nil {
+			t.Errorf("%s: %s", filter, err)
+		}
+		approx := getResponse(query + "ApproxTotal: on\n\n")
+		if err := assertEq(true, approx.IsApproxTotal()); err != nil {
+			t.Errorf("%s: %s", filter, err)
+		}
+		if err := assertEq(exact.Result, approx.Result); err != nil {
+			t.Errorf("%s: %s", filter, err)
+		}
+		// estimates must be in the range of the exact total
+		if approx.ResultTotal < exact.ResultTotal/2 || approx.ResultTotal > exact.ResultTotal*2 {
+			t.Errorf("%s: approximate total %d is not in the range of the exact total %d", filter, approx.ResultTotal, exact.ResultTotal)
+		}
+		body, _ := approx.JSON()
+		if err := assertLike(`"total_approx":true`, string(body)); err != nil {
+			t.Errorf("%s: %s", filter, err)
+		}
+	}
+
+	// small results are counted exactly
+	res := getResponse("GET hosts\nColumns: name\nFilter: name ~ testhost\nLimit: 95\nApproxTotal: on\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq(false, res.IsApproxTotal()); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(100, res.ResultTotal); err != nil {
+		t.Error(err)
+	}
+	body, _ := res.JSON()
+	if err := assertLike(`"total_approx":false`, string(body)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponsePassThroughColumns(t *testing.T) {
+	// backend answers each request with a single row containing the requested column names
+	listen := "mockprojection.sock"
+	os.Remove(listen)
+	l, err := net.Listen("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		l.Close()
+		os.Remove(listen)
+	}()
+	requests := make(chan *Request, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, _ := ParseRequest(conn)
+			data, _ := json.Marshal([][]string{req.Columns})
+			conn.Write([]byte(fmt.Sprintf("%d %11d\n%s\n", 200, len(data)+1, data)))
+			conn.Close()
+			requests <- req
+		}
+	}()
+
+	dataStore, dataStoreOrder := DataStore, DataStoreOrder
+	defer func() {
+		DataStore, DataStoreOrder = dataStore, dataStoreOrder
+	}()
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	connection := Connection{Name: "Test", ID: "projectionid", Source: []string{listen}}
+	p := NewPeer(&Config{NetTimeout: 5}, connection, waitGroup, shutdownChannel)
+	p.StatusSet("PeerStatus", PeerStatusUp)
+	DataStore = map[string]*Peer{p.ID: p}
+	DataStoreOrder = []string{p.ID}
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\nColumns: time peer_key message time\nFilter: time > 0\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// virtual and duplicate columns are not requested from the backend, duplicates are removed by default
+	backendReq := <-requests
+	if err = assertEq([]string{"time", "message"}, backendReq.Columns); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([][]interface{}{{"time", "projectionid", "message"}}, res.Result); err != nil {
+		t.Error(err)
+	}
+
+	// regular expression filters are pushed down to the backend
+	req, _, err = NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\nColumns: time message\nFilter: time > 0\nFilter: message ~ disk\nFilter: host_name ~~ ^web\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = req.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+	backendReq = <-requests
+	filters := ""
+	for i := range backendReq.Filter {
+		filters += backendReq.Filter[i].String("")
+	}
+	if err = assertEq("Filter: time > 0\nFilter: message ~ disk\nFilter: host_name ~~ ^web\n", filters); err != nil {
+		t.Error(err)
+	}
+
+	// hidden virtual columns are computed but removed from the result
+	req, _, err = NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\nColumns: time peer_key hidden message\nFilter: time > 0\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err = req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendReq = <-requests
+	if err = assertEq([]string{"time", "message"}, backendReq.Columns); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq([][]interface{}{{"time", "message"}}, res.Result); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseConsistency(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// a last update in the future prevents regular updates from interfering
+	backend := DataStore["mockid0"]
+	lastUpdate := time.Now().Unix() + 3600
+
+	tests := []struct {
+		consistency string
+		idling      bool
+		expectIdle  bool
+		refreshed   bool
+	}{
+		{"cached", true, true, false},
+		{"fresh", true, false, true},
+		{"fresh", false, false, true},
+	}
+	for _, test := range tests {
+		backend.StatusSet("Idling", test.idling)
+		backend.StatusSet("LastUpdate", lastUpdate)
+		queries := backend.StatusGet("Querys").(int)
+		res, err := peer.QueryString("GET hosts\nColumns: name\nConsistency: " + test.consistency + "\n\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(10, len(res)); err != nil {
+			t.Errorf("%s: %s", test.consistency, err)
+		}
+		if err = assertEq(test.expectIdle, backend.StatusGet("Idling")); err != nil {
+			t.Errorf("%s: %s", test.consistency, err)
+		}
+		// refreshing sends update queries to the backend
+		if err = assertEq(test.refreshed, backend.StatusGet("Querys").(int) > queries); err != nil {
+			t.Errorf("%s: %s", test.consistency, err)
+		}
+	}
+
+	// virtual tables do not refresh the backends
+	queries := backend.StatusGet("Querys").(int)
+	_, err := peer.QueryString("GET sites\nColumns: name\nConsistency: fresh\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(queries, backend.StatusGet("Querys").(int)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseNoSpinUp(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	// a last update in the future prevents regular updates from interfering
+	backend := DataStore["mockid0"]
+	lastUpdate := time.Now().Unix() + 3600
+
+	tests := []struct {
+		header     string
+		expectIdle bool
+		spunUp     bool
+	}{
+		{"NoSpinUp: on\n", true, false},
+		{"NoSpinUp: off\n", false, true},
+		{"", false, true},
+	}
+	for _, test := range tests {
+		backend.StatusSet("Idling", true)
+		backend.StatusSet("LastUpdate", lastUpdate)
+		queries := backend.StatusGet("Querys").(int)
+		res, err := peer.QueryString("GET hosts\nColumns: name state\n" + test.header + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// idling peers still answer from their cached data
+		if err = assertEq(10, len(res)); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+		if err = assertEq(test.expectIdle, backend.StatusGet("Idling")); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+		if err = assertEq(test.spunUp, backend.StatusGet("Querys").(int) > queries); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseRowAge(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// idling peers will not be updated within the test
+	now := time.Now().Unix()
+	for id, age := range map[string]int64{"mockid0": 100, "mockid1": 5} {
+		DataStore[id].StatusSet("Idling", true)
+		DataStore[id].StatusSet("LastUpdate", now-age)
+	}
+
+	res, err := peer.QueryString("GET hosts\nColumns: peer_key lmd_row_age\nSort: lmd_row_age desc\nConsistency: cached\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(20, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	// the stalest rows come first
+	if err = assertEq("mockid0", res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("mockid1", res[19][0]); err != nil {
+		t.Error(err)
+	}
+	if age := res[0][1].(float64); age < 100 || age > 110 {
+		t.Errorf("expected age of about 100 seconds, got %v", age)
+	}
+	if age := res[19][1].(float64); age < 5 || age > 15 {
+		t.Errorf("expected age of about 5 seconds, got %v", age)
+	}
+
+	res, err = peer.QueryString("GET hosts\nColumns: peer_key\nFilter: lmd_row_age > 50\nConsistency: cached\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseFilterStats(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	getResponse := func(query string) *Response {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	filter := "Filter: name ~ testhost\nFilter: name ~ testhost_[1-5]$\nFilter: name != testhost_1\nFilter: name = testhost_3\nFilter: name = testhost_4\nOr: 2\n"
+	for _, query := range []string{
+		"GET hosts\nColumns: name\n" + filter + "OutputFormat: wrapped_json\nFilterStats: on\n\n",
+		"GET hosts\nStats: state = 0\n" + filter + "OutputFormat: wrapped_json\nFilterStats: on\n\n",
+	} {
+		res := getResponse(query)
+		if err := assertEq(4, len(res.Request.Filter)); err != nil {
+			t.Fatal(err)
+		}
+		// counts of both backends are summed up
+		expected := &FilterStats{Rows: 20}
+		for i, passed := range []int{20, 10, 8, 4} {
+			expected.Stages = append(expected.Stages, FilterStageCount{Filter: res.Request.Filter[i].Normalized(), Passed: passed})
+		}
+		if err := assertEq(expected, res.FilterStats); err != nil {
+			t.Errorf("%q: %s", query, err)
+		}
+		body, _ := res.JSON()
+		if err := assertLike(`"filter_stats":\{"rows":20,"stages":\[\{"filter":.*"passed":4\}\]\}`, string(body)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the results are the same as without filter stats
+	res := getResponse("GET hosts\nColumns: name\n" + filter + "Sort: name asc\nFilterStats: on\n\n")
+	if err := assertEq(4, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	// exact matches on the name count all rows as well
+	res = getResponse("GET hosts\nColumns: name\nFilter: name = testhost_2\nOutputFormat: wrapped_json\nFilterStats: on\n\n")
+	if err := assertEq(&FilterStats{Rows: 20, Stages: []FilterStageCount{{Filter: `name = "testhost_2"`, Passed: 2}}}, res.FilterStats); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponsePeerWeight(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	countPeers := func(query string) map[string]int {
+		res, err := peer.QueryString(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int)
+		for _, row := range res {
+			counts[row[0].(string)]++
+		}
+		return counts
+	}
+
+	// equal weights return the rows of the first peer first
+	if err := assertEq(map[string]int{"mockid0": 8}, countPeers("GET hosts\nColumns: peer_key name\nLimit: 8\n\n")); err != nil {
+		t.Error(err)
+	}
+
+	weighted := DataStore["mockid0"]
+	weighted.Config.Weight = 3
+	defer func() { weighted.Config.Weight = 0 }()
+
+	tests := []struct {
+		query    string
+		expected map[string]int
+	}{
+		{"GET hosts\nColumns: peer_key name\nLimit: 8\n\n", map[string]int{"mockid0": 6, "mockid1": 2}},
+		{"GET hosts\nColumns: peer_key name\nLimit: 4\nOffset: 4\n\n", map[string]int{"mockid0": 3, "mockid1": 1}},
+		// the remaining rows of the other peer follow once a peer has no rows left
+		{"GET hosts\nColumns: peer_key name\nLimit: 20\n\n", map[string]int{"mockid0": 10, "mockid1": 10}},
+		// sorted results are not affected
+		{"GET hosts\nColumns: peer_key name\nSort: peer_key asc\nLimit: 8\n\n", map[string]int{"mockid0": 8}},
+	}
+	for _, test := range tests {
+		if err := assertEq(test.expected, countPeers(test.query)); err != nil {
+			t.Errorf("%q: %s", test.query, err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseWeightedRoundRobin(t *testing.T) {
+	rows := func(peer string, num int) (result [][]interface{}) {
+		for i := 0; i < num; i++ {
+			result = append(result, []interface{}{peer})
+		}
+		return
+	}
+	merged := weightedRoundRobin([][][]interface{}{rows("a", 5), rows("b", 3), rows("c", 1)}, []int{3, 1, 1})
+	order := ""
+	for _, row := range merged {
+		order += row[0].(string)
+	}
+	if err := assertEq("abacaaabb", order); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseFixed16Header(t *testing.T) {
+	tests := []struct {
+		code   int
+		size   int64
+		header string
+	}{
+		{200, 3, "200           3\n"},
+		{200, 5 << 30, "200  5368709120\n"},
+		{400, maxFixed16Size, "400 99999999999\n"},
+	}
+	for _, test := range tests {
+		header, err := fixed16Header(test.code, test.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.header, header); err != nil {
+			t.Error(err)
+		}
+		if err = assertEq(16, len(header)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	_, err := fixed16Header(200, maxFixed16Size+1)
+	if err = assertEq("response size of 100000000000 bytes exceeds the maximum of 99999999999 bytes for fixed16 headers", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+	_, err = fixed16Header(2000, 3)
+	if err = assertEq("response code 2000 does not fit into the fixed16 header", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseFeatures(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET status\nColumns: lmd_features\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	features, ok := res[0][0].([]interface{})
+	if !ok {
+		t.Fatalf("expected list, got %v", res[0][0])
+	}
+	if err = assertEq(len(Features), len(features)); err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"multiquery", "output_json", "output_msgpack", "auth", "saved_filters"} {
+		found := false
+		for _, f := range features {
+			if f == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("feature %s not found in %v", name, features)
+		}
+	}
+
+	// the registry must stay sorted
+	for i := 1; i < len(Features); i++ {
+		if Features[i-1] >= Features[i] {
+			t.Errorf("features not sorted: %s >= %s", Features[i-1], Features[i])
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseStalePeers(t *testing.T) {
+	peer := StartTestPeer(3, 10, 10)
+	PauseTestPeers(peer)
+
+	// idling peers will not be updated within the test
+	now := time.Now().Unix()
+	for id, age := range map[string]int64{"mockid0": 100, "mockid1": 5, "mockid2": 300} {
+		DataStore[id].StatusSet("Idling", true)
+		DataStore[id].StatusSet("LastUpdate", now-age)
+	}
+
+	res, err := peer.QueryString("GET sites\nColumns: key is_stale\nSort: key asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	for i, stale := range []float64{1, 0, 1} {
+		if err = assertEq(stale, res[i][1]); err != nil {
+			t.Errorf("%s: %s", res[i][0], err)
+		}
+	}
+
+	res, err = peer.QueryString("GET sites\nColumns: key\nFilter: is_stale = 0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"mockid1"}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// the stale count is the same for the status rows of all peers
+	res, err = peer.QueryString("GET status\nColumns: lmd_stale_peers\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res {
+		if err = assertEq(float64(2), row[0]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseMapStates(t *testing.T) {
+	peer := StartTestPeer(1, 10, 50)
+	PauseTestPeers(peer)
+
+	// spread host and service states over all possible values
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	for _, name := range []string{"hosts", "services"} {
+		data := p.Tables[name]
+		stateIndex := data.Table.GetColumn("state").Index
+		for i, row := range data.Data {
+			row[stateIndex] = float64(i % 4)
+		}
+	}
+	p.DataLock.Unlock()
+
+	tests := []struct {
+		query  string
+		expect []string
+	}{
+		{"GET hosts\nColumns: state\nFilter: state = %d\n", []string{"UP", "DOWN", "UNREACHABLE"}},
+		{"GET services\nColumns: state\nFilter: state = %d\n", []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}},
+		{"GET services\nColumns: host_state\nFilter: host_state = %d\n", []string{"UP", "DOWN", "UNREACHABLE"}},
+	}
+	for _, test := range tests {
+		for state, label := range test.expect {
+			res, err := peer.QueryString(fmt.Sprintf(test.query, state) + "MapStates: on\n\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 {
+				t.Fatalf("expected rows for: %s", fmt.Sprintf(test.query, state))
+			}
+			for _, row := range res {
+				if err = assertEq(label, row[0]); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}
+
+	// unknown host states keep their number
+	res, err := peer.QueryString("GET hosts\nColumns: state\nFilter: state = 3\nMapStates: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{float64(3)}, {float64(3)}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// non state columns are untouched
+	res, err = peer.QueryString("GET hosts\nColumns: name state_type state\nFilter: name = testhost_2\nMapStates: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("testhost_2", res[0][0]); err != nil {
+		t.Error(err)
+	}
+	if _, ok := res[0][1].(float64); !ok {
+		t.Errorf("expected numeric state_type, got %v", res[0][1])
+	}
+	if _, ok := res[0][2].(string); !ok {
+		t.Errorf("expected state label, got %v", res[0][2])
+	}
+
+	// progressive rows are mapped as well
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: state\nFilter: state = 0\nMapStates: on\nOutputFormat: ndjson\nProgressive: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &chunkRecorder{}
+	req.progressive = NewProgressiveWriter(recorder, req)
+	if _, err = req.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertLike(`^\["UP"\]\n`, strings.Join(recorder.chunks, "")); err != nil {
+		t.Error(err)
+	}
+
+	// numeric output is the default
+	res, err = peer.QueryString("GET services\nColumns: state\nFilter: state = 2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(float64(2), res[0][0]); err != nil {
+		t.Error(err)
+	}
+
+	// stats are not mapped
+	res, err = peer.QueryString("GET services\nStats: state = 2\nMapStates: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := res[0][0].(float64); !ok {
+		t.Errorf("expected numeric stats, got %v", res[0][0])
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseExplain(t *testing.T) {
+	peer := StartTestPeer(2, 10, 50)
+	PauseTestPeers(peer)
+
+	explain := func(query string) *QueryPlan {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Plan == nil {
+			t.Fatalf("expected query plan for: %s", query)
+		}
+		if err = assertEq(0, len(res.Result)); err != nil {
+			t.Error(err)
+		}
+		return res.Plan
+	}
+
+	queries := DataStore["mockid0"].StatusGet("Querys").(int)
+
+	// all rows are scanned
+	plan := explain("GET hosts\nColumns: name\nFilter: name = testhost_1\nExplain: on\n\n")
+	if err := assertEq([]string{"mockid0", "mockid1"}, plan.Peers); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(20, plan.RowsTotal); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(20, plan.RowsScanned); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(1, len(plan.Filters)); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertEq(FilterPlan{Filter: `name = "testhost_1"`, Access: "scan", Selectivity: equalSelectivity}, plan.Filters[0]); err != nil {
+		t.Error(err)
+	}
+
+	plan = explain("GET hosts\nColumns: name\nFilter: name ~ testhost_1\nExplain: on\n\n")
+	if err := assertEq(FilterPlan{Filter: `name ~ "testhost_1"`, Access: "scan", Selectivity: regexSelectivity}, plan.Filters[0]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(5, plan.RowsMatched); err != nil {
+		t.Error(err)
+	}
+
+	// explained queries are not sent to the backends
+	if err := assertEq(queries, DataStore["mockid0"].StatusGet("Querys").(int)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponsePeerBytes(t *testing.T) {
+	// each backend answers with a fixed number of log entries
+	startBackend := func(listen string, rows int) net.Listener {
+		os.Remove(listen)
+		l, err := net.Listen("unix", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				ParseRequest(conn)
+				result := make([][]interface{}, rows)
+				for i := range result {
+					result[i] = []interface{}{1500000000 + i, "log message"}
+				}
+				data, _ := json.Marshal(result)
+				conn.Write([]byte(fmt.Sprintf("%d %11d\n%s\n", 200, len(data)+1, data)))
+				conn.Close()
+			}
+		}()
+		return l
+	}
+	backends := map[string]int{"bytesid1": 1, "bytesid2": 100}
+
+	dataStore, dataStoreOrder := DataStore, DataStoreOrder
+	defer func() {
+		DataStore, DataStoreOrder = dataStore, dataStoreOrder
+	}()
+	DataStore = make(map[string]*Peer)
+	DataStoreOrder = []string{}
+	waitGroup := &sync.WaitGroup{}
+	shutdownChannel := make(chan bool)
+	for id, rows := range backends {
+		listen := id + ".sock"
+		l := startBackend(listen, rows)
+		defer func() {
+			l.Close()
+			os.Remove(listen)
+		}()
+		connection := Connection{Name: id, ID: id, Source: []string{listen}}
+		p := NewPeer(&Config{NetTimeout: 5}, connection, waitGroup, shutdownChannel)
+		p.StatusSet("PeerStatus", PeerStatusUp)
+		DataStore[p.ID] = p
+		DataStoreOrder = append(DataStoreOrder, p.ID)
+	}
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\nColumns: time message\nFilter: time > 0\nOutputFormat: wrapped_json\nPeerBytes: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(101, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	data, err := res.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped struct {
+		PeerBytes map[string]int `json:"peer_bytes"`
+	}
+	if err = json.Unmarshal(data, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(wrapped.PeerBytes)); err != nil {
+		t.Fatal(err)
+	}
+	for id := range backends {
+		if wrapped.PeerBytes[id] <= 0 {
+			t.Errorf("expected received bytes for %s, got %v", id, wrapped.PeerBytes)
+		}
+	}
+	if wrapped.PeerBytes["bytesid2"] <= wrapped.PeerBytes["bytesid1"]*50 {
+		t.Errorf("expected the larger backend to dominate the transfer, got %v", wrapped.PeerBytes)
+	}
+
+	// the counters are only sent on request
+	req.SendPeerBytes = false
+	data, err = res.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "peer_bytes") {
+		t.Errorf("expected no peer_bytes without PeerBytes header")
+	}
+}
+
+func TestResponseControlChars(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	output := "line1\nline2\tend\r\n\x07bell \"quoted\""
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	nameIndex := hosts.Table.GetColumn("name").Index
+	outputIndex := hosts.Table.GetColumn("plugin_output").Index
+	for _, row := range hosts.Data {
+		if row[nameIndex] == "testhost_1" {
+			row[outputIndex] = output
+		}
+	}
+	p.DataLock.Unlock()
+
+	getResponse := func(format string) *Response {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name plugin_output\nFilter: name = testhost_1\nOutputFormat: " + format + "\n\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// json formats escape all control characters and keep the original value
+	for _, format := range []string{"json", "wrapped_json", "ndjson"} {
+		data, err := getResponse(format).Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.ContainsAny(data, "\t\r\x07") {
+			t.Errorf("%s output contains raw control characters: %q", format, data)
+		}
+		if err = assertEq(true, bytes.Contains(data, []byte(`"line1\nline2\tend\r\n\u0007bell \"quoted\""`))); err != nil {
+			t.Errorf("%s: %s in %q", format, err, data)
+		}
+	}
+	// each ndjson row is a single line, followed by the totals line
+	data, err := getResponse("ndjson").Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(bytes.Split(data, []byte("\n")))); err != nil {
+		t.Error(err)
+	}
+
+	// control characters can be removed completely
+	defer atomic.StoreInt32(&stripControlChars, atomic.LoadInt32(&stripControlChars))
+	atomic.StoreInt32(&stripControlChars, 1)
+	for _, format := range []string{"json", "msgpack"} {
+		res := getResponse(format)
+		if err = assertEq([][]interface{}{{"testhost_1", "line1 line2 end  bell \"quoted\""}}, res.Result); err != nil {
+			t.Errorf("%s: %s", format, err)
+		}
+	}
+
+	// filters still use the original value
+	res, err := peer.QueryString("GET hosts\nColumns: name\nFilter: plugin_output ~ \\x07bell\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(1, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseUnsupportedTable(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	setUnsupported := func(id string) {
+		p := DataStore[id]
+		p.DataLock.Lock()
+		table := p.Tables["downtimes"]
+		table.Data = make([][]interface{}, 0)
+		table.Unsupported = true
+		p.Tables["downtimes"] = table
+		p.DataLock.Unlock()
+	}
+	getResponse := func() (*Response, error) {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET downtimes\nColumns: id peer_key\n\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		return req.GetResponse()
+	}
+
+	expected, err := getResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(4, len(expected.Result)); err != nil {
+		t.Error(err)
+	}
+
+	// table supported by some backends
+	setUnsupported("mockid0")
+	res, err := getResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(expected.Result)/2, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	for _, row := range res.Result {
+		if err = assertEq("mockid1", row[1]); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = assertEq(map[string]string{"mockid0": "table downtimes is not supported by this backend"}, res.Warnings); err != nil {
+		t.Error(err)
+	}
+
+	// table supported by no backend
+	setUnsupported("mockid1")
+	_, err = getResponse()
+	if err = assertEq("not found: table downtimes is not supported by any of the selected backends", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+	_, err = getResponse()
+	if err = assertEq(404, responseErrorCode(err)); err != nil {
+		t.Error(err)
+	}
+
+	// unknown tables are still bad requests
+	_, _, err = NewRequest(bufio.NewReader(bytes.NewBufferString("GET nosuchtable\nColumns: id\n\n")))
+	if err = assertEq(400, responseErrorCode(err)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseStablePagination(t *testing.T) {
+	peer := StartTestPeer(3, 10, 50)
+	PauseTestPeers(peer)
+
+	// many rows share the same sort key, the same hosts and services exist on all backends
+	query := "GET services\nColumns: host_name description state\nSort: state asc\nPeerOrder: latency\n"
+	full, err := peer.QueryString(query + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(120, len(full)); err != nil {
+		t.Fatal(err)
+	}
+
+	// change the backend order for every page, the pages must still partition the full result
+	pages := [][]interface{}{}
+	pageSize := 7
+	for offset, n := 0, 0; offset < len(full); offset, n = offset+pageSize, n+1 {
+		for i, id := range []string{"mockid0", "mockid1", "mockid2"} {
+			DataStore[id].StatusSet("ReponseTime", float64((i+n)%3))
+		}
+		page, err := peer.QueryString(fmt.Sprintf("%sOffset: %d\nLimit: %d\n\n", query, offset, pageSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page...)
+	}
+	if err = assertEq(full, pages); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseJSONMap(t *testing.T) {
+	peer := StartTestPeer(2, 10, 50)
+	PauseTestPeers(peer)
+
+	getMap := func(query string) (map[string]map[string]interface{}, error) {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			return nil, err
+		}
+		data, err := res.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]map[string]interface{}{}
+		if err = json.Unmarshal(data, &result); err != nil {
+			t.Fatalf("%s: %s", err, data)
+		}
+		return result, nil
+	}
+
+	// hosts use the name as key
+	hosts, err := getMap("GET hosts\nColumns: name state\nBackends: mockid0\nOutputFormat: json_map\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(hosts)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq("testhost_1", hosts["testhost_1"]["name"]); err != nil {
+		t.Error(err)
+	}
+	if _, ok := hosts["testhost_1"]["state"]; !ok {
+		t.Errorf("state missing in %v", hosts["testhost_1"])
+	}
+
+	// services use host name and description
+	services, err := getMap("GET services\nColumns: host_name description\nBackends: mockid0\nOutputFormat: json_map\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(40, len(services)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(map[string]interface{}{"host_name": "testhost_1", "description": "testsvc_1"}, services["testhost_1;testsvc_1"]); err != nil {
+		t.Error(err)
+	}
+
+	// duplicate objects from multiple backends must be merged
+	_, err = getMap("GET hosts\nColumns: name state\nOutputFormat: json_map\n\n")
+	if err = assertEq("bad request: duplicate key testhost_1 in json_map output, use MergeDuplicates or select a single backend", fmt.Sprintf("%v", err)); err != nil {
+		t.Error(err)
+	}
+	hosts, err = getMap("GET hosts\nColumns: name state\nMergeDuplicates: worst\nOutputFormat: json_map\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(hosts)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseStatsHeader(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	res, err := peer.QueryString("GET hosts\nColumns: state\nStats: state = 0\nStats: sum latency\nStats: state = 1\nStatsNegate:\nStats: state = 1\nStats: state = 2\nStatsOr: 2\nColumnHeaders: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"state", "state = 0", "sum latency", "not (state = 1)", "state = 1 or state = 2"}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	// stats without group by columns
+	res, err = peer.QueryString("GET hosts\nStats: avg latency\nStats: name ~ ^testhost_1\nColumnHeaders: on\nOutputFormat: json\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([]interface{}{"avg latency", "name ~ ^testhost_1"}, res[0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseSummary(t *testing.T) {
+	res := Response{
+		Request: &Request{Columns: []string{"name", "state", "latency"}, ColumnAliases: map[int]string{2: "lat"}, Summary: true},
+		Columns: []Column{
+			{Name: "name", Type: StringCol},
+			{Name: "state", Type: IntCol},
+			{Name: "latency", Type: FloatCol},
+		},
+		Result: [][]interface{}{
+			{"a", 0, 0.5},
+			{"b", 2, nil},
+			{"c", 1, 1.5},
+			{"d", 1, 0.25},
+		},
+	}
+	res.Request.Limit = 2
+	res.PostProcessing()
+
+	// limits are applied after the summary
+	if err := assertEq(2, len(res.Result)); err != nil {
+		t.Error(err)
+	}
+	expect := map[string]*ColumnSummary{
+		"state": {Min: 0.0, Max: 2.0, Avg: 1.0},
+		"lat":   {Min: 0.25, Max: 1.5, Avg: 0.75},
+	}
+	if err := assertEq(expect, res.Summary); err != nil {
+		t.Error(err)
+	}
+
+	res.Request.OutputFormat = "wrapped_json"
+	body, err := res.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped map[string]interface{}
+	if err = json.Unmarshal(body, &wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(map[string]interface{}{"min": 0.0, "max": 2.0, "avg": 1.0}, wrapped["summary"].(map[string]interface{})["state"]); err != nil {
+		t.Error(err)
+	}
+
+	// columns without values have an empty summary
+	res.Result = [][]interface{}{{"a", nil, nil}}
+	res.CalculateSummary()
+	if err = assertEq(&ColumnSummary{}, res.Summary["state"]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResponseWrappedJSONEnvelope(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	getWrapped := func(query string) map[string]interface{} {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.applyDefaultLimit()
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := res.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wrapped map[string]interface{}
+		if err = json.Unmarshal(body, &wrapped); err != nil {
+			t.Fatalf("invalid json: %s\n%s", err, body)
+		}
+		for _, key := range []string{"data", "failed", "total", "etag"} {
+			if _, ok := wrapped[key]; !ok {
+				t.Errorf("key %s missing in %s", key, body)
+			}
+		}
+		return wrapped
+	}
+
+	// normal result
+	wrapped := getWrapped("GET hosts\nColumns: name\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq(20, len(wrapped["data"].([]interface{}))); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(map[string]interface{}{}, wrapped["failed"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(20.0, wrapped["total"]); err != nil {
+		t.Error(err)
+	}
+
+	// empty result
+	wrapped = getWrapped("GET hosts\nColumns: name\nFilter: name = none\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq([]interface{}{}, wrapped["data"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(map[string]interface{}{}, wrapped["failed"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0.0, wrapped["total"]); err != nil {
+		t.Error(err)
+	}
+
+	// all backends failed
+	for _, id := range []string{"mockid0", "mockid1"} {
+		DataStore[id].StatusSet("PeerStatus", PeerStatusDown)
+		DataStore[id].StatusSet("LastError", "connection refused")
+	}
+	wrapped = getWrapped("GET hosts\nColumns: name\nOutputFormat: wrapped_json\n\n")
+	for _, id := range []string{"mockid0", "mockid1"} {
+		DataStore[id].StatusSet("PeerStatus", PeerStatusUp)
+		DataStore[id].StatusSet("LastError", "")
+	}
+	if err := assertEq([]interface{}{}, wrapped["data"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(map[string]interface{}{"mockid0": "connection refused", "mockid1": "connection refused"}, wrapped["failed"]); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(0.0, wrapped["total"]); err != nil {
+		t.Error(err)
+	}
+
+	// responses built without querying any backend, ex.: for noop requests
+	body, err := (&Response{Code: 200, Request: &Request{OutputFormat: "wrapped_json"}}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq("{\"data\":[]\n,\"failed\":{}\n\n,\"etag\":\"\"\n,\"total\":0}", string(body)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseShowLimit(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	defaultRows := atomic.LoadInt64(&defaultLimit)
+	defer atomic.StoreInt64(&defaultLimit, defaultRows)
+
+	getWrapped := func(query string) map[string]interface{} {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.applyDefaultLimit()
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := res.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wrapped map[string]interface{}
+		if err = json.Unmarshal(body, &wrapped); err != nil {
+			t.Fatalf("invalid json: %s\n%s", err, body)
+		}
+		return wrapped
+	}
+
+	// limit and offset are only sent on request
+	wrapped := getWrapped("GET hosts\nColumns: name\nLimit: 5\nOutputFormat: wrapped_json\n\n")
+	if _, ok := wrapped["limit"]; ok {
+		t.Errorf("limit should not be sent without ShowLimit header")
+	}
+
+	tests := []struct {
+		defaultLimit int64
+		header       string
+		limit        float64
+		offset       float64
+	}{
+		{0, "", 0, 0},
+		{0, "Limit: 5\nOffset: 2\n", 5, 2},
+		{3, "", 3, 0},
+		{3, "Limit: 100\nOffset: 1\n", 3, 1},
+		{3, "Limit: 2\n", 2, 0},
+	}
+	for _, test := range tests {
+		atomic.StoreInt64(&defaultLimit, test.defaultLimit)
+		wrapped = getWrapped("GET hosts\nColumns: name\n" + test.header + "ShowLimit: on\nOutputFormat: wrapped_json\n\n")
+		if err := assertEq(test.limit, wrapped["limit"]); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+		if err := assertEq(test.offset, wrapped["offset"]); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+		if err := assertEq(10.0, wrapped["total"]); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+		rows := 10 - int(test.offset)
+		if test.limit > 0 && int(test.limit) < rows {
+			rows = int(test.limit)
+		}
+		if err := assertEq(rows, len(wrapped["data"].([]interface{}))); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+	}
+
+	// client listener queries are capped
+	atomic.StoreInt64(&defaultLimit, 3)
+	res, err := peer.QueryString("GET hosts\nColumns: name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(3, len(res)); err != nil {
+		t.Error(err)
+	}
+
+	// internal requests and cluster sub-requests are not
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET hosts\nColumns: name\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	internal, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(10, len(internal.Result)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponsePeerStats(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// one critical host on the first and three on the second backend
+	for id, critical := range map[string]int{"mockid0": 1, "mockid1": 3} {
+		p := DataStore[id]
+		p.DataLock.Lock()
+		hosts := p.Tables["hosts"]
+		stateIndex := hosts.Table.ColumnsIndex["state"]
+		for i := range hosts.Data {
+			hosts.Data[i][stateIndex] = 0.0
+			if i < critical {
+				hosts.Data[i][stateIndex] = 2.0
+			}
+		}
+		p.DataLock.Unlock()
+	}
+
+	getWrapped := func(query string) map[string]interface{} {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.applyDefaultLimit()
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := res.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wrapped map[string]interface{}
+		if err = json.Unmarshal(body, &wrapped); err != nil {
+			t.Fatalf("invalid json: %s\n%s", err, body)
+		}
+		return wrapped
+	}
+
+	wrapped := getWrapped("GET hosts\nStats: state = 2\nStats: avg state\nPeerStats: on\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq([]interface{}{[]interface{}{4.0, 0.4}}, wrapped["data"]); err != nil {
+		t.Error(err)
+	}
+	expect := map[string]interface{}{
+		"mockid0": []interface{}{[]interface{}{1.0, 0.2}},
+		"mockid1": []interface{}{[]interface{}{3.0, 0.6}},
+	}
+	if err := assertEq(expect, wrapped["peer_stats"]); err != nil {
+		t.Error(err)
+	}
+
+	wrapped = getWrapped("GET hosts\nColumns: state\nStats: state >= 0\nPeerStats: on\nOutputFormat: wrapped_json\n\n")
+	if err := assertEq([]interface{}{[]interface{}{0.0, 16.0}, []interface{}{2.0, 4.0}}, wrapped["data"]); err != nil {
+		t.Error(err)
+	}
+	expect = map[string]interface{}{
+		"mockid0": []interface{}{[]interface{}{0.0, 9.0}, []interface{}{2.0, 1.0}},
+		"mockid1": []interface{}{[]interface{}{0.0, 7.0}, []interface{}{2.0, 3.0}},
+	}
+	if err := assertEq(expect, wrapped["peer_stats"]); err != nil {
+		t.Error(err)
+	}
+
+	// no breakdown without the header
+	wrapped = getWrapped("GET hosts\nStats: state = 2\nOutputFormat: wrapped_json\n\n")
+	if _, ok := wrapped["peer_stats"]; ok {
+		t.Errorf("peer_stats should not be sent without PeerStats header")
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseFloatPrecision(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	name := hosts.Data[0][hosts.Table.ColumnsIndex["name"]].(string)
+	hosts.Data[0][hosts.Table.ColumnsIndex["latency"]] = 0.123456
+	hosts.Data[0][hosts.Table.ColumnsIndex["execution_time"]] = 1.98765
+	hosts.Data[0][hosts.Table.ColumnsIndex["current_attempt"]] = 3.0
+	p.DataLock.Unlock()
+
+	query := "GET hosts\nColumns: name latency execution_time current_attempt\nFilter: name = " + name + "\n"
+	tests := []struct {
+		header string
+		expect []interface{}
+	}{
+		{"", []interface{}{name, 0.123456, 1.98765, 3.0}},
+		{"FloatPrecision: 3\n", []interface{}{name, 0.123, 1.988, 3.0}},
+		{"FloatPrecision: 1\n", []interface{}{name, 0.1, 2.0, 3.0}},
+		{"FloatPrecision: 0\n", []interface{}{name, 0.0, 2.0, 3.0}},
+	}
+	for _, test := range tests {
+		res, err := peer.QueryString(query + test.header + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq([][]interface{}{test.expect}, res); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+	}
+
+	// column formats take precedence
+	res, err := peer.QueryString("GET hosts\nColumns: name latency:round4 execution_time\nFilter: name = " + name + "\nFloatPrecision: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{name, 0.1235, 2.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// stats values keep their precision
+	res, err = peer.QueryString("GET hosts\nStats: avg latency\nFilter: name = " + name + "\nFloatPrecision: 1\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{0.123456}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// progressive rows are rounded as well
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query + "FloatPrecision: 1\nOutputFormat: ndjson\nProgressive: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &chunkRecorder{}
+	req.progressive = NewProgressiveWriter(recorder, req)
+	if _, err = req.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(fmt.Sprintf("[%q,0.1,2,3]\n", name), strings.Join(recorder.chunks, "")); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseTimeFormat(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	// the same timestamp on two backends in different timezones
+	var name string
+	for id, zone := range map[string]string{"mockid0": "Europe/Berlin", "mockid1": "America/New_York"} {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := DataStore[id]
+		p.Location = location
+		p.DataLock.Lock()
+		hosts := p.Tables["hosts"]
+		name = hosts.Data[0][hosts.Table.ColumnsIndex["name"]].(string)
+		hosts.Data[0][hosts.Table.ColumnsIndex["last_check"]] = 1500000000.0
+		hosts.Data[0][hosts.Table.ColumnsIndex["last_state_change"]] = 0.0
+		p.DataLock.Unlock()
+	}
+
+	query := "GET hosts\nColumns: peer_key last_check last_state_change\nFilter: name = " + name + "\nSort: peer_key asc\n"
+	tests := []struct {
+		header string
+		expect [][]interface{}
+	}{
+		{"", [][]interface{}{{"mockid0", 1500000000.0, 0.0}, {"mockid1", 1500000000.0, 0.0}}},
+		{"TimeFormat: epoch\n", [][]interface{}{{"mockid0", 1500000000.0, 0.0}, {"mockid1", 1500000000.0, 0.0}}},
+		{"TimeFormat: iso\n", [][]interface{}{{"mockid0", "2017-07-14T04:40:00+02:00", nil}, {"mockid1", "2017-07-13T22:40:00-04:00", nil}}},
+	}
+	for _, test := range tests {
+		res, err := peer.QueryString(query + test.header + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = assertEq(test.expect, res); err != nil {
+			t.Errorf("%s: %s", test.header, err)
+		}
+	}
+
+	// column formats keep the numeric value
+	res, err := peer.QueryString("GET hosts\nColumns: peer_key last_check:round0\nFilter: name = " + name + "\nSort: peer_key asc\nTimeFormat: iso\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{"mockid0", 1500000000.0}, {"mockid1", 1500000000.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseSplitBy(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	for k := range hosts.Data {
+		hosts.Data[k][hosts.Table.ColumnsIndex["state"]] = float64(k % 3)
+	}
+	p.DataLock.Unlock()
+
+	getBody := func(query string) []byte {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		res, err := req.GetResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := res.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// expected groups in the order of their first row
+	all, err := peer.QueryString("GET hosts\nColumns: name state\nSort: name asc\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []string{}
+	expect := make(map[string][][]interface{})
+	for _, row := range all {
+		key := fmt.Sprintf("%v", row[1])
+		if _, ok := expect[key]; !ok {
+			order = append(order, key)
+		}
+		expect[key] = append(expect[key], row)
+	}
+	if err = assertEq(3, len(order)); err != nil {
+		t.Fatal(err)
+	}
+
+	body := getBody("GET hosts\nColumns: name state\nSort: name asc\nSplitBy: state\n\n")
+	var split map[string][][]interface{}
+	if err = json.Unmarshal(body, &split); err != nil {
+		t.Fatalf("invalid json: %s\n%s", err, body)
+	}
+	if err = assertEq(expect, split); err != nil {
+		t.Error(err)
+	}
+	last := -1
+	for _, key := range order {
+		pos := strings.Index(string(body), "\""+key+"\":")
+		if pos < last {
+			t.Errorf("group %s is not in the order of the sorted rows: %s", key, body)
+		}
+		last = pos
+	}
+
+	// wrapped_json contains the columns header in each group
+	body = getBody("GET hosts\nColumns: name state\nSort: name asc\nSplitBy: state\nColumnHeaders: on\nMapStates: on\nOutputFormat: wrapped_json\n\n")
+	var wrapped struct {
+		Data  map[string][][]interface{} `json:"data"`
+		Total int                        `json:"total"`
+	}
+	if err = json.Unmarshal(body, &wrapped); err != nil {
+		t.Fatalf("invalid json: %s\n%s", err, body)
+	}
+	if err = assertEq(10, wrapped.Total); err != nil {
+		t.Error(err)
+	}
+	for _, label := range []string{"UP", "DOWN", "UNREACHABLE"} {
+		rows, ok := wrapped.Data[label]
+		if !ok {
+			t.Errorf("missing group %s in %s", label, body)
+			continue
+		}
+		if err = assertEq([]interface{}{"name", "state"}, rows[0]); err != nil {
+			t.Error(err)
+		}
+		for _, row := range rows[1:] {
+			if err = assertEq(label, row[1]); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+
+	// empty results are an empty object
+	body = getBody("GET hosts\nColumns: name state\nFilter: name = none\nSplitBy: state\n\n")
+	if err = assertEq("{}", string(body)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseFirstPerGroup(t *testing.T) {
+	peer := StartTestPeer(1, 10, 30)
+	PauseTestPeers(peer)
+
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	services := p.Tables["services"]
+	for k := range services.Data {
+		services.Data[k][services.Table.ColumnsIndex["last_check"]] = float64(1000 + k)
+	}
+	p.DataLock.Unlock()
+
+	// latest check of each host
+	all, err := peer.QueryString("GET services\nColumns: host_name description last_check\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, row := range all {
+		host := row[0].(string)
+		counts[host]++
+		if row[2].(float64) > latest[host] {
+			latest[host] = row[2].(float64)
+		}
+	}
+	multiple := false
+	for _, count := range counts {
+		if count > 1 {
+			multiple = true
+		}
+	}
+	if !multiple {
+		t.Fatalf("test requires hosts with more than one service")
+	}
+
+	res, err := peer.QueryString("GET services\nColumns: host_name description last_check\nSort: last_check desc\nFirstPerGroup: host_name\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(latest), len(res)); err != nil {
+		t.Error(err)
+	}
+	for _, row := range res {
+		if err = assertEq(latest[row[0].(string)], row[2]); err != nil {
+			t.Errorf("%s: %s", row[0], err)
+		}
+	}
+
+	// the limit applies to the groups
+	res, err = peer.QueryString("GET services\nColumns: host_name description last_check\nSort: last_check desc\nFirstPerGroup: host_name\nLimit: 2\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(2, len(res)); err != nil {
+		t.Fatal(err)
+	}
+	if res[0][0] == res[1][0] {
+		t.Errorf("expected different hosts, got: %v", res)
+	}
+
+	// all columns form the group key
+	res, err = peer.QueryString("GET services\nColumns: host_name description\nFirstPerGroup: host_name description\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(len(all), len(res)); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseLogLevel(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	output := logOutput
+	defer func() { logOutput = output }()
+	buf := new(bytes.Buffer)
+	logOutput = buf
+
+	if err := SetLogLevelClients([]string{"unix", "127.0.0.1", "10.1.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogLevelClients(nil)
+
+	clients := map[string]bool{
+		"unix":      true,
+		"127.0.0.1": true,
+		"127.0.0.2": false,
+		"10.1.2.3":  true,
+		"10.2.0.1":  false,
+		"unknown":   false,
+	}
+	for client, expect := range clients {
+		if err := assertEq(expect, logLevelClientAllowed(client)); err != nil {
+			t.Errorf("%s: %s", client, err)
+		}
+	}
+
+	query := func(text string) {
+		req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(text)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = req.ExpandRequestedBackends(); err != nil {
+			t.Fatal(err)
+		}
+		if err = req.enableDebug("unix"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = req.GetResponse(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only flagged requests log with the raised level
+	query("GET hosts\nColumns: name\n\n")
+	if err := assertEq("", buf.String()); err != nil {
+		t.Error(err)
+	}
+	query("GET hosts\nColumns: name\nLogLevel: trace\n\n")
+	if err := assertLike("PostProcessing", buf.String()); err != nil {
+		t.Error(err)
+	}
+
+	// clients have to be listed in LogLevelClients
+	SetLogLevelClients([]string{"127.0.0.1"})
+	_, err := peer.QueryString("GET hosts\nColumns: name\nLogLevel: trace\n\n")
+	if err == nil {
+		t.Fatal("expected error for client without permission")
+	}
+	if err = assertEq("bad request: LogLevel is not allowed for client unix", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err = assertLike("invalid client address none", SetLogLevelClients([]string{"none"}).Error()); err != nil {
+		t.Error(err)
+	}
+	if err = assertLike("invalid client network 10.0.0.0/99", SetLogLevelClients([]string{"10.0.0.0/99"}).Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseCaptureRaw(t *testing.T) {
+	peer := StartTestPeer(2, 10, 10)
+	PauseTestPeers(peer)
+
+	if err := SetLogLevelClients([]string{"unix"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLogLevelClients(nil)
+
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString("GET log\nColumns: time message\nFilter: time >= 1500000000\nFilter: host_name = test\nLimit: 5\nCaptureRaw: on\nOutputFormat: wrapped_json\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	if err = req.enableDebug("unix"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := req.GetResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := res.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wrapped struct {
+		Raw map[string]RawExchange `json:"raw"`
+	}
+	if err = json.Unmarshal(body, &wrapped); err != nil {
+		t.Fatalf("invalid json: %s\n%s", err, body)
+	}
+	if err = assertEq(2, len(wrapped.Raw)); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"mockid0", "mockid1"} {
+		raw, ok := wrapped.Raw[id]
+		if !ok {
+			t.Errorf("no raw capture for %s", id)
+			continue
+		}
+		for _, expect := range []string{"GET log\n", "Columns: time message\n", "Filter: time >= 1500000000\n", "Filter: host_name = test\n", "Limit: 5\n"} {
+			if err = assertLike(expect, raw.Request); err != nil {
+				t.Errorf("%s: %s", id, err)
+			}
+		}
+		if err = assertEq(len(raw.Response), raw.ResponseSize); err != nil {
+			t.Errorf("%s: %s", id, err)
+		}
+	}
+
+	// the response sample is bounded
+	capture := NewRawCapture()
+	capture.Add("mockid0", "GET log\n\n", make([]byte, maxRawCaptureSize+100))
+	if err = assertEq(maxRawCaptureSize, len(capture.Get()["mockid0"].Response)); err != nil {
+		t.Error(err)
+	}
+	if err = assertEq(maxRawCaptureSize+100, capture.Get()["mockid0"].ResponseSize); err != nil {
+		t.Error(err)
+	}
+
+	// raw capture is only available for passthrough tables
+	_, err = peer.QueryString("GET hosts\nColumns: name\nCaptureRaw: on\n\n")
+	if err == nil {
+		t.Fatal("expected error for table hosts")
+	}
+	if err = assertEq("bad request: CaptureRaw is not supported for table hosts, only for passthrough tables", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	// clients have to be listed in LogLevelClients
+	SetLogLevelClients(nil)
+	_, err = peer.QueryString("GET log\nColumns: time message\nLimit: 5\nCaptureRaw: on\n\n")
+	if err == nil {
+		t.Fatal("expected error for client without permission")
+	}
+	if err = assertEq("bad request: CaptureRaw is not allowed for client unix", err.Error()); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
+
+func TestResponseMapBooleans(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	p := DataStore["mockid0"]
+	p.DataLock.Lock()
+	hosts := p.Tables["hosts"]
+	name := hosts.Data[0][hosts.Table.ColumnsIndex["name"]].(string)
+	hosts.Data[0][hosts.Table.ColumnsIndex["notifications_enabled"]] = 1.0
+	hosts.Data[0][hosts.Table.ColumnsIndex["acknowledged"]] = 0.0
+	hosts.Data[0][hosts.Table.ColumnsIndex["state"]] = 1.0
+	p.DataLock.Unlock()
+
+	query := "GET hosts\nColumns: name notifications_enabled acknowledged state\nFilter: name = " + name + "\n"
+	res, err := peer.QueryString(query + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{name, 1.0, 0.0, 1.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// only boolean columns are mapped
+	res, err = peer.QueryString(query + "MapBooleans: on\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{name, true, false, 1.0}}, res); err != nil {
+		t.Error(err)
+	}
+
+	// progressive rows are mapped as well
+	req, _, err := NewRequest(bufio.NewReader(bytes.NewBufferString(query + "MapBooleans: on\nOutputFormat: ndjson\nProgressive: on\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = req.ExpandRequestedBackends(); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &chunkRecorder{}
+	req.progressive = NewProgressiveWriter(recorder, req)
+	if _, err = req.GetResponse(); err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq(fmt.Sprintf("[%q,true,false,1]\n", name), strings.Join(recorder.chunks, "")); err != nil {
+		t.Error(err)
+	}
+
+	// filters accept the same tokens
+	res, err = peer.QueryString("GET hosts\nColumns: name\nFilter: name = " + name + "\nFilter: notifications_enabled = true\nFilter: acknowledged = no\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = assertEq([][]interface{}{{name}}, res); err != nil {
+		t.Error(err)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}
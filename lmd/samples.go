@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// statsMaxSamples sets the maximum number of buffered values for exact median and percentile stats.
+var statsMaxSamples int64 = 1000000
+
+// statsApproxSamples sets the size of the reservoir used for approximate median and percentile stats.
+var statsApproxSamples int64 = 10000
+
+// errTooManySamples is returned if exact median or percentile stats would exceed the sample limit.
+var errTooManySamples = errors.New("bad request: too many values for exact median/percentile stats, use StatsApprox: on")
+
+// StatsSamples buffers the values required to calculate the median and percentiles.
+// In approximate mode the memory usage is bounded by using reservoir sampling once
+// the number of values exceeds the reservoir size.
+type StatsSamples struct {
+	Values   []float64
+	Seen     int  // number of values offered, can be larger than len(Values) in approximate mode
+	Approx   bool // use reservoir sampling
+	Overflow bool // exact mode only, set if the maximum number of samples has been reached
+}
+
+// NewStatsSamples creates a new sample buffer.
+func NewStatsSamples(approx bool) *StatsSamples {
+	return &StatsSamples{
+		Values: make([]float64, 0),
+		Approx: approx,
+	}
+}
+
+// Add adds a single value to the samples.
+func (s *StatsSamples) Add(value float64) {
+	s.Seen++
+	if s.Approx {
+		size := int(atomic.LoadInt64(&statsApproxSamples))
+		if len(s.Values) < size {
+			s.Values = append(s.Values, value)
+			return
+		}
+		// replace elements with gradually decreasing probability
+		if j := rand.Intn(s.Seen); j < size {
+			s.Values[j] = value
+		}
+		return
+	}
+	if s.Overflow {
+		return
+	}
+	if int64(len(s.Values)) >= atomic.LoadInt64(&statsMaxSamples) {
+		s.Overflow = true
+		s.Values = nil
+		return
+	}
+	s.Values = append(s.Values, value)
+}
+
+// Merge adds all samples from another sample buffer, ex.: from a different peer.
+func (s *StatsSamples) Merge(other *StatsSamples) {
+	if other == nil {
+		return
+	}
+	seenA, seenB := s.Seen, other.Seen
+	s.Seen += other.Seen
+	if other.Overflow {
+		s.Overflow = true
+	}
+	if s.Overflow {
+		s.Values = nil
+		return
+	}
+	if !s.Approx {
+		if int64(len(s.Values)+len(other.Values)) > atomic.LoadInt64(&statsMaxSamples) {
+			s.Overflow = true
+			s.Values = nil
+			return
+		}
+		s.Values = append(s.Values, other.Values...)
+		return
+	}
+	size := int(atomic.LoadInt64(&statsApproxSamples))
+	if len(s.Values)+len(other.Values) <= size {
+		s.Values = append(s.Values, other.Values...)
+		return
+	}
+
+	// both reservoirs represent a different number of values, so pick
+	// from each of them according to the number of values they have seen
+	valuesA := shuffledCopy(s.Values)
+	valuesB := shuffledCopy(other.Values)
+	merged := make([]float64, 0, size)
+	for len(merged) < size {
+		if len(valuesB) == 0 || (len(valuesA) > 0 && rand.Intn(seenA+seenB) < seenA) {
+			merged = append(merged, valuesA[0])
+			valuesA = valuesA[1:]
+			continue
+		}
+		merged = append(merged, valuesB[0])
+		valuesB = valuesB[1:]
+	}
+	s.Values = merged
+}
+
+// Percentile returns the given percentile (0-100) of all samples.
+// Values between the closest ranks are interpolated linearly.
+func (s *StatsSamples) Percentile(percentile float64) float64 {
+	if s == nil || len(s.Values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(s.Values))
+	copy(sorted, s.Values)
+	sort.Float64s(sorted)
+	rank := percentile / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func shuffledCopy(values []float64) []float64 {
+	shuffled := make([]float64, len(values))
+	copy(shuffled, values)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStatsSamplesExact(t *testing.T) {
+	samples := NewStatsSamples(false)
+	for _, v := range []float64{5, 1, 4, 2, 3} {
+		samples.Add(v)
+	}
+	if err := assertEq(3.0, samples.Percentile(50)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(1.0, samples.Percentile(0)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(5.0, samples.Percentile(100)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(4.6, math.Round(samples.Percentile(90)*100)/100); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatsSamplesOverflow(t *testing.T) {
+	defer atomic.StoreInt64(&statsMaxSamples, atomic.LoadInt64(&statsMaxSamples))
+	atomic.StoreInt64(&statsMaxSamples, 3)
+
+	samples := NewStatsSamples(false)
+	for i := 0; i < 3; i++ {
+		samples.Add(float64(i))
+	}
+	if err := assertEq(false, samples.Overflow); err != nil {
+		t.Error(err)
+	}
+	samples.Add(3)
+	if err := assertEq(true, samples.Overflow); err != nil {
+		t.Error(err)
+	}
+
+	// merging exceeds the limit as well
+	samplesA := NewStatsSamples(false)
+	samplesB := NewStatsSamples(false)
+	samplesA.Add(1)
+	samplesA.Add(2)
+	samplesB.Add(3)
+	samplesB.Add(4)
+	samplesA.Merge(samplesB)
+	if err := assertEq(true, samplesA.Overflow); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatsSamplesApprox(t *testing.T) {
+	num := 200000
+	values := rand.Perm(num)
+
+	samples := NewStatsSamples(true)
+	for _, v := range values {
+		samples.Add(float64(v))
+	}
+	if err := assertEq(int(atomic.LoadInt64(&statsApproxSamples)), len(samples.Values)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(num, samples.Seen); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []float64{10, 50, 90, 99} {
+		exact := p / 100 * float64(num-1)
+		approx := samples.Percentile(p)
+		if math.Abs(approx-exact) > float64(num)*0.02 {
+			t.Errorf("percentile %v is %v, expected %v +/- 2%%", p, approx, exact)
+		}
+	}
+}
+
+func TestStatsSamplesApproxMerge(t *testing.T) {
+	// first peer has small values only, second peer has 3 times as many large values
+	samplesA := NewStatsSamples(true)
+	samplesB := NewStatsSamples(true)
+	for i := 0; i < 50000; i++ {
+		samplesA.Add(float64(i))
+	}
+	for i := 0; i < 150000; i++ {
+		samplesB.Add(float64(100000 + i))
+	}
+	samplesA.Merge(samplesB)
+	if err := assertEq(int(atomic.LoadInt64(&statsApproxSamples)), len(samplesA.Values)); err != nil {
+		t.Error(err)
+	}
+	if err := assertEq(200000, samplesA.Seen); err != nil {
+		t.Error(err)
+	}
+	// 25% of all values are from the first peer
+	p20 := samplesA.Percentile(20)
+	if p20 >= 50000 {
+		t.Errorf("20th percentile should be from first peer, got %v", p20)
+	}
+	p30 := samplesA.Percentile(30)
+	if p30 < 100000 {
+		t.Errorf("30th percentile should be from second peer, got %v", p30)
+	}
+}
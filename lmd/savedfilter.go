@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// savedFilters contains the filter lines of the named filters from the SavedFilters config option for each table.
+// The lines are parsed for each request, so relative durations, ex.: Filter: last_check > 1h, never become stale.
+var savedFilters = make(map[string]map[string][]string)
+var savedFiltersLock = new(sync.RWMutex)
+
+// SetSavedFilters sets the named filters which can be used with the SavedFilter header.
+// The filters are given for each name and table in livestatus syntax, ex.: Filter: state = 2, Or: 2 or Negate:
+// It returns an error if any table does not exist or a filter cannot be parsed.
+func SetSavedFilters(filters map[string]map[string][]string) error {
+	saved := make(map[string]map[string][]string)
+	for name, tables := range filters {
+		saved[name] = make(map[string][]string)
+		for table, lines := range tables {
+			if _, ok := Objects.Tables[table]; !ok {
+				return fmt.Errorf("saved filter %s: table %s does not exist", name, table)
+			}
+			_, err := parseSavedFilterLines(table, lines)
+			if err != nil {
+				return fmt.Errorf("saved filter %s: %s", name, err.Error())
+			}
+			saved[name][table] = lines
+		}
+	}
+	savedFiltersLock.Lock()
+	savedFilters = saved
+	savedFiltersLock.Unlock()
+	return nil
+}
+
+// parseSavedFilterLines parses the filter lines of a saved filter and combines them into a single filter.
+// Multiple filter lines are combined with AND.
+func parseSavedFilterLines(table string, lines []string) (filter Filter, err error) {
+	stack := []Filter{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		matched := strings.SplitN(line, ":", 2)
+		if len(matched) != 2 {
+			err = fmt.Errorf("bad filter line: %s", line)
+			return
+		}
+		header := strings.ToLower(matched[0])
+		value := strings.TrimSpace(matched[1])
+		switch header {
+		case "filter":
+			err = ParseFilter(value, &line, table, &stack)
+		case "and", "or":
+			err = ParseFilterOp(header, value, &line, &stack)
+		case "negate":
+			err = parseFilterNegate(&line, &stack)
+		default:
+			err = fmt.Errorf("unsupported header %s, only Filter, And, Or and Negate are allowed", matched[0])
+		}
+		if err != nil {
+			return
+		}
+	}
+	switch len(stack) {
+	case 0:
+		err = fmt.Errorf("no filter for table %s", table)
+		return
+	case 1:
+		filter = stack[0]
+		return
+	}
+	filter = Filter{Filter: stack, GroupOperator: And}
+	return
+}
+
+// parseSavedFilter appends the named filter for the table to the saved filters of a request.
+// It returns an error if there is no such filter for this table.
+func parseSavedFilter(table string, name string, saved *[]Filter) (err error) {
+	name = strings.TrimSpace(name)
+	savedFiltersLock.RLock()
+	tables, ok := savedFilters[name]
+	var lines []string
+	if ok {
+		lines, ok = tables[table]
+	}
+	savedFiltersLock.RUnlock()
+	if tables == nil {
+		return fmt.Errorf("bad request: unknown saved filter %s", name)
+	}
+	if !ok {
+		return fmt.Errorf("bad request: saved filter %s is not defined for table %s", name, table)
+	}
+	filter, err := parseSavedFilterLines(table, lines)
+	if err != nil {
+		return fmt.Errorf("bad request: saved filter %s: %s", name, err.Error())
+	}
+	*saved = append(*saved, filter)
+	return
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSavedFilter(t *testing.T) {
+	peer := StartTestPeer(1, 10, 10)
+	PauseTestPeers(peer)
+
+	err := SetSavedFilters(map[string]map[string][]string{
+		"first-hosts": {
+			"hosts": {"Filter: name = testhost_1", "Filter: name = testhost_2", "Filter: name = testhost_3", "Or: 3"},
+		},
+		"not-first": {
+			"hosts":    {"Filter: name = testhost_1", "Negate:"},
+			"services": {"Filter: host_name != testhost_1", "Filter: description != testsvc_1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetSavedFilters(nil)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"GET hosts\nColumns: name\nSavedFilter: first-hosts\nSort: name asc\n\n", []string{"testhost_1", "testhost_2", "testhost_3"}},
+		// client filters are combined with AND
+		{"GET hosts\nColumns: name\nSavedFilter: first-hosts\nFilter: name != testhost_2\nSort: name asc\n\n", []string{"testhost_1", "testhost_3"}},
+		// the saved filter is a single group, so it does not mix with preceding Or groups
+		{"GET hosts\nColumns: name\nFilter: name = testhost_4\nFilter: name = testhost_2\nOr: 2\nSavedFilter: first-hosts\n\n", []string{"testhost_2"}},
+		{"GET hosts\nColumns: name\nSavedFilter: first-hosts\nSavedFilter: not-first\nSort: name asc\n\n", []string{"testhost_2", "testhost_3"}},
+		// following Or groups cannot absorb the saved filter
+		{"GET hosts\nColumns: name\nFilter: name = testhost_5\nSavedFilter: first-hosts\nFilter: name = testhost_1\nOr: 2\n\n", []string{"testhost_1"}},
+	}
+	for _, test := range tests {
+		res, err := peer.QueryString(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, row := range res {
+			names = append(names, fmt.Sprintf("%v", row[0]))
+		}
+		if err = assertEq(test.expected, names); err != nil {
+			t.Errorf("%q: %s", test.query, err)
+		}
+	}
+
+	// multiple filter lines are combined with AND
+	res, err := peer.QueryString("GET services\nColumns: host_name description\nSavedFilter: not-first\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range res {
+		if row[0] == "testhost_1" || row[1] == "testsvc_1" {
+			t.Errorf("unexpected row: %v", row)
+		}
+	}
+
+	errors := []struct {
+		query string
+		err   string
+	}{
+		{"GET hosts\nSavedFilter: unknown\n\n", "bad request: unknown saved filter unknown"},
+		{"GET services\nSavedFilter: first-hosts\n\n", "bad request: saved filter first-hosts is not defined for table services"},
+		// saved filters cannot be negated
+		{"GET hosts\nSavedFilter: first-hosts\nNegate:\n\n", "bad request: not enough filter on stack in Negate:"},
+	}
+	for _, test := range errors {
+		_, err := peer.QueryString(test.query)
+		if err = assertEq(test.err, fmt.Sprintf("%v", err)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	invalid := []struct {
+		filters map[string]map[string][]string
+		err     string
+	}{
+		{map[string]map[string][]string{"x": {"nonexisting": {"Filter: name = a"}}}, "saved filter x: table nonexisting does not exist"},
+		{map[string]map[string][]string{"x": {"hosts": {"Stats: state = 0"}}}, "saved filter x: unsupported header Stats, only Filter, And, Or and Negate are allowed"},
+		{map[string]map[string][]string{"x": {"hosts": {"Filter: name = a", "Or: 2"}}}, "saved filter x: bad request: not enough filter on stack in Or: 2"},
+		{map[string]map[string][]string{"x": {"hosts": {}}}, "saved filter x: no filter for table hosts"},
+	}
+	for _, test := range invalid {
+		if err = assertEq(test.err, fmt.Sprintf("%v", SetSavedFilters(test.filters))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// relative durations are resolved for each request, not when loading the config
+	if err = SetSavedFilters(map[string]map[string][]string{"recent": {"hosts": {"Filter: last_check > 1h"}}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	start := time.Now().Unix()
+	saved := []Filter{}
+	if err = parseSavedFilter("hosts", "recent", &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved[0].FloatValue < float64(start-3600) {
+		t.Errorf("saved filter uses stale timestamp %f, expected at least %d", saved[0].FloatValue, start-3600)
+	}
+
+	if err := StopTestPeer(peer); err != nil {
+		panic(err.Error())
+	}
+}